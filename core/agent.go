@@ -0,0 +1,100 @@
+package core
+
+import (
+    "sync"
+    "time"
+)
+
+// The agentSession structure holds a user unlocked by an Agent, along with the timer which locks the user again once the
+// session has been idle for too long, and the time the user was last used.
+type agentSession struct {
+    user     *User
+    timer    *time.Timer
+    lastUsed time.Time
+}
+
+// The Agent type holds users whose sessions have been started, keyed by username, so that a long-lived process serving
+// repeated command-line invocations need not derive each user's keys from their password every time.  A user is locked
+// again, which ends their session and wipes their keys, when Lock is called or once they have gone unused for the idle
+// time.  An Agent may be used from several goroutines at once.
+type Agent struct {
+    lock     sync.Mutex
+    sessions map[string]*agentSession
+    idle     time.Duration
+}
+
+// NewAgent produces an agent which locks users once they have gone unused for the given idle time.
+func NewAgent(idle time.Duration) *Agent {
+    return &Agent{sessions: make(map[string]*agentSession), idle: idle}
+}
+
+// Unlock loads the named user and starts their session with the password, holding it until the user is locked.  A user
+// who is already unlocked is replaced, and their previous session ended.
+func (this *Agent) Unlock(name string, password string) error {
+    if this.idle <= 0 {
+        return NewError("Invalid agent idle time "+this.idle.String(), name)
+    }
+    user, err := LoadUser(name)
+    if err != nil {
+        return err
+    }
+    if err := user.StartSession(password); err != nil {
+        return err
+    }
+
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    this.remove(name)
+    s := &agentSession{user: user, lastUsed: time.Now()}
+    s.timer = time.AfterFunc(this.idle, func() {
+        this.lock.Lock()
+        defer this.lock.Unlock()
+        // the user may have been locked and unlocked again since the timer was started
+        if this.sessions[name] != s {
+            return
+        }
+        // the user may have been used while the timer was firing, in which case it must wait out the rest of the idle
+        // time
+        if remaining := this.idle - time.Since(s.lastUsed); remaining > 0 {
+            s.timer.Reset(remaining)
+            return
+        }
+        this.remove(name)
+    })
+    this.sessions[name] = s
+    return nil
+}
+
+// User produces the named user, with their session active, if they are unlocked, and restarts their idle time.  The
+// time of use is recorded, so that an idle timer which fires at the same time finds the user in use and waits again
+// rather than locking them.  The user must not be relied upon after it has been locked, since its session is then
+// ended.
+func (this *Agent) User(name string) (*User, bool) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    s, ok := this.sessions[name]
+    if !ok {
+        return nil, false
+    }
+    s.lastUsed = time.Now()
+    s.timer.Reset(this.idle)
+    return s.user, true
+}
+
+// Lock ends the session of the named user, wiping their keys, and forgets them.  Locking a user who is not unlocked has no
+// effect.
+func (this *Agent) Lock(name string) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    this.remove(name)
+}
+
+// The remove function stops the idle timer of the named user, ends their session and forgets them.  The agent must be
+// locked.
+func (this *Agent) remove(name string) {
+    if s, ok := this.sessions[name]; ok {
+        delete(this.sessions, name)
+        s.timer.Stop()
+        s.user.EndSession()
+    }
+}
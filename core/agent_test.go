@@ -0,0 +1,115 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type AgentTestSuite struct {
+    suite.Suite
+}
+
+func (suite *AgentTestSuite) TestUnlock() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        encrypted, err := u.Encrypt([]byte("data"))
+        a.NoError(err)
+
+        agent := NewAgent(time.Minute)
+        a.Error(agent.Unlock("test.user", "wrong"))
+        a.Error(agent.Unlock("nobody", "password"))
+        _, ok := agent.User("test.user")
+        a.False(ok)
+
+        if a.NoError(agent.Unlock("test.user", "password")) {
+            unlocked, ok := agent.User("test.user")
+            if a.True(ok) {
+                a.True(unlocked.CanSign())
+                data, err := unlocked.Decrypt(encrypted)
+                a.NoError(err)
+                a.Equal([]byte("data"), data)
+            }
+
+            agent.Lock("test.user")
+            _, ok = agent.User("test.user")
+            a.False(ok)
+            if a.NotNil(unlocked) {
+                a.False(unlocked.CanSign())
+            }
+            agent.Lock("test.user")
+        }
+
+        a.Error(NewAgent(0).Unlock("test.user", "password"))
+        u.Drop()
+    }
+}
+
+func (suite *AgentTestSuite) TestIdle() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        agent := NewAgent(100 * time.Millisecond)
+        if a.NoError(agent.Unlock("test.user", "password")) {
+            unlocked, _ := agent.User("test.user")
+
+            // each use restarts the idle time
+            for i := 0; i < 4; i++ {
+                time.Sleep(50 * time.Millisecond)
+                _, ok := agent.User("test.user")
+                a.True(ok)
+            }
+
+            time.Sleep(200 * time.Millisecond)
+            _, ok := agent.User("test.user")
+            a.False(ok)
+            if a.NotNil(unlocked) {
+                a.False(unlocked.CanSign())
+            }
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *AgentTestSuite) TestUseWhileExpiring() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+
+    agent := NewAgent(100 * time.Millisecond)
+    if !a.NoError(agent.Unlock("test.user", "password")) {
+        return
+    }
+    defer agent.Lock("test.user")
+
+    // hold the agent until the timer has fired, and use the user as User would before the timer's callback can run
+    agent.lock.Lock()
+    time.Sleep(150 * time.Millisecond)
+    s := agent.sessions["test.user"]
+    s.lastUsed = time.Now()
+    s.timer.Reset(agent.idle)
+    agent.lock.Unlock()
+
+    time.Sleep(20 * time.Millisecond)
+    unlocked, ok := agent.User("test.user")
+    if a.True(ok) {
+        a.True(unlocked.CanSign())
+    }
+
+    time.Sleep(200 * time.Millisecond)
+    _, ok = agent.User("test.user")
+    a.False(ok)
+}
+
+func TestAgentTestSuite(t *testing.T) {
+    suite.Run(t, new(AgentTestSuite))
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "time"
+)
+
+// The Attachment structure holds a file attached to a user's view of an entry.  The file name, content type and data are
+// all encrypted under the user's symmetric key, each bound to the entry and to its part of the attachment.
+type Attachment struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the attachment was added.
+    CreatedAt time.Time
+
+    // The EntryId is the identifier of the entry to which the file is attached.
+    EntryId string
+    // UserId is the foreign key of the user whose view of the entry the file is attached to.
+    UserId int64
+
+    // The Name field is the encrypted file name.
+    Name string
+    // The ContentType field is the encrypted MIME type of the file.
+    ContentType string
+    // The Size is the length of the file in bytes.
+    Size int
+    // The Data field is the encrypted content of the file.
+    Data string
+    // The Policy is the version of the format in which the encrypted fields are held, as for an entry view.  Only the
+    // fields of an attachment added before the version was recorded, which holds zero, may lack additional data.
+    Policy PolicyVersion `sql:"not null;default:0"`
+}
+
+// The attachmentAD function produces the additional data which binds the ciphertext of the named part of an attachment,
+// one of "name", "type" or "data", to the entry, so that it fails to decrypt as any other part or entry field.
+func (this *Attachment) attachmentAD(part string) []byte {
+    return []byte(this.EntryId + "\x00attachment." + part)
+}
+
+// The decrypt function decrypts the ciphertext of the named part of the attachment with the user's key, falling back to
+// ciphertext without additional data only for an attachment whose policy does not require bound fields.
+func (this *Attachment) decrypt(user *User, part string, encrypted string) ([]byte, error) {
+    data, err := user.DecryptWithAD(encrypted, this.attachmentAD(part))
+    if err != nil && !this.Policy.bound() && errors.Is(err, ErrDecryption) {
+        if legacy, e := user.Decrypt(encrypted); e == nil {
+            return legacy, nil
+        }
+    }
+    return data, err
+}
+
+// The parts function locates the encrypted fields of the attachment, keyed by the name of the part each holds.
+func (this *Attachment) parts() map[string]*string {
+    return map[string]*string{"name": &this.Name, "type": &this.ContentType, "data": &this.Data}
+}
+
+// The AttachmentMeta structure describes an attachment without its content.
+type AttachmentMeta struct {
+    // The Id identifies the attachment to ReadAttachment.
+    Id  int64
+    // The Name is the file name.
+    Name string
+    // The ContentType is the MIME type of the file.
+    ContentType string
+    // The Size is the length of the file in bytes.
+    Size int
+    // CreatedAt is the time when the attachment was added.
+    CreatedAt time.Time
+}
+
+// AddAttachment attaches a file to the entry, provided that the user has write permission and an active session.  The
+// file may be no larger than the configured MaxAttachmentSize.  The attachment is stored immediately, so the entry must
+// have been saved.
+func (this *EntryView) AddAttachment(name string, contentType string, data []byte) (err error) {
+    defer func() { this.audit("write attachment", err) }()
+    user := this.getUser()
+    if !user.Can("w", this) {
+        return NewError("Attachment write permission denied", user, ErrPermission)
+    }
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", user)
+    }
+    if len(data) > config.maxAttachmentSize() {
+        return NewError(fmt.Sprintf("Attachment of %d bytes exceeds the limit of %d bytes", len(data), config.maxAttachmentSize()), user)
+    }
+
+    attachment := &Attachment{EntryId: this.EntryId, UserId: this.UserId, Size: len(data), Policy: CurrentPolicy}
+    plain := map[string][]byte{"name": []byte(name), "type": []byte(contentType), "data": data}
+    for part, value := range attachment.parts() {
+        if *value, err = user.EncryptWithAD(plain[part], attachment.attachmentAD(part)); err != nil {
+            return err
+        }
+    }
+
+    if err := DB.Create(attachment).Error; err != nil {
+        return NewError(err, user)
+    }
+    return nil
+}
+
+// Attachments lists the files attached to the entry, provided that the user has read permission and an active session.
+func (this *EntryView) Attachments() ([]AttachmentMeta, error) {
+    user := this.getUser()
+    if !user.Can("r", this) {
+        return nil, NewError("Attachment read permission denied", user, ErrPermission)
+    }
+
+    var attachments []Attachment
+    if err := DB.Where("entry_id = ? AND user_id = ?", this.EntryId, this.UserId).Order("id").Find(&attachments).Error; err != nil {
+        return nil, NewError(err, user)
+    }
+
+    var result []AttachmentMeta
+    for _, a := range attachments {
+        name, err := a.decrypt(user, "name", a.Name)
+        if err != nil {
+            return nil, err
+        }
+        contentType, err := a.decrypt(user, "type", a.ContentType)
+        if err != nil {
+            return nil, err
+        }
+        result = append(result, AttachmentMeta{a.Id, string(name), string(contentType), a.Size, a.CreatedAt})
+    }
+    return result, nil
+}
+
+// ReadAttachment reads the content of the file attached to the entry with the given Id, provided that the user has read
+// permission and an active session.
+func (this *EntryView) ReadAttachment(id int64) (data []byte, err error) {
+    defer func() { this.audit("read attachment", err) }()
+    user := this.getUser()
+    if !user.Can("r", this) {
+        return nil, NewError("Attachment read permission denied", user, ErrPermission)
+    }
+
+    attachment := new(Attachment)
+    if DB.Where("id = ? AND entry_id = ? AND user_id = ?", id, this.EntryId, this.UserId).First(attachment).RecordNotFound() {
+        return nil, NewError(fmt.Sprintf("Attachment %d not found", id), user, ErrNotFound)
+    }
+    return attachment.decrypt(user, "data", attachment.Data)
+}
+
+// The reencryptAttachments function moves every attachment of the user from the previous keys to the updated keys of the
+// same user, binding the fields of any attachment which was not yet bound.  The changed attachments are returned rather
+// than stored, so that the caller can store them along with its other changes.
+func reencryptAttachments(previous *User, updated *User) ([]Attachment, error) {
+    var attachments []Attachment
+    if err := DB.Where("user_id = ?", previous.Id).Find(&attachments).Error; err != nil {
+        return nil, NewError(err, previous)
+    }
+
+    for i := range attachments {
+        a := &attachments[i]
+        for part, value := range a.parts() {
+            data, err := a.decrypt(previous, part, *value)
+            if err != nil {
+                return nil, err
+            }
+            *value, err = updated.EncryptWithAD(data, a.attachmentAD(part))
+            utils.SecureZero(data)
+            if err != nil {
+                return nil, err
+            }
+        }
+        a.Policy = CurrentPolicy
+    }
+    return attachments, nil
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type AttachmentTestSuite struct {
+    suite.Suite
+}
+
+func (suite *AttachmentTestSuite) TestRoundTrip() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.Error(entry.AddAttachment("codes.txt", "text/plain", []byte("1234")))
+            a.NoError(entry.Save())
+
+            a.NoError(entry.AddAttachment("codes.txt", "text/plain", []byte("1234 5678")))
+            a.NoError(entry.AddAttachment("cert.der", "application/x-x509-ca-cert", []byte{0, 1, 2, 3}))
+
+            stored := new(Attachment)
+            if a.NoError(DB.Where("entry_id = ?", entry.EntryId).First(stored).Error) {
+                a.NotContains(stored.Name, "codes")
+                a.NotContains(stored.Data, "1234")
+            }
+
+            a.NoError(u.ChangePassword("password", "changed"))
+            a.NoError(entry.AttachUser(u))
+
+            attachments, err := entry.Attachments()
+            if a.NoError(err) && a.Len(attachments, 2) {
+                a.Equal("codes.txt", attachments[0].Name)
+                a.Equal("text/plain", attachments[0].ContentType)
+                a.Equal(9, attachments[0].Size)
+                a.Equal("cert.der", attachments[1].Name)
+
+                data, err := entry.ReadAttachment(attachments[0].Id)
+                if a.NoError(err) {
+                    a.Equal([]byte("1234 5678"), data)
+                }
+                data, err = entry.ReadAttachment(attachments[1].Id)
+                if a.NoError(err) {
+                    a.Equal([]byte{0, 1, 2, 3}, data)
+                }
+                _, err = entry.ReadAttachment(attachments[1].Id + 100)
+                a.Error(err)
+
+                entry.Permissions, err = u.Sign([]byte("w"))
+                a.NoError(err)
+                _, err = entry.ReadAttachment(attachments[0].Id)
+                if a.Error(err) {
+                    a.Equal(ErrPermission, err.(*Error).Code)
+                }
+                _, err = entry.Attachments()
+                a.Error(err)
+            }
+
+            a.NoError(entry.Purge())
+            var count int
+            DB.Model(&Attachment{}).Where("entry_id = ?", entry.EntryId).Count(&count)
+            a.Equal(0, count)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *AttachmentTestSuite) TestSizeLimit() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) && a.NoError(entry.Save()) {
+            previous := config.MaxAttachmentSize
+            config.MaxAttachmentSize = 16
+            a.NoError(entry.AddAttachment("small.txt", "text/plain", make([]byte, 16)))
+            err = entry.AddAttachment("large.txt", "text/plain", make([]byte, 17))
+            if a.Error(err) {
+                a.Contains(err.Error(), "exceeds the limit")
+            }
+            config.MaxAttachmentSize = previous
+
+            attachments, err := entry.Attachments()
+            if a.NoError(err) {
+                a.Len(attachments, 1)
+            }
+            a.NoError(entry.Purge())
+        }
+        u.Drop()
+    }
+}
+
+func (suite *AttachmentTestSuite) TestBinding() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    entry, err := NewEntry(u)
+    if !a.NoError(err) {
+        return
+    }
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", entry.EntryId).Delete(EntryView{})
+    a.NoError(entry.AddAttachment("evil-name", "text/plain", []byte("data")))
+    defer DB.Where("entry_id = ?", entry.EntryId).Delete(Attachment{})
+
+    // attachment ciphertext neither decrypts as an entry field nor as another part of the attachment
+    stored := new(Attachment)
+    if a.NoError(DB.Where("entry_id = ?", entry.EntryId).First(stored).Error) {
+        a.Equal(CurrentPolicy, stored.Policy)
+        entry.Password = stored.Name
+        _, err = entry.ReadPassword()
+        a.True(errors.Is(err, ErrDecryption))
+        data := stored.Data
+        a.NoError(DB.Model(stored).UpdateColumn("data", stored.Name).Error)
+        _, err = entry.ReadAttachment(stored.Id)
+        a.True(errors.Is(err, ErrDecryption))
+        a.NoError(DB.Model(stored).UpdateColumn("data", data).Error)
+    }
+
+    // attachments added before binding still decrypt until the user's keys change, which binds them
+    legacy := &Attachment{EntryId: entry.EntryId, UserId: u.Id, Size: 6}
+    for _, f := range []struct {
+        value *string
+        data  string
+    }{{&legacy.Name, "old.txt"}, {&legacy.ContentType, "text/plain"}, {&legacy.Data, "legacy"}} {
+        *f.value, err = u.Encrypt([]byte(f.data))
+        a.NoError(err)
+    }
+    if a.NoError(DB.Create(legacy).Error) {
+        data, err := entry.ReadAttachment(legacy.Id)
+        if a.NoError(err) {
+            a.Equal([]byte("legacy"), data)
+        }
+        a.NoError(u.RotateDEK())
+        rotated := new(Attachment)
+        if a.NoError(DB.First(rotated, legacy.Id).Error) {
+            a.Equal(CurrentPolicy, rotated.Policy)
+            _, err = u.Decrypt(rotated.Data)
+            a.Error(err)
+        }
+        data, err = entry.ReadAttachment(legacy.Id)
+        if a.NoError(err) {
+            a.Equal([]byte("legacy"), data)
+        }
+    }
+}
+
+func TestAttachmentTestSuite(t *testing.T) {
+    suite.Run(t, new(AttachmentTestSuite))
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+    "log"
+    "time"
+)
+
+// The AuditEntry structure records a single attempt by a user to access an entry.
+type AuditEntry struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // The Timestamp is the time of the attempt.
+    Timestamp time.Time
+    // UserId is the foreign key of the user who made the attempt.
+    UserId int64
+    // The EntryId is the identifier of the entry which was accessed.
+    EntryId string
+    // The Action describes the access, such as "read password", "write title" or "delete".
+    Action string
+    // The Success flag records whether the attempt succeeded.  Attempts which were denied are recorded as unsuccessful.
+    Success bool
+}
+
+// The Auditor function receives a record of every read, write and delete of an entry, including attempts which fail.  It
+// stores the records in the database by default, and may be replaced by embedders to redirect them elsewhere, or set to
+// nil to disable auditing.
+var Auditor func(AuditEntry) = StoreAudit
+
+// StoreAudit stores the audit record in the database.  Failures are logged rather than returned, so that auditing never
+// prevents access to an entry.
+func StoreAudit(entry AuditEntry) {
+    if err := DB.Create(&entry).Error; err != nil {
+        log.Print(NewError(err))
+    }
+}
+
+// The audit function passes a record of an access to the entry to the Auditor, if there is one.
+func (this *EntryView) audit(action string, err error) {
+    if Auditor != nil {
+        Auditor(AuditEntry{Timestamp: time.Now().UTC(), UserId: this.UserId, EntryId: this.EntryId, Action: action, Success: err == nil})
+    }
+}
+
+// The written function audits a write of the named field of the entry, and reports it to OnEntryChange if it succeeded.
+func (this *EntryView) written(field string, err error) {
+    this.audit("write "+field, err)
+    if err == nil {
+        this.changed(field)
+    }
+}
+
+// AuditLog lists the audit records stored in the database for the user's accesses since the given time, oldest first.
+func (this *User) AuditLog(since time.Time) ([]AuditEntry, error) {
+    var entries []AuditEntry
+    if err := DB.Where("user_id = ? AND timestamp >= ?", this.Id, since.UTC()).Order("id").Find(&entries).Error; err != nil {
+        return nil, NewError(err, this)
+    }
+    return entries, nil
+}
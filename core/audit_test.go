@@ -0,0 +1,87 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type AuditTestSuite struct {
+    suite.Suite
+}
+
+func (suite *AuditTestSuite) TestAuditLog() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        start := time.Now().Add(-time.Second)
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WritePassword("secret"))
+            a.NoError(entry.Save())
+            _, err = entry.ReadPassword()
+            a.NoError(err)
+
+            entry.Permissions, err = u.Sign([]byte("w"))
+            a.NoError(err)
+            _, err = entry.ReadPassword()
+            a.Error(err)
+
+            log, err := u.AuditLog(start)
+            if a.NoError(err) && a.Len(log, 3) {
+                a.Equal("write password", log[0].Action)
+                a.True(log[0].Success)
+                a.Equal("read password", log[1].Action)
+                a.True(log[1].Success)
+                a.Equal(entry.EntryId, log[1].EntryId)
+                a.Equal(u.Id, log[1].UserId)
+                a.False(log[1].Timestamp.Before(start))
+                a.Equal("read password", log[2].Action)
+                a.False(log[2].Success)
+            }
+
+            log, err = u.AuditLog(time.Now().Add(time.Hour))
+            a.NoError(err)
+            a.Empty(log)
+
+            DB.Unscoped().Delete(entry)
+        }
+        DB.Where("user_id = ?", u.Id).Delete(AuditEntry{})
+        u.Drop()
+    }
+}
+
+func (suite *AuditTestSuite) TestAuditor() {
+    a := assert.New(suite.T())
+
+    var records []AuditEntry
+    Auditor = func(entry AuditEntry) {
+        records = append(records, entry)
+    }
+    defer func() { Auditor = StoreAudit }()
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WriteTitle("Title"))
+            _, err = entry.ReadTitle()
+            a.NoError(err)
+            if a.Len(records, 2) {
+                a.Equal("write title", records[0].Action)
+                a.Equal("read title", records[1].Action)
+            }
+
+            log, err := u.AuditLog(time.Time{})
+            a.NoError(err)
+            a.Empty(log)
+        }
+        u.Drop()
+    }
+}
+
+func TestAuditTestSuite(t *testing.T) {
+    suite.Run(t, new(AuditTestSuite))
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// DefaultRangeURL is the address of the Pwned Passwords range API, to which HTTPRangeChecker appends the hash prefix.
+const DefaultRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// The RangeChecker interface looks up hashes of compromised passwords by k-anonymity: only the first five hexadecimal
+// characters of the SHA-1 hash of a password are disclosed, and every known hash sharing them is returned, so that the
+// password and its full hash never leave the process.
+type RangeChecker interface {
+    // Range produces the remaining 35 characters, in upper case, of each known hash beginning with the prefix, along with
+    // the number of times the password has been seen in breaches.
+    Range(prefix string) (map[string]int, error)
+}
+
+// The HTTPRangeChecker type is a RangeChecker which queries a service implementing the Pwned Passwords range API.
+type HTTPRangeChecker struct {
+    // The URL is the address to which the prefix is appended.  Empty selects DefaultRangeURL.
+    URL string
+    // The Client makes the requests.  Nil selects http.DefaultClient.
+    Client *http.Client
+}
+
+// Range requests the hashes beginning with the prefix from the service.  Padding is requested, so that the size of the
+// response does not hint at the prefix, and the padding entries, which have a count of zero, are discarded.
+func (this *HTTPRangeChecker) Range(prefix string) (map[string]int, error) {
+    url := this.URL
+    if len(url) == 0 {
+        url = DefaultRangeURL
+    }
+    client := this.Client
+    if client == nil {
+        client = http.DefaultClient
+    }
+
+    request, err := http.NewRequest("GET", url+prefix, nil)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    request.Header.Set("Add-Padding", "true")
+    response, err := client.Do(request)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return nil, NewError(fmt.Sprintf("Range request failed with status %d", response.StatusCode))
+    }
+
+    suffixes := make(map[string]int)
+    scanner := bufio.NewScanner(response.Body)
+    for scanner.Scan() {
+        parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+        if len(parts) != 2 {
+            continue
+        }
+        count, err := strconv.Atoi(parts[1])
+        if err != nil || count <= 0 {
+            continue
+        }
+        suffixes[strings.ToUpper(parts[0])] = count
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, NewError(err)
+    }
+    return suffixes, nil
+}
+
+// IsPasswordCompromised checks whether the password of the entry appears in the breaches known to the checker, provided
+// that the user has read permission, and produces the number of times it has been seen.  Only the first five characters
+// of the SHA-1 hash of the password are passed to the checker.  An entry without a password is not compromised.
+func (this *EntryView) IsPasswordCompromised(checker RangeChecker) (compromised bool, count int, err error) {
+    defer func() { this.audit("check password compromised", err) }()
+    if !this.getUser().Can("r", this) {
+        return false, 0, NewError("Password read permission denied", this.getUser(), ErrPermission)
+    }
+    if len(this.Password) == 0 {
+        return false, 0, nil
+    }
+
+    data, err := this.decryptField("password")
+    if err != nil {
+        return false, 0, err
+    }
+    sum := sha1.Sum(data)
+    utils.SecureZero(data)
+    hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+    suffixes, err := checker.Range(hash[:5])
+    if err != nil {
+        return false, 0, NewError(err, this.getUser())
+    }
+    count, compromised = suffixes[hash[5:]]
+    return compromised, count, nil
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// The fakeRangeChecker type answers range queries from memory, recording the prefixes it was asked for.
+type fakeRangeChecker struct {
+    suffixes map[string]map[string]int
+    prefixes []string
+}
+
+func (this *fakeRangeChecker) Range(prefix string) (map[string]int, error) {
+    this.prefixes = append(this.prefixes, prefix)
+    return this.suffixes[prefix], nil
+}
+
+type BreachTestSuite struct {
+    suite.Suite
+}
+
+func (suite *BreachTestSuite) TestIsPasswordCompromised() {
+    a := assert.New(suite.T())
+
+    // the SHA-1 hash of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+    checker := &fakeRangeChecker{suffixes: map[string]map[string]int{
+        "5BAA6": {"1E4C9B93F3F0682250B6CF8331B7EE68FD8": 3861493, "0018A45C4D1DEF81644B54AB7F969B88D65": 1},
+    }}
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        compromised, count, err := entry.IsPasswordCompromised(checker)
+        a.NoError(err)
+        a.False(compromised)
+        a.Empty(checker.prefixes)
+
+        a.NoError(entry.WritePassword("password"))
+        compromised, count, err = entry.IsPasswordCompromised(checker)
+        a.NoError(err)
+        a.True(compromised)
+        a.Equal(3861493, count)
+        a.Equal([]string{"5BAA6"}, checker.prefixes)
+
+        a.NoError(entry.WritePassword("a much less common password"))
+        compromised, count, err = entry.IsPasswordCompromised(checker)
+        a.NoError(err)
+        a.False(compromised)
+        a.Equal(0, count)
+        if a.Len(checker.prefixes, 2) {
+            a.Len(checker.prefixes[1], 5)
+        }
+
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        _, _, err = entry.IsPasswordCompromised(checker)
+        a.True(errors.Is(err, ErrPermission))
+        a.Len(checker.prefixes, 2)
+
+        u.Drop()
+    }
+}
+
+func (suite *BreachTestSuite) TestHTTPRangeChecker() {
+    a := assert.New(suite.T())
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/range/5BAA6" || r.Header.Get("Add-Padding") != "true" {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n1e4c9b93f3f0682250b6cf8331b7ee68fd8:3861493\r\n00D4F6E8FA6EECAD2A3AA415EEC418D38EC:0\r\n")
+    }))
+    defer server.Close()
+
+    checker := &HTTPRangeChecker{URL: server.URL + "/range/"}
+    suffixes, err := checker.Range("5BAA6")
+    if a.NoError(err) {
+        a.Equal(map[string]int{"0018A45C4D1DEF81644B54AB7F969B88D65": 1, "1E4C9B93F3F0682250B6CF8331B7EE68FD8": 3861493}, suffixes)
+    }
+    _, err = checker.Range("FFFFF")
+    a.Error(err)
+}
+
+func TestBreachTestSuite(t *testing.T) {
+    suite.Run(t, new(BreachTestSuite))
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha512"
+    "encoding/asn1"
+    "encoding/base64"
+    "github.com/awm/passrep/utils"
+    "math/big"
+)
+
+// The newGCM function initializes a new GCM instance with the given key.
+func newGCM(key []byte) (cipher.AEAD, *Error) {
+    c, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, NewError(err, ErrCrypto)
+    }
+
+    gcm, err := cipher.NewGCM(c)
+    if err != nil {
+        return nil, NewError(err, ErrCrypto)
+    }
+
+    return gcm, nil
+}
+
+// The sealWithKey function encrypts and base64 encodes data with the given symmetric key.
+func sealWithKey(key []byte, data []byte) (string, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return "", err
+    }
+
+    nonce := utils.RandomBytes(gcm.NonceSize())
+    if nonce == nil {
+        return "", NewError("Nonce generation failed", ErrEncryption)
+    }
+
+    raw := gcm.Seal(nil, nonce, data, nil)
+    return base64.StdEncoding.EncodeToString(append(nonce, raw...)), nil
+}
+
+// The openWithKey function decrypts a base64 encoded string that was encrypted with sealWithKey using the given key.
+// Malformed input fails with ErrDecryption, as for User.Decrypt.
+func openWithKey(key []byte, encrypted string) ([]byte, error) {
+    raw, err := base64.StdEncoding.DecodeString(encrypted)
+    if err != nil {
+        return nil, NewError(err, ErrDecryption)
+    }
+
+    gcm, e := newGCM(key)
+    if e != nil {
+        return nil, e
+    }
+
+    nonceLen := gcm.NonceSize()
+    if len(raw) < nonceLen+gcm.Overhead() {
+        return nil, NewError("Data too short", ErrDecryption)
+    }
+
+    data, err := gcm.Open(nil, raw[:nonceLen], raw[nonceLen:], nil)
+    if err != nil {
+        return nil, NewError(err, ErrDecryption)
+    }
+    return data, nil
+}
+
+// The unmarshalPublicKey function decodes an ASN.1 marshalled SigningKey into an ECDSA public key on the P521 curve.
+func unmarshalPublicKey(key []byte) (*ecdsa.PublicKey, error) {
+    var raw SigningKey
+    rest, err := asn1.Unmarshal(key, &raw)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    if len(rest) > 0 {
+        return nil, NewError("Trailing data after public key")
+    }
+
+    curve := elliptic.P521()
+    if !curve.IsOnCurve(raw.X, raw.Y) {
+        return nil, NewError("Public key is not on the curve")
+    }
+    return &ecdsa.PublicKey{Curve: curve, X: raw.X, Y: raw.Y}, nil
+}
+
+// The unmarshalPrivateKey function decodes the big-endian private scalar of an ECDSA key on the P521 curve.
+func unmarshalPrivateKey(key []byte) (*ecdsa.PrivateKey, error) {
+    curve := elliptic.P521()
+    d := new(big.Int).SetBytes(key)
+    if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+        return nil, NewError("Invalid private key")
+    }
+
+    priv := new(ecdsa.PrivateKey)
+    priv.PublicKey.Curve = curve
+    priv.D = d
+    priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+    return priv, nil
+}
+
+// The signData function produces the ASN.1 marshalled signature of the SHA-512 hash of the data.
+func signData(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+    hash := sha512.Sum512(data)
+
+    var err error
+    var sig Signature
+    sig.R, sig.S, err = ecdsa.Sign(rand.Reader, key, hash[:])
+    if err != nil {
+        return nil, NewError(err)
+    }
+
+    raw, err := asn1.Marshal(sig)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    return raw, nil
+}
+
+// The verifySignature function checks a signature of the SHA-512 hash of the data.
+func verifySignature(key *ecdsa.PublicKey, data []byte, sig *Signature) bool {
+    if sig.R == nil || sig.S == nil {
+        return false
+    }
+    hash := sha512.Sum512(data)
+    return ecdsa.Verify(key, hash[:], sig.R, sig.S)
+}
+
+// Sign produces a detached, base64 encoded ECDSA signature of the data, using the same P521 and SHA-512 scheme as
+// User.Sign.  The key is the big-endian encoding of the private scalar.
+func Sign(data []byte, key []byte) (string, error) {
+    priv, err := unmarshalPrivateKey(key)
+    if err != nil {
+        return "", err
+    }
+
+    raw, err := signData(priv, data)
+    if err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Verify checks a signature produced by Sign against the data.  The key is the ASN.1 marshalled public key, as found in
+// a user's base64 decoded PublicKey field.
+func Verify(data []byte, signature string, key []byte) (bool, error) {
+    pub, err := unmarshalPublicKey(key)
+    if err != nil {
+        return false, err
+    }
+
+    raw, err := base64.StdEncoding.DecodeString(signature)
+    if err != nil {
+        return false, NewError(err)
+    }
+    var sig Signature
+    rest, err := asn1.Unmarshal(raw, &sig)
+    if err != nil {
+        return false, NewError(err)
+    }
+    if len(rest) > 0 {
+        return false, NewError("Trailing data after signature")
+    }
+
+    return verifySignature(pub, data, &sig), nil
+}
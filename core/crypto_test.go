@@ -0,0 +1,153 @@
+package core
+
+import (
+    "encoding/asn1"
+    "encoding/base64"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "math/big"
+    "testing"
+)
+
+type CryptoTestSuite struct {
+    suite.Suite
+}
+
+func (suite *CryptoTestSuite) TestSignVerify() {
+    a := assert.New(suite.T())
+
+    u := User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(&u, "password")
+    if !a.NoError(err) {
+        return
+    }
+    encoded, err := k.EncodedPublicKey()
+    a.NoError(err)
+    public, err := base64.StdEncoding.DecodeString(encoded)
+    a.NoError(err)
+    private := k.SigningKey.D.Bytes()
+
+    data := []byte("rwd")
+    signature, err := Sign(data, private)
+    if a.NoError(err) {
+        ok, err := Verify(data, signature, public)
+        a.NoError(err)
+        a.True(ok)
+
+        ok, err = Verify([]byte("rw"), signature, public)
+        a.NoError(err)
+        a.False(ok)
+
+        raw, _ := base64.StdEncoding.DecodeString(signature)
+        raw[len(raw)-1] ^= 0x01
+        ok, err = Verify(data, base64.StdEncoding.EncodeToString(raw), public)
+        a.False(ok && err == nil)
+    }
+
+    other := User{Name: "other.user", CryptoSalt: u.SigningSalt, SigningSalt: u.CryptoSalt}
+    ok2, err := MakeKeys(&other, "password")
+    if a.NoError(err) {
+        signature, err = Sign(data, ok2.SigningKey.D.Bytes())
+        a.NoError(err)
+        ok, err := Verify(data, signature, public)
+        a.NoError(err)
+        a.False(ok)
+    }
+
+    _, err = Sign(data, []byte{})
+    a.Error(err)
+    _, err = Verify(data, signature, []byte("garbage"))
+    a.Error(err)
+}
+
+func (suite *CryptoTestSuite) TestMalformedCiphertext() {
+    a := assert.New(suite.T())
+
+    u := &User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(u, "password")
+    if !a.NoError(err) {
+        return
+    }
+    u.keys = k
+    u.PublicKey, _ = k.EncodedPublicKey()
+
+    encrypted, err := u.Encrypt([]byte("data"))
+    if !a.NoError(err) {
+        return
+    }
+    raw, _ := base64.StdEncoding.DecodeString(encrypted)
+    for _, malformed := range []string{
+        "",
+        "not base64!",
+        "AAAA",
+        base64.StdEncoding.EncodeToString(raw[:12]),
+        base64.StdEncoding.EncodeToString(raw[:27]),
+        encrypted[:len(encrypted)-1],
+    } {
+        _, err := u.Decrypt(malformed)
+        a.True(errors.Is(err, ErrDecryption), "Decrypt(%q): %v", malformed, err)
+        _, _, err = u.DecryptShared(malformed, "", u)
+        a.True(errors.Is(err, ErrDecryption), "DecryptShared(%q): %v", malformed, err)
+        _, err = openWithKey(k.CryptoKey, malformed)
+        a.True(errors.Is(err, ErrDecryption), "openWithKey(%q): %v", malformed, err)
+    }
+}
+
+func (suite *CryptoTestSuite) TestInvalidPeerKey() {
+    a := assert.New(suite.T())
+
+    u := &User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(u, "password")
+    if !a.NoError(err) {
+        return
+    }
+    u.keys = k
+    u.PublicKey, _ = k.EncodedPublicKey()
+    valid, _ := base64.StdEncoding.DecodeString(u.PublicKey)
+    offCurve, _ := asn1.Marshal(SigningKey{big.NewInt(1), big.NewInt(1)})
+
+    for _, key := range [][]byte{offCurve, append(valid, 0), []byte("garbage")} {
+        peer := &User{Name: "peer.user", PublicKey: base64.StdEncoding.EncodeToString(key)}
+        a.NotPanics(func() {
+            _, _, err := u.EncryptShared([]byte("data"), nil, peer)
+            a.True(errors.Is(err, ErrCrypto), "EncryptShared: %v", err)
+            _, _, err = u.DecryptShared("AAAA", "", peer)
+            a.True(errors.Is(err, ErrCrypto), "DecryptShared: %v", err)
+        })
+    }
+}
+
+func TestCryptoTestSuite(t *testing.T) {
+    suite.Run(t, new(CryptoTestSuite))
+}
+
+func FuzzDecrypt(f *testing.F) {
+    u := &User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(u, "password")
+    if err != nil {
+        f.Fatal(err)
+    }
+    u.keys = k
+    u.PublicKey, _ = k.EncodedPublicKey()
+
+    encrypted, err := u.Encrypt([]byte("data"))
+    if err != nil {
+        f.Fatal(err)
+    }
+    for _, seed := range []string{"", "AAAA", "not base64!", encrypted, encrypted[:20]} {
+        f.Add(seed)
+    }
+
+    f.Fuzz(func(t *testing.T, input string) {
+        if _, err := u.Decrypt(input); err != nil && !errors.Is(err, ErrDecryption) {
+            t.Errorf("Decrypt(%q) failed without ErrDecryption: %v", input, err)
+        }
+        if _, _, err := u.DecryptShared(input, "", u); err != nil && !errors.Is(err, ErrDecryption) {
+            t.Errorf("DecryptShared(%q) failed without ErrDecryption: %v", input, err)
+        }
+        if _, err := openWithKey(k.CryptoKey, input); err != nil && !errors.Is(err, ErrDecryption) {
+            t.Errorf("openWithKey(%q) failed without ErrDecryption: %v", input, err)
+        }
+    })
+}
@@ -4,18 +4,177 @@ import (
     "fmt"
     "github.com/jinzhu/gorm"
     _ "github.com/mattn/go-sqlite3"
+    "io"
+    "log"
+    "strings"
+    "time"
 )
 
 var DB gorm.DB
 
-// most of this is temporary for testing and will be cleaned up later as the database handling is fleshed out
-func init() {
-    var err error
-    DB, err = gorm.Open("sqlite3", ":memory:")
+// The Config structure gathers the settings which control the behaviour of the package.
+type Config struct {
+    // Driver is the name of the database driver to connect with.
+    Driver string
+    // Source is the driver-specific data source name of the database.
+    Source string
+    // LogMode enables logging of every database statement.
+    LogMode bool
+    // LogWriter receives the database log output; nil leaves it at the default destination.
+    LogWriter io.Writer
+    // KdfIterations is the number of PBKDF2 iterations used when deriving keys from a password.  New users record the
+    // count in effect when they are created, so changing it only affects new users and those stored without a count.
+    KdfIterations int
+    // MaxAttachmentSize is the largest file, in bytes, which may be attached to an entry.  Zero selects the default of
+    // DefaultMaxAttachmentSize.
+    MaxAttachmentSize int
+    // MaxFailedLogins is the number of consecutive failed logins after which a user is locked out.  Zero selects the
+    // default of DefaultMaxFailedLogins.
+    MaxFailedLogins int
+    // LockoutDuration is how long a user is locked out once MaxFailedLogins is reached, which doubles with each further
+    // failure up to MaxLockoutDuration.  Zero selects the default of DefaultLockoutDuration.
+    LockoutDuration time.Duration
+}
+
+// DefaultMaxAttachmentSize is the largest file, in bytes, which may be attached to an entry unless configured otherwise.
+const DefaultMaxAttachmentSize = 1 << 20
+
+const (
+    // DefaultMaxFailedLogins is the number of consecutive failed logins after which a user is locked out unless
+    // configured otherwise.
+    DefaultMaxFailedLogins = 5
+    // DefaultLockoutDuration is how long a user is first locked out unless configured otherwise.
+    DefaultLockoutDuration = time.Minute
+    // MaxLockoutDuration is the longest a user is locked out, however many logins have failed.
+    MaxLockoutDuration = 24 * time.Hour
+)
+
+// The config variable holds the configuration most recently passed to OpenDB.
+var config = DefaultConfig()
+
+// DefaultConfig produces the configuration used when the package is initialized.
+func DefaultConfig() *Config {
+    return &Config{
+        Driver:            "sqlite3",
+        Source:            ":memory:",
+        LogMode:           true,
+        KdfIterations:     100000,
+        MaxAttachmentSize: DefaultMaxAttachmentSize,
+        MaxFailedLogins:   DefaultMaxFailedLogins,
+        LockoutDuration:   DefaultLockoutDuration,
+    }
+}
+
+// The maxAttachmentSize function provides the attachment size limit in effect for the configuration.
+func (this *Config) maxAttachmentSize() int {
+    if this.MaxAttachmentSize > 0 {
+        return this.MaxAttachmentSize
+    }
+    return DefaultMaxAttachmentSize
+}
+
+// The lockoutDuration function provides how long a user is locked out after the given number of consecutive failed
+// logins, which is zero until the configured limit is reached.
+func (this *Config) lockoutDuration(failures int) time.Duration {
+    limit := this.MaxFailedLogins
+    if limit <= 0 {
+        limit = DefaultMaxFailedLogins
+    }
+    if failures < limit {
+        return 0
+    }
+
+    lockout := this.LockoutDuration
+    if lockout <= 0 {
+        lockout = DefaultLockoutDuration
+    }
+    for i := limit; i < failures && lockout < MaxLockoutDuration; i++ {
+        lockout *= 2
+    }
+    if lockout > MaxLockoutDuration {
+        lockout = MaxLockoutDuration
+    }
+    return lockout
+}
+
+// OpenDB connects to the database described by the configuration, migrates it, and makes the
+// configuration current for the rest of the package.
+func OpenDB(c *Config) error {
+    if c.KdfIterations <= 0 {
+        return NewError(fmt.Sprintf("Invalid KDF iteration count %d", c.KdfIterations))
+    }
+
+    db, err := gorm.Open(c.Driver, c.Source)
     if err != nil {
-        panic(fmt.Sprintf("Error when connecting to database: %v", err))
+        return NewError(err)
+    }
+
+    if c.LogWriter != nil {
+        db.SetLogger(log.New(c.LogWriter, "\r\n", 0))
+    }
+    db.LogMode(c.LogMode)
+
+    previous := DB
+    DB = db
+    if err := Migrate(); err != nil {
+        DB = previous
+        return err
+    }
+    config = c
+    return nil
+}
+
+// The models variable lists an instance of every type stored in the database.
+var models = []interface{}{
+    &User{},
+    &EntryView{},
+    &Team{},
+    &TeamMember{},
+    &TeamEntry{},
+    &SharedLink{},
+    &Grant{},
+    &AuditEntry{},
+    &Attachment{},
+}
+
+// Migrate creates or updates the tables and indexes for every model.  It only adds what is missing, so it is safe to call
+// repeatedly.
+func Migrate() error {
+    for _, m := range models {
+        if err := DB.AutoMigrate(m).Error; err != nil {
+            return NewError(err)
+        }
     }
 
-    DB.LogMode(true)
-    DB.CreateTable(User{})
+    if err := DB.Model(&User{}).AddUniqueIndex("idx_users_name", "name").Error; err != nil {
+        return NewError(err)
+    }
+    // each user holds at most one live view of an entry, which replaces the indexes of earlier versions; views in the
+    // trash are left out, so that the entry may be shared with the user again
+    DB.Model(&EntryView{}).RemoveIndex("idx_entry_views_entry_id_user_id")
+    DB.Model(&EntryView{}).RemoveIndex("uix_entry_views_entry_id_user_id")
+    if err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uix_entry_views_live_entry_id_user_id ON entry_views (entry_id, user_id) WHERE deleted_at IS NULL").Error; err != nil {
+        return NewError(err)
+    }
+    if err := DB.Model(&AuditEntry{}).AddIndex("idx_audit_entries_user_id", "user_id").Error; err != nil {
+        return NewError(err)
+    }
+    return nil
+}
+
+// The isUniqueViolation function determines whether an error produced by the database reports that a unique index
+// would have been broken.
+func isUniqueViolation(err error) bool {
+    message := strings.ToLower(err.Error())
+    return strings.Contains(message, "unique constraint") || strings.Contains(message, "duplicate key") ||
+        strings.Contains(message, "duplicate entry")
+}
+
+// InitError holds the error, if any, from opening the default database when the package was initialized.  Embedders
+// which call OpenDB with their own configuration may ignore it.
+var InitError error
+
+// most of this is temporary for testing and will be cleaned up later as the database handling is fleshed out
+func init() {
+    InitError = OpenDB(DefaultConfig())
 }
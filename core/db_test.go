@@ -0,0 +1,78 @@
+package core
+
+import (
+    "bytes"
+    "code.google.com/p/go.crypto/pbkdf2"
+    "crypto/sha512"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type DBTestSuite struct {
+    suite.Suite
+}
+
+func (suite *DBTestSuite) TearDownTest() {
+    OpenDB(DefaultConfig())
+}
+
+func (suite *DBTestSuite) TestInitialized() {
+    a := assert.New(suite.T())
+
+    a.NoError(InitError)
+    a.NoError(DB.DB().Ping())
+}
+
+func (suite *DBTestSuite) TestMigrate() {
+    a := assert.New(suite.T())
+
+    a.NoError(Migrate())
+    a.NoError(Migrate())
+
+    entry := EntryView{EntryId: "entry", UserId: 1, AuthorityId: 1}
+    if a.NoError(DB.Create(&entry).Error) {
+        a.NotEqual(0, entry.Id)
+        DB.Unscoped().Delete(&entry)
+    }
+}
+
+func (suite *DBTestSuite) TestDefaultConfig() {
+    a := assert.New(suite.T())
+
+    c := DefaultConfig()
+    a.Equal("sqlite3", c.Driver)
+    a.True(c.LogMode)
+    a.Equal(100000, c.KdfIterations)
+    a.Equal(DefaultMaxAttachmentSize, c.MaxAttachmentSize)
+    a.Error(OpenDB(&Config{Driver: "sqlite3", Source: ":memory:"}))
+}
+
+func (suite *DBTestSuite) TestCustomConfig() {
+    a := assert.New(suite.T())
+
+    var quiet bytes.Buffer
+    c := &Config{Driver: "sqlite3", Source: ":memory:", LogMode: false, LogWriter: &quiet, KdfIterations: 1000}
+    if a.NoError(OpenDB(c)) {
+        u := User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+        k, err := MakeKeys(&u, "password")
+        if a.NoError(err) {
+            expected := pbkdf2.Key([]byte("password"), make([]byte, 32), 1000, 32, sha512.New)
+            a.Equal(expected, k.CryptoKey)
+        }
+
+        DB.Create(&u)
+        a.Equal(0, quiet.Len())
+    }
+
+    var verbose bytes.Buffer
+    c = &Config{Driver: "sqlite3", Source: ":memory:", LogMode: true, LogWriter: &verbose, KdfIterations: 1000}
+    if a.NoError(OpenDB(c)) {
+        DB.Create(&User{Name: "test.user", CryptoSalt: "a", SigningSalt: "b", PublicKey: "c"})
+        a.Contains(verbose.String(), "INSERT")
+    }
+}
+
+func TestDBTestSuite(t *testing.T) {
+    suite.Run(t, new(DBTestSuite))
+}
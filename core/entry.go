@@ -1,12 +1,21 @@
 package core
 
 import (
+    "encoding/base64"
     "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "github.com/jinzhu/gorm"
+    "log"
+    "strings"
     "time"
 )
 
 // EntryView instances represent one user's view of a password database entry.
-// Most fields are kept encrypted until they need to be accessed.
+// Most fields are kept encrypted until they need to be accessed.  The fields of every view, including the display fields
+// of a view shared by another authority, are encrypted under the symmetric key of the view's own user; the authority only
+// signs the permissions.  Sharing an entry therefore means writing a view whose fields are re-encrypted for the recipient.
 type EntryView struct {
     // The Id is the database row identifier.
     Id  int64
@@ -14,6 +23,9 @@ type EntryView struct {
     CreatedAt time.Time
     // UpdatedAt is the time when the entry was last updated.
     UpdatedAt time.Time
+    // DeletedAt is the time when the entry was deleted, or nil if it has not been.  Deleted entries are kept in the
+    // database but excluded from queries.
+    DeletedAt *time.Time
 
     // The EntryId string is the unique identifier for the password entry, and ties together the individual views into the entry of each user.
     EntryId string
@@ -46,120 +58,388 @@ type EntryView struct {
     Expiry string
     // The Extras field is extra encrypted JSON data associated with the entry.
     Extras string
+    // The TotpSecret field is the encrypted otpauth URI holding the TOTP secret and parameters of the entry.
+    TotpSecret string
+    // The Tags field is the encrypted JSON array of the entry's tags.
+    Tags string
 
     // The Userdata field is extra encrypted user-specific JSON data associated with the entry.
     Userdata string
+
+    // SharedBy is the foreign key of the user who shared the entry, while the fields remain encrypted under the secret
+    // shared between that user and the view's user.  The fields are moved to the view user's own key on first access, at
+    // which point SharedBy is reset to zero.
+    SharedBy int64
+
+    // The Acknowledged flag records whether the user has seen an entry shared with them by another authority.
+    Acknowledged bool
+    // The Archived flag hides the entry from listings without deleting it.
+    Archived bool
+    // The Policy is the version of the format in which every field of the view is encrypted.  Views stored before the
+    // version was recorded hold zero, and are treated as PolicyV1; only their fields may lack additional data.
+    Policy PolicyVersion `sql:"not null;default:0"`
+
+    // The RowSignature is the authority's signature over the entry's immutable metadata, binding the EntryId, UserId,
+    // AuthorityId and Permissions columns together so that none of them can be altered or swapped independently.
+    RowSignature string
+
+    // LastUsedAt is the time when the entry was last touched, or nil if it never has been.
+    LastUsedAt *time.Time
+
+    // The Version is incremented each time the entry is saved, so that Save can detect when the stored entry has been
+    // changed since this copy was loaded.
+    Version int `sql:"not null;default:0"`
+
+    // The user field is a reference to the owning user, if it has already been resolved.
+    user *User `sql:"-"`
+    // The authority field is a reference to the authority user, if it has already been resolved.
+    authority *User `sql:"-"`
+    // The grant field is the signed record of permissions last given to the view's user by another user, which is stored
+    // along with the view when it is next saved.
+    grant *Grant `sql:"-"`
+}
+
+// The ListOptions structure controls which entries are included by functions which list entries.
+type ListOptions struct {
+    // IncludeArchived causes archived entries to be listed along with active ones.
+    IncludeArchived bool
+    // SortByTitle causes the entries to be ordered by their decrypted titles, as for the SortByTitle function.
+    SortByTitle bool
+    // The Collation is the BCP 47 language tag whose collation rules order the titles when sorting by title.  An empty
+    // tag keeps plain byte ordering.
+    Collation string
+    // The Session, if set, is the user whose entries are listed, and is attached to each listed entry in place of a
+    // user loaded without keys, so that titles can be read when sorting by title.
+    Session *User
+}
+
+// The listOptions function combines the optional list options passed to a listing function.  Where more than one gives
+// a collation or session, the last one applies.
+func listOptions(options []ListOptions) ListOptions {
+    var result ListOptions
+    for _, o := range options {
+        result.IncludeArchived = result.IncludeArchived || o.IncludeArchived
+        result.SortByTitle = result.SortByTitle || o.SortByTitle
+        if len(o.Collation) > 0 {
+            result.Collation = o.Collation
+        }
+        if o.Session != nil {
+            result.Session = o.Session
+        }
+    }
+    return result
+}
+
+// The OnEntryChange function, if set, is called after each successful write of a field of an entry, with the name of the
+// field, and after each successful save of an entry, with an empty field name, along with the name of the user making the
+// change.  Attempts which fail, including those denied permission, are not reported.  Embedders may use it to trigger
+// synchronization or invalidate caches.
+var OnEntryChange func(entryId string, field string, user string)
+
+// The changed function reports a change to the entry to OnEntryChange, if it is set.
+func (this *EntryView) changed(field string) {
+    if OnEntryChange != nil {
+        OnEntryChange(this.EntryId, field, this.getUser().Name)
+    }
+}
+
+// The FieldError type is produced when a specific field of an entry fails a check.
+type FieldError struct {
+    // The Err is the underlying error describing the failure.
+    Err *Error
+    // The Field is the name of the entry field which failed.
+    Field string
+}
+
+// Error produces a string describing the error.
+func (this *FieldError) Error() string {
+    return this.Err.Error()
+}
+
+// Unwrap provides the underlying error.
+func (this *FieldError) Unwrap() error {
+    return this.Err
 }
 
 // The getAuthority function finds the authority user model instance and sets the internal reference pointer.
 func (this *EntryView) getAuthority() *User {
-    authority := new(User)
-    DB.Model(this).Related(authority, "AuthorityId")
+    if this.authority != nil && this.authority.Id == this.AuthorityId {
+        return this.authority
+    }
+    authority, err := Resolver.ById(this.AuthorityId)
+    if err != nil {
+        return new(User)
+    }
+    this.authority = authority
     return authority
 }
 
 // The getUser function finds the user model instance and sets the internal reference pointer.
 func (this *EntryView) getUser() *User {
-    user := new(User)
-    DB.Model(this).Related(user, "UserId")
+    if this.user != nil && this.user.Id == this.UserId {
+        return this.user
+    }
+    user, err := Resolver.ById(this.UserId)
+    if err != nil {
+        return new(User)
+    }
+    this.user = user
     return user
 }
 
-// ReadGroup reads the group field of the entry, provided that the user has appropriate permissions.
-// Read access to the group field is granted to users with any permissions, since this field is necessary in order to be able
-// to display the entry properly.
-func (this *EntryView) ReadGroup() (string, error) {
-    if this.getUser().Can("*", this) {
-        data, err := this.getUser().Decrypt(this.Group)
+// AttachUser sets the user through whom the entry is accessed, so that a user instance with an active session can be used
+// rather than one loaded without keys.  The user must be the owner of the view.
+func (this *EntryView) AttachUser(user *User) error {
+    if user.Id != this.UserId {
+        return NewError("Entry does not belong to the user", user)
+    }
+    this.user = user
+    return nil
+}
+
+// The fieldAD function produces the additional data which binds the ciphertext of the named field to the entry and field,
+// so that it fails to decrypt if it is moved to another entry or field.
+func (this *EntryView) fieldAD(name string) []byte {
+    return []byte(this.EntryId + "\x00" + name)
+}
+
+// The decryptBound function decrypts the ciphertext of the named field of the entry with the user's key.  Fields written
+// before ciphertext was bound to its entry and field are encrypted without additional data, and are decrypted as such if
+// the bound form fails, until they are next written.  Once the entry's policy requires bound fields, they must be bound.
+func decryptBound(user *User, entry *EntryView, name string, encrypted string) ([]byte, error) {
+    data, err := user.DecryptWithAD(encrypted, entry.fieldAD(name))
+    if err != nil && !entry.Policy.bound() && errors.Is(err, ErrDecryption) {
+        if legacy, e := user.Decrypt(encrypted); e == nil {
+            return legacy, nil
+        }
+    }
+    return data, err
+}
+
+// The decryptField function decrypts the named field of the entry with the user's key, first moving the fields of a newly
+// shared entry over to that key.
+func (this *EntryView) decryptField(name string) ([]byte, error) {
+    if err := this.acceptShare(); err != nil {
+        return nil, err
+    }
+    field, ok := findField(encryptedFields, name)
+    if !ok {
+        return nil, NewError("Unknown field '"+name+"'", this.getUser())
+    }
+    return decryptBound(this.getUser(), this, name, *field.value(this))
+}
+
+// The encryptField function encrypts a new value for the named field of the entry with the user's key, bound to the entry
+// and field, first moving the fields of a newly shared entry over to that key so that all of the fields remain under the
+// same key.
+func (this *EntryView) encryptField(name string, data []byte) (string, error) {
+    if err := this.acceptShare(); err != nil {
+        return "", err
+    }
+    return this.getUser().EncryptWithAD(data, this.fieldAD(name))
+}
+
+// The acceptShare function re-encrypts the fields of an entry shared with the user, which are encrypted under the secret
+// shared with the sharing user, under the user's own symmetric key.  The user must have an active session.  Stored
+// entries are updated immediately, so this only happens once.
+func (this *EntryView) acceptShare() error {
+    if this.SharedBy == 0 {
+        return nil
+    }
+
+    user := this.getUser()
+    sharer, err := this.findSharer()
+    if err != nil {
+        return err
+    }
+
+    values := make(map[string]string)
+    for _, f := range encryptedFields {
+        value := *f.value(this)
+        if len(value) == 0 {
+            continue
+        }
+        data, _, err := user.DecryptShared(value, "", sharer)
+        if err != nil {
+            return err
+        }
+        values[f.name], err = user.EncryptWithAD(data, this.fieldAD(f.name))
+        if err != nil {
+            return err
+        }
+    }
+
+    if this.Id != 0 {
+        columns := map[string]interface{}{"shared_by": 0, "policy": CurrentPolicy}
+        for _, f := range encryptedFields {
+            if value, ok := values[f.name]; ok {
+                columns[f.column] = value
+            }
+        }
+        if err := DB.Model(this).UpdateColumns(columns).Error; err != nil {
+            return NewError(err, user)
+        }
+    }
+    for _, f := range encryptedFields {
+        if value, ok := values[f.name]; ok {
+            *f.value(this) = value
+        }
+    }
+    this.SharedBy = 0
+    this.Policy = CurrentPolicy
+    return nil
+}
+
+// The findSharer function resolves the user who shared the entry while its fields remain encrypted under the secret
+// shared with them, producing nil once the fields have been moved over to the user's own key.
+func (this *EntryView) findSharer() (*User, error) {
+    if this.SharedBy == 0 {
+        return nil, nil
+    }
+    sharer, err := Resolver.ById(this.SharedBy)
+    if err != nil {
+        return nil, NewError("Entry sharer not found", this.getUser(), ErrNotFound)
+    }
+    return sharer, nil
+}
+
+// The entryField structure describes one of the encrypted string fields of an entry.
+type entryField struct {
+    // The name is the lowercase identifier of the field used by ReadField and WriteField.
+    name string
+    // The column is the name of the database column holding the field.
+    column string
+    // The label is the human-readable name of the field used in error messages.
+    label string
+    // The query is the permission required in order to read the field.
+    query string
+    // The value function locates the field within a particular entry.
+    value func(*EntryView) *string
+}
+
+// The entryFields table lists the encrypted string fields of an entry, in display order.
+var entryFields = []entryField{
+    {"group", "group", "Group", "*", func(e *EntryView) *string { return &e.Group }},
+    {"icon", "icon", "Icon", "*", func(e *EntryView) *string { return &e.Icon }},
+    {"title", "title", "Title", "*", func(e *EntryView) *string { return &e.Title }},
+    {"username", "username", "Username", "r", func(e *EntryView) *string { return &e.Username }},
+    {"password", "password", "Password", "r", func(e *EntryView) *string { return &e.Password }},
+    {"url", "url", "URL", "r", func(e *EntryView) *string { return &e.Url }},
+    {"comment", "comment", "Comment", "r", func(e *EntryView) *string { return &e.Comment }},
+}
+
+// The encryptedFields table extends entryFields with the encrypted fields which do not hold plain strings.  The userdata
+// field is private to the user, so no permission is required to access it.
+var encryptedFields = append(append([]entryField{}, entryFields...),
+    entryField{"expiry", "expiry", "Expiry date", "r", func(e *EntryView) *string { return &e.Expiry }},
+    entryField{"extras", "extras", "Extras", "r", func(e *EntryView) *string { return &e.Extras }},
+    entryField{"totp", "totp_secret", "TOTP secret", "r", func(e *EntryView) *string { return &e.TotpSecret }},
+    entryField{"tags", "tags", "Tags", "r", func(e *EntryView) *string { return &e.Tags }},
+    entryField{"userdata", "userdata", "Userdata", "", func(e *EntryView) *string { return &e.Userdata }},
+)
+
+// The findField function looks up the description of the named field in the given table.
+func findField(table []entryField, name string) (*entryField, bool) {
+    for i := range table {
+        if table[i].name == name {
+            return &table[i], true
+        }
+    }
+    return nil, false
+}
+
+// The findEntryField function looks up the description of the named string field.
+func findEntryField(name string) (*entryField, bool) {
+    return findField(entryFields, name)
+}
+
+// ReadField reads the named string field of the entry, provided that the user has the permission required for that field.
+func (this *EntryView) ReadField(name string) (result string, err error) {
+    defer func() { this.audit("read "+name, err) }()
+    field, ok := findEntryField(name)
+    if !ok {
+        return "", NewError("Unknown field '"+name+"'", this.getUser())
+    }
+
+    if this.getUser().Can(field.query, this) {
+        data, err := this.decryptField(field.name)
         if err != nil {
             return "", err
         }
         return string(data), nil
     }
-    return "", NewError("Group read permission denied", this.getUser())
+    return "", NewError(field.label+" read permission denied", this.getUser(), ErrPermission)
+}
+
+// WriteField writes the named string field of the entry, provided that the user has appropriate permissions.
+func (this *EntryView) WriteField(name string, value string) (err error) {
+    defer func() { this.written(name, err) }()
+    field, ok := findEntryField(name)
+    if !ok {
+        return NewError("Unknown field '"+name+"'", this.getUser())
+    }
+
+    if this.getUser().Can("w", this) {
+        data, err := this.encryptField(field.name, []byte(value))
+        if err != nil {
+            return err
+        }
+        *field.value(this) = data
+        return nil
+    }
+    return NewError(field.label+" write permission denied", this.getUser(), ErrPermission)
+}
+
+// ReadGroup reads the group field of the entry, provided that the user has appropriate permissions.
+// Read access to the group field is granted to users with any permissions, since this field is necessary in order to be able
+// to display the entry properly.
+func (this *EntryView) ReadGroup() (string, error) {
+    return this.ReadField("group")
 }
 
 // ReadIcon reads the icon field of the entry, provided that the user has appropriate permissions.
 // Read access to the icon field is granted to users with any permissions, since this field is necessary
 // in order to be able to display the entry properly.
 func (this *EntryView) ReadIcon() (string, error) {
-    if this.getUser().Can("*", this) {
-        data, err := this.getUser().Decrypt(this.Icon)
-        if err != nil {
-            return "", err
-        }
-
-        return string(data), nil
-    }
-    return "", NewError("Icon read permission denied", this.getUser())
+    return this.ReadField("icon")
 }
 
 // ReadTitle reads the title field of the entry, provided that the user has appropriate permissions.
 // Read access to the title field is granted to users with any permissions, since this field is necessary
 // in order to be able to display the entry properly.
 func (this *EntryView) ReadTitle() (string, error) {
-    if this.getUser().Can("*", this) {
-        data, err := this.getUser().Decrypt(this.Title)
-        if err != nil {
-            return "", err
-        }
-        return string(data), nil
-    }
-    return "", NewError("Title read permission denied", this.getUser())
+    return this.ReadField("title")
 }
 
 // ReadUsername reads the username field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) ReadUsername() (string, error) {
-    if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Username)
-        if err != nil {
-            return "", err
-        }
-        return string(data), nil
-    }
-    return "", NewError("Username read permission denied", this.getUser())
+    return this.ReadField("username")
 }
 
 // ReadPassword reads the password field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) ReadPassword() (string, error) {
-    if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Password)
-        if err != nil {
-            return "", err
-        }
-        return string(data), nil
-    }
-    return "", NewError("Password read permission denied", this.getUser())
+    return this.ReadField("password")
 }
 
-// ReadUrl reads the password field of the entry, provided that the user has appropriate permissions.
+// ReadUrl reads the url field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) ReadUrl() (string, error) {
-    if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Url)
-        if err != nil {
-            return "", err
-        }
-        return string(data), nil
-    }
-    return "", NewError("URL read permission denied", this.getUser())
+    return this.ReadField("url")
 }
 
 // ReadComment reads the comment field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) ReadComment() (string, error) {
-    if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Comment)
-        if err != nil {
-            return "", err
-        }
-        return string(data), nil
-    }
-    return "", NewError("Comment read permission denied", this.getUser())
+    return this.ReadField("comment")
 }
 
-// ReadExpiry reads the expiry date field of the entry, provided that the user has appropriate permissions.
-func (this *EntryView) ReadExpiry() (time.Time, error) {
+// ReadExpiry reads the expiry date field of the entry, provided that the user has appropriate permissions.  An entry which
+// never expires, because no expiry date has been written or it has been cleared, produces the zero time.
+func (this *EntryView) ReadExpiry() (result time.Time, err error) {
+    defer func() { this.audit("read expiry", err) }()
     if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Expiry)
+        if len(this.Expiry) == 0 {
+            return time.Time{}, nil
+        }
+        data, err := this.decryptField("expiry")
         if err != nil {
             return time.Now(), err
         }
@@ -171,31 +451,29 @@ func (this *EntryView) ReadExpiry() (time.Time, error) {
         }
         return t, nil
     }
-    return time.Now(), NewError("Expiry date read permission denied", this.getUser())
+    return time.Now(), NewError("Expiry date read permission denied", this.getUser(), ErrPermission)
 }
 
-// ReadExtras reads the extras field of the entry, provided that the user has appropriate permissions.
-func (this *EntryView) ReadExtras(user string) (interface{}, error) {
+// ReadExtras reads the extras field of the entry, provided that the user has appropriate permissions.  The extras are
+// shared by every user of the entry, unlike the userdata.  The result is a map[string]interface{}, which is empty if the
+// field has not been written.
+func (this *EntryView) ReadExtras() (result interface{}, err error) {
+    defer func() { this.audit("read extras", err) }()
     if this.getUser().Can("r", this) {
-        data, err := this.getUser().Decrypt(this.Extras)
+        extras, err := this.loadExtras()
         if err != nil {
             return nil, err
         }
-
-        var extras interface{}
-        err = json.Unmarshal(data, &extras)
-        if err != nil {
-            return nil, NewError(err, this.getUser())
-        }
         return extras, nil
     }
-    return nil, NewError("Comment read permission denied", this.getUser())
+    return nil, NewError("Extras read permission denied", this.getUser(), ErrPermission)
 }
 
 // ReadUserdata reads the userdata field of the entry.
 // No specific permissions are required since this field is only ever accessible by the user and is not propagated to others.
-func (this *EntryView) ReadUserdata() (interface{}, error) {
-    data, err := this.getUser().Decrypt(this.Userdata)
+func (this *EntryView) ReadUserdata() (result interface{}, err error) {
+    defer func() { this.audit("read userdata", err) }()
+    data, err := this.decryptField("userdata")
     if err != nil {
         return nil, err
     }
@@ -210,137 +488,1027 @@ func (this *EntryView) ReadUserdata() (interface{}, error) {
 
 // WriteGroup writes the group field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WriteGroup(group string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(group))
-        if err != nil {
-            return err
-        }
-        this.Group = data
-        return nil
-    }
-    return NewError("Group write permission denied", this.getUser())
+    return this.WriteField("group", group)
 }
 
 // WriteIcon writes the icon field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WriteIcon(icon string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(icon))
-        if err != nil {
-            return err
-        }
-        this.Icon = data
-        return nil
-    }
-    return NewError("Icon write permission denied", this.getUser())
+    return this.WriteField("icon", icon)
 }
 
 // WriteTitle writes the title field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WriteTitle(title string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(title))
-        if err != nil {
-            return err
-        }
-        this.Title = data
-        return nil
-    }
-    return NewError("Title write permission denied", this.getUser())
+    return this.WriteField("title", title)
 }
 
 // WriteUsername writes the username field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WriteUsername(username string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(username))
-        if err != nil {
-            return err
-        }
-        this.Username = data
-        return nil
-    }
-    return NewError("Username write permission denied", this.getUser())
+    return this.WriteField("username", username)
 }
 
 // WritePassword writes the password field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WritePassword(password string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(password))
-        if err != nil {
-            return err
-        }
-        this.Password = data
-        return nil
-    }
-    return NewError("Password write permission denied", this.getUser())
+    return this.WriteField("password", password)
 }
 
 // WriteUrl writes the url field of the entry, provided that the user has appropriate permissions.
+// The url is normalized before being stored so that equivalent addresses are stored identically.
 func (this *EntryView) WriteUrl(url string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(url))
-        if err != nil {
-            return err
-        }
-        this.Url = data
-        return nil
+    return this.WriteField("url", utils.NormalizeUrl(url))
+}
+
+// MatchUrl determines whether the url stored in the entry is equivalent to the given url.  False is returned if the
+// user is not permitted to read the url field.
+func (this *EntryView) MatchUrl(url string) bool {
+    stored, err := this.ReadUrl()
+    if err != nil || len(stored) == 0 {
+        return false
     }
-    return NewError("URL write permission denied", this.getUser())
+    return utils.NormalizeUrl(stored) == utils.NormalizeUrl(url)
 }
 
 // WriteComment writes the comment field of the entry, provided that the user has appropriate permissions.
 func (this *EntryView) WriteComment(comment string) error {
-    if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(comment))
-        if err != nil {
-            return err
-        }
-        this.Comment = data
-        return nil
-    }
-    return NewError("Comment write permission denied", this.getUser())
+    return this.WriteField("comment", comment)
 }
 
-// WriteExpiry writes the expiry field of the entry, provided that the user has appropriate permissions.
-func (this *EntryView) WriteExpiry(expiry time.Time) error {
+// WriteExpiry writes the expiry field of the entry, provided that the user has appropriate permissions.  The zero time
+// means that the entry never expires, and clears the field.
+func (this *EntryView) WriteExpiry(expiry time.Time) (err error) {
+    defer func() { this.written("expiry", err) }()
     if this.getUser().Can("w", this) {
-        data, err := this.getUser().Encrypt([]byte(expiry.Format(time.RFC3339)))
+        if expiry.IsZero() {
+            this.Expiry = ""
+            return nil
+        }
+        data, err := this.encryptField("expiry", []byte(expiry.Format(time.RFC3339)))
         if err != nil {
             return err
         }
         this.Expiry = data
         return nil
     }
-    return NewError("Expiry date write permission denied", this.getUser())
+    return NewError("Expiry date write permission denied", this.getUser(), ErrPermission)
 }
 
 // WriteExtras writes the extras field of the entry, provided that the user has appropriate permissions and a valid encryption key.
-func (this *EntryView) WriteExtras(extras interface{}) error {
+// Extras forming an object may not hold keys beginning with ReservedExtraPrefix.
+func (this *EntryView) WriteExtras(extras interface{}) (err error) {
+    defer func() { this.written("extras", err) }()
     if this.getUser().Can("w", this) {
         bytes, err := json.Marshal(extras)
         if err != nil {
             return NewError(err, this.getUser())
         }
+        if err := this.checkExtraKeys(bytes); err != nil {
+            return err
+        }
 
-        data, e := this.getUser().Encrypt(bytes)
+        data, e := this.encryptField("extras", bytes)
         if e != nil {
             return e
         }
         this.Extras = data
         return nil
     }
-    return NewError("Extras write permission denied", this.getUser())
+    return NewError("Extras write permission denied", this.getUser(), ErrPermission)
+}
+
+// ReservedExtraPrefix begins the keys of extras which are reserved for internal use, so that they cannot collide with
+// those set by users through SetExtra.
+const ReservedExtraPrefix = "_"
+
+// The checkExtraKey function ensures that the key names an extra which may be accessed by users.
+func (this *EntryView) checkExtraKey(key string) error {
+    if len(key) == 0 {
+        return NewError("No extra key given", this.getUser())
+    }
+    if strings.HasPrefix(key, ReservedExtraPrefix) {
+        return NewError("Extra key '"+key+"' is reserved", this.getUser())
+    }
+    return nil
+}
+
+// The checkExtraKeys function ensures that none of the keys of the encoded extras is reserved, where they form an object.
+// Extras of any other form hold no keys to check.
+func (this *EntryView) checkExtraKeys(data []byte) error {
+    var extras map[string]json.RawMessage
+    if json.Unmarshal(data, &extras) != nil {
+        return nil
+    }
+    for key := range extras {
+        if strings.HasPrefix(key, ReservedExtraPrefix) {
+            return NewError("Extra key '"+key+"' is reserved", this.getUser())
+        }
+    }
+    return nil
+}
+
+// The loadExtras function decrypts the extras field of the entry as an object, producing an empty one if the field has
+// not been written.
+func (this *EntryView) loadExtras() (map[string]interface{}, error) {
+    extras := make(map[string]interface{})
+    if len(this.Extras) == 0 {
+        return extras, nil
+    }
+    data, err := this.decryptField("extras")
+    if err != nil {
+        return nil, err
+    }
+    defer utils.SecureZero(data)
+    if err := json.Unmarshal(data, &extras); err != nil {
+        return nil, NewError("Extras are not an object: "+err.Error(), this.getUser())
+    }
+    return extras, nil
+}
+
+// GetExtra reads a single value from the extras of the entry, provided that the user has read permission, reporting
+// whether the key was present.  Keys beginning with ReservedExtraPrefix may not be read.
+func (this *EntryView) GetExtra(key string) (value interface{}, ok bool, err error) {
+    defer func() { this.audit("read extra "+key, err) }()
+    if err := this.checkExtraKey(key); err != nil {
+        return nil, false, err
+    }
+    if !this.getUser().Can("r", this) {
+        return nil, false, NewError("Extras read permission denied", this.getUser(), ErrPermission)
+    }
+
+    extras, err := this.loadExtras()
+    if err != nil {
+        return nil, false, err
+    }
+    value, ok = extras[key]
+    return value, ok, nil
+}
+
+// SetExtra changes a single value in the extras of the entry, provided that the user has write permission, leaving the
+// other values as they are.  A nil value removes the key.  Keys beginning with ReservedExtraPrefix may not be set.
+func (this *EntryView) SetExtra(key string, value interface{}) (err error) {
+    defer func() { this.written("extras", err) }()
+    if err := this.checkExtraKey(key); err != nil {
+        return err
+    }
+    if !this.getUser().Can("w", this) {
+        return NewError("Extras write permission denied", this.getUser(), ErrPermission)
+    }
+    return this.setExtra(key, value)
+}
+
+// The setExtra function changes a single value in the extras of the entry, without checking the key or permissions.
+func (this *EntryView) setExtra(key string, value interface{}) error {
+    extras, err := this.loadExtras()
+    if err != nil {
+        return err
+    }
+    if value == nil {
+        delete(extras, key)
+    } else {
+        extras[key] = value
+    }
+
+    data, err := json.Marshal(extras)
+    if err != nil {
+        return NewError(err, this.getUser())
+    }
+    defer utils.SecureZero(data)
+    encrypted, err := this.encryptField("extras", data)
+    if err != nil {
+        return err
+    }
+    this.Extras = encrypted
+    return nil
 }
 
 // WriteUserdata writes the userdata field of the entry, provided that the user a valid encryption key.
-func (this *EntryView) WriteUserdata(userdata interface{}) error {
+func (this *EntryView) WriteUserdata(userdata interface{}) (err error) {
+    defer func() { this.written("userdata", err) }()
     bytes, err := json.Marshal(userdata)
     if err != nil {
         return NewError(err, this.getUser())
     }
 
-    data, e := this.getUser().Encrypt(bytes)
+    data, e := this.encryptField("userdata", bytes)
     if e != nil {
         return e
     }
     this.Userdata = data
     return nil
 }
+
+// WriteBatch writes several fields of the entry together and saves it, provided that the user has write permission.  The
+// fields are keyed by the names of the string fields, whose values are strings, along with "expiry", whose value is a
+// time.Time, and "extras", whose value is a map whose keys may not be reserved, as for WriteExtras.  Every value is
+// encrypted before any field is changed, so if a field is unknown, holds a value of the wrong type or cannot be
+// encrypted, the entry is left as it was and nothing is stored.  If the entry cannot be saved, its fields are restored
+// to their previous values.
+func (this *EntryView) WriteBatch(fields map[string]interface{}) (err error) {
+    defer func() { this.audit("write batch", err) }()
+    user := this.getUser()
+    if !user.Can("w", this) {
+        return NewError("Entry write permission denied", user, ErrPermission)
+    }
+    if err := this.acceptShare(); err != nil {
+        return err
+    }
+
+    encrypted := make(map[*string]string, len(fields))
+    for name, value := range fields {
+        data, err := this.encryptBatchField(name, value)
+        if err != nil {
+            return err
+        }
+        field, _ := findField(encryptedFields, name)
+        encrypted[field.value(this)] = data
+    }
+
+    previous := make(map[*string]string, len(encrypted))
+    for target, data := range encrypted {
+        previous[target] = *target
+        *target = data
+    }
+    if err := this.Save(); err != nil {
+        for target, value := range previous {
+            *target = value
+        }
+        return err
+    }
+    return nil
+}
+
+// The encryptBatchField function encrypts a value given to WriteBatch for the named field, checking that it has the type
+// which the field requires.
+func (this *EntryView) encryptBatchField(name string, value interface{}) (string, error) {
+    user := this.getUser()
+    switch name {
+    case "expiry":
+        expiry, ok := value.(time.Time)
+        if !ok {
+            return "", NewError("Expiry date must be a time", user)
+        }
+        if expiry.IsZero() {
+            return "", nil
+        }
+        return this.encryptField(name, []byte(expiry.Format(time.RFC3339)))
+    case "extras":
+        switch value.(type) {
+        case map[string]interface{}, map[string]string:
+        default:
+            return "", NewError("Extras must be a map", user)
+        }
+        data, err := json.Marshal(value)
+        if err != nil {
+            return "", NewError(err, user)
+        }
+        defer utils.SecureZero(data)
+        if err := this.checkExtraKeys(data); err != nil {
+            return "", err
+        }
+        return this.encryptField(name, data)
+    }
+
+    field, ok := findEntryField(name)
+    if !ok {
+        return "", NewError("Unknown field '"+name+"'", user)
+    }
+    text, ok := value.(string)
+    if !ok {
+        return "", NewError(field.label+" must be a string", user)
+    }
+    if name == "url" {
+        text = utils.NormalizeUrl(text)
+    }
+    return this.encryptField(name, []byte(text))
+}
+
+// Validate checks that every non-empty field of the entry which the user is permitted to read can actually be decrypted.
+// This is an integrity probe rather than a permission check, so fields the user cannot read are skipped, and the entry
+// is left unchanged, even when newly shared.  The first field which fails to decrypt is reported via a FieldError with
+// ErrDecryption.
+func (this *EntryView) Validate() error {
+    user := this.getUser()
+    sharer, err := this.findSharer()
+    if err != nil {
+        return err
+    }
+    for _, f := range encryptedFields {
+        value := *f.value(this)
+        if len(value) == 0 {
+            continue
+        }
+        if len(f.query) > 0 && !user.Can(f.query, this) {
+            continue
+        }
+
+        data, err := this.probeField(&f, sharer)
+        if err != nil {
+            return &FieldError{NewError("Field '"+f.name+"' could not be decrypted", user, ErrDecryption), f.name}
+        }
+        utils.SecureZero(data)
+    }
+    return nil
+}
+
+// VerifyIntegrity attempts to decrypt every field of the entry which the user is permitted to read, and produces a
+// FieldError with ErrDecryption for each one which fails to decrypt or authenticate, so that a corrupted entry can be
+// reported before the damaged field is needed, such as after a migration or restore.  Unlike Validate, which stops at
+// the first failure, every field is checked, and nothing is produced for an intact entry.  As with Validate, the entry
+// is left unchanged.  The user must have an active session; otherwise, or if the sharer of a newly shared entry cannot
+// be found, that failure is the only error produced.
+func (this *EntryView) VerifyIntegrity() []error {
+    user := this.getUser()
+    key := user.getEncryptionKey()
+    if key == nil {
+        return []error{NewError("Private key unavailable", user, ErrCrypto)}
+    }
+    utils.SecureZero(key)
+    sharer, err := this.findSharer()
+    if err != nil {
+        return []error{err}
+    }
+
+    var errs []error
+    for _, f := range encryptedFields {
+        if len(*f.value(this)) == 0 || (len(f.query) > 0 && !user.Can(f.query, this)) {
+            continue
+        }
+        data, err := this.probeField(&f, sharer)
+        if err != nil {
+            errs = append(errs, &FieldError{NewError("Field '"+f.name+"' could not be decrypted", user, ErrDecryption), f.name})
+            continue
+        }
+        utils.SecureZero(data)
+    }
+    return errs
+}
+
+// The probeField function decrypts the field of the entry for an integrity probe without changing the entry.  The fields
+// of a newly shared entry are decrypted with the secret shared with its sharer, given by findSharer, rather than being
+// moved over to the user's own key as they are when read.
+func (this *EntryView) probeField(f *entryField, sharer *User) ([]byte, error) {
+    user := this.getUser()
+    if sharer != nil {
+        data, _, err := user.DecryptShared(*f.value(this), "", sharer)
+        return data, err
+    }
+    return decryptBound(user, this, f.name, *f.value(this))
+}
+
+// NewEntry creates a new, empty entry owned by the user, who acts as its authority with full permissions.  The user must
+// have an active session.  The entry is not stored until it is saved.
+func NewEntry(owner *User) (*EntryView, error) {
+    raw := utils.RandomBytes(16)
+    if raw == nil {
+        return nil, NewError("RNG failure!", owner)
+    }
+
+    entry := &EntryView{EntryId: base64.URLEncoding.EncodeToString(raw), UserId: owner.Id, Policy: CurrentPolicy, user: owner}
+    if err := owner.GrantPermissions(entry, owner, ValidPermissions); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+// Clone creates and stores a copy of the entry under a new EntryId, owned by the same user, who acts as authority of the
+// copy with full permissions.  The user must have read permission on the entry and an active session.  Every field which
+// the user is permitted to read is re-encrypted into the copy, along with the user's private userdata, and the title is
+// replaced by the new title.  Attachments are not copied.
+func (this *EntryView) Clone(newTitle string) (result *EntryView, err error) {
+    defer func() { this.audit("clone", err) }()
+    user := this.getUser()
+    if !user.Can("r", this) {
+        return nil, NewError("Entry read permission denied", user, ErrPermission)
+    }
+
+    clone, err := NewEntry(user)
+    if err != nil {
+        return nil, err
+    }
+    for _, f := range encryptedFields {
+        value := f.value(this)
+        if len(*value) == 0 || (len(f.query) > 0 && !user.Can(f.query, this)) {
+            continue
+        }
+        data, err := this.decryptField(f.name)
+        if err != nil {
+            return nil, err
+        }
+        *f.value(clone), err = clone.encryptField(f.name, data)
+        utils.SecureZero(data)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if err := clone.WriteTitle(newTitle); err != nil {
+        return nil, err
+    }
+
+    if err := clone.Save(); err != nil {
+        return nil, err
+    }
+    return clone, nil
+}
+
+// LoadEntry instantiates the view of an entry belonging to the given user from the database.  The view refers to the
+// user it was loaded for, so its fields can be read once that user's session is started.  A view whose row signature does
+// not verify is refused with ErrPermission, as by VerifyRow.
+func LoadEntry(entryId string, userId int64) (*EntryView, error) {
+    user, err := Resolver.ById(userId)
+    if err != nil {
+        return nil, err
+    }
+
+    entry := new(EntryView)
+    if DB.Where(&EntryView{EntryId: entryId, UserId: userId}).First(entry).RecordNotFound() {
+        return nil, NewError("Entry '"+entryId+"' not found", user, ErrNotFound)
+    }
+    entry.user = user
+    if err := entry.VerifyRow(); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+// AllViews lists the view of the entry belonging to each user who holds one, in the order they were created, so that every
+// user with access to the entry can be found.  Each view refers to its own user, which is resolved when it is first
+// needed.  An entry with no views produces an empty list rather than an error.  Views whose row signature fails to
+// verify are skipped and reported, as by verifiedViews.
+func AllViews(entryId string) ([]*EntryView, error) {
+    views, err := findViews(entryId)
+    if err != nil {
+        return nil, err
+    }
+    return verifiedViews(views), nil
+}
+
+// The findViews function lists the views of the entry as AllViews does, but without verifying their row signatures, for
+// callers which check each view themselves.
+func findViews(entryId string) ([]*EntryView, error) {
+    var views []*EntryView
+    if err := DB.Where("entry_id = ?", entryId).Order("id").Find(&views).Error; err != nil {
+        return nil, NewError(err)
+    }
+    return views, nil
+}
+
+// Siblings lists the views of the same entry belonging to other users, as for AllViews.
+func (this *EntryView) Siblings() ([]*EntryView, error) {
+    views, err := AllViews(this.EntryId)
+    if err != nil {
+        return nil, err
+    }
+    var siblings []*EntryView
+    for _, view := range views {
+        if view.UserId != this.UserId {
+            siblings = append(siblings, view)
+        }
+    }
+    return siblings, nil
+}
+
+// ListEntries lists the views of every entry belonging to the given user.  Archived entries are excluded, and the
+// entries are left in no particular order, unless otherwise requested through the options.  Sorting by title requires
+// the user's active session to be given in the options, as otherwise no title can be read.  The views share a single
+// reference to the user.  Views whose row signature fails to verify are skipped and reported, as by verifiedViews.
+func ListEntries(userId int64, options ...ListOptions) ([]*EntryView, error) {
+    opts := listOptions(options)
+    user := opts.Session
+    if user == nil {
+        var err error
+        if user, err = Resolver.ById(userId); err != nil {
+            return nil, err
+        }
+    } else if user.Id != userId {
+        return nil, NewError("Session does not belong to the user", user)
+    }
+
+    var entries []*EntryView
+    query := DB.Where("user_id = ?", userId)
+    if !opts.IncludeArchived {
+        query = query.Where("archived = ?", false)
+    }
+    if err := query.Find(&entries).Error; err != nil {
+        return nil, NewError(err, user)
+    }
+    for _, e := range entries {
+        e.user = user
+    }
+    entries = verifiedViews(entries)
+    if err := sortEntries(entries, opts); err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
+
+// Save stores the entry in the database, creating the row if the entry has not been stored yet and updating it otherwise.
+// The entry must identify its user and authority, and its row signature must be valid.  An entry which has been saved
+// elsewhere since it was loaded is not stored, and ErrConflict is produced.
+func (this *EntryView) Save() error {
+    if err := this.checkSave(); err != nil {
+        return err
+    }
+
+    version := this.Version
+    tx := DB.Begin()
+    if err := this.store(tx); err != nil {
+        tx.Rollback()
+        this.Version = version
+        return err
+    }
+    if err := tx.Commit().Error; err != nil {
+        this.Version = version
+        return NewError(err, this.getUser())
+    }
+    this.changed("")
+    return nil
+}
+
+// The store function creates the entry, or updates it if it has already been stored, through the given transaction.  An
+// update first advances the stored version, provided that it still matches the entry's own, and fails with ErrConflict if
+// it does not, since the entry has then been saved elsewhere since this copy was loaded.  The caller should reload the
+// entry and apply its changes again.  Creating a view of an entry which its user already holds also fails with
+// ErrConflict.
+func (this *EntryView) store(tx *gorm.DB) error {
+    user := this.getUser()
+    if this.Id == 0 {
+        if err := tx.Create(this).Error; err != nil {
+            if isUniqueViolation(err) {
+                return NewError("User already holds a view of entry '"+this.EntryId+"'", user, ErrConflict)
+            }
+            return NewError(err, user)
+        }
+        return this.storeGrant(tx)
+    }
+
+    result := tx.Unscoped().Model(&EntryView{}).Where("id = ? AND version = ?", this.Id, this.Version).UpdateColumn("version", this.Version+1)
+    if result.Error != nil {
+        return NewError(result.Error, user)
+    }
+    if result.RowsAffected == 0 {
+        return NewError("Entry '"+this.EntryId+"' was changed since it was loaded", user, ErrConflict)
+    }
+    this.Version++
+    if err := tx.Save(this).Error; err != nil {
+        return NewError(err, user)
+    }
+    return this.storeGrant(tx)
+}
+
+// The storeGrant function stores the grant made by the latest change to the view's permissions, if any, through the
+// given transaction, so that the grant is kept only if the view is.
+func (this *EntryView) storeGrant(tx *gorm.DB) error {
+    if this.grant == nil {
+        return nil
+    }
+    if err := storeGrant(tx, this.grant); err != nil {
+        return err
+    }
+    this.grant = nil
+    return nil
+}
+
+// The checkSave function ensures that the entry identifies its user and authority and has a valid row signature, so that
+// it may be stored.
+func (this *EntryView) checkSave() error {
+    user := this.getUser()
+    if len(this.EntryId) == 0 {
+        return NewError("Entry has no EntryId", user)
+    }
+    if this.UserId == 0 {
+        return NewError("Entry '"+this.EntryId+"' has no user", user)
+    }
+    if this.AuthorityId == 0 {
+        return NewError("Entry '"+this.EntryId+"' has no authority", user)
+    }
+    return this.VerifyRow()
+}
+
+// Delete moves the entry to the user's trash, provided that the user holds delete permission or is the entry's own
+// authority.  The row is soft-deleted, so it is excluded from queries but remains in storage until it is purged, and can
+// be restored until then.
+func (this *EntryView) Delete() (err error) {
+    defer func() { this.audit("delete", err) }()
+    user := this.getUser()
+    if this.AuthorityId != this.UserId && !user.Can("d", this) {
+        return NewError("Entry delete permission denied", user, ErrPermission)
+    }
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", user)
+    }
+
+    if err := DB.Delete(this).Error; err != nil {
+        return NewError(err, user)
+    }
+    return nil
+}
+
+// Restore moves a deleted entry out of the user's trash, provided that the user holds write or delete permission or is
+// the entry's own authority.  If the entry has been shared with the user again since it was deleted, the user already
+// holds a view of it, and ErrConflict is produced.
+func (this *EntryView) Restore() (err error) {
+    defer func() { this.audit("restore", err) }()
+    user := this.getUser()
+    if this.AuthorityId != this.UserId && !user.Can("w", this) && !user.Can("d", this) {
+        return NewError("Entry restore permission denied", user, ErrPermission)
+    }
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", user)
+    }
+
+    if err := DB.Unscoped().Model(this).UpdateColumn("deleted_at", nil).Error; err != nil {
+        if isUniqueViolation(err) {
+            return NewError("User already holds another view of entry '"+this.EntryId+"'", user, ErrConflict)
+        }
+        return NewError(err, user)
+    }
+    this.DeletedAt = nil
+    return nil
+}
+
+// Purge permanently removes the entry and its attachments from the database, whether or not it has been deleted first,
+// provided that the user holds delete permission or is the entry's own authority.  A purged entry cannot be restored.
+func (this *EntryView) Purge() (err error) {
+    defer func() { this.audit("purge", err) }()
+    user := this.getUser()
+    if this.AuthorityId != this.UserId && !user.Can("d", this) {
+        return NewError("Entry purge permission denied", user, ErrPermission)
+    }
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", user)
+    }
+
+    if err := DB.Where("entry_id = ? AND user_id = ?", this.EntryId, this.UserId).Delete(Attachment{}).Error; err != nil {
+        return NewError(err, user)
+    }
+    if err := DB.Unscoped().Delete(this).Error; err != nil {
+        return NewError(err, user)
+    }
+    return nil
+}
+
+// ShareWith gives the recipient their own view of the entry with the given permissions, granted by the sharing user.
+// The sharing user must hold delegate permission on the entry and every permission being granted, and have an active
+// session.  Only the fields the permissions allow the recipient to read are copied, each encrypted under the secret
+// shared between the two users until the recipient first accesses the view and moves them to their own key.
+func (this *EntryView) ShareWith(recipient *User, permissions string) (*EntryView, error) {
+    view, err := this.shareView(recipient, permissions)
+    if err != nil {
+        return nil, err
+    }
+    if err := view.Save(); err != nil {
+        return nil, err
+    }
+    return view, nil
+}
+
+// The shareView function prepares the recipient's view of the entry for ShareWith, without storing it.
+func (this *EntryView) shareView(recipient *User, permissions string) (*EntryView, error) {
+    sharer := this.getUser()
+    if recipient.Id == sharer.Id {
+        return nil, NewError("Cannot share an entry with its own user", sharer)
+    }
+
+    view := &EntryView{EntryId: this.EntryId, UserId: recipient.Id, SharedBy: sharer.Id, Policy: CurrentPolicy, user: recipient}
+    if err := sharer.grant(this, view, permissions, time.Time{}); err != nil {
+        return nil, err
+    }
+
+    for _, f := range encryptedFields {
+        if len(*f.value(this)) == 0 || len(f.query) == 0 {
+            continue
+        }
+        if f.query != "*" && !strings.Contains(permissions, f.query) {
+            continue
+        }
+
+        data, err := this.decryptField(f.name)
+        if err != nil {
+            return nil, err
+        }
+        *f.value(view), _, err = sharer.EncryptShared(data, nil, recipient)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return view, nil
+}
+
+// Acknowledge marks an entry shared with the user as seen, removing it from the user's pending shares.
+func (this *EntryView) Acknowledge() error {
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", this.getUser())
+    }
+    if err := DB.Model(this).UpdateColumn("acknowledged", true).Error; err != nil {
+        return NewError(err, this.getUser())
+    }
+    this.Acknowledged = true
+    return nil
+}
+
+// Touch records that the entry has just been used, provided that the user has read permission, by setting its UpdatedAt
+// and LastUsedAt times to now without otherwise changing it.  Only those columns are updated, and the version is left
+// alone, so that touching an entry does not make other loaded copies conflict.
+func (this *EntryView) Touch() error {
+    user := this.getUser()
+    if !user.Can("r", this) {
+        return NewError("Entry read permission denied", user, ErrPermission)
+    }
+    if this.Id == 0 {
+        return NewError("Entry has not been stored", user)
+    }
+
+    now := time.Now()
+    columns := map[string]interface{}{"updated_at": now, "last_used_at": now}
+    if err := DB.Model(this).UpdateColumns(columns).Error; err != nil {
+        return NewError(err, user)
+    }
+    this.UpdatedAt = now
+    this.LastUsedAt = &now
+    return nil
+}
+
+// ReadAllFields reads the named string field from each of the entries, keyed by entry Id.  Failures for individual
+// entries do not stop the remaining entries from being read, and are instead collected and returned separately, each
+// keeping the code of the underlying failure.
+func ReadAllFields(entries []*EntryView, name string) (map[int64]string, []error) {
+    values := make(map[int64]string)
+    var errs []error
+    for _, e := range entries {
+        value, err := e.ReadField(name)
+        if err != nil {
+            failed := NewError(err, e.getUser())
+            failed.Msg = fmt.Sprintf("Entry %d: %s", e.Id, failed.Msg)
+            errs = append(errs, failed)
+            continue
+        }
+        values[e.Id] = value
+    }
+    return values, errs
+}
+
+// ReadAllTitles reads the title of each of the entries, keyed by entry Id, collecting any per-entry failures.
+func ReadAllTitles(entries []*EntryView) (map[int64]string, []error) {
+    return ReadAllFields(entries, "title")
+}
+
+// ReadAllUsernames reads the username of each of the entries, keyed by entry Id, collecting any per-entry failures.
+func ReadAllUsernames(entries []*EntryView) (map[int64]string, []error) {
+    return ReadAllFields(entries, "username")
+}
+
+// The ListView structure holds the fields of an entry needed to show it in a list, as read by ReadListFields.
+type ListView struct {
+    // The Title is the decrypted title of the entry.
+    Title string
+    // The Group is the decrypted group of the entry.
+    Group string
+    // The Icon is the decrypted icon of the entry.
+    Icon string
+    // The Username is the decrypted username of the entry, which is left empty unless the user has read permission.
+    Username string
+}
+
+// ReadListFields reads the title, group, icon and username of the entry together, verifying the permissions and setting
+// up the cipher once rather than for each field as the individual readers do, so that a long list of entries can be
+// shown quickly.  The user must hold some permission for the entry, as for the title, group and icon, while the
+// username is only read with read permission and is otherwise left empty, as is any field which has not been written.
+func (this *EntryView) ReadListFields() (result ListView, err error) {
+    defer func() { this.audit("read list fields", err) }()
+    user := this.getUser()
+    // the permissions are verified once for all of the fields, rather than by Can for each
+    held, ok := this.heldPermissions()
+    if !ok || held.Empty() {
+        return ListView{}, NewError("Entry read permission denied", user, ErrPermission)
+    }
+    if err := this.acceptShare(); err != nil {
+        return ListView{}, err
+    }
+
+    key := user.getEncryptionKey()
+    if key == nil {
+        return ListView{}, NewError("Private key unavailable", user, ErrCrypto)
+    }
+    defer utils.SecureZero(key)
+    gcm, e := user.makeGCM(key)
+    if e != nil {
+        return ListView{}, e
+    }
+
+    values := map[string]*string{"title": &result.Title, "group": &result.Group, "icon": &result.Icon, "username": &result.Username}
+    for name, value := range values {
+        field, _ := findField(entryFields, name)
+        encrypted := *field.value(this)
+        if len(encrypted) == 0 || (field.query == "r" && !held.Read) {
+            continue
+        }
+        data, err := user.openGCM(gcm, encrypted, this.fieldAD(name))
+        if err != nil && !this.Policy.bound() && errors.Is(err, ErrDecryption) {
+            // as for decryptBound, fields written before ciphertext was bound to its entry and field have no additional data
+            if legacy, e := user.openGCM(gcm, encrypted, nil); e == nil {
+                data, err = legacy, nil
+            }
+        }
+        if err != nil {
+            return ListView{}, err
+        }
+        *value = string(data)
+    }
+    return result, nil
+}
+
+// ReencryptField decrypts the named field and encrypts it again under a fresh nonce, provided that the user has write
+// permission.  If the entry has been stored, only the corresponding column is updated, along with the version, so that
+// an entry which has been saved elsewhere since it was loaded is not overwritten and ErrConflict is produced, as by Save.
+func (this *EntryView) ReencryptField(name string) (err error) {
+    defer func() { this.written(name, err) }()
+    user := this.getUser()
+    field, ok := findField(encryptedFields, name)
+    if !ok {
+        return NewError("Unknown field '"+name+"'", user)
+    }
+    if len(field.query) > 0 && !user.Can("w", this) {
+        return NewError(field.label+" write permission denied", user, ErrPermission)
+    }
+
+    if len(*field.value(this)) == 0 {
+        return nil
+    }
+    data, err := this.decryptField(field.name)
+    if err != nil {
+        return err
+    }
+    encrypted, err := user.EncryptWithAD(data, this.fieldAD(field.name))
+    utils.SecureZero(data)
+    if err != nil {
+        return err
+    }
+
+    if this.Id != 0 {
+        tx := DB.Begin()
+        columns := map[string]interface{}{field.column: encrypted, "version": this.Version + 1}
+        result := tx.Unscoped().Model(&EntryView{}).Where("id = ? AND version = ?", this.Id, this.Version).UpdateColumns(columns)
+        if result.Error != nil {
+            tx.Rollback()
+            return NewError(result.Error, user)
+        }
+        if result.RowsAffected == 0 {
+            tx.Rollback()
+            return NewError("Entry '"+this.EntryId+"' was changed since it was loaded", user, ErrConflict)
+        }
+        if err := tx.Commit().Error; err != nil {
+            return NewError(err, user)
+        }
+        this.Version++
+    }
+    *field.value(this) = encrypted
+    return nil
+}
+
+// The setArchived function changes the archived state of the entry, persisting it if the entry has been stored.
+func (this *EntryView) setArchived(archived bool) error {
+    if this.Id != 0 {
+        if err := DB.Model(this).UpdateColumn("archived", archived).Error; err != nil {
+            return NewError(err, this.getUser())
+        }
+    }
+    this.Archived = archived
+    return nil
+}
+
+// Archive hides the entry from default listings while keeping it intact.  Archiving is distinct from deletion and only
+// affects the user's own view of the entry, so no particular permissions are required.
+func (this *EntryView) Archive() error {
+    return this.setArchived(true)
+}
+
+// Unarchive returns an archived entry to default listings.
+func (this *EntryView) Unarchive() error {
+    return this.setArchived(false)
+}
+
+const (
+    // The expirySeparator separates the permissions from their expiry time in a signed grant.
+    expirySeparator = "@"
+)
+
+// The formatPermissions function produces the content of a signed grant of the permissions, valid until the given time.
+// Grants which never expire consist of the permissions alone.
+func formatPermissions(permissions string, validUntil time.Time) []byte {
+    if validUntil.IsZero() {
+        return []byte(permissions)
+    }
+    return []byte(permissions + expirySeparator + validUntil.UTC().Format(time.RFC3339))
+}
+
+// The parsePermissions function splits the content of a signed grant into the permissions and their expiry time, which
+// is zero if the grant never expires.
+func parsePermissions(raw []byte) (string, time.Time, error) {
+    parts := strings.SplitN(string(raw), expirySeparator, 2)
+    if _, err := ParsePermissions(parts[0]); err != nil {
+        return "", time.Time{}, err
+    }
+    if len(parts) == 1 {
+        return parts[0], time.Time{}, nil
+    }
+
+    validUntil, err := time.Parse(time.RFC3339, parts[1])
+    if err != nil {
+        return "", time.Time{}, NewError(err)
+    }
+    return parts[0], validUntil, nil
+}
+
+// The grantedPermissions function verifies the entry's permissions and row signatures against its authority, and
+// provides the permissions granted along with their expiry time.
+func (this *EntryView) grantedPermissions() (string, time.Time, error) {
+    ok, raw, err := this.getAuthority().Verify(this.Permissions)
+    if err != nil {
+        return "", time.Time{}, err
+    }
+    if !ok {
+        return "", time.Time{}, NewError("Entry permissions signature invalid", this.getUser(), ErrPermission)
+    }
+    if err := this.VerifyRow(); err != nil {
+        return "", time.Time{}, err
+    }
+    return parsePermissions(raw)
+}
+
+// ValidUntil provides the time at which the user's permissions on the entry expire, which is zero if they never expire.
+func (this *EntryView) ValidUntil() (time.Time, error) {
+    _, validUntil, err := this.grantedPermissions()
+    return validUntil, err
+}
+
+// The rowMetadata structure is the immutable metadata of an entry covered by its row signature.
+type rowMetadata struct {
+    EntryId     string
+    UserId      int64
+    AuthorityId int64
+    Permissions string
+}
+
+// The metadata function produces the canonical encoding of the entry's immutable metadata.
+func (this *EntryView) metadata() ([]byte, error) {
+    return json.Marshal(rowMetadata{this.EntryId, this.UserId, this.AuthorityId, this.Permissions})
+}
+
+// SignRow signs the entry's immutable metadata on behalf of its authority, who must have an active session.  This must be
+// done whenever the EntryId, UserId, AuthorityId or Permissions of the entry are set.
+func (this *EntryView) SignRow(authority *User) error {
+    if authority.Id != this.AuthorityId {
+        return NewError("Only the entry authority may sign the entry", authority)
+    }
+
+    data, err := this.metadata()
+    if err != nil {
+        return NewError(err, authority)
+    }
+    signed, err := authority.Sign(data)
+    if err != nil {
+        return err
+    }
+    this.RowSignature = signed
+    return nil
+}
+
+// VerifyRow checks that the entry's immutable metadata is exactly what its authority signed, detecting rows whose
+// metadata has been altered in storage.  A row which is unsigned or fails to verify produces ErrPermission.
+func (this *EntryView) VerifyRow() error {
+    if len(this.RowSignature) == 0 {
+        return NewError("Entry '"+this.EntryId+"' row is not signed", this.getUser(), ErrPermission)
+    }
+
+    data, err := this.metadata()
+    if err != nil {
+        return NewError(err, this.getUser())
+    }
+    ok, signed, err := this.getAuthority().Verify(this.RowSignature)
+    if err != nil || !ok || string(signed) != string(data) {
+        return NewError("Entry '"+this.EntryId+"' row signature invalid", this.getUser(), ErrPermission)
+    }
+    return nil
+}
+
+// The verifiedRow function reports whether the row signature of the view verifies, as by VerifyRow.  A view which fails
+// is reported to the log and audited as a failed "verify row", so that tampering with one row is noticed without hiding
+// the user's other entries from listings.
+func (this *EntryView) verifiedRow() bool {
+    err := this.VerifyRow()
+    if err != nil {
+        log.Print(err)
+        this.audit("verify row", err)
+    }
+    return err == nil
+}
+
+// The verifiedViews function keeps, in order, only the views whose row signature verifies, reporting the others as
+// verifiedRow does.  Every function which lists views skips tampered rows in this way, while LoadEntry refuses them.
+func verifiedViews(views []*EntryView) []*EntryView {
+    verified := views[:0]
+    for _, e := range views {
+        if e.verifiedRow() {
+            verified = append(verified, e)
+        }
+    }
+    return verified
+}
@@ -0,0 +1,1265 @@
+package core
+
+import (
+    "encoding/base64"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+// The countingResolver type counts the lookups made through the wrapped resolver.
+type countingResolver struct {
+    UserResolver
+    byId int
+}
+
+func (this *countingResolver) ById(id int64) (*User, error) {
+    this.byId++
+    return this.UserResolver.ById(id)
+}
+
+type EntryTestSuite struct {
+    suite.Suite
+}
+
+// The newTestEntry function produces an entry owned by the given user, who also acts as its authority with full permissions.
+func newTestEntry(a *assert.Assertions, user *User, entryId string) *EntryView {
+    permissions, err := user.Sign([]byte("rwd"))
+    a.NoError(err)
+    entry := &EntryView{EntryId: entryId, UserId: user.Id, AuthorityId: user.Id, Permissions: permissions, user: user}
+    a.NoError(entry.SignRow(user))
+    return entry
+}
+
+func (suite *EntryTestSuite) TestValidate() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Title"))
+        a.NoError(entry.WriteUsername("someone"))
+        a.NoError(entry.WritePassword("secret"))
+        a.NoError(entry.Validate())
+
+        entry.Password = entry.Password[:len(entry.Password)-8] + "AAAAAAA="
+        err = entry.Validate()
+        if a.Error(err) {
+            fe, ok := err.(*FieldError)
+            if a.True(ok) {
+                a.Equal("password", fe.Field)
+            }
+            a.Contains(err.Error(), "password")
+            a.True(errors.Is(err, ErrDecryption))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestVerifyIntegrity() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Title"))
+        a.NoError(entry.WriteUsername("someone"))
+        a.NoError(entry.WritePassword("secret"))
+        a.NoError(entry.WriteComment("comment"))
+        a.Empty(entry.VerifyIntegrity())
+
+        raw, err := base64.StdEncoding.DecodeString(entry.Username)
+        a.NoError(err)
+        raw[len(raw)/2] ^= 1
+        entry.Username = base64.StdEncoding.EncodeToString(raw)
+        errs := entry.VerifyIntegrity()
+        if a.Len(errs, 1) {
+            fe, ok := errs[0].(*FieldError)
+            if a.True(ok) {
+                a.Equal("username", fe.Field)
+            }
+            a.True(errors.Is(errs[0], ErrDecryption))
+        }
+
+        // fields the user may not read are skipped
+        entry.Password = entry.Comment
+        a.Len(entry.VerifyIntegrity(), 2)
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        a.Empty(entry.VerifyIntegrity())
+
+        // only the encryption key is needed
+        signing := u.keys.SigningKey
+        u.keys.SigningKey = nil
+        a.Empty(entry.VerifyIntegrity())
+        u.keys.SigningKey = signing
+
+        u.EndSession()
+        errs = entry.VerifyIntegrity()
+        if a.Len(errs, 1) {
+            a.True(errors.Is(errs[0], ErrCrypto))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestReadField() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteField("password", "secret"))
+
+        password, err := entry.ReadPassword()
+        a.NoError(err)
+        field, err := entry.ReadField("password")
+        a.NoError(err)
+        a.Equal("secret", field)
+        a.Equal(password, field)
+
+        _, err = entry.ReadField("notes")
+        a.Error(err)
+        a.Error(entry.WriteField("notes", "value"))
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestSharedDisplayFields() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        recipient, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := authority.Sign([]byte("r"))
+            a.NoError(err)
+            entry := &EntryView{EntryId: "shared", UserId: recipient.Id, AuthorityId: authority.Id, Permissions: permissions, user: recipient}
+            a.NoError(entry.SignRow(authority))
+
+            // the recipient lacks write permission, so the display fields are encrypted for them directly
+            entry.Title, err = recipient.Encrypt([]byte("Shared Title"))
+            a.NoError(err)
+            entry.Group, err = recipient.Encrypt([]byte("Shared Group"))
+            a.NoError(err)
+
+            title, err := entry.ReadTitle()
+            if a.NoError(err) {
+                a.Equal("Shared Title", title)
+            }
+            group, err := entry.ReadGroup()
+            if a.NoError(err) {
+                a.Equal("Shared Group", group)
+            }
+            a.Error(entry.WriteTitle("Changed"))
+
+            recipient.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestUrlNormalization() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        variants := []string{"example.com", "http://example.com", "https://example.com/"}
+        for _, v := range variants {
+            entry := newTestEntry(a, u, "entry")
+            a.NoError(entry.WriteUrl(v))
+            stored, err := entry.ReadUrl()
+            if a.NoError(err) {
+                a.Equal("https://example.com", stored)
+            }
+            for _, other := range variants {
+                a.True(entry.MatchUrl(other))
+            }
+            a.False(entry.MatchUrl("https://example.org"))
+            a.False(entry.MatchUrl("https://example.com:80"))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestReadAllTitles() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for i, title := range []string{"First", "Second", "Third"} {
+            entry := newTestEntry(a, u, title)
+            entry.Id = int64(i + 1)
+            a.NoError(entry.WriteTitle(title))
+            entries = append(entries, entry)
+        }
+        entries[1].Title = "corrupt"
+
+        titles, errs := ReadAllTitles(entries)
+        a.Len(titles, 2)
+        a.Equal("First", titles[1])
+        a.Equal("Third", titles[3])
+        if a.Len(errs, 1) {
+            a.Contains(errs[0].Error(), "Entry 2")
+            a.True(errors.Is(errs[0], ErrDecryption))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestReencryptField() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteUsername("someone"))
+        a.NoError(entry.WritePassword("secret"))
+        a.NoError(DB.Create(entry).Error)
+        username, password := entry.Username, entry.Password
+
+        a.NoError(entry.ReencryptField("password"))
+        a.Equal(username, entry.Username)
+        a.NotEqual(password, entry.Password)
+        plain, err := entry.ReadPassword()
+        if a.NoError(err) {
+            a.Equal("secret", plain)
+        }
+
+        stored := new(EntryView)
+        a.NoError(DB.First(stored, entry.Id).Error)
+        a.Equal(entry.Password, stored.Password)
+        a.Equal(username, stored.Username)
+        a.Equal(entry.Version, stored.Version)
+
+        // a copy loaded before another session saved the entry does not overwrite it
+        stale, err := LoadEntry(entry.EntryId, u.Id)
+        if a.NoError(err) && a.NoError(stale.AttachUser(u)) {
+            a.NoError(entry.WritePassword("changed"))
+            a.NoError(entry.Save())
+            err = stale.ReencryptField("password")
+            if a.Error(err) {
+                a.True(errors.Is(err, ErrConflict))
+            }
+            stored = new(EntryView)
+            a.NoError(DB.First(stored, entry.Id).Error)
+            a.Equal(entry.Password, stored.Password)
+        }
+
+        // the change is audited and reported like any other write
+        var changes []string
+        OnEntryChange = func(entryId string, field string, user string) { changes = append(changes, field) }
+        a.NoError(entry.ReencryptField("password"))
+        OnEntryChange = nil
+        a.Equal([]string{"password"}, changes)
+        records, err := u.AuditLog(time.Now().Add(-time.Minute))
+        if a.NoError(err) && a.NotEmpty(records) {
+            last := records[len(records)-1]
+            a.Equal("write password", last.Action)
+            a.True(last.Success)
+        }
+
+        a.Error(entry.ReencryptField("notes"))
+
+        DB.Delete(entry)
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestArchive() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := authority.Sign([]byte("r"))
+            a.NoError(err)
+            entry := &EntryView{EntryId: "shared", UserId: user.Id, AuthorityId: authority.Id, Permissions: permissions}
+            a.NoError(DB.Create(entry).Error)
+
+            a.NoError(entry.Archive())
+            pending, err := user.PendingShares()
+            if a.NoError(err) {
+                a.Empty(pending)
+            }
+            pending, err = user.PendingShares(ListOptions{IncludeArchived: true})
+            if a.NoError(err) && a.Len(pending, 1) {
+                a.True(pending[0].Archived)
+            }
+
+            a.NoError(entry.Unarchive())
+            pending, err = user.PendingShares()
+            if a.NoError(err) && a.Len(pending, 1) {
+                a.False(pending[0].Archived)
+            }
+
+            DB.Delete(entry)
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestRowSignature() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := user.Sign([]byte("rwd"))
+            a.NoError(err)
+            entry := &EntryView{EntryId: "entry", UserId: user.Id, AuthorityId: user.Id, Permissions: permissions}
+            a.Error(entry.VerifyRow())
+            a.Error(entry.SignRow(authority))
+            a.NoError(entry.SignRow(user))
+            a.NoError(DB.Create(entry).Error)
+
+            loaded, err := LoadEntry("entry", user.Id)
+            if a.NoError(err) {
+                a.NoError(loaded.VerifyRow())
+                a.True(user.Can("r", loaded))
+            }
+
+            // an attacker with database access re-points the entry at another authority
+            a.NoError(DB.Model(entry).UpdateColumn("authority_id", authority.Id).Error)
+            loaded = new(EntryView)
+            a.NoError(DB.First(loaded, entry.Id).Error)
+            a.Error(loaded.VerifyRow())
+            a.False(user.Can("r", loaded))
+
+            // loading refuses the tampered row, while listing skips it
+            _, err = LoadEntry("entry", user.Id)
+            a.True(errors.Is(err, ErrPermission), "LoadEntry: %v", err)
+            listed, err := ListEntries(user.Id)
+            a.NoError(err)
+            a.Empty(listed)
+            listed, err = AllViews("entry")
+            a.NoError(err)
+            a.Empty(listed)
+
+            DB.Delete(entry)
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestSave() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Title"))
+        a.NoError(entry.WritePassword("secret"))
+        if a.NoError(entry.Save()) {
+            a.NotEqual(0, entry.Id)
+            a.False(entry.CreatedAt.IsZero())
+
+            loaded := new(EntryView)
+            if a.NoError(DB.First(loaded, entry.Id).Error) {
+                a.Equal(entry.EntryId, loaded.EntryId)
+                a.Equal(entry.Permissions, loaded.Permissions)
+                a.Equal(entry.RowSignature, loaded.RowSignature)
+                a.Equal(entry.Title, loaded.Title)
+                a.Equal(entry.Password, loaded.Password)
+            }
+
+            a.NoError(entry.WriteTitle("Renamed"))
+            if a.NoError(entry.Save()) {
+                loaded = new(EntryView)
+                if a.NoError(DB.First(loaded, entry.Id).Error) {
+                    a.Equal(entry.Title, loaded.Title)
+                }
+            }
+
+            DB.Delete(entry)
+        }
+
+        a.Error((&EntryView{UserId: u.Id, AuthorityId: u.Id, user: u}).Save())
+        a.Error((&EntryView{EntryId: "entry", AuthorityId: u.Id, user: u}).Save())
+        a.Error((&EntryView{EntryId: "entry", UserId: u.Id, user: u}).Save())
+
+        unsigned := newTestEntry(a, u, "unsigned")
+        unsigned.RowSignature = ""
+        a.Error(unsigned.Save())
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestLoadEntries() {
+    a := assert.New(suite.T())
+
+    first, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        second, err := NewUser("other.user", "secret")
+        if a.NoError(err) {
+            var saved []*EntryView
+            for _, id := range []string{"one", "two"} {
+                entry := newTestEntry(a, first, id)
+                a.NoError(entry.WriteTitle("First " + id))
+                a.NoError(entry.Save())
+                saved = append(saved, entry)
+            }
+            for _, id := range []string{"one", "three"} {
+                entry := newTestEntry(a, second, id)
+                a.NoError(entry.WriteTitle("Second " + id))
+                a.NoError(entry.Save())
+                saved = append(saved, entry)
+            }
+
+            entries, err := ListEntries(first.Id)
+            if a.NoError(err) && a.Len(entries, 2) {
+                for _, e := range entries {
+                    a.Equal(first.Id, e.UserId)
+                }
+            }
+            entries, err = ListEntries(second.Id)
+            if a.NoError(err) && a.Len(entries, 2) {
+                for _, e := range entries {
+                    a.Equal(second.Id, e.UserId)
+                }
+            }
+
+            loaded, err := LoadEntry("one", second.Id)
+            if a.NoError(err) {
+                a.Equal(second.Id, loaded.UserId)
+                _, err = loaded.ReadTitle()
+                a.Error(err)
+                if a.NoError(loaded.getUser().StartSession("secret")) {
+                    title, err := loaded.ReadTitle()
+                    a.NoError(err)
+                    a.Equal("Second one", title)
+                }
+            }
+
+            a.NoError(saved[0].Archive())
+            entries, err = ListEntries(first.Id)
+            a.NoError(err)
+            a.Len(entries, 1)
+            entries, err = ListEntries(first.Id, ListOptions{IncludeArchived: true})
+            a.NoError(err)
+            a.Len(entries, 2)
+
+            _, err = LoadEntry("three", first.Id)
+            if a.Error(err) {
+                a.Equal(ErrNotFound, err.(*Error).Code)
+            }
+
+            for _, e := range saved {
+                DB.Delete(e)
+            }
+            second.Drop()
+        }
+        first.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestDelete() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        recipient, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            owned, err := authority.Sign([]byte("r"))
+            a.NoError(err)
+            entry := &EntryView{EntryId: "owned", UserId: authority.Id, AuthorityId: authority.Id, Permissions: owned, user: authority}
+            a.NoError(entry.SignRow(authority))
+            if a.NoError(entry.Save()) {
+                a.NoError(entry.Delete())
+                _, err = LoadEntry("owned", authority.Id)
+                a.Error(err)
+            }
+
+            for _, p := range []string{"r", "rd"} {
+                permissions, err := authority.Sign([]byte(p))
+                a.NoError(err)
+                entry := &EntryView{EntryId: "shared", UserId: recipient.Id, AuthorityId: authority.Id, Permissions: permissions, user: recipient}
+                a.NoError(entry.SignRow(authority))
+                if !a.NoError(entry.Save()) {
+                    continue
+                }
+
+                err = entry.Delete()
+                if p == "r" {
+                    if a.Error(err) {
+                        a.Equal(ErrPermission, err.(*Error).Code)
+                    }
+                    _, err = LoadEntry("shared", recipient.Id)
+                    a.NoError(err)
+                    DB.Unscoped().Delete(entry)
+                } else {
+                    a.NoError(err)
+                    _, err = LoadEntry("shared", recipient.Id)
+                    a.Error(err)
+
+                    deleted := new(EntryView)
+                    if a.NoError(DB.Unscoped().First(deleted, entry.Id).Error) {
+                        a.NotNil(deleted.DeletedAt)
+                    }
+                }
+            }
+
+            recipient.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestTrash() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        restored, err := NewEntry(u)
+        a.NoError(err)
+        purged, err := NewEntry(u)
+        a.NoError(err)
+        for _, e := range []*EntryView{restored, purged} {
+            a.NoError(e.WriteTitle("Title"))
+            a.NoError(e.Save())
+            a.NoError(e.Delete())
+        }
+
+        entries, err := ListEntries(u.Id)
+        a.NoError(err)
+        a.Empty(entries)
+        entries, err = u.SearchEntries("Title")
+        a.NoError(err)
+        a.Empty(entries)
+
+        trash, err := u.Trash()
+        if a.NoError(err) && a.Len(trash, 2) {
+            a.Equal(restored.Id, trash[0].Id)
+            a.NotNil(trash[0].DeletedAt)
+        }
+
+        if a.NoError(trash[0].Restore()) {
+            a.Nil(trash[0].DeletedAt)
+            loaded, err := LoadEntry(restored.EntryId, u.Id)
+            if a.NoError(err) && a.NoError(loaded.AttachUser(u)) {
+                title, err := loaded.ReadTitle()
+                a.NoError(err)
+                a.Equal("Title", title)
+            }
+        }
+
+        if a.NoError(trash[1].Purge()) {
+            a.True(DB.Unscoped().First(new(EntryView), purged.Id).RecordNotFound())
+        }
+
+        trash, err = u.Trash()
+        a.NoError(err)
+        a.Empty(trash)
+
+        a.NoError(restored.Purge())
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestCachedUsers() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        recipient, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := authority.Sign([]byte("rw"))
+            a.NoError(err)
+            entry := &EntryView{EntryId: "shared", UserId: recipient.Id, AuthorityId: authority.Id, Permissions: permissions}
+            a.NoError(entry.SignRow(authority))
+
+            counter := &countingResolver{UserResolver: Resolver}
+            original := Resolver
+            Resolver = counter
+            defer func() { Resolver = original }()
+
+            a.Error(entry.AttachUser(authority))
+            a.NoError(entry.AttachUser(recipient))
+            a.Equal(0, counter.byId)
+
+            a.NoError(entry.WriteTitle("Title"))
+            a.NoError(entry.WriteUsername("someone"))
+            a.NoError(entry.WritePassword("secret"))
+            for i := 0; i < 3; i++ {
+                _, err = entry.ReadTitle()
+                a.NoError(err)
+                _, err = entry.ReadPassword()
+                a.NoError(err)
+            }
+            a.Equal(1, counter.byId)
+            a.Equal(recipient, entry.getUser())
+            a.Equal(authority.Id, entry.getAuthority().Id)
+            a.Equal(1, counter.byId)
+
+            recipient.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestShareWith() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("admin", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    reader, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer reader.Drop()
+    writer, err := NewUser("other.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer writer.Drop()
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WriteTitle("Title"))
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.WriteUserdata(map[string]interface{}{"private": true}))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+
+    _, err = entry.ShareWith(reader, "rx")
+    a.Error(err)
+    _, err = entry.ShareWith(reader, "")
+    a.Error(err)
+
+    shared, err := entry.ShareWith(reader, "r")
+    if a.NoError(err) {
+        a.Equal(owner.Id, shared.SharedBy)
+        a.Empty(shared.Userdata)
+
+        a.NoError(owner.ChangePassword("secret", "changed"))
+
+        loaded, err := LoadEntry("entry", reader.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(reader)) {
+            a.Equal(owner.Id, loaded.SharedBy)
+
+            // integrity probes leave the share to be accepted when it is first read
+            a.NoError(loaded.Validate())
+            a.Empty(loaded.VerifyIntegrity())
+            a.Equal(owner.Id, loaded.SharedBy)
+            stored := new(EntryView)
+            if a.NoError(DB.First(stored, loaded.Id).Error) {
+                a.Equal(owner.Id, stored.SharedBy)
+                a.Equal(loaded.Password, stored.Password)
+            }
+
+            password, err := loaded.ReadPassword()
+            a.NoError(err)
+            a.Equal("hunter2", password)
+            a.Equal(int64(0), loaded.SharedBy)
+            a.Error(loaded.WriteTitle("Changed"))
+
+            _, err = loaded.ShareWith(writer, "r")
+            if a.Error(err) {
+                a.Equal(ErrPermission, err.(*Error).Code)
+            }
+        }
+
+        loaded, err = LoadEntry("entry", reader.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(reader)) {
+            a.Equal(int64(0), loaded.SharedBy)
+            title, err := loaded.ReadTitle()
+            a.NoError(err)
+            a.Equal("Title", title)
+        }
+    }
+
+    entry, err = LoadEntry("entry", owner.Id)
+    if a.NoError(err) && a.NoError(entry.AttachUser(owner)) {
+        shared, err = entry.ShareWith(writer, "w")
+        if a.NoError(err) {
+            a.Empty(shared.Password)
+            title, err := shared.ReadTitle()
+            a.NoError(err)
+            a.Equal("Title", title)
+            _, err = shared.ReadPassword()
+            a.Error(err)
+            a.NoError(shared.WritePassword("replaced"))
+        }
+    }
+}
+
+func (suite *EntryTestSuite) TestClone() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("admin", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    writer, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer writer.Drop()
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WriteTitle("Title"))
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.WriteUrl("https://example.com"))
+    a.NoError(entry.WriteUserdata(map[string]interface{}{"private": true}))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+
+    clone, err := entry.Clone("Copy")
+    if a.NoError(err) {
+        defer DB.Unscoped().Delete(clone)
+        a.NotEqual(entry.EntryId, clone.EntryId)
+        a.NotEqual(int64(0), clone.Id)
+        a.Equal(owner.Id, clone.AuthorityId)
+        a.True(owner.Can("rwd", clone))
+        a.NotEqual(entry.Password, clone.Password)
+
+        title, err := clone.ReadTitle()
+        a.NoError(err)
+        a.Equal("Copy", title)
+        url, err := clone.ReadUrl()
+        a.NoError(err)
+        a.Equal("https://example.com", url)
+        userdata, err := clone.ReadUserdata()
+        a.NoError(err)
+        a.Equal(map[string]interface{}{"private": true}, userdata)
+
+        a.NoError(clone.WritePassword("changed"))
+        a.NoError(clone.Save())
+        loaded, err := LoadEntry("entry", owner.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(owner)) {
+            password, err := loaded.ReadPassword()
+            a.NoError(err)
+            a.Equal("hunter2", password)
+            title, err := loaded.ReadTitle()
+            a.NoError(err)
+            a.Equal("Title", title)
+        }
+    }
+
+    shared, err := entry.ShareWith(writer, "w")
+    if a.NoError(err) {
+        _, err = shared.Clone("Copy")
+        if a.Error(err) {
+            a.Equal(ErrPermission, err.(*Error).Code)
+        }
+    }
+}
+
+func (suite *EntryTestSuite) TestOnEntryChange() {
+    a := assert.New(suite.T())
+
+    var changes []string
+    OnEntryChange = func(entryId string, field string, user string) {
+        changes = append(changes, entryId+" "+field+" "+user)
+    }
+    defer func() { OnEntryChange = nil }()
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WritePassword("hunter2"))
+        a.Equal([]string{"entry password test.user"}, changes)
+
+        a.NoError(entry.WriteExpiry(time.Now()))
+        a.NoError(entry.Save())
+        a.Equal([]string{"entry password test.user", "entry expiry test.user", "entry  test.user"}, changes)
+
+        // denied writes are not reported
+        a.NoError(u.GrantPermissions(entry, u, "r"))
+        changes = nil
+        a.Error(entry.WritePassword("changed"))
+        a.Error(entry.WriteField("nonexistent", "value"))
+        a.Empty(changes)
+
+        OnEntryChange = nil
+        a.NoError(entry.WriteUserdata("private"))
+
+        DB.Unscoped().Delete(entry)
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestFieldBinding() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        first := newTestEntry(a, u, "first")
+        a.NoError(first.WritePassword("hunter2"))
+        second := newTestEntry(a, u, "second")
+        a.NoError(second.WritePassword("other"))
+
+        // ciphertext moved to another entry or field no longer decrypts
+        second.Password = first.Password
+        _, err = second.ReadPassword()
+        a.True(errors.Is(err, ErrDecryption))
+        first.Comment = first.Password
+        _, err = first.ReadComment()
+        a.True(errors.Is(err, ErrDecryption))
+        password, err := first.ReadPassword()
+        a.NoError(err)
+        a.Equal("hunter2", password)
+
+        // fields written before binding still decrypt until they are written again
+        first.Comment, err = u.Encrypt([]byte("legacy"))
+        a.NoError(err)
+        comment, err := first.ReadComment()
+        a.NoError(err)
+        a.Equal("legacy", comment)
+        a.NoError(first.ReencryptField("comment"))
+        _, err = u.Decrypt(first.Comment)
+        a.Error(err)
+        comment, err = first.ReadComment()
+        a.NoError(err)
+        a.Equal("legacy", comment)
+
+        // an entry whose fields are all bound refuses ciphertext without additional data
+        bound, err := NewEntry(u)
+        if a.NoError(err) {
+            a.Equal(CurrentPolicy, bound.Policy)
+            bound.Comment, err = u.Encrypt([]byte("legacy"))
+            a.NoError(err)
+            _, err = bound.ReadComment()
+            a.True(errors.Is(err, ErrDecryption))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestConflict() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Original"))
+        a.NoError(entry.Save())
+        a.Equal(0, entry.Version)
+
+        first, err := LoadEntry("entry", u.Id)
+        a.NoError(err)
+        second, err := LoadEntry("entry", u.Id)
+        a.NoError(err)
+        if a.NotNil(first) && a.NotNil(second) {
+            a.NoError(first.AttachUser(u))
+            a.NoError(second.AttachUser(u))
+
+            a.NoError(first.WriteTitle("First"))
+            a.NoError(first.Save())
+            a.Equal(1, first.Version)
+
+            a.NoError(second.WriteTitle("Second"))
+            err = second.Save()
+            a.True(errors.Is(err, ErrConflict))
+            a.Equal(0, second.Version)
+
+            reloaded, err := LoadEntry("entry", u.Id)
+            if a.NoError(err) {
+                a.NoError(reloaded.AttachUser(u))
+                title, err := reloaded.ReadTitle()
+                a.NoError(err)
+                a.Equal("First", title)
+
+                a.NoError(reloaded.WriteTitle("Second"))
+                a.NoError(reloaded.Save())
+                a.Equal(2, reloaded.Version)
+            }
+
+            // changing the password re-encrypts the entry, so copies loaded beforehand conflict
+            a.NoError(u.ChangePassword("password", "new password"))
+            a.NoError(first.WriteTitle("Stale"))
+            a.True(errors.Is(first.Save(), ErrConflict))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestSetExtra() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        _, ok, err := entry.GetExtra("pin")
+        a.NoError(err)
+        a.False(ok)
+
+        a.NoError(entry.SetExtra("pin", "1234"))
+        a.NoError(entry.SetExtra("questions", []interface{}{"a", "b"}))
+        a.NoError(entry.Save())
+
+        loaded, err := LoadEntry("entry", u.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(u)) {
+            value, ok, err := loaded.GetExtra("pin")
+            a.NoError(err)
+            a.True(ok)
+            a.Equal("1234", value)
+            value, ok, err = loaded.GetExtra("questions")
+            a.NoError(err)
+            a.True(ok)
+            a.Equal([]interface{}{"a", "b"}, value)
+
+            a.NoError(loaded.SetExtra("pin", nil))
+            _, ok, err = loaded.GetExtra("pin")
+            a.NoError(err)
+            a.False(ok)
+            extras, err := loaded.ReadExtras()
+            a.NoError(err)
+            a.Equal(map[string]interface{}{"questions": []interface{}{"a", "b"}}, extras)
+        }
+
+        a.Error(entry.SetExtra("_totp", "secret"))
+        _, _, err = entry.GetExtra("_totp")
+        a.Error(err)
+        a.Error(entry.SetExtra("", "value"))
+        a.Error(entry.WriteExtras(map[string]interface{}{"pin": "1234", "_totp": "secret"}))
+        a.Error(entry.WriteBatch(map[string]interface{}{"extras": map[string]string{"_totp": "secret"}}))
+        extras, err := entry.ReadExtras()
+        if a.NoError(err) {
+            a.NotContains(extras, "_totp")
+        }
+
+        a.NoError(entry.WriteExtras([]interface{}{"not", "an", "object"}))
+        a.Error(entry.SetExtra("pin", "1234"))
+
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        _, _, err = entry.GetExtra("pin")
+        a.True(errors.Is(err, ErrPermission))
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestReadExtras() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("owner", "password")
+    if !a.NoError(err) {
+        return
+    }
+    reader, err := NewUser("reader", "password")
+    if !a.NoError(err) {
+        owner.Drop()
+        return
+    }
+
+    entry := newTestEntry(a, owner, "entry")
+    extras, err := entry.ReadExtras()
+    a.NoError(err)
+    a.Equal(map[string]interface{}{}, extras)
+
+    a.NoError(entry.WriteExtras(map[string]interface{}{"pin": "1234"}))
+    a.NoError(entry.Save())
+    extras, err = entry.ReadExtras()
+    a.NoError(err)
+    a.Equal(map[string]interface{}{"pin": "1234"}, extras)
+
+    if _, err := entry.ShareWith(reader, "r"); a.NoError(err) {
+        shared, err := LoadEntry("entry", reader.Id)
+        if a.NoError(err) && a.NoError(shared.AttachUser(reader)) {
+            extras, err = shared.ReadExtras()
+            a.NoError(err)
+            a.Equal(map[string]interface{}{"pin": "1234"}, extras)
+            a.Error(shared.WriteExtras(map[string]interface{}{"pin": "0000"}))
+        }
+    }
+
+    a.NoError(owner.GrantPermissions(entry, owner, "w"))
+    _, err = entry.ReadExtras()
+    if a.True(errors.Is(err, ErrPermission)) {
+        a.Contains(err.Error(), "Extras read permission denied")
+    }
+
+    reader.Drop()
+    owner.Drop()
+}
+
+func (suite *EntryTestSuite) TestExpiry() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        expiry, err := entry.ReadExpiry()
+        a.NoError(err)
+        a.True(expiry.IsZero())
+
+        first := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+        a.NoError(entry.WriteExpiry(first))
+        a.NoError(entry.Save())
+        loaded, err := LoadEntry("entry", u.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(u)) {
+            expiry, err = loaded.ReadExpiry()
+            a.NoError(err)
+            a.True(first.Equal(expiry))
+        }
+
+        second := first.AddDate(1, 0, 0)
+        a.NoError(entry.WriteExpiry(second))
+        a.NoError(entry.Save())
+        loaded, err = LoadEntry("entry", u.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(u)) {
+            expiry, err = loaded.ReadExpiry()
+            a.NoError(err)
+            a.True(second.Equal(expiry))
+        }
+
+        a.NoError(entry.WriteExpiry(time.Time{}))
+        a.Empty(entry.Expiry)
+        a.NoError(entry.Save())
+        loaded, err = LoadEntry("entry", u.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(u)) {
+            expiry, err = loaded.ReadExpiry()
+            a.NoError(err)
+            a.True(expiry.IsZero())
+        }
+        expiring, err := u.ExpiringWithin(100 * 365 * 24 * time.Hour)
+        a.NoError(err)
+        a.Empty(expiring)
+
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        _, err = entry.ReadExpiry()
+        a.True(errors.Is(err, ErrPermission))
+
+        DB.Unscoped().Delete(entry)
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestAllViews() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("owner", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    reader, err := NewUser("reader", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer reader.Drop()
+    other, err := NewUser("other", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer other.Drop()
+
+    entry := newTestEntry(a, owner, "shared")
+    a.NoError(entry.WriteTitle("Shared"))
+    a.NoError(entry.Save())
+    view, err := entry.ShareWith(reader, "rd")
+    a.NoError(err)
+    unrelated := newTestEntry(a, other, "unrelated")
+    a.NoError(unrelated.Save())
+
+    views, err := AllViews("shared")
+    if a.NoError(err) && a.Len(views, 2) {
+        a.Equal(owner.Id, views[0].UserId)
+        a.Equal(reader.Id, views[1].UserId)
+    }
+    siblings, err := entry.Siblings()
+    if a.NoError(err) && a.Len(siblings, 1) {
+        a.Equal(reader.Id, siblings[0].UserId)
+    }
+    if view != nil {
+        siblings, err = view.Siblings()
+        if a.NoError(err) && a.Len(siblings, 1) {
+            a.Equal(owner.Id, siblings[0].UserId)
+        }
+    }
+    views, err = AllViews("missing")
+    a.NoError(err)
+    a.Empty(views)
+
+    // a user holds only one view of an entry
+    _, err = entry.ShareWith(reader, "r")
+    a.True(errors.Is(err, ErrConflict))
+    views, err = AllViews("shared")
+    a.NoError(err)
+    a.Len(views, 2)
+
+    // but may be given another once they have moved theirs to the trash
+    if view != nil && a.NoError(view.Delete()) {
+        shared, err := entry.ShareWith(reader, "r")
+        if a.NoError(err) {
+            a.NotEqual(view.Id, shared.Id)
+        }
+        errs, err := owner.GrantPermissionsBulk(entry, []*User{reader}, "rw")
+        if a.NoError(err) && a.Len(errs, 1) {
+            a.NoError(errs[0])
+        }
+        a.True(errors.Is(view.Restore(), ErrConflict))
+        views, err = AllViews("shared")
+        a.NoError(err)
+        a.Len(views, 2)
+    }
+}
+
+func (suite *EntryTestSuite) TestReadListFields() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Mail"))
+        a.NoError(entry.WriteGroup("Personal"))
+        a.NoError(entry.WriteUsername("alice"))
+        a.NoError(entry.WritePassword("secret"))
+
+        fields, err := entry.ReadListFields()
+        if a.NoError(err) {
+            title, _ := entry.ReadTitle()
+            group, _ := entry.ReadGroup()
+            username, _ := entry.ReadUsername()
+            a.Equal(ListView{Title: title, Group: group, Username: username}, fields)
+            a.Equal(ListView{Title: "Mail", Group: "Personal", Username: "alice"}, fields)
+        }
+
+        // the username needs read permission, unlike the others
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        fields, err = entry.ReadListFields()
+        if a.NoError(err) {
+            a.Equal(ListView{Title: "Mail", Group: "Personal"}, fields)
+        }
+        _, err = entry.ReadUsername()
+        a.True(errors.Is(err, ErrPermission))
+
+        a.NoError(u.RevokePermissions(entry, u))
+        _, err = entry.ReadListFields()
+        a.True(errors.Is(err, ErrPermission))
+
+        u.Drop()
+    }
+}
+
+func (suite *EntryTestSuite) TestWriteBatch() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WriteTitle("Original"))
+        a.NoError(entry.Save())
+
+        expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+        a.NoError(entry.WriteBatch(map[string]interface{}{
+            "title":    "Mail",
+            "username": "alice",
+            "password": "secret",
+            "expiry":   expiry,
+            "extras":   map[string]interface{}{"pin": "1234"},
+        }))
+        a.Equal(1, entry.Version)
+
+        loaded, err := LoadEntry("entry", u.Id)
+        if a.NoError(err) {
+            a.NoError(loaded.AttachUser(u))
+            title, _ := loaded.ReadTitle()
+            username, _ := loaded.ReadUsername()
+            password, _ := loaded.ReadPassword()
+            a.Equal([]string{"Mail", "alice", "secret"}, []string{title, username, password})
+            stored, err := loaded.ReadExpiry()
+            a.NoError(err)
+            a.True(expiry.Equal(stored))
+            pin, ok, err := loaded.GetExtra("pin")
+            a.NoError(err)
+            a.True(ok)
+            a.Equal("1234", pin)
+        }
+
+        // a value of the wrong type fails the whole batch, so neither the entry nor the database changes
+        before := *entry
+        a.Error(entry.WriteBatch(map[string]interface{}{"title": "Bank", "username": "bob", "password": 1234}))
+        a.Error(entry.WriteBatch(map[string]interface{}{"title": "Bank", "colour": "blue"}))
+        a.Equal(before.Title, entry.Title)
+        a.Equal(before.Username, entry.Username)
+        a.Equal(before.Password, entry.Password)
+        a.Equal(1, entry.Version)
+        loaded, err = LoadEntry("entry", u.Id)
+        if a.NoError(err) {
+            a.Equal(before.Title, loaded.Title)
+            a.Equal(before.Username, loaded.Username)
+            a.Equal(before.Password, loaded.Password)
+        }
+
+        // a batch which cannot be saved leaves the entry as it was
+        stale := before
+        a.NoError(entry.WriteTitle("Changed"))
+        a.NoError(entry.Save())
+        err = stale.WriteBatch(map[string]interface{}{"title": "Bank", "username": "bob", "password": "hunter2"})
+        a.True(errors.Is(err, ErrConflict))
+        a.Equal(before.Title, stale.Title)
+        a.Equal(before.Username, stale.Username)
+        a.Equal(before.Password, stale.Password)
+
+        a.NoError(u.GrantPermissions(entry, u, "r"))
+        err = entry.WriteBatch(map[string]interface{}{"title": "Bank"})
+        a.True(errors.Is(err, ErrPermission))
+
+        u.Drop()
+    }
+}
+
+// The newBenchmarkEntry function creates a user and an entry with the fields shown in a list.
+func newBenchmarkEntry(b *testing.B) (*User, *EntryView) {
+    u, err := NewUser("benchmark.user", "password")
+    if err != nil {
+        b.Fatal(err)
+    }
+    entry, err := NewEntry(u)
+    if err != nil {
+        b.Fatal(err)
+    }
+    for name, value := range map[string]string{"title": "Mail", "group": "Personal", "icon": "mail.png", "username": "alice"} {
+        if err := entry.WriteField(name, value); err != nil {
+            b.Fatal(err)
+        }
+    }
+    return u, entry
+}
+
+func BenchmarkReadListFields(b *testing.B) {
+    u, entry := newBenchmarkEntry(b)
+    defer u.Drop()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if _, err := entry.ReadListFields(); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkReadFieldsIndividually(b *testing.B) {
+    u, entry := newBenchmarkEntry(b)
+    defer u.Drop()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        for _, name := range []string{"title", "group", "icon", "username"} {
+            if _, err := entry.ReadField(name); err != nil {
+                b.Fatal(err)
+            }
+        }
+    }
+}
+
+func TestEntryTestSuite(t *testing.T) {
+    suite.Run(t, new(EntryTestSuite))
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+    "encoding/base64"
+    "github.com/awm/passrep/utils"
+    "sync"
+    "time"
+)
+
+// The ephemeralSecret structure holds a decrypted value awaiting redemption, along with the timer which purges it.
+type ephemeralSecret struct {
+    data  []byte
+    timer *time.Timer
+}
+
+// The ephemeralStore holds the secrets handed out by ReadPasswordEphemeral, keyed by token.
+var ephemeralStore = struct {
+    sync.Mutex
+    secrets map[string]*ephemeralSecret
+}{secrets: make(map[string]*ephemeralSecret)}
+
+// The takeEphemeral function removes the secret with the given token from the store, stopping its timer, and produces it
+// if it was present.
+func takeEphemeral(token string) (*ephemeralSecret, bool) {
+    ephemeralStore.Lock()
+    defer ephemeralStore.Unlock()
+    secret, ok := ephemeralStore.secrets[token]
+    if ok {
+        delete(ephemeralStore.secrets, token)
+        secret.timer.Stop()
+    }
+    return secret, ok
+}
+
+// ReadPasswordEphemeral decrypts the password of the entry, provided that the user has read permission, and holds it in
+// memory under a random token rather than returning it.  The password may be retrieved once through RedeemEphemeral, and
+// is wiped and discarded when redeemed or once the ttl has passed, whichever comes first.  This suits copying a password
+// to the clipboard, where the caller should not keep the plaintext itself.
+func (this *EntryView) ReadPasswordEphemeral(ttl time.Duration) (token string, err error) {
+    defer func() { this.audit("read password ephemeral", err) }()
+    if ttl <= 0 {
+        return "", NewError("Invalid ephemeral lifetime "+ttl.String(), this.getUser())
+    }
+    if !this.getUser().Can("r", this) {
+        return "", NewError("Password read permission denied", this.getUser(), ErrPermission)
+    }
+
+    data, err := this.decryptField("password")
+    if err != nil {
+        return "", err
+    }
+    raw := utils.RandomBytes(32)
+    if raw == nil {
+        utils.SecureZero(data)
+        return "", NewError("Token generation failed", this.getUser())
+    }
+    token = base64.RawURLEncoding.EncodeToString(raw)
+
+    ephemeralStore.Lock()
+    defer ephemeralStore.Unlock()
+    secret := &ephemeralSecret{data: data}
+    secret.timer = time.AfterFunc(ttl, func() {
+        if expired, ok := takeEphemeral(token); ok {
+            utils.SecureZero(expired.data)
+        }
+    })
+    ephemeralStore.secrets[token] = secret
+    return token, nil
+}
+
+// RedeemEphemeral retrieves the password held under a token produced by ReadPasswordEphemeral, reporting whether it was
+// found.  Each token may only be redeemed once, and not after it has expired.
+func RedeemEphemeral(token string) (string, bool) {
+    secret, ok := takeEphemeral(token)
+    if !ok {
+        return "", false
+    }
+    password := string(secret.data)
+    utils.SecureZero(secret.data)
+    return password, true
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type EphemeralTestSuite struct {
+    suite.Suite
+}
+
+func (suite *EphemeralTestSuite) TestRedeem() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WritePassword("hunter2"))
+
+        token, err := entry.ReadPasswordEphemeral(time.Minute)
+        if a.NoError(err) {
+            a.NotContains(token, "hunter2")
+            password, ok := RedeemEphemeral(token)
+            a.True(ok)
+            a.Equal("hunter2", password)
+
+            // tokens are single-use
+            password, ok = RedeemEphemeral(token)
+            a.False(ok)
+            a.Empty(password)
+        }
+
+        _, ok := RedeemEphemeral("bogus")
+        a.False(ok)
+        _, err = entry.ReadPasswordEphemeral(0)
+        a.Error(err)
+
+        a.NoError(u.GrantPermissions(entry, u, "w"))
+        _, err = entry.ReadPasswordEphemeral(time.Minute)
+        a.True(errors.Is(err, ErrPermission))
+
+        u.Drop()
+    }
+}
+
+func (suite *EphemeralTestSuite) TestExpiry() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WritePassword("hunter2"))
+
+        token, err := entry.ReadPasswordEphemeral(20 * time.Millisecond)
+        if a.NoError(err) {
+            time.Sleep(100 * time.Millisecond)
+            _, ok := RedeemEphemeral(token)
+            a.False(ok)
+
+            ephemeralStore.Lock()
+            a.NotContains(ephemeralStore.secrets, token)
+            ephemeralStore.Unlock()
+        }
+
+        u.Drop()
+    }
+}
+
+func TestEphemeralTestSuite(t *testing.T) {
+    suite.Run(t, new(EphemeralTestSuite))
+}
@@ -1,10 +1,64 @@
 package core
 
 import (
+    "encoding/json"
     "fmt"
     "runtime"
 )
 
+// The ErrorCode type classifies errors so that callers can react to them without parsing messages.  Each code is also an
+// error value in its own right, so that errors.Is(err, ErrNotFound) reports whether err carries that code.
+type ErrorCode int
+
+const (
+    // ErrNone is the code of an error which has not been classified.
+    ErrNone ErrorCode = iota
+    // ErrEncryption indicates that data could not be encrypted.
+    ErrEncryption
+    // ErrDecryption indicates that data could not be decrypted or authenticated.
+    ErrDecryption
+    // ErrPermission indicates that the user lacks the permission required for an operation.
+    ErrPermission
+    // ErrNotFound indicates that a requested record does not exist.
+    ErrNotFound
+    // ErrCrypto indicates a failure of a cryptographic primitive other than encryption or decryption, such as key
+    // handling or signing.
+    ErrCrypto
+    // ErrAuthentication indicates that a password or other credential was rejected.
+    ErrAuthentication
+    // ErrConflict indicates that a record was changed elsewhere since it was loaded, so the change was not stored.
+    ErrConflict
+)
+
+// The errorCodeNames map holds the descriptions of the error codes.
+var errorCodeNames = map[ErrorCode]string{
+    ErrNone:           "none",
+    ErrEncryption:     "encryption",
+    ErrDecryption:     "decryption",
+    ErrPermission:     "permission",
+    ErrNotFound:       "not found",
+    ErrCrypto:         "crypto",
+    ErrAuthentication: "authentication",
+    ErrConflict:       "conflict",
+}
+
+// String produces a short description of the error code.
+func (this ErrorCode) String() string {
+    if name, ok := errorCodeNames[this]; ok {
+        return name
+    }
+    return fmt.Sprintf("code %d", int(this))
+}
+
+// Error produces the description of the error code, so that the code can be used as a sentinel error.
+func (this ErrorCode) Error() string {
+    return this.String()
+}
+
+// ErrorIncludeSource causes the JSON encoding of an Error to include the source file and line where it originated.  It is
+// off by default, since errors are commonly returned to clients who should not see server paths, and is meant for debugging.
+var ErrorIncludeSource = false
+
 // The Error type is the basic PWS error type used when no other type is more appropriate.
 type Error struct {
     // The File is the source file where the error originated.
@@ -15,24 +69,40 @@ type Error struct {
     User string
     // The Msg is the string describing the error.
     Msg string
+    // The Code classifies the error, or is ErrNone if it has not been classified.
+    Code ErrorCode
+
+    // The wrapped field is the underlying error which the error was created from, if any.
+    wrapped error
 }
 
-// NewError produces a new Error instance.
-func NewError(content interface{}, user ...interface{}) *Error {
+// NewError produces a new Error instance.  The optional arguments may include the user for whom the error was
+// generated and an ErrorCode.  When the content is an error it is wrapped, so that it remains available through
+// errors.Unwrap, and wrapping an existing Error keeps its code unless a new one is given.
+func NewError(content interface{}, options ...interface{}) *Error {
     err := new(Error)
-    if user != nil {
-        err.SetUser(user[0])
-    }
 
     switch c := content.(type) {
     case *Error:
         err.Msg = c.Msg
+        err.Code = c.Code
+        err.wrapped = c
     case error:
         err.Msg = c.Error()
+        err.wrapped = c
     case string:
         err.Msg = c
     }
 
+    for _, option := range options {
+        switch o := option.(type) {
+        case ErrorCode:
+            err.SetCode(o)
+        default:
+            err.SetUser(o)
+        }
+    }
+
     _, file, line, ok := runtime.Caller(1)
     if ok {
         err.File = file
@@ -58,9 +128,43 @@ func (this *Error) Error() string {
         result += ": "
     }
     result += this.Msg
+    if this.Code != ErrNone {
+        result += fmt.Sprintf(" [%s]", this.Code)
+    }
     return result
 }
 
+// Is reports whether the error carries the code given as the target, allowing the codes to be used with errors.Is.
+func (this *Error) Is(target error) bool {
+    code, ok := target.(ErrorCode)
+    return ok && code != ErrNone && this.Code == code
+}
+
+// Unwrap provides the underlying error which the error was created from, or nil if there is none.
+func (this *Error) Unwrap() error {
+    return this.wrapped
+}
+
+// The errorJSON structure is the JSON encoding of an Error.
+type errorJSON struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+    User    string `json:"user,omitempty"`
+    File    string `json:"file,omitempty"`
+    Line    int    `json:"line,omitempty"`
+}
+
+// MarshalJSON encodes the error as an object holding its code, message and user, for returning to clients of a service.
+// The source file and line are only included when ErrorIncludeSource is set.
+func (this *Error) MarshalJSON() ([]byte, error) {
+    encoded := errorJSON{Code: this.Code.String(), Message: this.Msg, User: this.User}
+    if ErrorIncludeSource {
+        encoded.File = this.File
+        encoded.Line = this.Line
+    }
+    return json.Marshal(encoded)
+}
+
 // SetUser changes the user field after creation.
 func (this *Error) SetUser(user interface{}) *Error {
     switch u := user.(type) {
@@ -71,3 +175,9 @@ func (this *Error) SetUser(user interface{}) *Error {
     }
     return this
 }
+
+// SetCode changes the code field after creation.
+func (this *Error) SetCode(code ErrorCode) *Error {
+    this.Code = code
+    return this
+}
@@ -1,6 +1,9 @@
 package core
 
 import (
+    "encoding/json"
+    "errors"
+    "fmt"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/suite"
     "testing"
@@ -18,7 +21,7 @@ func (suite *ErrorTestSuite) TestCreation() {
 
     e := NewError("A test error", "test.user")
     a.Error(e)
-    a.Contains(e.Error(), "error_test.go:19 - test.user: A test error")
+    a.Contains(e.Error(), "error_test.go:22 - test.user: A test error")
 }
 
 func (suite *ErrorTestSuite) TestWrapping() {
@@ -27,15 +30,99 @@ func (suite *ErrorTestSuite) TestWrapping() {
     u := User{Name: "test.user"}
     e := NewError(assert.AnError, &u)
     a.Error(e)
-    a.Contains(e.Error(), "error_test.go:28 - test.user: assert.AnError general error for testing")
+    a.Contains(e.Error(), "error_test.go:31 - test.user: assert.AnError general error for testing")
 
     e = NewError(assert.AnError)
     a.Error(e)
-    a.Contains(e.Error(), "error_test.go:32: assert.AnError general error for testing")
+    a.Contains(e.Error(), "error_test.go:35: assert.AnError general error for testing")
 
     e2 := NewError(e)
     a.Error(e2)
-    a.Contains(e2.Error(), "error_test.go:36: assert.AnError general error for testing")
+    a.Contains(e2.Error(), "error_test.go:39: assert.AnError general error for testing")
+}
+
+func (suite *ErrorTestSuite) TestCode() {
+    a := assert.New(suite.T())
+
+    e := NewError("A test error", "test.user", ErrNotFound)
+    a.Equal(ErrNotFound, e.Code)
+    a.Equal("test.user", e.User)
+    a.Contains(e.Error(), "test.user: A test error [not found]")
+
+    e2 := NewError(e)
+    a.Equal(ErrNotFound, e2.Code)
+    a.Contains(e2.Error(), "A test error [not found]")
+
+    e3 := NewError(e2, ErrPermission)
+    a.Equal(ErrPermission, e3.Code)
+
+    e4 := NewError(assert.AnError).SetCode(ErrDecryption)
+    a.Equal(ErrDecryption, e4.Code)
+    a.Contains(e4.Error(), "[decryption]")
+
+    a.NotContains(NewError("Plain").Error(), "[")
+}
+
+func (suite *ErrorTestSuite) TestIsAs() {
+    a := assert.New(suite.T())
+
+    e := NewError(NewError(assert.AnError, ErrDecryption), "test.user")
+    a.True(errors.Is(e, ErrDecryption))
+    a.False(errors.Is(e, ErrNotFound))
+    a.False(errors.Is(e, ErrNone))
+    a.True(errors.Is(e, assert.AnError))
+    a.Equal(ErrDecryption, e.Code)
+
+    wrapped := fmt.Errorf("loading entry: %w", e)
+    a.True(errors.Is(wrapped, ErrDecryption))
+    var target *Error
+    if a.True(errors.As(wrapped, &target)) {
+        a.Equal("test.user", target.User)
+        a.Equal(ErrDecryption, target.Code)
+    }
+
+    field := &FieldError{NewError("Field 'title' could not be decrypted", ErrDecryption), "title"}
+    a.True(errors.Is(field, ErrDecryption))
+
+    a.Nil(NewError("Plain").Unwrap())
+    a.Equal("not found", ErrNotFound.Error())
+}
+
+func (suite *ErrorTestSuite) TestJSON() {
+    a := assert.New(suite.T())
+
+    e := NewError("A test error", "test.user", ErrNotFound)
+    encoded, err := json.Marshal(e)
+    if a.NoError(err) {
+        a.JSONEq(`{"code": "not found", "message": "A test error", "user": "test.user"}`, string(encoded))
+    }
+
+    encoded, err = json.Marshal(NewError(assert.AnError))
+    if a.NoError(err) {
+        a.JSONEq(`{"code": "none", "message": "assert.AnError general error for testing"}`, string(encoded))
+    }
+
+    ErrorIncludeSource = true
+    defer func() { ErrorIncludeSource = false }()
+    encoded, err = json.Marshal(e)
+    if a.NoError(err) {
+        var decoded map[string]interface{}
+        if a.NoError(json.Unmarshal(encoded, &decoded)) {
+            a.Len(decoded, 5)
+            a.Equal("not found", decoded["code"])
+            a.Equal("A test error", decoded["message"])
+            a.Equal("test.user", decoded["user"])
+            a.Equal(e.File, decoded["file"])
+            a.Contains(decoded["file"], "error_test.go")
+            a.Equal(float64(e.Line), decoded["line"])
+        }
+    }
+
+    // errors nested in other values are encoded the same way
+    encoded, err = json.Marshal(map[string]error{"error": NewError("Nested", ErrPermission)})
+    if a.NoError(err) {
+        a.Contains(string(encoded), `"code":"permission"`)
+    }
 }
 
 func TestErrorTestSuite(t *testing.T) {
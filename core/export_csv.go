@@ -0,0 +1,121 @@
+package core
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "time"
+)
+
+// The RedactedPassword string replaces the passwords written by ExportCSVRedacted.
+const RedactedPassword = "********"
+
+// The csvExportColumns table lists the header and entry field of each column written by the CSV export, in order.
+var csvExportColumns = []struct {
+    header string
+    field  string
+}{
+    {"Title", "title"},
+    {"Username", "username"},
+    {"Password", "password"},
+    {"Url", "url"},
+    {"Comment", "comment"},
+    {"Group", "group"},
+    {"Expiry", "expiry"},
+}
+
+// CSVExportMapping produces the mapping which imports CSV data written by ExportCSV through ImportCSV.  The expiry column
+// is not imported.
+func CSVExportMapping() CSVMapping {
+    mapping := make(CSVMapping)
+    for _, column := range csvExportColumns {
+        if _, ok := findEntryField(column.field); ok {
+            mapping[column.header] = column.field
+        }
+    }
+    return mapping
+}
+
+// ExportCSV writes a header row followed by a row for each of the user's entries, including archived ones, holding the
+// decrypted title, username, password, url, comment, group and expiry date.  Fields which the user is not permitted to
+// read are left empty.  The user must have an active session.  The entries are loaded in batches and each row is written
+// before the next entry is decrypted, so the export does not hold the whole vault in memory; should it fail part way
+// through, the error reports how many entries were written.  The passwords are written in plain text, so
+// ExportCSVRedacted should be preferred unless the passwords themselves are needed.
+func (this *User) ExportCSV(w io.Writer) error {
+    return this.exportCSV(w, false)
+}
+
+// ExportCSVRedacted writes the same rows as ExportCSV, except that every password which is set is replaced by
+// RedactedPassword.
+func (this *User) ExportCSVRedacted(w io.Writer) error {
+    return this.exportCSV(w, true)
+}
+
+// The exportCSV function writes the user's entries as CSV, optionally masking the passwords.
+func (this *User) exportCSV(w io.Writer, redact bool) error {
+    writer := csv.NewWriter(w)
+    var header []string
+    for _, column := range csvExportColumns {
+        header = append(header, column.header)
+    }
+    if err := writer.Write(header); err != nil {
+        return NewError(err, this)
+    }
+
+    count := 0
+    err := this.eachEntry(func(e *EntryView) error {
+        var record []string
+        for _, column := range csvExportColumns {
+            value, err := e.exportField(column.field)
+            if err != nil {
+                return err
+            }
+            if redact && column.field == "password" && len(value) > 0 {
+                value = RedactedPassword
+            }
+            record = append(record, value)
+        }
+        if err := writer.Write(record); err != nil {
+            return err
+        }
+        count++
+        return nil
+    }, ListOptions{IncludeArchived: true})
+    if err != nil {
+        writer.Flush()
+        return this.exportFailed(count, err)
+    }
+
+    writer.Flush()
+    if err := writer.Error(); err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// The exportFailed function wraps an error which interrupted an export, keeping its code, and notes how many entries had
+// been written, since the output written so far is incomplete.
+func (this *User) exportFailed(count int, err error) *Error {
+    failed := NewError(err, this)
+    failed.Msg = fmt.Sprintf("Export failed after %d entries: %s", count, failed.Msg)
+    return failed
+}
+
+// The exportField function reads the named field for export, producing an empty string if the field is not set or the
+// user is not permitted to read it.
+func (this *EntryView) exportField(name string) (string, error) {
+    field, _ := findField(encryptedFields, name)
+    if len(*field.value(this)) == 0 || !this.getUser().Can(field.query, this) {
+        return "", nil
+    }
+
+    if name == "expiry" {
+        expiry, err := this.ReadExpiry()
+        if err != nil {
+            return "", err
+        }
+        return expiry.Format(time.RFC3339), nil
+    }
+    return this.ReadField(name)
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "math"
+    "strings"
+)
+
+const (
+    // UpperCharacters is the set of uppercase letters used when generating passwords.
+    UpperCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+    // LowerCharacters is the set of lowercase letters used when generating passwords.
+    LowerCharacters = "abcdefghijklmnopqrstuvwxyz"
+    // DigitCharacters is the set of digits used when generating passwords.
+    DigitCharacters = "0123456789"
+    // SymbolCharacters is the set of symbols used when generating passwords.
+    SymbolCharacters = "!#$%&*+-=?@^_~()[]{}<>.,:;/"
+    // AmbiguousCharacters are the characters which are easily confused with one another when read.
+    AmbiguousCharacters = "0O1Il|"
+)
+
+// The PasswordPolicy structure controls which characters a generated password is drawn from.
+type PasswordPolicy struct {
+    // Upper enables uppercase letters.
+    Upper bool
+    // Lower enables lowercase letters.
+    Lower bool
+    // Digits enables digits.
+    Digits bool
+    // Symbols enables symbols.
+    Symbols bool
+    // ExcludeAmbiguous removes the AmbiguousCharacters from every class.
+    ExcludeAmbiguous bool
+
+    // MinUpper is the minimum number of uppercase letters.
+    MinUpper int
+    // MinLower is the minimum number of lowercase letters.
+    MinLower int
+    // MinDigits is the minimum number of digits.
+    MinDigits int
+    // MinSymbols is the minimum number of symbols.
+    MinSymbols int
+}
+
+// DefaultPasswordPolicy produces a policy which uses every character class and requires at least one of each.
+func DefaultPasswordPolicy() PasswordPolicy {
+    return PasswordPolicy{
+        Upper:      true,
+        Lower:      true,
+        Digits:     true,
+        Symbols:    true,
+        MinUpper:   1,
+        MinLower:   1,
+        MinDigits:  1,
+        MinSymbols: 1,
+    }
+}
+
+// The characterClass structure is one of the enabled classes of a policy, along with its minimum count.
+type characterClass struct {
+    characters string
+    min        int
+}
+
+// The classes function lists the enabled character classes of the policy, with ambiguous characters removed if requested.
+func (this PasswordPolicy) classes() ([]characterClass, error) {
+    all := []struct {
+        name       string
+        enabled    bool
+        characters string
+        min        int
+    }{
+        {"uppercase", this.Upper, UpperCharacters, this.MinUpper},
+        {"lowercase", this.Lower, LowerCharacters, this.MinLower},
+        {"digit", this.Digits, DigitCharacters, this.MinDigits},
+        {"symbol", this.Symbols, SymbolCharacters, this.MinSymbols},
+    }
+
+    var result []characterClass
+    for _, c := range all {
+        if c.min < 0 {
+            return nil, NewError(fmt.Sprintf("Negative minimum %s count", c.name))
+        }
+        if !c.enabled {
+            if c.min > 0 {
+                return nil, NewError(fmt.Sprintf("Minimum %s count given but %s characters are disabled", c.name, c.name))
+            }
+            continue
+        }
+
+        characters := c.characters
+        if this.ExcludeAmbiguous {
+            characters = strings.Map(func(r rune) rune {
+                if strings.ContainsRune(AmbiguousCharacters, r) {
+                    return -1
+                }
+                return r
+            }, characters)
+        }
+        result = append(result, characterClass{characters, c.min})
+    }
+    if len(result) == 0 {
+        return nil, NewError("No character classes enabled")
+    }
+    return result, nil
+}
+
+// The randomIndex function produces a uniformly distributed random integer in [0, n).  Random values falling in the
+// incomplete range at the top of the 32-bit space are rejected, so that no result is more likely than another.
+func randomIndex(n int) (int, error) {
+    if n <= 0 || int64(n) > 1<<32 {
+        return 0, NewError(fmt.Sprintf("Invalid random range %d", n))
+    }
+
+    limit := (1 << 32) - (1<<32)%uint64(n)
+    for {
+        raw := utils.RandomBytes(4)
+        if raw == nil {
+            return 0, NewError("RNG failure!")
+        }
+        value := uint64(binary.BigEndian.Uint32(raw))
+        if value < limit {
+            return int(value % uint64(n)), nil
+        }
+    }
+}
+
+// GeneratePassword produces a random password of the given length which satisfies the policy.  Each character class's
+// minimum is met first, the remainder is drawn from all enabled classes together, and the result is shuffled so that the
+// required characters are not at predictable positions.
+func GeneratePassword(length int, policy PasswordPolicy) (string, error) {
+    classes, err := policy.classes()
+    if err != nil {
+        return "", err
+    }
+
+    required := 0
+    pool := ""
+    for _, c := range classes {
+        required += c.min
+        pool += c.characters
+    }
+    if length <= 0 || required > length {
+        return "", NewError(fmt.Sprintf("Policy requires %d characters, which cannot be met with length %d", required, length))
+    }
+
+    password := make([]byte, 0, length)
+    for _, c := range classes {
+        for i := 0; i < c.min; i++ {
+            j, err := randomIndex(len(c.characters))
+            if err != nil {
+                return "", err
+            }
+            password = append(password, c.characters[j])
+        }
+    }
+    for len(password) < length {
+        j, err := randomIndex(len(pool))
+        if err != nil {
+            return "", err
+        }
+        password = append(password, pool[j])
+    }
+
+    for i := len(password) - 1; i > 0; i-- {
+        j, err := randomIndex(i + 1)
+        if err != nil {
+            return "", err
+        }
+        password[i], password[j] = password[j], password[i]
+    }
+    return string(password), nil
+}
+
+// DefaultWordlist provides a copy of the built-in passphrase wordlist, the EFF large wordlist.
+func DefaultWordlist() []string {
+    result := make([]string, len(effWordlist))
+    copy(result, effWordlist)
+    return result
+}
+
+// GeneratePassphrase produces a passphrase of the given number of words, each chosen uniformly at random from the wordlist
+// and joined by the separator.  A nil wordlist selects the default wordlist.
+func GeneratePassphrase(words int, separator string, wordlist []string) (string, error) {
+    if wordlist == nil {
+        wordlist = effWordlist
+    }
+    if words < 1 {
+        return "", NewError(fmt.Sprintf("Invalid passphrase word count %d", words))
+    }
+    if len(wordlist) == 0 {
+        return "", NewError("Empty passphrase wordlist")
+    }
+
+    chosen := make([]string, words)
+    for i := range chosen {
+        j, err := randomIndex(len(wordlist))
+        if err != nil {
+            return "", err
+        }
+        chosen[i] = wordlist[j]
+    }
+    return strings.Join(chosen, separator), nil
+}
+
+// PassphraseEntropy determines the entropy in bits of a passphrase generated by GeneratePassphrase with the given number
+// of words and wordlist, assuming the words of the list are distinct.  A nil wordlist selects the default wordlist.
+func PassphraseEntropy(words int, wordlist []string) float64 {
+    if wordlist == nil {
+        wordlist = effWordlist
+    }
+    if words < 1 || len(wordlist) == 0 {
+        return 0
+    }
+    return float64(words) * math.Log2(float64(len(wordlist)))
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "strings"
+    "testing"
+)
+
+type GenerateTestSuite struct {
+    suite.Suite
+}
+
+// The countIn function counts the characters of s which belong to the set.
+func countIn(s string, set string) int {
+    count := 0
+    for _, r := range s {
+        if strings.ContainsRune(set, r) {
+            count++
+        }
+    }
+    return count
+}
+
+func (suite *GenerateTestSuite) TestPasswordConstraints() {
+    a := assert.New(suite.T())
+
+    policy := DefaultPasswordPolicy()
+    policy.MinDigits = 3
+    policy.MinSymbols = 2
+    policy.ExcludeAmbiguous = true
+    for i := 0; i < 500; i++ {
+        password, err := GeneratePassword(12, policy)
+        if !a.NoError(err) {
+            return
+        }
+        a.Len(password, 12)
+        a.True(countIn(password, UpperCharacters) >= 1)
+        a.True(countIn(password, LowerCharacters) >= 1)
+        a.True(countIn(password, DigitCharacters) >= 3)
+        a.True(countIn(password, SymbolCharacters) >= 2)
+        a.Equal(0, countIn(password, AmbiguousCharacters))
+    }
+
+    _, err := GeneratePassword(6, policy)
+    a.Error(err)
+    _, err = GeneratePassword(0, PasswordPolicy{Lower: true})
+    a.Error(err)
+    _, err = GeneratePassword(8, PasswordPolicy{})
+    a.Error(err)
+    _, err = GeneratePassword(8, PasswordPolicy{Lower: true, MinDigits: 1})
+    a.Error(err)
+}
+
+func (suite *GenerateTestSuite) TestPasswordDistribution() {
+    a := assert.New(suite.T())
+
+    counts := make(map[rune]int)
+    total := 0
+    for i := 0; i < 400; i++ {
+        password, err := GeneratePassword(65, PasswordPolicy{Lower: true})
+        if !a.NoError(err) {
+            return
+        }
+        for _, r := range password {
+            counts[r]++
+            total++
+        }
+    }
+
+    a.Len(counts, len(LowerCharacters))
+    expected := float64(total) / float64(len(LowerCharacters))
+    for r, c := range counts {
+        a.InDelta(expected, float64(c), expected*0.2, "character %c", r)
+    }
+}
+
+func (suite *GenerateTestSuite) TestPassphrase() {
+    a := assert.New(suite.T())
+
+    wordlist := DefaultWordlist()
+    a.Len(wordlist, 7776)
+    wordlist[0] = "changed"
+    a.NotEqual("changed", DefaultWordlist()[0])
+
+    passphrase, err := GeneratePassphrase(6, "-", nil)
+    if a.NoError(err) {
+        words := strings.Split(passphrase, "-")
+        a.Len(words, 6)
+        for _, w := range words {
+            a.Contains(effWordlist, w)
+        }
+    }
+
+    seen := make(map[string]bool)
+    for i := 0; i < 50; i++ {
+        passphrase, err := GeneratePassphrase(4, " ", nil)
+        if a.NoError(err) {
+            a.False(seen[passphrase])
+            seen[passphrase] = true
+        }
+    }
+
+    passphrase, err = GeneratePassphrase(3, "", []string{"x"})
+    a.NoError(err)
+    a.Equal("xxx", passphrase)
+
+    a.InDelta(12.925, PassphraseEntropy(1, nil), 0.001)
+    a.InDelta(6*PassphraseEntropy(1, nil), PassphraseEntropy(6, nil), 0.001)
+    a.Equal(0.0, PassphraseEntropy(6, []string{"x"}))
+
+    _, err = GeneratePassphrase(0, " ", nil)
+    a.Error(err)
+    _, err = GeneratePassphrase(4, " ", []string{})
+    a.Error(err)
+}
+
+func TestGenerateTestSuite(t *testing.T) {
+    suite.Run(t, new(GenerateTestSuite))
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "github.com/awm/passrep/utils"
+    "sort"
+)
+
+// The GroupPayload structure holds data sealed by one user for several recipients.  The data is encrypted once under a
+// random content key, and only the content key is encrypted for each recipient, under the secret shared between the
+// sender and that recipient, so that sealing for a large team costs little more than sealing for a single user.  Since
+// every recipient learns the content key, the payload is also signed by the sender, so that no recipient can substitute
+// data of their own for the others.
+type GroupPayload struct {
+    // The Sender is the name of the user who sealed the payload.
+    Sender string
+    // The Ciphertext is the base64 encoded data encrypted under the content key.
+    Ciphertext string
+    // The Keys hold the base64 encoded content key encrypted for each recipient, keyed by the recipient's name.
+    Keys map[string]string
+    // The Signature is the sender's detached, base64 encoded signature over the Sender, Ciphertext and Keys.
+    Signature string
+}
+
+// The groupPayloadContent structure is the signed content of a group payload, with the keys sorted by recipient name.
+type groupPayloadContent struct {
+    Sender     string
+    Ciphertext string
+    Keys       [][2]string
+}
+
+// The content function produces the canonical encoding of the signed fields of the payload.
+func (this *GroupPayload) content() ([]byte, error) {
+    names := make([]string, 0, len(this.Keys))
+    for name := range this.Keys {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    keys := make([][2]string, len(names))
+    for i, name := range names {
+        keys[i] = [2]string{name, this.Keys[name]}
+    }
+    return json.Marshal(groupPayloadContent{this.Sender, this.Ciphertext, keys})
+}
+
+// SealForGroup encrypts the data so that each of the recipients, and no one else, can open it with OpenGroup.  The user
+// must have an active session.
+func (this *User) SealForGroup(data []byte, recipients []*User) (*GroupPayload, error) {
+    if len(recipients) == 0 {
+        return nil, NewError("No recipients", this)
+    }
+
+    contentKey := utils.RandomBytes(32)
+    if contentKey == nil {
+        return nil, NewError("RNG failure!", this)
+    }
+    defer utils.SecureZero(contentKey)
+
+    ciphertext, err := sealWithKey(contentKey, data)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    payload := &GroupPayload{Sender: this.Name, Ciphertext: ciphertext, Keys: make(map[string]string)}
+    for _, recipient := range recipients {
+        secret, err := this.makeSharedSecret(recipient)
+        if err != nil {
+            return nil, err
+        }
+        payload.Keys[recipient.Name], err = sealWithKey(secret, contentKey)
+        utils.SecureZero(secret)
+        if err != nil {
+            return nil, NewError(err, this)
+        }
+    }
+
+    content, err := payload.content()
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    if this.keys == nil || this.keys.SigningKey == nil {
+        return nil, NewError("Private key unavailable", this, ErrCrypto)
+    }
+    raw, err := signData(this.keys.SigningKey, content)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    payload.Signature = base64.StdEncoding.EncodeToString(raw)
+    return payload, nil
+}
+
+// OpenGroup checks that the payload was signed by the sender and has not been altered, then decrypts it as a member of
+// the group it was sealed for.  The user must have an active session.  Opening a payload which was not sealed for the
+// user fails with ErrPermission, and one which was altered, or not sealed by the sender, fails with ErrDecryption.
+func (this *User) OpenGroup(p *GroupPayload, from *User) ([]byte, error) {
+    if p.Sender != from.Name {
+        return nil, NewError("Group payload was sealed by '"+p.Sender+"' rather than '"+from.Name+"'", this, ErrDecryption)
+    }
+    key, err := base64.StdEncoding.DecodeString(from.PublicKey)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    content, err := p.content()
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    ok, err := Verify(content, p.Signature, key)
+    if err != nil || !ok {
+        return nil, NewError("Group payload signature invalid", this, ErrDecryption)
+    }
+    wrapped, ok := p.Keys[this.Name]
+    if !ok {
+        return nil, NewError("Group payload was not sealed for the user", this, ErrPermission)
+    }
+
+    secret, err := this.makeSharedSecret(from)
+    if err != nil {
+        return nil, err
+    }
+    defer utils.SecureZero(secret)
+
+    contentKey, err := openWithKey(secret, wrapped)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    defer utils.SecureZero(contentKey)
+
+    data, err := openWithKey(contentKey, p.Ciphertext)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    return data, nil
+}
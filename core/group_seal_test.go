@@ -0,0 +1,130 @@
+package core
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type GroupTestSuite struct {
+    suite.Suite
+}
+
+func (suite *GroupTestSuite) TestSealForGroup() {
+    a := assert.New(suite.T())
+
+    sender, err := NewUser("sender", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer sender.Drop()
+    var users []*User
+    for i := 0; i < 4; i++ {
+        u, err := NewUser(fmt.Sprintf("user.%d", i), "password")
+        if !a.NoError(err) {
+            return
+        }
+        defer u.Drop()
+        users = append(users, u)
+    }
+    recipients, outsider := users[:3], users[3]
+
+    _, err = sender.SealForGroup([]byte("secret"), nil)
+    a.Error(err)
+
+    payload, err := sender.SealForGroup([]byte("secret"), recipients)
+    if !a.NoError(err) {
+        return
+    }
+    a.Len(payload.Keys, 3)
+    a.NotContains(payload.Ciphertext, "secret")
+    for _, recipient := range recipients {
+        data, err := recipient.OpenGroup(payload, sender)
+        if a.NoError(err) {
+            a.Equal([]byte("secret"), data)
+        }
+    }
+
+    _, err = outsider.OpenGroup(payload, sender)
+    a.True(errors.Is(err, ErrPermission))
+    // a key copied from another recipient is of no use to the outsider
+    payload.Keys[outsider.Name] = payload.Keys[recipients[0].Name]
+    _, err = outsider.OpenGroup(payload, sender)
+    a.True(errors.Is(err, ErrDecryption))
+    _, err = recipients[0].OpenGroup(payload, outsider)
+    a.True(errors.Is(err, ErrDecryption))
+
+    tampered := *payload
+    tampered.Ciphertext = payload.Keys[recipients[1].Name]
+    _, err = recipients[0].OpenGroup(&tampered, sender)
+    a.True(errors.Is(err, ErrDecryption))
+}
+
+func (suite *GroupTestSuite) TestRecipientForgery() {
+    a := assert.New(suite.T())
+
+    sender, err := NewUser("sender", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer sender.Drop()
+    forger, err := NewUser("forger", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer forger.Drop()
+    victim, err := NewUser("victim", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer victim.Drop()
+
+    payload, err := sender.SealForGroup([]byte("secret"), []*User{forger, victim})
+    if !a.NoError(err) {
+        return
+    }
+
+    // a recipient learns the content key, and so can encrypt data of their own under it
+    secret, err := forger.makeSharedSecret(sender)
+    if !a.NoError(err) {
+        return
+    }
+    contentKey, err := openWithKey(secret, payload.Keys[forger.Name])
+    if !a.NoError(err) {
+        return
+    }
+    forged := *payload
+    forged.Ciphertext, err = sealWithKey(contentKey, []byte("forged"))
+    a.NoError(err)
+    _, err = victim.OpenGroup(&forged, sender)
+    a.True(errors.Is(err, ErrDecryption))
+
+    // nor can the forger sign the substitute in the sender's name
+    forged.Signature = ""
+    content, err := forged.content()
+    if a.NoError(err) {
+        raw, err := signData(forger.keys.SigningKey, content)
+        if a.NoError(err) {
+            forged.Signature = base64.StdEncoding.EncodeToString(raw)
+        }
+    }
+    _, err = victim.OpenGroup(&forged, sender)
+    a.True(errors.Is(err, ErrDecryption))
+
+    forged = *payload
+    forged.Keys = map[string]string{victim.Name: payload.Keys[victim.Name]}
+    _, err = victim.OpenGroup(&forged, sender)
+    a.True(errors.Is(err, ErrDecryption))
+
+    data, err := victim.OpenGroup(payload, sender)
+    if a.NoError(err) {
+        a.Equal([]byte("secret"), data)
+    }
+}
+
+func TestGroupTestSuite(t *testing.T) {
+    suite.Run(t, new(GroupTestSuite))
+}
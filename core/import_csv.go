@@ -0,0 +1,185 @@
+package core
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// The CSVMapping type maps the names of CSV header columns to the entry fields which their values are imported into.
+// The fields may be any of group, icon, title, username, password, url and comment.
+type CSVMapping map[string]string
+
+// The ImportError type is produced when some of the records of an import fail while the rest are imported.
+type ImportError struct {
+    // The Err is the underlying error summarizing the failure.
+    Err *Error
+    // The Errors are the failures of the individual records, each identifying the record which failed.
+    Errors []error
+}
+
+// Error produces a string describing the error, including the failure of each record.
+func (this *ImportError) Error() string {
+    messages := []string{this.Err.Error()}
+    for _, err := range this.Errors {
+        messages = append(messages, err.Error())
+    }
+    return strings.Join(messages, "\n")
+}
+
+// Unwrap provides the underlying error.
+func (this *ImportError) Unwrap() error {
+    return this.Err
+}
+
+// The ImportOptions structure controls how ImportCSV and ImportKDBX import entries.
+type ImportOptions struct {
+    // DryRun causes every record to be read and checked as it would be for a real import, without anything being stored
+    // and without any entries being returned, so that the outcome can be previewed.
+    DryRun bool
+    // The Report, if set, is filled in with a summary of the import, whether or not it is a dry run.
+    Report *ImportReport
+}
+
+// The importOptions function combines the optional import options passed to an import function.  The last report given
+// is the one filled in.
+func importOptions(options []ImportOptions) ImportOptions {
+    var result ImportOptions
+    for _, o := range options {
+        result.DryRun = result.DryRun || o.DryRun
+        if o.Report != nil {
+            result.Report = o.Report
+        }
+    }
+    return result
+}
+
+// The ImportReport structure summarizes the records read by an import.
+type ImportReport struct {
+    // The Total is the number of records read.
+    Total int
+    // The Valid is the number of records which were, or in a dry run would be, imported.
+    Valid int
+    // The Skipped is the number of records which could not be imported.
+    Skipped int
+    // The Errors are the failures of the skipped records, each identifying the record which failed.
+    Errors []error
+}
+
+// The record function counts a record read by an import, along with its failure, if any.
+func (this *ImportReport) record(err error) {
+    this.Total++
+    if err != nil {
+        this.Skipped++
+        this.Errors = append(this.Errors, err)
+    } else {
+        this.Valid++
+    }
+}
+
+// ImportCSV reads CSV data whose first row is a header and creates and saves an entry owned by the owner for each of the
+// remaining rows.  The columns named in the mapping are imported into the corresponding entry fields, while columns
+// missing from the data are left empty and unmapped columns are ignored.  Each row must have a title.  A row which cannot
+// be imported does not stop the others, and the failures are instead collected into an ImportError returned alongside
+// the entries which were imported.  Data which cannot be read, other than a row with the wrong number of fields, stops
+// the import at that row.  The owner must have an active session.  The options may request a dry run, which
+// returns the same errors without storing or returning any entries, and a report of the rows read.
+func ImportCSV(r io.Reader, mapping CSVMapping, owner *User, options ...ImportOptions) ([]*EntryView, error) {
+    opts := importOptions(options)
+    report := &ImportReport{}
+    if opts.Report != nil {
+        report = opts.Report
+        *report = ImportReport{}
+    }
+
+    for _, name := range mapping {
+        if _, ok := findEntryField(name); !ok {
+            return nil, NewError("Unknown field '"+name+"'", owner)
+        }
+    }
+
+    reader := csv.NewReader(r)
+    header, err := reader.Read()
+    if err != nil {
+        return nil, NewError(err, owner)
+    }
+    columns := make(map[int]string)
+    for i, column := range header {
+        if i == 0 {
+            column = strings.TrimPrefix(column, "\ufeff")
+        }
+        if name, ok := mapping[strings.TrimSpace(column)]; ok {
+            columns[i] = name
+        }
+    }
+
+    var entries []*EntryView
+    for row := 1; ; row++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            report.record(NewError(fmt.Sprintf("Row %d: %v", row, err), owner))
+            // a row with the wrong number of fields is skipped, while any other failure to read stops the import
+            if e, ok := err.(*csv.ParseError); ok && e.Err == csv.ErrFieldCount {
+                continue
+            }
+            break
+        }
+
+        entry, err := importCSVRecord(record, columns, owner, opts.DryRun)
+        if err != nil {
+            report.record(NewError(fmt.Sprintf("Row %d: %v", row, err), owner))
+            continue
+        }
+        report.record(nil)
+        if !opts.DryRun {
+            entries = append(entries, entry)
+        }
+    }
+
+    if len(report.Errors) > 0 {
+        return entries, &ImportError{NewError(fmt.Sprintf("%d rows could not be imported", len(report.Errors)), owner), report.Errors}
+    }
+    return entries, nil
+}
+
+// The importCSVRecord function creates the entry for a single CSV record, and saves it unless this is a dry run.
+func importCSVRecord(record []string, columns map[int]string, owner *User, dryRun bool) (*EntryView, error) {
+    entry, err := NewEntry(owner)
+    if err != nil {
+        return nil, err
+    }
+
+    title := ""
+    for i, value := range record {
+        name, ok := columns[i]
+        if !ok {
+            continue
+        }
+        if name == "title" {
+            title = strings.TrimSpace(value)
+        }
+        if name == "url" {
+            err = entry.WriteUrl(value)
+        } else {
+            err = entry.WriteField(name, value)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    if len(title) == 0 {
+        return nil, &FieldError{NewError("Title is required", owner), "title"}
+    }
+
+    if dryRun {
+        return entry, entry.checkSave()
+    }
+    if err := entry.Save(); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+    "bytes"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "strings"
+    "testing"
+    "time"
+)
+
+type ImportCSVTestSuite struct {
+    suite.Suite
+}
+
+const testCSV = `Name,Login,Password,Website,Notes,Folder
+Mail,alice,secret,https://mail.example.com,"first line
+second line",Personal
+Mail,bob,hunter2,,,Work
+,carol,nameless,,,
+Bank,dave,"pass,word",https://bank.example.com,,
+`
+
+func (suite *ImportCSVTestSuite) TestImport() {
+    a := assert.New(suite.T())
+
+    mapping := CSVMapping{
+        "Name":     "title",
+        "Login":    "username",
+        "Password": "password",
+        "Website":  "url",
+        "Notes":    "comment",
+        "Folder":   "group",
+        "Tags":     "icon",
+    }
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entries, err := ImportCSV(strings.NewReader(testCSV), mapping, u)
+        if a.Error(err) {
+            ie, ok := err.(*ImportError)
+            if a.True(ok) && a.Len(ie.Errors, 1) {
+                a.Contains(ie.Errors[0].Error(), "Row 3")
+                a.Contains(ie.Errors[0].Error(), "Title is required")
+            }
+        }
+
+        if a.Len(entries, 3) {
+            for _, e := range entries {
+                a.NotEqual(0, e.Id)
+                a.Equal(u.Id, e.UserId)
+            }
+
+            comment, _ := entries[0].ReadComment()
+            a.Equal("first line\nsecond line", comment)
+            group, _ := entries[0].ReadGroup()
+            a.Equal("Personal", group)
+
+            title, _ := entries[1].ReadTitle()
+            a.Equal("Mail", title)
+            username, _ := entries[1].ReadUsername()
+            a.Equal("bob", username)
+            a.NotEqual(entries[0].EntryId, entries[1].EntryId)
+
+            password, _ := entries[2].ReadPassword()
+            a.Equal("pass,word", password)
+            a.True(entries[2].MatchUrl("https://bank.example.com"))
+        }
+
+        for _, e := range entries {
+            DB.Unscoped().Delete(e)
+        }
+
+        _, err = ImportCSV(strings.NewReader(testCSV), CSVMapping{"Name": "nonexistent"}, u)
+        a.Error(err)
+
+        u.Drop()
+    }
+}
+
+func (suite *ImportCSVTestSuite) TestDryRun() {
+    a := assert.New(suite.T())
+
+    mapping := CSVMapping{"Name": "title", "Login": "username", "Password": "password", "Website": "url"}
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var preview ImportReport
+        entries, dryErr := ImportCSV(strings.NewReader(testCSV), mapping, u, ImportOptions{DryRun: true, Report: &preview})
+        a.Nil(entries)
+        a.Error(dryErr)
+        a.Equal(4, preview.Total)
+        a.Equal(3, preview.Valid)
+        a.Equal(1, preview.Skipped)
+        if a.Len(preview.Errors, 1) {
+            a.Contains(preview.Errors[0].Error(), "Row 3")
+        }
+        var count int
+        DB.Model(&EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+        a.Equal(0, count)
+
+        var report ImportReport
+        entries, err = ImportCSV(strings.NewReader(testCSV), mapping, u, ImportOptions{Report: &report})
+        a.Equal(dryErr.Error(), err.Error())
+        a.Len(entries, report.Valid)
+        a.Equal(preview.Total, report.Total)
+        a.Equal(preview.Valid, report.Valid)
+        a.Equal(preview.Skipped, report.Skipped)
+        if a.Len(report.Errors, 1) {
+            a.Equal(preview.Errors[0].Error(), report.Errors[0].Error())
+        }
+        for _, e := range entries {
+            DB.Unscoped().Delete(e)
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *ImportCSVTestSuite) TestExportRoundTrip() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WriteTitle(`Mail, "work"`))
+            a.NoError(entry.WriteUsername("alice"))
+            a.NoError(entry.WritePassword(`p,a"ss`))
+            a.NoError(entry.WriteComment("first line\nsecond line"))
+            a.NoError(entry.WriteExpiry(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)))
+            a.NoError(entry.Save())
+        }
+
+        var redacted bytes.Buffer
+        if a.NoError(u.ExportCSVRedacted(&redacted)) {
+            a.Contains(redacted.String(), RedactedPassword)
+            a.NotContains(redacted.String(), `p,a""ss`)
+            a.Contains(redacted.String(), "2030-01-02T03:04:05Z")
+        }
+
+        var exported bytes.Buffer
+        if a.NoError(u.ExportCSV(&exported)) {
+            DB.Unscoped().Delete(entry)
+
+            entries, err := ImportCSV(&exported, CSVExportMapping(), u)
+            if a.NoError(err) && a.Len(entries, 1) {
+                for _, name := range []string{"title", "username", "password", "comment", "group"} {
+                    original, _ := entry.exportField(name)
+                    value, err := entries[0].exportField(name)
+                    a.NoError(err)
+                    a.Equal(original, value, name)
+                }
+                DB.Unscoped().Delete(entries[0])
+            }
+        }
+
+        u.Drop()
+    }
+}
+
+// The failingReader type produces its data and then fails every read after it, as a broken connection would.
+type failingReader struct {
+    data *strings.Reader
+}
+
+func (this failingReader) Read(p []byte) (int, error) {
+    if this.data.Len() > 0 {
+        return this.data.Read(p)
+    }
+    return 0, errors.New("connection reset")
+}
+
+func (suite *ImportCSVTestSuite) TestReadFailure() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var report ImportReport
+        r := failingReader{strings.NewReader("Name,Password\nMail,secret\n")}
+        entries, err := ImportCSV(r, CSVMapping{"Name": "title", "Password": "password"}, u, ImportOptions{Report: &report})
+        if a.Error(err) {
+            ie, ok := err.(*ImportError)
+            if a.True(ok) && a.Len(ie.Errors, 1) {
+                a.Contains(ie.Errors[0].Error(), "connection reset")
+            }
+        }
+        a.Len(entries, 1)
+        a.Equal(2, report.Total)
+        a.Equal(1, report.Skipped)
+
+        for _, e := range entries {
+            DB.Unscoped().Delete(e)
+        }
+        u.Drop()
+    }
+}
+
+func TestImportCSVTestSuite(t *testing.T) {
+    suite.Run(t, new(ImportCSVTestSuite))
+}
@@ -0,0 +1,820 @@
+package core
+
+import (
+    "bytes"
+    "compress/gzip"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/xml"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/chacha20"
+    "golang.org/x/crypto/salsa20/salsa"
+    "io"
+    "io/ioutil"
+    "strings"
+)
+
+const (
+    // The kdbxSignature1 and kdbxSignature2 values identify a KeePass 2 database file.
+    kdbxSignature1 = 0x9AA2D903
+    kdbxSignature2 = 0xB54BFB67
+)
+
+// The KDBX outer header field identifiers.
+const (
+    kdbxEndOfHeader          = 0
+    kdbxCipherId             = 2
+    kdbxCompressionFlags     = 3
+    kdbxMasterSeed           = 4
+    kdbxTransformSeed        = 5
+    kdbxTransformRounds      = 6
+    kdbxEncryptionIV         = 7
+    kdbxProtectedStreamKey   = 8
+    kdbxStreamStartBytes     = 9
+    kdbxInnerRandomStreamId  = 10
+    kdbxKdfParameters        = 11
+    kdbxPublicCustomData     = 12
+    kdbxInnerEndOfHeader     = 0
+    kdbxInnerRandomStream    = 1
+    kdbxInnerRandomStreamKey = 2
+)
+
+// The KDBX inner random stream identifiers, which select the cipher protecting values such as passwords.
+const (
+    kdbxStreamNone     = 0
+    kdbxStreamSalsa20  = 2
+    kdbxStreamChaCha20 = 3
+)
+
+// The KDBX cipher and key derivation function UUIDs.
+var (
+    kdbxCipherAES      = []byte{0x31, 0xc1, 0xf2, 0xe6, 0xbf, 0x71, 0x43, 0x50, 0xbe, 0x58, 0x05, 0x21, 0x6a, 0xfc, 0x5a, 0xff}
+    kdbxCipherChaCha20 = []byte{0xd6, 0x03, 0x8a, 0x2b, 0x8b, 0x6f, 0x4c, 0xb5, 0xa5, 0x24, 0x33, 0x9a, 0x31, 0xdb, 0xb5, 0x9a}
+    kdbxKdfAES         = []byte{0xc9, 0xd9, 0xf3, 0x9a, 0x62, 0x8a, 0x44, 0x60, 0xbf, 0x74, 0x0d, 0x08, 0xc1, 0x8a, 0x4f, 0xea}
+    kdbxKdfArgon2d     = []byte{0xef, 0x63, 0x6d, 0xdf, 0x8c, 0x29, 0x44, 0x4b, 0x91, 0xf7, 0xa9, 0xa4, 0x03, 0xe3, 0x0a, 0x0c}
+    kdbxKdfArgon2id    = []byte{0x9e, 0x29, 0x8b, 0x19, 0x56, 0xdb, 0x47, 0x73, 0xb2, 0x3d, 0xfc, 0x3e, 0xc6, 0xf0, 0xa1, 0xe6}
+)
+
+// The limits on the key derivation parameters accepted from a KDBX header, which are checked before any key is derived
+// so that a crafted file cannot exhaust the CPU time or memory of the importer.  They are well beyond the parameters
+// KeePass chooses for a second of derivation on current hardware.
+const (
+    kdbxMaxAESRounds        = 1 << 30
+    kdbxMaxArgon2Iterations = 1 << 12
+    kdbxMaxArgon2Memory     = 1 << 31
+    kdbxMaxArgon2Threads    = 255
+)
+
+// The kdbxSalsa20Nonce is the fixed nonce of the Salsa20 inner random stream.
+var kdbxSalsa20Nonce = []byte{0xE8, 0x30, 0x09, 0x4B, 0x97, 0x20, 0x5D, 0x2A}
+
+// The kdbxStandardFields map gives the entry field which each of the standard KeePass strings is imported into.  Any
+// other strings are imported into the extras.
+var kdbxStandardFields = map[string]string{
+    "Title":    "title",
+    "UserName": "username",
+    "Password": "password",
+    "URL":      "url",
+    "Notes":    "comment",
+}
+
+// The kdbxHeader structure holds the fields of a KDBX outer header.
+type kdbxHeader struct {
+    major              uint16
+    cipher             []byte
+    compressed         bool
+    masterSeed         []byte
+    transformSeed      []byte
+    transformRounds    uint64
+    iv                 []byte
+    protectedStreamKey []byte
+    streamStartBytes   []byte
+    innerStream        uint32
+    kdf                map[string][]byte
+}
+
+// The kdbxEntry structure holds the strings of an entry read from a KDBX database, along with its group path.
+type kdbxEntry struct {
+    group   string
+    strings map[string]string
+}
+
+// ImportKDBX reads a KeePass 2 database in the KDBX 3.1 or 4 format and creates an entry owned by the owner for each
+// KeePass entry outside the recycle bin.  The standard strings are mapped to the corresponding entry fields, the path
+// of the KeePass group below the root becomes the group, and any custom strings are stored in the extras as a JSON
+// object.  The owner must have an active session.  Nothing is stored unless the whole database can be read and every
+// entry can be imported, and the failures of individual entries are collected into an ImportError; the entries are then
+// stored in a single transaction.  The options may request a dry run, which returns the same errors without storing or
+// returning any entries, and a report of the entries read.
+func ImportKDBX(r io.Reader, masterPassword string, owner *User, options ...ImportOptions) ([]*EntryView, error) {
+    opts := importOptions(options)
+    report := &ImportReport{}
+    if opts.Report != nil {
+        report = opts.Report
+        *report = ImportReport{}
+    }
+
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, NewError(err, owner)
+    }
+
+    entries, err := readKDBX(data, masterPassword)
+    if err != nil {
+        if e, ok := err.(*Error); ok {
+            return nil, e.SetUser(owner)
+        }
+        return nil, NewError(err, owner)
+    }
+
+    var views []*EntryView
+    for i, k := range entries {
+        view, err := importKDBXEntry(k, owner)
+        if err != nil {
+            report.record(NewError(fmt.Sprintf("Entry %d: %v", i+1, err), owner))
+            continue
+        }
+        report.record(nil)
+        views = append(views, view)
+    }
+    if len(report.Errors) > 0 {
+        return nil, &ImportError{NewError(fmt.Sprintf("%d entries could not be imported", len(report.Errors)), owner), report.Errors}
+    }
+    if opts.DryRun {
+        return nil, nil
+    }
+
+    if err := owner.saveImported(views); err != nil {
+        return nil, err
+    }
+    return views, nil
+}
+
+// The importKDBXEntry function creates the entry, without saving it, for a single entry read from a KDBX database.
+func importKDBXEntry(k kdbxEntry, owner *User) (*EntryView, error) {
+    view, err := NewEntry(owner)
+    if err != nil {
+        return nil, err
+    }
+    if err := view.WriteGroup(k.group); err != nil {
+        return nil, err
+    }
+
+    extras := make(map[string]string)
+    for key, value := range k.strings {
+        name, ok := kdbxStandardFields[key]
+        if !ok {
+            extras[key] = value
+            continue
+        }
+        if name == "url" {
+            err = view.WriteUrl(value)
+        } else {
+            err = view.WriteField(name, value)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    if len(extras) > 0 {
+        if err := view.WriteExtras(extras); err != nil {
+            return nil, err
+        }
+    }
+    return view, view.checkSave()
+}
+
+// The readKDBX function decrypts a KDBX database and extracts its entries.
+func readKDBX(data []byte, password string) ([]kdbxEntry, error) {
+    r := bytes.NewReader(data)
+    header, err := readKDBXHeader(r)
+    if err != nil {
+        return nil, err
+    }
+    headerBytes := data[:len(data)-r.Len()]
+
+    transformed, err := header.transformKey(password)
+    if err != nil {
+        return nil, err
+    }
+    seeded := append(append([]byte{}, header.masterSeed...), transformed...)
+    key := sha256.Sum256(seeded)
+    defer utils.SecureZero(key[:])
+    defer utils.SecureZero(seeded)
+    utils.SecureZero(transformed)
+
+    var payload []byte
+    if header.major >= 4 {
+        hmacBase := sha512.Sum512(append(seeded, 1))
+        payload, err = readKDBX4Blocks(r, headerBytes, hmacBase[:])
+        if err != nil {
+            return nil, err
+        }
+        payload, err = header.decrypt(key[:], payload)
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        rest, _ := ioutil.ReadAll(r)
+        payload, err = header.decrypt(key[:], rest)
+        if err != nil {
+            return nil, err
+        }
+        if len(payload) < len(header.streamStartBytes) || !utils.ConstantTimeEqual(payload[:len(header.streamStartBytes)], header.streamStartBytes) {
+            return nil, NewError("Invalid master password or corrupt KDBX file", ErrAuthentication)
+        }
+        payload, err = readKDBX3Blocks(payload[len(header.streamStartBytes):])
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if header.compressed {
+        z, err := gzip.NewReader(bytes.NewReader(payload))
+        if err != nil {
+            return nil, NewError(err)
+        }
+        payload, err = ioutil.ReadAll(z)
+        if err != nil {
+            return nil, NewError(err)
+        }
+    }
+
+    streamId, streamKey := header.innerStream, header.protectedStreamKey
+    if header.major >= 4 {
+        streamId, streamKey, payload, err = readKDBXInnerHeader(payload)
+        if err != nil {
+            return nil, err
+        }
+    }
+    stream, err := newKDBXStream(streamId, streamKey)
+    if err != nil {
+        return nil, err
+    }
+    return readKDBXXML(payload, stream)
+}
+
+// The readKDBXHeader function reads and checks the signature, version and outer header fields of a KDBX database.
+func readKDBXHeader(r *bytes.Reader) (*kdbxHeader, error) {
+    var preamble struct {
+        Signature1 uint32
+        Signature2 uint32
+        Minor      uint16
+        Major      uint16
+    }
+    if err := binary.Read(r, binary.LittleEndian, &preamble); err != nil {
+        return nil, NewError("Not a KDBX file")
+    }
+    if preamble.Signature1 != kdbxSignature1 || preamble.Signature2 != kdbxSignature2 {
+        return nil, NewError("Not a KDBX file")
+    }
+    if preamble.Major != 3 && preamble.Major != 4 {
+        return nil, NewError(fmt.Sprintf("Unsupported KDBX version %d.%d", preamble.Major, preamble.Minor))
+    }
+
+    header := &kdbxHeader{major: preamble.Major, innerStream: kdbxStreamNone}
+    for {
+        var id uint8
+        var length uint32
+        if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+            return nil, NewError("Truncated KDBX header")
+        }
+        if header.major >= 4 {
+            err := binary.Read(r, binary.LittleEndian, &length)
+            if err != nil {
+                return nil, NewError("Truncated KDBX header")
+            }
+        } else {
+            var short uint16
+            if err := binary.Read(r, binary.LittleEndian, &short); err != nil {
+                return nil, NewError("Truncated KDBX header")
+            }
+            length = uint32(short)
+        }
+        if int64(length) > int64(r.Len()) {
+            return nil, NewError("Truncated KDBX header")
+        }
+        value := make([]byte, length)
+        if _, err := io.ReadFull(r, value); err != nil {
+            return nil, NewError("Truncated KDBX header")
+        }
+
+        switch id {
+        case kdbxEndOfHeader:
+            return header, header.check()
+        case kdbxCipherId:
+            header.cipher = value
+        case kdbxCompressionFlags:
+            if len(value) != 4 {
+                return nil, NewError("Invalid KDBX compression flags")
+            }
+            header.compressed = binary.LittleEndian.Uint32(value) == 1
+        case kdbxMasterSeed:
+            header.masterSeed = value
+        case kdbxTransformSeed:
+            header.transformSeed = value
+        case kdbxTransformRounds:
+            if len(value) != 8 {
+                return nil, NewError("Invalid KDBX transform rounds")
+            }
+            header.transformRounds = binary.LittleEndian.Uint64(value)
+        case kdbxEncryptionIV:
+            header.iv = value
+        case kdbxProtectedStreamKey:
+            header.protectedStreamKey = value
+        case kdbxStreamStartBytes:
+            header.streamStartBytes = value
+        case kdbxInnerRandomStreamId:
+            if len(value) != 4 {
+                return nil, NewError("Invalid KDBX inner stream")
+            }
+            header.innerStream = binary.LittleEndian.Uint32(value)
+        case kdbxKdfParameters:
+            kdf, err := readVariantDictionary(value)
+            if err != nil {
+                return nil, err
+            }
+            header.kdf = kdf
+        }
+    }
+}
+
+// The check function ensures that the header contains every field required by its version.
+func (this *kdbxHeader) check() error {
+    if len(this.cipher) == 0 || len(this.masterSeed) == 0 || len(this.iv) == 0 {
+        return NewError("Incomplete KDBX header")
+    }
+    if this.major >= 4 {
+        if this.kdf == nil {
+            return NewError("Incomplete KDBX header")
+        }
+    } else if len(this.transformSeed) == 0 || len(this.streamStartBytes) == 0 {
+        return NewError("Incomplete KDBX header")
+    }
+    return nil
+}
+
+// The readVariantDictionary function decodes a KDBX 4 variant dictionary into the raw values of its items.
+func readVariantDictionary(data []byte) (map[string][]byte, error) {
+    r := bytes.NewReader(data)
+    var version uint16
+    if err := binary.Read(r, binary.LittleEndian, &version); err != nil || version&0xFF00 != 0x0100 {
+        return nil, NewError("Unsupported KDBX parameter dictionary")
+    }
+
+    result := make(map[string][]byte)
+    for {
+        var kind uint8
+        if err := binary.Read(r, binary.LittleEndian, &kind); err != nil {
+            return nil, NewError("Truncated KDBX parameter dictionary")
+        }
+        if kind == 0 {
+            return result, nil
+        }
+
+        var fields [2][]byte
+        for i := range fields {
+            var length int32
+            if err := binary.Read(r, binary.LittleEndian, &length); err != nil || length < 0 || int(length) > r.Len() {
+                return nil, NewError("Truncated KDBX parameter dictionary")
+            }
+            fields[i] = make([]byte, length)
+            io.ReadFull(r, fields[i])
+        }
+        result[string(fields[0])] = fields[1]
+    }
+}
+
+// The transformKey function derives the transformed key from the password using the database's key derivation function.
+func (this *kdbxHeader) transformKey(password string) ([]byte, error) {
+    hashed := sha256.Sum256([]byte(password))
+    composite := sha256.Sum256(hashed[:])
+
+    if this.major < 4 {
+        if this.transformRounds > kdbxMaxAESRounds {
+            return nil, NewError("KDBX transform rounds out of range")
+        }
+        return kdbxAESKdf(composite[:], this.transformSeed, this.transformRounds)
+    }
+
+    uuid := this.kdf["$UUID"]
+    uint64Param := func(name string) (uint64, error) {
+        value, ok := this.kdf[name]
+        if !ok || len(value) != 8 {
+            return 0, NewError("Missing KDBX key derivation parameter '" + name + "'")
+        }
+        return binary.LittleEndian.Uint64(value), nil
+    }
+    switch {
+    case bytes.Equal(uuid, kdbxKdfAES):
+        rounds, err := uint64Param("R")
+        if err != nil {
+            return nil, err
+        }
+        if rounds > kdbxMaxAESRounds {
+            return nil, NewError("KDBX key derivation parameter 'R' out of range")
+        }
+        return kdbxAESKdf(composite[:], this.kdf["S"], rounds)
+    case bytes.Equal(uuid, kdbxKdfArgon2id):
+        iterations, err := uint64Param("I")
+        if err != nil {
+            return nil, err
+        }
+        memory, err := uint64Param("M")
+        if err != nil {
+            return nil, err
+        }
+        parallelism, ok := this.kdf["P"]
+        if !ok || len(parallelism) != 4 {
+            return nil, NewError("Missing KDBX key derivation parameter 'P'")
+        }
+        threads := binary.LittleEndian.Uint32(parallelism)
+        version, ok := this.kdf["V"]
+        if !ok || len(version) != 4 || binary.LittleEndian.Uint32(version) != argon2.Version {
+            return nil, NewError("Unsupported Argon2 version")
+        }
+        if iterations == 0 || iterations > kdbxMaxArgon2Iterations {
+            return nil, NewError("KDBX key derivation parameter 'I' out of range")
+        }
+        if memory > kdbxMaxArgon2Memory {
+            return nil, NewError("KDBX key derivation parameter 'M' out of range")
+        }
+        if threads == 0 || threads > kdbxMaxArgon2Threads {
+            return nil, NewError("KDBX key derivation parameter 'P' out of range")
+        }
+        return argon2.IDKey(composite[:], this.kdf["S"], uint32(iterations), uint32(memory/1024), uint8(threads), 32), nil
+    case bytes.Equal(uuid, kdbxKdfArgon2d):
+        return nil, NewError("Unsupported KDBX key derivation function Argon2d; change it to Argon2id or AES-KDF in KeePass before importing")
+    }
+    return nil, NewError("Unsupported KDBX key derivation function")
+}
+
+// The kdbxAESKdf function transforms the key by repeatedly encrypting it with AES under the seed.
+func kdbxAESKdf(key []byte, seed []byte, rounds uint64) ([]byte, error) {
+    block, err := aes.NewCipher(seed)
+    if err != nil {
+        return nil, NewError(err)
+    }
+
+    transformed := append([]byte{}, key...)
+    for i := uint64(0); i < rounds; i++ {
+        block.Encrypt(transformed[:16], transformed[:16])
+        block.Encrypt(transformed[16:], transformed[16:])
+    }
+    result := sha256.Sum256(transformed)
+    return result[:], nil
+}
+
+// The decrypt function decrypts the payload of the database with the final key, using the database's cipher.
+func (this *kdbxHeader) decrypt(key []byte, data []byte) ([]byte, error) {
+    switch {
+    case bytes.Equal(this.cipher, kdbxCipherAES):
+        block, err := aes.NewCipher(key)
+        if err != nil {
+            return nil, NewError(err)
+        }
+        if len(this.iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+            return nil, NewError("Corrupt KDBX file")
+        }
+        plain := make([]byte, len(data))
+        cipher.NewCBCDecrypter(block, this.iv).CryptBlocks(plain, data)
+
+        padding := int(plain[len(plain)-1])
+        if padding == 0 || padding > block.BlockSize() {
+            return nil, NewError("Invalid master password or corrupt KDBX file", ErrAuthentication)
+        }
+        for _, b := range plain[len(plain)-padding:] {
+            if int(b) != padding {
+                return nil, NewError("Invalid master password or corrupt KDBX file", ErrAuthentication)
+            }
+        }
+        return plain[:len(plain)-padding], nil
+    case bytes.Equal(this.cipher, kdbxCipherChaCha20):
+        c, err := chacha20.NewUnauthenticatedCipher(key, this.iv)
+        if err != nil {
+            return nil, NewError(err)
+        }
+        plain := make([]byte, len(data))
+        c.XORKeyStream(plain, data)
+        return plain, nil
+    }
+    return nil, NewError("Unsupported KDBX cipher")
+}
+
+// The readKDBX3Blocks function reassembles the hashed block stream of a KDBX 3 database, checking the hash of each block.
+func readKDBX3Blocks(data []byte) ([]byte, error) {
+    r := bytes.NewReader(data)
+    var result []byte
+    for {
+        var block struct {
+            Index uint32
+            Hash  [32]byte
+            Size  int32
+        }
+        if err := binary.Read(r, binary.LittleEndian, &block); err != nil {
+            return nil, NewError("Truncated KDBX block stream")
+        }
+        if block.Size == 0 {
+            return result, nil
+        }
+        if block.Size < 0 || int(block.Size) > r.Len() {
+            return nil, NewError("Truncated KDBX block stream")
+        }
+
+        content := make([]byte, block.Size)
+        io.ReadFull(r, content)
+        hash := sha256.Sum256(content)
+        if !bytes.Equal(hash[:], block.Hash[:]) {
+            return nil, NewError("Corrupt KDBX block")
+        }
+        result = append(result, content...)
+    }
+}
+
+// The kdbxBlockKey function derives the HMAC key of a KDBX 4 block from the HMAC base key.
+func kdbxBlockKey(base []byte, index uint64) []byte {
+    var prefix [8]byte
+    binary.LittleEndian.PutUint64(prefix[:], index)
+    key := sha512.Sum512(append(prefix[:], base...))
+    return key[:]
+}
+
+// The readKDBX4Blocks function checks the header hash and HMAC of a KDBX 4 database, then reassembles its HMAC block
+// stream, checking the HMAC of each block.  A header HMAC mismatch indicates the wrong password.
+func readKDBX4Blocks(r *bytes.Reader, headerBytes []byte, hmacBase []byte) ([]byte, error) {
+    var stored [2][32]byte
+    if err := binary.Read(r, binary.LittleEndian, &stored); err != nil {
+        return nil, NewError("Truncated KDBX header")
+    }
+    hash := sha256.Sum256(headerBytes)
+    if !utils.ConstantTimeEqual(hash[:], stored[0][:]) {
+        return nil, NewError("Corrupt KDBX header")
+    }
+    mac := hmac.New(sha256.New, kdbxBlockKey(hmacBase, ^uint64(0)))
+    mac.Write(headerBytes)
+    if !hmac.Equal(mac.Sum(nil), stored[1][:]) {
+        return nil, NewError("Invalid master password or corrupt KDBX file", ErrAuthentication)
+    }
+
+    var result []byte
+    for index := uint64(0); ; index++ {
+        var block struct {
+            Hmac [32]byte
+            Size int32
+        }
+        if err := binary.Read(r, binary.LittleEndian, &block); err != nil {
+            return nil, NewError("Truncated KDBX block stream")
+        }
+        if block.Size < 0 || int(block.Size) > r.Len() {
+            return nil, NewError("Truncated KDBX block stream")
+        }
+        content := make([]byte, block.Size)
+        io.ReadFull(r, content)
+
+        var prefix [12]byte
+        binary.LittleEndian.PutUint64(prefix[:8], index)
+        binary.LittleEndian.PutUint32(prefix[8:], uint32(block.Size))
+        mac := hmac.New(sha256.New, kdbxBlockKey(hmacBase, index))
+        mac.Write(prefix[:])
+        mac.Write(content)
+        if !hmac.Equal(mac.Sum(nil), block.Hmac[:]) {
+            return nil, NewError("Corrupt KDBX block")
+        }
+
+        if block.Size == 0 {
+            return result, nil
+        }
+        result = append(result, content...)
+    }
+}
+
+// The readKDBXInnerHeader function reads the inner header of a decrypted KDBX 4 payload, returning the inner random
+// stream settings along with the remaining XML document.
+func readKDBXInnerHeader(data []byte) (uint32, []byte, []byte, error) {
+    r := bytes.NewReader(data)
+    streamId := uint32(kdbxStreamNone)
+    var streamKey []byte
+    for {
+        var field struct {
+            Id     uint8
+            Length int32
+        }
+        if err := binary.Read(r, binary.LittleEndian, &field); err != nil {
+            return 0, nil, nil, NewError("Truncated KDBX inner header")
+        }
+        if field.Length < 0 || int(field.Length) > r.Len() {
+            return 0, nil, nil, NewError("Truncated KDBX inner header")
+        }
+        value := make([]byte, field.Length)
+        io.ReadFull(r, value)
+
+        switch field.Id {
+        case kdbxInnerEndOfHeader:
+            return streamId, streamKey, data[len(data)-r.Len():], nil
+        case kdbxInnerRandomStream:
+            if len(value) != 4 {
+                return 0, nil, nil, NewError("Invalid KDBX inner stream")
+            }
+            streamId = binary.LittleEndian.Uint32(value)
+        case kdbxInnerRandomStreamKey:
+            streamKey = value
+        }
+    }
+}
+
+// The kdbxStream interface is the inner random stream which protects values within the XML document.  Protected values
+// are XORed with consecutive parts of the stream in document order.
+type kdbxStream interface {
+    XORKeyStream(dst, src []byte)
+}
+
+// The kdbxNullStream type is the inner random stream of a database which does not protect values.
+type kdbxNullStream struct{}
+
+// XORKeyStream copies the data unchanged.
+func (kdbxNullStream) XORKeyStream(dst, src []byte) {
+    copy(dst, src)
+}
+
+// The kdbxSalsa20Stream type is the Salsa20 inner random stream, which continues across calls.
+type kdbxSalsa20Stream struct {
+    key     [32]byte
+    counter [16]byte
+    block   uint64
+    buffer  []byte
+}
+
+// XORKeyStream XORs the data with the next part of the stream.
+func (this *kdbxSalsa20Stream) XORKeyStream(dst, src []byte) {
+    for i := range src {
+        if len(this.buffer) == 0 {
+            var zeros, keystream [64]byte
+            binary.LittleEndian.PutUint64(this.counter[8:], this.block)
+            salsa.XORKeyStream(keystream[:], zeros[:], &this.counter, &this.key)
+            this.block++
+            this.buffer = keystream[:]
+        }
+        dst[i] = src[i] ^ this.buffer[0]
+        this.buffer = this.buffer[1:]
+    }
+}
+
+// The newKDBXStream function creates the inner random stream with the given identifier and key.
+func newKDBXStream(id uint32, key []byte) (kdbxStream, error) {
+    switch id {
+    case kdbxStreamNone:
+        return kdbxNullStream{}, nil
+    case kdbxStreamSalsa20:
+        stream := new(kdbxSalsa20Stream)
+        stream.key = sha256.Sum256(key)
+        copy(stream.counter[:8], kdbxSalsa20Nonce)
+        return stream, nil
+    case kdbxStreamChaCha20:
+        hash := sha512.Sum512(key)
+        c, err := chacha20.NewUnauthenticatedCipher(hash[:32], hash[32:44])
+        if err != nil {
+            return nil, NewError(err)
+        }
+        return c, nil
+    }
+    return nil, NewError(fmt.Sprintf("Unsupported KDBX inner stream %d", id))
+}
+
+// The kdbxGroup structure tracks a group enclosing the current position in the XML document.
+type kdbxGroup struct {
+    name string
+    uuid string
+}
+
+// The readKDBXXML function extracts the entries from the XML document of a database, unprotecting protected values.
+// Entries in the recycle bin and the history of entries are skipped, although their protected values are still
+// unprotected in order to keep the inner random stream in step.
+func readKDBXXML(data []byte, stream kdbxStream) ([]kdbxEntry, error) {
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+    var path []string
+    var groups []kdbxGroup
+    var entries []kdbxEntry
+    var current *kdbxEntry
+    var key string
+    recycleBinEnabled := true
+    recycleBin := ""
+    history := 0
+
+    parent := func() string {
+        if len(path) < 2 {
+            return ""
+        }
+        return path[len(path)-2]
+    }
+    text := func(start *xml.StartElement) (string, error) {
+        var content struct {
+            Text string `xml:",chardata"`
+        }
+        if err := decoder.DecodeElement(&content, start); err != nil {
+            return "", NewError(err)
+        }
+        path = path[:len(path)-1]
+        return content.Text, nil
+    }
+
+    for {
+        token, err := decoder.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, NewError(err)
+        }
+
+        switch t := token.(type) {
+        case xml.StartElement:
+            path = append(path, t.Name.Local)
+            switch t.Name.Local {
+            case "Group":
+                groups = append(groups, kdbxGroup{})
+            case "History":
+                history++
+            case "Entry":
+                if history == 0 {
+                    current = &kdbxEntry{strings: make(map[string]string)}
+                }
+            case "Name", "UUID", "RecycleBinUUID", "RecycleBinEnabled", "Key":
+                inGroup := parent() == "Group"
+                value, err := text(&t)
+                if err != nil {
+                    return nil, err
+                }
+                switch {
+                case t.Name.Local == "Name" && inGroup:
+                    groups[len(groups)-1].name = value
+                case t.Name.Local == "UUID" && inGroup:
+                    groups[len(groups)-1].uuid = value
+                case t.Name.Local == "RecycleBinUUID":
+                    recycleBin = value
+                case t.Name.Local == "RecycleBinEnabled":
+                    recycleBinEnabled = strings.EqualFold(value, "True")
+                case t.Name.Local == "Key":
+                    key = value
+                }
+            case "Value":
+                inString := parent() == "String"
+                protected := false
+                for _, attr := range t.Attr {
+                    if attr.Name.Local == "Protected" && strings.EqualFold(attr.Value, "True") {
+                        protected = true
+                    }
+                }
+                value, err := text(&t)
+                if err != nil {
+                    return nil, err
+                }
+                if protected {
+                    raw, err := base64.StdEncoding.DecodeString(value)
+                    if err != nil {
+                        return nil, NewError(err)
+                    }
+                    stream.XORKeyStream(raw, raw)
+                    value = string(raw)
+                }
+                if current != nil && history == 0 && inString {
+                    current.strings[key] = value
+                }
+            }
+        case xml.EndElement:
+            path = path[:len(path)-1]
+            switch t.Name.Local {
+            case "Group":
+                groups = groups[:len(groups)-1]
+            case "History":
+                history--
+            case "Entry":
+                if history > 0 || current == nil {
+                    continue
+                }
+                recycled := false
+                var names []string
+                for i, g := range groups {
+                    if recycleBinEnabled && len(recycleBin) > 0 && g.uuid == recycleBin {
+                        recycled = true
+                    }
+                    if i > 0 {
+                        names = append(names, g.name)
+                    }
+                }
+                if !recycled {
+                    current.group = strings.Join(names, "/")
+                    entries = append(entries, *current)
+                }
+                current = nil
+            }
+        }
+    }
+    return entries, nil
+}
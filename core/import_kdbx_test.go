@@ -0,0 +1,201 @@
+package core
+
+import (
+    "bytes"
+    "encoding/binary"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "golang.org/x/crypto/argon2"
+    "io/ioutil"
+    "testing"
+)
+
+type ImportKDBXTestSuite struct {
+    suite.Suite
+}
+
+// The checkImported function checks the entries imported from the test databases and then deletes them.
+func checkImported(a *assert.Assertions, entries []*EntryView) {
+    byTitle := make(map[string]*EntryView)
+    for _, entry := range entries {
+        title, err := entry.ReadTitle()
+        a.NoError(err)
+        byTitle[title] = entry
+        defer DB.Unscoped().Delete(entry)
+    }
+    a.Len(entries, 3)
+    a.NotContains(byTitle, "Trash")
+
+    if entry, ok := byTitle["Example"]; a.True(ok) {
+        group, _ := entry.ReadGroup()
+        a.Equal("Internet", group)
+        username, _ := entry.ReadUsername()
+        a.Equal("alice", username)
+        password, _ := entry.ReadPassword()
+        a.Equal("s3cret", password)
+        url, _ := entry.ReadUrl()
+        a.Equal("https://example.com", url)
+        comment, _ := entry.ReadComment()
+        a.Equal("some notes", comment)
+        extras, err := entry.ReadExtras()
+        if a.NoError(err) {
+            a.Equal(map[string]interface{}{"PIN": "1234"}, extras)
+        }
+    }
+    if entry, ok := byTitle["Mail"]; a.True(ok) {
+        group, _ := entry.ReadGroup()
+        a.Equal("Internet/Mail", group)
+        password, _ := entry.ReadPassword()
+        a.Equal("mailpw", password)
+    }
+    if entry, ok := byTitle["Top"]; a.True(ok) {
+        group, _ := entry.ReadGroup()
+        a.Equal("", group)
+        password, _ := entry.ReadPassword()
+        a.Equal("toppw", password)
+    }
+}
+
+func (suite *ImportKDBXTestSuite) TestImport() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        for _, name := range []string{"testdata/kdbx3.kdbx", "testdata/kdbx4.kdbx"} {
+            data, err := ioutil.ReadFile(name)
+            if a.NoError(err) {
+                entries, err := ImportKDBX(bytes.NewReader(data), "test", u)
+                if a.NoError(err, name) {
+                    checkImported(a, entries)
+                }
+            }
+        }
+        u.Drop()
+    }
+}
+
+func (suite *ImportKDBXTestSuite) TestDryRun() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        data, err := ioutil.ReadFile("testdata/kdbx4.kdbx")
+        if a.NoError(err) {
+            var preview ImportReport
+            entries, err := ImportKDBX(bytes.NewReader(data), "test", u, ImportOptions{DryRun: true, Report: &preview})
+            a.NoError(err)
+            a.Nil(entries)
+            a.Equal(ImportReport{Total: 3, Valid: 3}, preview)
+            var count int
+            DB.Model(&EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+            a.Equal(0, count)
+
+            var report ImportReport
+            entries, err = ImportKDBX(bytes.NewReader(data), "test", u, ImportOptions{Report: &report})
+            if a.NoError(err) {
+                a.Equal(preview, report)
+                a.Len(entries, report.Valid)
+                checkImported(a, entries)
+            }
+        }
+        u.Drop()
+    }
+}
+
+func (suite *ImportKDBXTestSuite) TestWrongPassword() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        for _, name := range []string{"testdata/kdbx3.kdbx", "testdata/kdbx4.kdbx"} {
+            data, err := ioutil.ReadFile(name)
+            if a.NoError(err) {
+                entries, err := ImportKDBX(bytes.NewReader(data), "wrong", u)
+                a.Nil(entries)
+                if a.Error(err, name) {
+                    a.Equal(ErrAuthentication, err.(*Error).Code)
+                }
+            }
+        }
+
+        var count int
+        DB.Model(&EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+        a.Equal(0, count)
+        u.Drop()
+    }
+}
+
+func (suite *ImportKDBXTestSuite) TestInvalid() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        data, err := ioutil.ReadFile("testdata/kdbx4.kdbx")
+        if a.NoError(err) {
+            unsupported := append([]byte{}, data...)
+            unsupported[10] = 2
+            _, err = ImportKDBX(bytes.NewReader(unsupported), "test", u)
+            if a.Error(err) {
+                a.Contains(err.Error(), "Unsupported KDBX version")
+            }
+
+            for _, length := range []int{0, 8, 40, len(data) / 2, len(data) - 1} {
+                a.NotPanics(func() {
+                    _, err = ImportKDBX(bytes.NewReader(data[:length]), "test", u)
+                })
+                a.Error(err)
+            }
+        }
+        u.Drop()
+    }
+}
+
+func (suite *ImportKDBXTestSuite) TestKdfLimits() {
+    a := assert.New(suite.T())
+
+    le32 := func(v uint32) []byte {
+        b := make([]byte, 4)
+        binary.LittleEndian.PutUint32(b, v)
+        return b
+    }
+    le64 := func(v uint64) []byte {
+        b := make([]byte, 8)
+        binary.LittleEndian.PutUint64(b, v)
+        return b
+    }
+    argon := func(iterations uint64, memory uint64, parallelism uint32) *kdbxHeader {
+        return &kdbxHeader{major: 4, kdf: map[string][]byte{
+            "$UUID": kdbxKdfArgon2id,
+            "S":     make([]byte, 32),
+            "I":     le64(iterations),
+            "M":     le64(memory),
+            "P":     le32(parallelism),
+            "V":     le32(argon2.Version),
+        }}
+    }
+
+    for _, header := range []*kdbxHeader{
+        argon(0, 1<<16, 1),
+        argon(1<<40, 1<<16, 1),
+        argon(1, 1<<60, 1),
+        argon(1, 1<<16, 0),
+        argon(1, 1<<16, 256),
+        argon(1, 1<<16, 1<<31),
+        {major: 4, kdf: map[string][]byte{"$UUID": kdbxKdfAES, "S": make([]byte, 32), "R": le64(1 << 62)}},
+        {major: 3, transformSeed: make([]byte, 32), transformRounds: 1 << 62},
+    } {
+        _, err := header.transformKey("test")
+        if a.Error(err) {
+            a.IsType(&Error{}, err)
+            a.Contains(err.Error(), "out of range")
+        }
+    }
+
+    key, err := argon(1, 1<<16, 1).transformKey("test")
+    a.NoError(err)
+    a.Len(key, 32)
+}
+
+func TestImportKDBXTestSuite(t *testing.T) {
+    suite.Run(t, new(ImportKDBXTestSuite))
+}
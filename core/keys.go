@@ -5,6 +5,10 @@ import (
     "crypto/ecdsa"
     "crypto/elliptic"
     "crypto/sha512"
+    "encoding/asn1"
+    "encoding/base64"
+    "github.com/awm/passrep/utils"
+    "golang.org/x/crypto/argon2"
     "math/big"
 )
 
@@ -22,32 +26,128 @@ type SigningKey struct {
 
 // The Keys structure holds the private cryptographic and signing keys of a user.
 type Keys struct {
-    // The CryptoKey field is the private symmetric encryption key for the user's own data.
+    // The CryptoKey field is the private symmetric key derived from the user's password.  It wraps the user's data key,
+    // or for a legacy user without one, encrypts the user's own data directly.
     CryptoKey []byte
+    // The DataKey field is the user's random data encryption key, unwrapped with the CryptoKey, which encrypts the user's
+    // own data.  It is nil for a legacy user.
+    DataKey []byte
     // The SigningKey is the ECDSA private (and public) key used for signing entry and permission changes.
     SigningKey *ecdsa.PrivateKey
 }
 
-// PublicSigningKey provides access to the user's public ECDSA key.
+// Wipe overwrites the private keys in place, so that they do not linger in memory once the session ends.  The keys are
+// unusable afterwards.
+func (this *Keys) Wipe() {
+    utils.SecureZero(this.CryptoKey)
+    utils.SecureZero(this.DataKey)
+    if this.SigningKey != nil && this.SigningKey.D != nil {
+        words := this.SigningKey.D.Bits()
+        for i := range words {
+            words[i] = 0
+        }
+        this.SigningKey.D.SetInt64(0)
+    }
+}
+
+// The dataKey function provides the key which encrypts the user's own data, which is the CryptoKey for a legacy user
+// without a data key.
+func (this *Keys) dataKey() []byte {
+    if this.DataKey != nil {
+        return this.DataKey
+    }
+    return this.CryptoKey
+}
+
+// The unwrapDataKey function decrypts the user's wrapped data key with the CryptoKey, leaving the DataKey nil for a
+// legacy user who has none.
+func (this *Keys) unwrapDataKey(user *User) error {
+    if len(user.WrappedDataKey) == 0 {
+        return nil
+    }
+    dataKey, err := openWithKey(this.CryptoKey, user.WrappedDataKey)
+    if err != nil {
+        if e, ok := err.(*Error); ok {
+            return e.SetUser(user)
+        }
+        return err
+    }
+    this.DataKey = dataKey
+    return nil
+}
+
+// PublicSigningKey provides a copy of the user's public ECDSA key, which the caller may modify freely.
 func (this *Keys) PublicSigningKey() *ecdsa.PublicKey {
-    return &this.SigningKey.PublicKey
+    return &ecdsa.PublicKey{
+        Curve: this.SigningKey.PublicKey.Curve,
+        X:     new(big.Int).Set(this.SigningKey.PublicKey.X),
+        Y:     new(big.Int).Set(this.SigningKey.PublicKey.Y),
+    }
 }
 
-// PublicSigningKey provides access to the user's public ECDSA key.
+// PublicSigningKeyNoCurve provides a copy of the user's public ECDSA key without the curve info.
 func (this *Keys) PublicSigningKeyNoCurve() *SigningKey {
-    return &SigningKey{this.SigningKey.PublicKey.X, this.SigningKey.PublicKey.Y}
+    return &SigningKey{new(big.Int).Set(this.SigningKey.PublicKey.X), new(big.Int).Set(this.SigningKey.PublicKey.Y)}
+}
+
+// EncodedPublicKey produces the base64 encoded form of the public signing key, as stored in a user's PublicKey field.
+func (this *Keys) EncodedPublicKey() (string, error) {
+    raw, err := asn1.Marshal(*this.PublicSigningKeyNoCurve())
+    if err != nil {
+        return "", NewError(err)
+    }
+    return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+const (
+    // KdfPbkdf2 selects PBKDF2 with SHA-512 for deriving keys from a password.  It is the default.
+    KdfPbkdf2 = "pbkdf2"
+    // KdfArgon2id selects the memory-hard Argon2id function for deriving keys from a password.
+    KdfArgon2id = "argon2id"
+)
+
+// The KdfParams structure holds the cost parameters of the key derivation function.  Only the parameters relevant to the
+// chosen function are used.
+type KdfParams struct {
+    // Iterations is the number of PBKDF2 iterations.
+    Iterations int
+    // Time is the number of passes Argon2id makes over its memory.
+    Time uint32
+    // Memory is the amount of memory used by Argon2id, in KiB.
+    Memory uint32
+    // Parallelism is the number of threads used by Argon2id.
+    Parallelism uint8
+}
+
+// The deriveKey function derives a key of the given length from the password and salt using the user's key derivation
+// function and parameters.
+func deriveKey(user *User, password []byte, salt []byte, length int) ([]byte, error) {
+    switch user.KdfAlgorithm {
+    case "", KdfPbkdf2:
+        return pbkdf2.Key(password, salt, user.kdfIterations(), length, sha512.New), nil
+    case KdfArgon2id:
+        if user.KdfTime == 0 || user.KdfMemory == 0 || user.KdfParallelism == 0 {
+            return nil, NewError("Invalid Argon2id parameters", user)
+        }
+        return argon2.IDKey(password, salt, user.KdfTime, user.KdfMemory, user.KdfParallelism, uint32(length)), nil
+    }
+    return nil, NewError("Unknown key derivation function '"+user.KdfAlgorithm+"'", user)
 }
 
 // MakeKeys takes the password salts from the user as well as the user's password, and generates the corresponding set of private keys.
 func MakeKeys(user *User, password string) (*Keys, error) {
     pwbytes := []byte(password)
+    defer utils.SecureZero(pwbytes)
     keys := new(Keys)
 
     salt, err := user.GetCryptoSalt()
     if err != nil {
         return nil, NewError(err, user)
     }
-    keys.CryptoKey = pbkdf2.Key(pwbytes, salt, 100000, 32, sha512.New)
+    keys.CryptoKey, err = deriveKey(user, pwbytes, salt, 32)
+    if err != nil {
+        return nil, err
+    }
 
     curve := elliptic.P521()
     params := curve.Params()
@@ -56,8 +156,12 @@ func MakeKeys(user *User, password string) (*Keys, error) {
     if err != nil {
         return nil, NewError(err, user)
     }
-    raw := pbkdf2.Key(pwbytes, salt, 100000, params.BitSize/8+8, sha512.New)
+    raw, err := deriveKey(user, pwbytes, salt, params.BitSize/8+8)
+    if err != nil {
+        return nil, err
+    }
     k := new(big.Int).SetBytes(raw)
+    utils.SecureZero(raw)
     n := new(big.Int).Sub(params.N, one)
     k.Mod(k, n)
     k.Add(k, one)
@@ -69,3 +173,111 @@ func MakeKeys(user *User, password string) (*Keys, error) {
 
     return keys, nil
 }
+
+const (
+    // SealedKeysVersion is the format version of the blobs produced by Keys.Seal.
+    SealedKeysVersion = 1
+    // SealIterations is the number of PBKDF2 iterations used to derive the wrapping key of sealed keys from the
+    // passphrase.  It is deliberately low, since sealing exists to avoid the cost of the password key derivation, so the
+    // passphrase should be a random secret, such as one kept in the operating system's keychain, rather than a password.
+    SealIterations = 10000
+)
+
+// The sealSaltSize is the length of the random salt in the header of sealed keys, which follows the version byte.
+const sealSaltSize = 16
+
+// The sealedKeys structure is the encoded form of the keys held within a sealed blob.
+type sealedKeys struct {
+    CryptoKey  []byte
+    DataKey    []byte
+    SigningKey []byte
+}
+
+// The sealingKey function derives the key which wraps sealed keys from the passphrase and salt.
+func sealingKey(passphrase string, salt []byte) []byte {
+    pwbytes := []byte(passphrase)
+    defer utils.SecureZero(pwbytes)
+    return pbkdf2.Key(pwbytes, salt, SealIterations, 32, sha512.New)
+}
+
+// Seal encrypts the keys under a passphrase, so that an application can cache them at rest and restore them with
+// UnsealKeys rather than deriving them from the user's password again.  The blob holds a format version byte and a random
+// salt, followed by the keys encrypted with AES-GCM, which also authenticates the version and salt.
+func (this *Keys) Seal(passphrase string) ([]byte, error) {
+    if len(passphrase) == 0 {
+        return nil, NewError("No passphrase given")
+    }
+    if this.SigningKey == nil || this.SigningKey.D == nil {
+        return nil, NewError("Signing key unavailable", ErrCrypto)
+    }
+
+    salt := utils.RandomBytes(sealSaltSize)
+    if salt == nil {
+        return nil, NewError("RNG failure!")
+    }
+    header := append([]byte{SealedKeysVersion}, salt...)
+
+    signing := this.SigningKey.D.Bytes()
+    defer utils.SecureZero(signing)
+    plain, err := asn1.Marshal(sealedKeys{this.CryptoKey, this.DataKey, signing})
+    if err != nil {
+        return nil, NewError(err)
+    }
+    defer utils.SecureZero(plain)
+
+    key := sealingKey(passphrase, salt)
+    defer utils.SecureZero(key)
+    gcm, e := newGCM(key)
+    if e != nil {
+        return nil, e
+    }
+    nonce := utils.RandomBytes(gcm.NonceSize())
+    if nonce == nil {
+        return nil, NewError("Nonce generation failed", ErrEncryption)
+    }
+    sealed := gcm.Seal(nil, nonce, plain, header)
+    return append(append(header, nonce...), sealed...), nil
+}
+
+// UnsealKeys decrypts keys sealed by Keys.Seal.  A wrong passphrase, or a blob which has been altered, fails with
+// ErrAuthentication.  The restored keys may be used to resume a session with User.StartSessionWithKeys.
+func UnsealKeys(blob []byte, passphrase string) (*Keys, error) {
+    if len(blob) == 0 || blob[0] != SealedKeysVersion {
+        return nil, NewError("Unsupported sealed keys format", ErrDecryption)
+    }
+    if len(blob) < 1+sealSaltSize {
+        return nil, NewError("Data too short", ErrDecryption)
+    }
+    header, rest := blob[:1+sealSaltSize], blob[1+sealSaltSize:]
+
+    key := sealingKey(passphrase, header[1:])
+    defer utils.SecureZero(key)
+    gcm, e := newGCM(key)
+    if e != nil {
+        return nil, e
+    }
+    nonceLen := gcm.NonceSize()
+    if len(rest) < nonceLen+gcm.Overhead() {
+        return nil, NewError("Data too short", ErrDecryption)
+    }
+    plain, err := gcm.Open(nil, rest[:nonceLen], rest[nonceLen:], header)
+    if err != nil {
+        return nil, NewError("Incorrect passphrase or corrupted keys", ErrAuthentication)
+    }
+    defer utils.SecureZero(plain)
+
+    var decoded sealedKeys
+    if _, err := asn1.Unmarshal(plain, &decoded); err != nil {
+        return nil, NewError(err, ErrDecryption)
+    }
+    defer utils.SecureZero(decoded.SigningKey)
+    signing, err := unmarshalPrivateKey(decoded.SigningKey)
+    if err != nil {
+        return nil, err
+    }
+    keys := &Keys{CryptoKey: decoded.CryptoKey, SigningKey: signing}
+    if len(decoded.DataKey) > 0 {
+        keys.DataKey = decoded.DataKey
+    }
+    return keys, nil
+}
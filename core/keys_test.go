@@ -1,7 +1,9 @@
 package core
 
 import (
+    "bytes"
     "crypto/elliptic"
+    "errors"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/suite"
     "math/big"
@@ -48,6 +50,154 @@ func (suite *KeysTestSuite) TestCreation() {
     a.Exactly(k.SigningKey.D, signingKey, "Signing key does not match")
 }
 
+func (suite *KeysTestSuite) TestDefensiveCopies() {
+    a := assert.New(suite.T())
+
+    u := User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(&u, "password")
+    if a.NoError(err) {
+        u.keys = k
+        original := append([]byte(nil), k.CryptoKey...)
+
+        key := u.getEncryptionKey()
+        for i := range key {
+            key[i] = 0
+        }
+        a.Equal(original, k.CryptoKey, "Cryptographic key altered through returned slice")
+
+        x := new(big.Int).Set(k.SigningKey.PublicKey.X)
+        k.PublicSigningKeyNoCurve().X.SetInt64(0)
+        k.PublicSigningKey().X.SetInt64(0)
+        a.Equal(x, k.SigningKey.PublicKey.X, "Public key altered through returned copy")
+    }
+}
+
+func (suite *KeysTestSuite) TestWipe() {
+    a := assert.New(suite.T())
+
+    u := User{Name: "test.user", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    k, err := MakeKeys(&u, "password")
+    if a.NoError(err) {
+        key := k.CryptoKey
+        words := k.SigningKey.D.Bits()
+        a.NotEqual(make([]byte, len(key)), key)
+
+        k.Wipe()
+        a.Equal(make([]byte, len(key)), key, "Cryptographic key not zeroed")
+        a.Equal(0, k.SigningKey.D.Sign(), "Signing key not zeroed")
+        for _, w := range words {
+            a.Zero(w, "Signing key storage not zeroed")
+        }
+
+        u.keys = k
+        u.EndSession()
+        a.Nil(u.keys)
+    }
+}
+
+func (suite *KeysTestSuite) TestArgon2id() {
+    a := assert.New(suite.T())
+
+    params := KdfParams{Time: 1, Memory: 8 * 1024, Parallelism: 1}
+    u, err := NewUserWithKdf("test.user", "password", KdfArgon2id, params)
+    if a.NoError(err) {
+        a.Equal(KdfArgon2id, u.KdfAlgorithm)
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(params.Time, loaded.KdfTime)
+            a.Equal(params.Memory, loaded.KdfMemory)
+            a.Equal(params.Parallelism, loaded.KdfParallelism)
+            a.NoError(loaded.StartSession("password"))
+            a.Error(loaded.StartSession("wrong"))
+
+            var pbkdf User
+            pbkdf.copyFields(loaded)
+            pbkdf.KdfAlgorithm = KdfPbkdf2
+            a.False(pbkdf.VerifyPassword("password"))
+        }
+        a.Error(u.RekeyKdf("password", 250000))
+
+        u.Drop()
+    }
+
+    _, err = NewUserWithKdf("test.user", "password", KdfArgon2id, KdfParams{})
+    a.Error(err)
+    _, err = NewUserWithKdf("test.user", "password", "scrypt", params)
+    a.Error(err)
+}
+
+func (suite *KeysTestSuite) TestSeal() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        encrypted, err := u.Encrypt([]byte("data"))
+        a.NoError(err)
+
+        blob, err := u.keys.Seal("cache secret")
+        if a.NoError(err) {
+            a.Equal(byte(SealedKeysVersion), blob[0])
+            a.False(bytes.Contains(blob, u.keys.CryptoKey))
+
+            _, err = UnsealKeys(blob, "wrong secret")
+            a.True(errors.Is(err, ErrAuthentication))
+            tampered := append([]byte(nil), blob...)
+            tampered[len(tampered)-1] ^= 1
+            _, err = UnsealKeys(tampered, "cache secret")
+            a.True(errors.Is(err, ErrAuthentication))
+            tampered = append([]byte(nil), blob...)
+            tampered[0] = SealedKeysVersion + 1
+            _, err = UnsealKeys(tampered, "cache secret")
+            a.Error(err)
+            _, err = UnsealKeys(blob[:10], "cache secret")
+            a.Error(err)
+
+            keys, err := UnsealKeys(blob, "cache secret")
+            if a.NoError(err) {
+                a.Equal(u.keys.CryptoKey, keys.CryptoKey)
+                a.Equal(u.keys.DataKey, keys.DataKey)
+                a.Equal(0, u.keys.SigningKey.D.Cmp(keys.SigningKey.D))
+
+                loaded, err := LoadUser("test.user")
+                if a.NoError(err) && a.NoError(loaded.StartSessionWithKeys(keys)) {
+                    data, err := loaded.Decrypt(encrypted)
+                    a.NoError(err)
+                    a.Equal([]byte("data"), data)
+                    a.True(loaded.CanSign())
+                }
+            }
+        }
+        _, err = u.keys.Seal("")
+        a.Error(err)
+
+        // keys derived from the password alone have their data key unwrapped on resuming
+        derived, err := MakeKeys(u, "password")
+        if a.NoError(err) {
+            blob, err := derived.Seal("cache secret")
+            if a.NoError(err) {
+                keys, err := UnsealKeys(blob, "cache secret")
+                if a.NoError(err) {
+                    a.Nil(keys.DataKey)
+                    loaded, err := LoadUser("test.user")
+                    if a.NoError(err) && a.NoError(loaded.StartSessionWithKeys(keys)) {
+                        data, err := loaded.Decrypt(encrypted)
+                        a.NoError(err)
+                        a.Equal([]byte("data"), data)
+                    }
+                }
+            }
+        }
+
+        other, err := NewUser("other.user", "password")
+        if a.NoError(err) {
+            a.True(errors.Is(other.StartSessionWithKeys(u.keys), ErrAuthentication))
+            other.Drop()
+        }
+        u.Drop()
+    }
+}
+
 func TestKeysTestSuite(t *testing.T) {
     suite.Run(t, new(KeysTestSuite))
 }
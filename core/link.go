@@ -0,0 +1,175 @@
+package core
+
+import (
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/json"
+    "github.com/awm/passrep/utils"
+    "time"
+)
+
+// The PlainEntry structure holds the decrypted contents of an entry.
+type PlainEntry struct {
+    // The EntryId string is the unique identifier for the password entry.
+    EntryId string
+    // The Group is the name of the group to which the entry belongs.
+    Group string
+    // The Icon is the image data or path to image file of the entry.
+    Icon string
+    // The Title is the title of the entry.
+    Title string
+    // The Username is the username stored in the entry.
+    Username string
+    // The Password is the password stored in the entry.
+    Password string
+    // The Url is the url stored in the entry.
+    Url string
+    // The Comment is the comment stored in the entry.
+    Comment string
+}
+
+// The SharedLink structure stores a copy of an entry encrypted under the wrapping key carried by a read-only link token.
+type SharedLink struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the link was created.
+    CreatedAt time.Time
+    // UpdatedAt is the time when the link was last updated.
+    UpdatedAt time.Time
+
+    // The Reference is the random identifier of the link embedded in its token.
+    Reference string `sql:"not null;unique"`
+    // UserId is the foreign key of the user who created the link.
+    UserId int64
+    // The Data field is the JSON encoded PlainEntry encrypted under the link's wrapping key.
+    Data string
+    // ExpiresAt is the time after which the link may no longer be redeemed.
+    ExpiresAt time.Time
+}
+
+// The linkToken structure is the signed content of a read-only link token.
+type linkToken struct {
+    Reference string
+    Key       []byte
+    Expires   time.Time
+    Signer    string
+}
+
+// The plain function decrypts every field of the entry which the user is permitted to read.
+func (this *EntryView) plain() *PlainEntry {
+    result := &PlainEntry{EntryId: this.EntryId}
+    targets := map[string]*string{
+        "group":    &result.Group,
+        "icon":     &result.Icon,
+        "title":    &result.Title,
+        "username": &result.Username,
+        "password": &result.Password,
+        "url":      &result.Url,
+        "comment":  &result.Comment,
+    }
+    for _, f := range entryFields {
+        if len(*f.value(this)) == 0 {
+            continue
+        }
+        value, err := this.ReadField(f.name)
+        if err == nil {
+            *targets[f.name] = value
+        }
+    }
+    return result
+}
+
+// ReadOnlyLink produces a signed token granting read-only access to a snapshot of the entry until the duration elapses.
+// The token does not contain the entry itself, only a reference to an encrypted copy and the key needed to unwrap it, so
+// anyone holding the token can read the entry until it expires.  The user must have read permission and an active session.
+func (this *EntryView) ReadOnlyLink(d time.Duration) (string, error) {
+    user := this.getUser()
+    if !user.Can("r", this) {
+        return "", NewError("Link read permission denied", user, ErrPermission)
+    }
+
+    bytes, err := json.Marshal(this.plain())
+    if err != nil {
+        return "", NewError(err, user)
+    }
+
+    key := utils.RandomBytes(32)
+    reference := utils.RandomBytes(16)
+    if key == nil || reference == nil {
+        return "", NewError("RNG failure!", user)
+    }
+    data, err := sealWithKey(key, bytes)
+    if err != nil {
+        return "", NewError(err, user)
+    }
+
+    token := linkToken{
+        Reference: base64.URLEncoding.EncodeToString(reference),
+        Key:       key,
+        Expires:   time.Now().UTC().Add(d),
+        Signer:    user.Name,
+    }
+    raw, err := json.Marshal(token)
+    if err != nil {
+        return "", NewError(err, user)
+    }
+    signed, err := user.Sign(raw)
+    if err != nil {
+        return "", err
+    }
+
+    link := SharedLink{Reference: token.Reference, UserId: user.Id, Data: data, ExpiresAt: token.Expires}
+    if err := DB.Create(&link).Error; err != nil {
+        return "", NewError(err, user)
+    }
+    return signed, nil
+}
+
+// RedeemReadOnlyLink checks the signature and expiry of a token produced by ReadOnlyLink, and returns the entry it refers to.
+func RedeemReadOnlyLink(token string) (*PlainEntry, error) {
+    raw, err := base64.StdEncoding.DecodeString(token)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    var sig Signature
+    unverified, err := asn1.Unmarshal(raw, &sig)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    var claimed linkToken
+    if err := json.Unmarshal(unverified, &claimed); err != nil {
+        return nil, NewError("Malformed link token")
+    }
+
+    signer, err := Resolver.ByName(claimed.Signer)
+    if err != nil {
+        return nil, NewError("Link signer not found", ErrNotFound)
+    }
+    ok, content, err := signer.Verify(token)
+    if err != nil || !ok {
+        return nil, NewError("Link signature invalid")
+    }
+    var verified linkToken
+    if err := json.Unmarshal(content, &verified); err != nil {
+        return nil, NewError("Malformed link token")
+    }
+    if time.Now().UTC().After(verified.Expires) {
+        DB.Where(&SharedLink{Reference: verified.Reference}).Delete(SharedLink{})
+        return nil, NewError("Link expired")
+    }
+
+    link := new(SharedLink)
+    if DB.Where(&SharedLink{Reference: verified.Reference}).First(link).RecordNotFound() {
+        return nil, NewError("Link not found", ErrNotFound)
+    }
+    data, err := openWithKey(verified.Key, link.Data)
+    if err != nil {
+        return nil, NewError("Link key invalid")
+    }
+
+    entry := new(PlainEntry)
+    if err := json.Unmarshal(data, entry); err != nil {
+        return nil, NewError(err)
+    }
+    return entry, nil
+}
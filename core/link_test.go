@@ -0,0 +1,56 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type LinkTestSuite struct {
+    suite.Suite
+}
+
+func (suite *LinkTestSuite) TestRedeem() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry := newTestEntry(a, u, "linked")
+        a.NoError(entry.WriteTitle("Linked"))
+        a.NoError(entry.WritePassword("secret"))
+
+        token, err := entry.ReadOnlyLink(time.Hour)
+        if a.NoError(err) {
+            a.NotContains(token, "secret")
+            plain, err := RedeemReadOnlyLink(token)
+            if a.NoError(err) {
+                a.Equal("linked", plain.EntryId)
+                a.Equal("Linked", plain.Title)
+                a.Equal("secret", plain.Password)
+            }
+
+            tampered := []byte(token)
+            i := len(tampered) / 2
+            if tampered[i] == 'A' {
+                tampered[i] = 'B'
+            } else {
+                tampered[i] = 'A'
+            }
+            _, err = RedeemReadOnlyLink(string(tampered))
+            a.Error(err)
+        }
+
+        token, err = entry.ReadOnlyLink(-time.Second)
+        if a.NoError(err) {
+            _, err = RedeemReadOnlyLink(token)
+            a.Error(err)
+        }
+
+        u.Drop()
+    }
+}
+
+func TestLinkTestSuite(t *testing.T) {
+    suite.Run(t, new(LinkTestSuite))
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+    "encoding/base64"
+)
+
+// The SharePayload structure carries data sealed by one user for another, in a form which can be marshalled to JSON for
+// transport.
+type SharePayload struct {
+    // The Ciphertext is the base64 encoded data, encrypted under the secret shared between the two users.
+    Ciphertext string `json:"ciphertext"`
+    // The Signature is the sender's detached, base64 encoded signature over the Ciphertext.
+    Signature string `json:"signature"`
+}
+
+// Seal encrypts the data for the recipient under the secret shared between the two users, and signs the result so that
+// the recipient can confirm who sent it.  The user must have an active session.
+func (this *User) Seal(data []byte, to *User) (*SharePayload, error) {
+    ciphertext, _, err := this.EncryptShared(data, nil, to)
+    if err != nil {
+        return nil, err
+    }
+
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    if this.keys == nil || this.keys.SigningKey == nil {
+        return nil, NewError("Private key unavailable", this, ErrCrypto)
+    }
+    raw, err := signData(this.keys.SigningKey, []byte(ciphertext))
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    return &SharePayload{Ciphertext: ciphertext, Signature: base64.StdEncoding.EncodeToString(raw)}, nil
+}
+
+// Unseal checks that the payload was signed by the sender and has not been altered, then decrypts it under the secret
+// shared between the two users.  The user must have an active session.
+func (this *User) Unseal(p *SharePayload, from *User) ([]byte, error) {
+    key, err := base64.StdEncoding.DecodeString(from.PublicKey)
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    ok, err := Verify([]byte(p.Ciphertext), p.Signature, key)
+    if err != nil || !ok {
+        return nil, NewError("Payload signature invalid", this, ErrDecryption)
+    }
+
+    data, _, err := this.DecryptShared(p.Ciphertext, "", from)
+    if err != nil {
+        return nil, err
+    }
+    return data, nil
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type PayloadTestSuite struct {
+    suite.Suite
+}
+
+func (suite *PayloadTestSuite) TestSeal() {
+    a := assert.New(suite.T())
+
+    alice, err := NewUser("alice", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer alice.Drop()
+    bob, err := NewUser("bob", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer bob.Drop()
+    eve, err := NewUser("eve", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer eve.Drop()
+
+    ours, err := alice.makeSharedSecret(bob)
+    a.NoError(err)
+    theirs, err := bob.makeSharedSecret(alice)
+    a.NoError(err)
+    a.Equal(ours, theirs)
+
+    payload, err := alice.Seal([]byte("a recognizable secret value"), bob)
+    if a.NoError(err) {
+        encoded, err := json.Marshal(payload)
+        a.NoError(err)
+        a.NotContains(string(encoded), "recognizable")
+
+        var received SharePayload
+        if a.NoError(json.Unmarshal(encoded, &received)) {
+            data, err := bob.Unseal(&received, alice)
+            a.NoError(err)
+            a.Equal([]byte("a recognizable secret value"), data)
+        }
+
+        _, err = eve.Unseal(payload, alice)
+        a.Error(err)
+        _, err = bob.Unseal(payload, eve)
+        a.True(errors.Is(err, ErrDecryption))
+    }
+}
+
+func (suite *PayloadTestSuite) TestTamper() {
+    a := assert.New(suite.T())
+
+    alice, err := NewUser("alice", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer alice.Drop()
+    bob, err := NewUser("bob", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer bob.Drop()
+
+    payload, err := alice.Seal([]byte("a recognizable secret value"), bob)
+    if a.NoError(err) {
+        raw, err := base64.StdEncoding.DecodeString(payload.Ciphertext)
+        if a.NoError(err) {
+            raw[len(raw)-1] ^= 1
+            tampered := &SharePayload{Ciphertext: base64.StdEncoding.EncodeToString(raw), Signature: payload.Signature}
+            _, err = bob.Unseal(tampered, alice)
+            a.True(errors.Is(err, ErrDecryption))
+
+            // even when signed by the sender, altered ciphertext fails authentication
+            sig, err := signData(alice.keys.SigningKey, []byte(tampered.Ciphertext))
+            if a.NoError(err) {
+                tampered.Signature = base64.StdEncoding.EncodeToString(sig)
+                _, err = bob.Unseal(tampered, alice)
+                a.True(errors.Is(err, ErrDecryption))
+            }
+        }
+    }
+}
+
+func TestPayloadTestSuite(t *testing.T) {
+    suite.Run(t, new(PayloadTestSuite))
+}
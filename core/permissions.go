@@ -0,0 +1,391 @@
+package core
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "github.com/awm/passrep/utils"
+    "github.com/jinzhu/gorm"
+    "time"
+)
+
+// The PermSet structure holds a set of permissions in structured form.
+type PermSet struct {
+    // Read permits reading the entry's fields.
+    Read bool
+    // Write permits changing the entry's fields.
+    Write bool
+    // Delete permits deleting the entry, and delegating permissions on it to other users.
+    Delete bool
+}
+
+// ParsePermissions converts a permissions string into a PermSet.  Each character must be one of ValidPermissions, and a
+// character may be repeated without effect.  The empty string produces an empty set.
+func ParsePermissions(s string) (PermSet, error) {
+    var set PermSet
+    for _, p := range s {
+        switch p {
+        case 'r':
+            set.Read = true
+        case 'w':
+            set.Write = true
+        case 'd':
+            set.Delete = true
+        default:
+            return PermSet{}, NewError("Invalid permission '" + string(p) + "'")
+        }
+    }
+    return set, nil
+}
+
+// String produces the canonical permissions string for the set, holding each permission once, in the order of
+// ValidPermissions.
+func (this PermSet) String() string {
+    s := ""
+    if this.Read {
+        s += "r"
+    }
+    if this.Write {
+        s += "w"
+    }
+    if this.Delete {
+        s += "d"
+    }
+    return s
+}
+
+// Empty reports whether the set holds no permissions.
+func (this PermSet) Empty() bool {
+    return !this.Read && !this.Write && !this.Delete
+}
+
+// Intersects reports whether the two sets hold any permission in common.
+func (this PermSet) Intersects(other PermSet) bool {
+    return (this.Read && other.Read) || (this.Write && other.Write) || (this.Delete && other.Delete)
+}
+
+// The Grant structure is a standalone, signed record of permissions given by one user to another on an entry.  Unlike
+// the permissions of a view, a grant names the users involved, so it can be checked by anyone holding the grantor's
+// public key without access to either user's view of the entry.
+type Grant struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the grant was created.
+    CreatedAt time.Time
+    // UpdatedAt is the time when the grant was last updated.
+    UpdatedAt time.Time
+
+    // The EntryId string is the unique identifier for the password entry the grant applies to.
+    EntryId string
+    // The Grantor is the name of the user giving the permissions.
+    Grantor string
+    // The Grantee is the name of the user receiving the permissions.
+    Grantee string
+    // The Permissions are the permission characters granted.
+    Permissions string
+    // The Signature is the grantor's detached signature over the other fields of the grant.
+    Signature string
+}
+
+// The grantContent structure is the signed content of a grant.
+type grantContent struct {
+    EntryId     string
+    Grantor     string
+    Grantee     string
+    Permissions string
+}
+
+// The content function produces the canonical encoding of the signed fields of the grant.
+func (this *Grant) content() ([]byte, error) {
+    return json.Marshal(grantContent{this.EntryId, this.Grantor, this.Grantee, this.Permissions})
+}
+
+// NewGrant produces a grant of the permissions on the entry from the grantor, who must have an active session, to the
+// grantee.  The grant is not stored; see SaveGrant.
+func NewGrant(grantor *User, grantee *User, entryId string, permissions string) (*Grant, error) {
+    if _, err := ParsePermissions(permissions); err != nil {
+        return nil, NewError(err, grantor)
+    }
+
+    grant := &Grant{EntryId: entryId, Grantor: grantor.Name, Grantee: grantee.Name, Permissions: permissions}
+    if err := grant.sign(grantor); err != nil {
+        return nil, err
+    }
+    return grant, nil
+}
+
+// The sign function replaces the signature of the grant with one made by the grantor, who must have an active session.
+func (this *Grant) sign(grantor *User) error {
+    data, err := this.content()
+    if err != nil {
+        return NewError(err, grantor)
+    }
+
+    grantor.keysLock.RLock()
+    defer grantor.keysLock.RUnlock()
+    if grantor.keys == nil || grantor.keys.SigningKey == nil {
+        return NewError("Private key unavailable", grantor, ErrCrypto)
+    }
+    key := grantor.keys.SigningKey.D.Bytes()
+    defer utils.SecureZero(key)
+    this.Signature, err = Sign(data, key)
+    return err
+}
+
+// GetUserPubkey provides the decoded public key of the named user, or nil if the user cannot be found.
+func GetUserPubkey(name string) []byte {
+    user, err := Resolver.ByName(name)
+    if err != nil {
+        return nil
+    }
+    key, err := base64.StdEncoding.DecodeString(user.PublicKey)
+    if err != nil {
+        return nil
+    }
+    return key
+}
+
+// Verify checks that the grant was signed by its grantor and has not been altered since.
+func (this *Grant) Verify() (bool, error) {
+    key := GetUserPubkey(this.Grantor)
+    if key == nil {
+        return false, NewError("Grantor '"+this.Grantor+"' not found", ErrNotFound)
+    }
+
+    data, err := this.content()
+    if err != nil {
+        return false, NewError(err)
+    }
+    return Verify(data, this.Signature, key)
+}
+
+// SaveGrant stores the grant in the database, creating it if it has not been stored yet and updating it otherwise.
+func SaveGrant(grant *Grant) error {
+    if len(grant.Signature) == 0 {
+        return NewError("Grant is not signed", grant.Grantor)
+    }
+
+    if grant.Id == 0 {
+        if err := DB.Create(grant).Error; err != nil {
+            return NewError(err, grant.Grantor)
+        }
+    } else {
+        if err := DB.Save(grant).Error; err != nil {
+            return NewError(err, grant.Grantor)
+        }
+    }
+    return nil
+}
+
+// The storeGrant function stores the grant through the given transaction in place of the latest grant between the same
+// users on the same entry, or as a new grant if there is none, so that each pair of users holds a single current grant.
+func storeGrant(tx *gorm.DB, grant *Grant) error {
+    if len(grant.Signature) == 0 {
+        return NewError("Grant is not signed", grant.Grantor)
+    }
+
+    var previous Grant
+    query := tx.Where(&Grant{EntryId: grant.EntryId, Grantor: grant.Grantor, Grantee: grant.Grantee}).Order("id desc")
+    if !query.First(&previous).RecordNotFound() {
+        grant.Id = previous.Id
+        grant.CreatedAt = previous.CreatedAt
+        if err := tx.Save(grant).Error; err != nil {
+            return NewError(err, grant.Grantor)
+        }
+        return nil
+    }
+    if err := tx.Create(grant).Error; err != nil {
+        return NewError(err, grant.Grantor)
+    }
+    return nil
+}
+
+// GrantsFor lists the stored grants which apply to the entry, in the order they were created.  The grants are not
+// verified.
+func GrantsFor(entryId string) ([]*Grant, error) {
+    var grants []*Grant
+    if err := DB.Where(&Grant{EntryId: entryId}).Order("id").Find(&grants).Error; err != nil {
+        return nil, NewError(err)
+    }
+    return grants, nil
+}
+
+// The AccessDiscrepancy type names a way in which the grants on an entry and the permissions of its views disagree.
+type AccessDiscrepancy string
+
+const (
+    // InvalidGrant is reported for a stored grant whose signature does not verify.  The grant is otherwise ignored.
+    InvalidGrant AccessDiscrepancy = "invalid grant"
+    // InvalidView is reported for a view whose permissions or row signature do not verify against its authority.
+    InvalidView AccessDiscrepancy = "invalid view"
+    // MissingView is reported for a user holding a grant on the entry but no view of it.
+    MissingView AccessDiscrepancy = "missing view"
+    // MissingGrant is reported for a view holding permissions given by another user, for which no grant exists.
+    MissingGrant AccessDiscrepancy = "missing grant"
+    // PermissionMismatch is reported for a view whose permissions, or the user who gave them, differ from the latest
+    // grant to its user.
+    PermissionMismatch AccessDiscrepancy = "permission mismatch"
+)
+
+// The AccessIssue structure describes a single discrepancy found by ReconcileAccess.
+type AccessIssue struct {
+    // The Kind is the type of discrepancy found.
+    Kind AccessDiscrepancy
+    // The User is the name of the user whose access is affected.
+    User string
+    // The Grant is the latest verified grant to the user, or for InvalidGrant the grant which failed to verify.  It is
+    // nil where there is no such grant.
+    Grant *Grant
+    // The View is the user's view of the entry, or nil where there is none.
+    View *EntryView
+    // Held is the canonical form of the permissions the view holds, where they could be verified.
+    Held string
+    // Fixed reports whether RepairAccess has corrected the view.
+    Fixed bool
+}
+
+// The ReconcileReport structure lists the discrepancies between the grants on an entry and the permissions of its
+// views.
+type ReconcileReport struct {
+    // The EntryId string is the unique identifier for the password entry which was checked.
+    EntryId string
+    // The Issues are the discrepancies found, in the order of the views and then the grants concerned.
+    Issues []AccessIssue
+}
+
+// Consistent reports whether every discrepancy in the report has been fixed, which is trivially so when none were
+// found.
+func (this *ReconcileReport) Consistent() bool {
+    for _, issue := range this.Issues {
+        if !issue.Fixed {
+            return false
+        }
+    }
+    return true
+}
+
+// ReconcileAccess compares the stored grants on the entry with the permissions held by each view of it, and reports
+// where they disagree.  The latest verified grant to a user is taken as the record of their access, and is expected to
+// match both the permissions of the user's view and the authority who signed them.  A view whose permissions were given
+// by its own user, as for the entry's creator, needs no grant.  Nothing is changed; see RepairAccess.
+func ReconcileAccess(entryId string) (ReconcileReport, error) {
+    report := ReconcileReport{EntryId: entryId}
+    grants, err := GrantsFor(entryId)
+    if err != nil {
+        return report, err
+    }
+    // views whose row signatures fail are reported below rather than refused
+    views, err := findViews(entryId)
+    if err != nil {
+        return report, err
+    }
+
+    latest := make(map[string]*Grant)
+    var grantees []string
+    for _, grant := range grants {
+        ok, err := grant.Verify()
+        if err == nil && ok {
+            _, err = ParsePermissions(grant.Permissions)
+        }
+        if err != nil || !ok {
+            report.Issues = append(report.Issues, AccessIssue{Kind: InvalidGrant, User: grant.Grantee, Grant: grant})
+            continue
+        }
+        if _, found := latest[grant.Grantee]; !found {
+            grantees = append(grantees, grant.Grantee)
+        }
+        latest[grant.Grantee] = grant
+    }
+
+    viewed := make(map[string]bool)
+    for _, view := range views {
+        user, err := Resolver.ById(view.UserId)
+        if err != nil {
+            return report, err
+        }
+        view.user = user
+        viewed[user.Name] = true
+        grant := latest[user.Name]
+
+        perms, _, err := view.grantedPermissions()
+        if err != nil {
+            issue := AccessIssue{Kind: InvalidView, User: user.Name, Grant: grant, View: view}
+            report.Issues = append(report.Issues, issue)
+            continue
+        }
+        held, _ := ParsePermissions(perms)
+        issue := AccessIssue{User: user.Name, Grant: grant, View: view, Held: held.String()}
+        if grant == nil {
+            if view.AuthorityId != view.UserId && !held.Empty() {
+                issue.Kind = MissingGrant
+                report.Issues = append(report.Issues, issue)
+            }
+            continue
+        }
+        granted, _ := ParsePermissions(grant.Permissions)
+        if granted != held || view.getAuthority().Name != grant.Grantor {
+            issue.Kind = PermissionMismatch
+            report.Issues = append(report.Issues, issue)
+        }
+    }
+
+    for _, name := range grantees {
+        if !viewed[name] {
+            report.Issues = append(report.Issues, AccessIssue{Kind: MissingView, User: name, Grant: latest[name]})
+        }
+    }
+    return report, nil
+}
+
+// RepairAccess reconciles the entry as ReconcileAccess does, and then corrects the views this user is responsible for.
+// A mismatched view whose latest grant was made by this user has its permissions signed again to match the grant, which
+// requires this user to still hold them, and a view given permissions by this user without any grant, as for views
+// shared before grants were recorded, has a grant of the permissions it holds stored for it.  Other discrepancies are
+// left for the users concerned, and remain unfixed in the report.  This user must have an active session.
+func (this *User) RepairAccess(entryId string) (ReconcileReport, error) {
+    report, err := ReconcileAccess(entryId)
+    if err != nil {
+        return report, err
+    }
+
+    var own *EntryView
+    for i := range report.Issues {
+        issue := &report.Issues[i]
+        switch issue.Kind {
+        case PermissionMismatch:
+            if issue.Grant.Grantor != this.Name {
+                continue
+            }
+            if len(issue.Grant.Permissions) == 0 {
+                if issue.View.AuthorityId != this.Id {
+                    continue
+                }
+                err = this.RevokePermissions(issue.View, issue.View.user)
+                break
+            }
+            if own == nil {
+                if own, err = LoadEntry(entryId, this.Id); err != nil {
+                    return report, NewError("Grant permission denied", this, ErrPermission)
+                }
+                own.user = this
+            }
+            if err = this.grant(own, issue.View, issue.Grant.Permissions, time.Time{}); err == nil {
+                err = issue.View.Save()
+            }
+        case MissingGrant:
+            if issue.View.AuthorityId != this.Id {
+                continue
+            }
+            var grant *Grant
+            if grant, err = NewGrant(this, issue.View.user, entryId, issue.Held); err == nil {
+                err = SaveGrant(grant)
+            }
+        default:
+            continue
+        }
+        if err != nil {
+            return report, err
+        }
+        issue.Fixed = true
+    }
+    return report, nil
+}
@@ -0,0 +1,294 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type PermissionsTestSuite struct {
+    suite.Suite
+}
+
+func (suite *PermissionsTestSuite) TestGrant() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer authority.Drop()
+    user, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer user.Drop()
+
+    a.Equal(GetUserPubkey("admin"), GetUserPubkey(authority.Name))
+    a.NotNil(GetUserPubkey("admin"))
+    a.Nil(GetUserPubkey("nobody"))
+
+    _, err = NewGrant(authority, user, "entry", "r$")
+    a.Error(err)
+
+    grant, err := NewGrant(authority, user, "entry", "rw")
+    if !a.NoError(err) {
+        return
+    }
+    ok, err := grant.Verify()
+    a.NoError(err)
+    a.True(ok)
+
+    if a.NoError(SaveGrant(grant)) {
+        defer DB.Delete(grant)
+        a.NotEqual(0, grant.Id)
+    }
+    other, err := NewGrant(authority, user, "other", "r")
+    if a.NoError(err) && a.NoError(SaveGrant(other)) {
+        defer DB.Delete(other)
+    }
+
+    grants, err := GrantsFor("entry")
+    if a.NoError(err) && a.Len(grants, 1) {
+        ok, err = grants[0].Verify()
+        a.NoError(err)
+        a.True(ok)
+    }
+
+    forged := *grant
+    forged.Permissions = "rwd"
+    ok, err = forged.Verify()
+    a.NoError(err)
+    a.False(ok)
+
+    forged = *grant
+    forged.Grantee = authority.Name
+    ok, err = forged.Verify()
+    a.NoError(err)
+    a.False(ok)
+
+    // claiming the grant came from another user fails against that user's key
+    forged = *grant
+    forged.Grantor = user.Name
+    ok, err = forged.Verify()
+    a.NoError(err)
+    a.False(ok)
+
+    forged.Grantor = "nobody"
+    _, err = forged.Verify()
+    a.Error(err)
+
+    a.Error(SaveGrant(&Grant{EntryId: "entry"}))
+}
+
+func (suite *PermissionsTestSuite) TestParsePermissions() {
+    a := assert.New(suite.T())
+
+    set, err := ParsePermissions("rwd")
+    a.NoError(err)
+    a.Equal(PermSet{Read: true, Write: true, Delete: true}, set)
+    a.Equal(ValidPermissions, set.String())
+
+    set, err = ParsePermissions("r")
+    a.NoError(err)
+    a.Equal(PermSet{Read: true}, set)
+    a.Equal("r", set.String())
+
+    set, err = ParsePermissions("")
+    a.NoError(err)
+    a.True(set.Empty())
+    a.Equal("", set.String())
+
+    set, err = ParsePermissions("rr")
+    a.NoError(err)
+    a.Equal(PermSet{Read: true}, set)
+    a.Equal("r", set.String())
+
+    set, err = ParsePermissions("dwr")
+    a.NoError(err)
+    a.Equal("rwd", set.String())
+
+    _, err = ParsePermissions("x")
+    a.Error(err)
+    _, err = ParsePermissions("rx")
+    a.Error(err)
+    _, err = ParsePermissions("*")
+    a.Error(err)
+
+    read, _ := ParsePermissions("r")
+    readWrite, _ := ParsePermissions("rw")
+    writeDelete, _ := ParsePermissions("wd")
+    a.True(read.Intersects(readWrite))
+    a.False(read.Intersects(writeDelete))
+    a.True(readWrite.Intersects(writeDelete))
+    a.False(read.Intersects(PermSet{}))
+}
+
+func (suite *PermissionsTestSuite) TestReconcileAccess() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("admin", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    reader, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer reader.Drop()
+    other, err := NewUser("other.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer other.Drop()
+    absent, err := NewUser("absent.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer absent.Drop()
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WriteTitle("Title"))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(Grant{})
+
+    report, err := ReconcileAccess("entry")
+    if a.NoError(err) {
+        a.Empty(report.Issues)
+        a.True(report.Consistent())
+    }
+
+    _, err = entry.ShareWith(reader, "r")
+    a.NoError(err)
+    _, err = entry.ShareWith(other, "r")
+    a.NoError(err)
+    grants, err := GrantsFor("entry")
+    if a.NoError(err) && a.Len(grants, 2) {
+        a.Equal(reader.Name, grants[0].Grantee)
+        a.Equal(other.Name, grants[1].Grantee)
+    }
+    report, err = ReconcileAccess("entry")
+    if a.NoError(err) {
+        a.Empty(report.Issues)
+    }
+    a.NoError(DB.Where("entry_id = ?", "entry").Delete(Grant{}).Error)
+
+    for _, grant := range []struct {
+        to    *User
+        perms string
+    }{{reader, "r"}, {reader, "wr"}, {absent, "r"}} {
+        g, err := NewGrant(owner, grant.to, "entry", grant.perms)
+        if a.NoError(err) {
+            a.NoError(SaveGrant(g))
+        }
+    }
+    forged, err := NewGrant(owner, other, "entry", "r")
+    if a.NoError(err) {
+        forged.Permissions = "rwd"
+        a.NoError(SaveGrant(forged))
+    }
+
+    report, err = ReconcileAccess("entry")
+    if a.NoError(err) && a.Len(report.Issues, 4) {
+        a.Equal(InvalidGrant, report.Issues[0].Kind)
+        a.Equal(other.Name, report.Issues[0].User)
+        a.Equal(PermissionMismatch, report.Issues[1].Kind)
+        a.Equal(reader.Name, report.Issues[1].User)
+        a.Equal("r", report.Issues[1].Held)
+        a.Equal("wr", report.Issues[1].Grant.Permissions)
+        a.Equal(MissingGrant, report.Issues[2].Kind)
+        a.Equal(other.Name, report.Issues[2].User)
+        a.Equal(MissingView, report.Issues[3].Kind)
+        a.Equal(absent.Name, report.Issues[3].User)
+        a.False(report.Consistent())
+    }
+
+    report, err = reader.RepairAccess("entry")
+    if a.NoError(err) {
+        a.Len(report.Issues, 4)
+        a.False(report.Consistent())
+    }
+
+    report, err = owner.RepairAccess("entry")
+    if a.NoError(err) && a.Len(report.Issues, 4) {
+        a.False(report.Issues[0].Fixed)
+        a.True(report.Issues[1].Fixed)
+        a.True(report.Issues[2].Fixed)
+        a.False(report.Issues[3].Fixed)
+    }
+
+    view, err := LoadEntry("entry", reader.Id)
+    if a.NoError(err) && a.NoError(view.AttachUser(reader)) {
+        a.True(reader.Can("rw", view))
+        a.False(reader.Can("d", view))
+    }
+    view, err = LoadEntry("entry", other.Id)
+    if a.NoError(err) && a.NoError(view.AttachUser(other)) {
+        a.True(other.Can("r", view))
+    }
+
+    report, err = ReconcileAccess("entry")
+    if a.NoError(err) && a.Len(report.Issues, 2) {
+        a.Equal(InvalidGrant, report.Issues[0].Kind)
+        a.Equal(MissingView, report.Issues[1].Kind)
+    }
+}
+
+func (suite *PermissionsTestSuite) TestGrantRecorded() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("owner.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    other, err := NewUser("other.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer other.Drop()
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WriteTitle("Title"))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(Grant{})
+
+    view, err := entry.ShareWith(other, "r")
+    if !a.NoError(err) {
+        return
+    }
+    report, err := ReconcileAccess("entry")
+    if a.NoError(err) {
+        a.Empty(report.Issues)
+    }
+    report, err = owner.RepairAccess("entry")
+    if a.NoError(err) {
+        a.Empty(report.Issues)
+    }
+    view, err = LoadEntry("entry", other.Id)
+    if a.NoError(err) && a.NoError(view.AttachUser(other)) {
+        a.True(other.Can("r", view))
+    }
+
+    a.NoError(owner.GrantPermissions(view, other, "rw"))
+    grants, err := GrantsFor("entry")
+    if a.NoError(err) && a.Len(grants, 1) {
+        a.Equal("rw", grants[0].Permissions)
+    }
+    a.NoError(owner.RevokePermissions(view, other))
+    grants, err = GrantsFor("entry")
+    if a.NoError(err) && a.Len(grants, 1) {
+        a.Equal("", grants[0].Permissions)
+    }
+    report, err = ReconcileAccess("entry")
+    if a.NoError(err) {
+        a.Empty(report.Issues)
+    }
+}
+
+func TestPermissionsTestSuite(t *testing.T) {
+    suite.Run(t, new(PermissionsTestSuite))
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+    "fmt"
+    "github.com/awm/passrep/utils"
+)
+
+// The PolicyVersion type numbers the formats in which the fields of entry views and attachments are encrypted, so that
+// rows written under an older format can be found and upgraded by UpgradeCrypto.
+type PolicyVersion int
+
+const (
+    // PolicyV1 encrypts each field with AES-GCM under the user's key, without additional data.  Rows stored before the
+    // policy was recorded hold zero, which is treated as PolicyV1.
+    PolicyV1 PolicyVersion = iota + 1
+    // PolicyV2 encrypts each field with AES-GCM under the user's wrapped data key, bound through additional data to its
+    // entry and field, so that it fails to decrypt if it is moved elsewhere.
+    PolicyV2
+)
+
+// CurrentPolicy is the policy under which new rows are encrypted.
+const CurrentPolicy = PolicyV2
+
+// The bound function reports whether the policy requires every field to be bound to its entry and field, so that
+// ciphertext without additional data must be refused.
+func (this PolicyVersion) bound() bool {
+    return this >= PolicyV2
+}
+
+// The upgradeBatchSize variable is the number of rows upgraded in each transaction by UpgradeCrypto, which may be
+// replaced when testing.
+var upgradeBatchSize = 100
+
+// UpgradeCrypto re-encrypts, under the target policy, every field of the views and attachments belonging to the user
+// whose recorded policy is below the target, and returns the number of views and attachments upgraded.  The user must
+// have an active session.  A legacy user without a data key is first given one, as by RotateDEK, which upgrades all of
+// their rows at once.  Otherwise the rows are upgraded in batches, each stored in its own transaction along with the
+// policy of its rows, so that an upgrade which is interrupted continues from where it stopped when run again; the count
+// returned alongside an error is of the rows upgraded before it.  Views shared with the user which have not yet been
+// accessed are left alone, since they are moved to the current policy when they are.  The key derivation function is a
+// property of the user's keys rather than of their rows, and changing it requires the password, so it is upgraded by
+// StartSession or RekeyKdf instead.
+func UpgradeCrypto(user *User, target PolicyVersion) (int, error) {
+    if target < PolicyV1 || target > CurrentPolicy {
+        return 0, NewError(fmt.Sprintf("Unknown crypto policy %d", target), user)
+    }
+    if !user.isStored() {
+        return 0, NewError("User has not been stored", user)
+    }
+    key := user.getEncryptionKey()
+    if key == nil {
+        return 0, NewError("Private key unavailable", user, ErrCrypto)
+    }
+    utils.SecureZero(key)
+    if target == PolicyV1 {
+        // every row meets the oldest policy already
+        return 0, nil
+    }
+
+    count := 0
+    if len(user.WrappedDataKey) == 0 {
+        var views, attachments int
+        if err := DB.Unscoped().Model(&EntryView{}).Where(outdatedViews, user.Id, 0, target).Count(&views).Error; err != nil {
+            return 0, NewError(err, user)
+        }
+        if err := DB.Model(&Attachment{}).Where(outdatedAttachments, user.Id, target).Count(&attachments).Error; err != nil {
+            return 0, NewError(err, user)
+        }
+        if err := user.RotateDEK(); err != nil {
+            return 0, err
+        }
+        count = views + attachments
+    }
+
+    for {
+        upgraded, err := user.upgradeBatch(target)
+        count += upgraded
+        if err != nil || upgraded == 0 {
+            return count, err
+        }
+    }
+}
+
+// The outdatedViews and outdatedAttachments conditions select the rows of a user whose policy is below a target.  Views
+// awaiting acceptance of a share are excluded, while views in the trash are included.
+const (
+    outdatedViews       = "user_id = ? AND shared_by = ? AND policy < ?"
+    outdatedAttachments = "user_id = ? AND policy < ?"
+)
+
+// The findOutdated function finds up to limit of the user's views and attachments whose policy is below the target,
+// views first.
+func (this *User) findOutdated(target PolicyVersion, limit int) ([]*EntryView, []Attachment, error) {
+    var views []*EntryView
+    if err := DB.Unscoped().Where(outdatedViews, this.Id, 0, target).Order("id").Limit(limit).Find(&views).Error; err != nil {
+        return nil, nil, NewError(err, this)
+    }
+
+    var attachments []Attachment
+    if len(views) < limit {
+        query := DB.Where(outdatedAttachments, this.Id, target).Order("id").Limit(limit - len(views))
+        if err := query.Find(&attachments).Error; err != nil {
+            return nil, nil, NewError(err, this)
+        }
+    }
+    return views, attachments, nil
+}
+
+// The upgradeBatch function upgrades the next batch of the user's views and attachments whose policy is below the
+// target, storing them in a single transaction, and returns how many were upgraded.  A view saved elsewhere since the
+// batch was read fails with ErrConflict, leaving the whole batch for the next attempt.
+func (this *User) upgradeBatch(target PolicyVersion) (int, error) {
+    views, attachments, err := this.findOutdated(target, upgradeBatchSize)
+    if err != nil {
+        return 0, err
+    }
+
+    columns := make([]map[string]interface{}, len(views))
+    for i, e := range views {
+        columns[i] = map[string]interface{}{"policy": target, "version": e.Version + 1}
+        for _, f := range encryptedFields {
+            value := *f.value(e)
+            if len(value) == 0 {
+                continue
+            }
+            data, err := decryptBound(this, e, f.name, value)
+            if err != nil {
+                return 0, err
+            }
+            columns[i][f.column], err = this.EncryptWithAD(data, e.fieldAD(f.name))
+            utils.SecureZero(data)
+            if err != nil {
+                return 0, err
+            }
+        }
+    }
+    for i := range attachments {
+        a := &attachments[i]
+        for part, value := range a.parts() {
+            data, err := a.decrypt(this, part, *value)
+            if err != nil {
+                return 0, err
+            }
+            *value, err = this.EncryptWithAD(data, a.attachmentAD(part))
+            utils.SecureZero(data)
+            if err != nil {
+                return 0, err
+            }
+        }
+        a.Policy = target
+    }
+
+    tx := DB.Begin()
+    for i, e := range views {
+        // the version is advanced, so that copies loaded before the upgrade conflict rather than overwrite it
+        result := tx.Unscoped().Model(&EntryView{}).Where("id = ? AND version = ?", e.Id, e.Version).UpdateColumns(columns[i])
+        if result.Error != nil {
+            tx.Rollback()
+            return 0, NewError(result.Error, this)
+        }
+        if result.RowsAffected == 0 {
+            tx.Rollback()
+            return 0, NewError("Entry '"+e.EntryId+"' was changed since it was loaded", this, ErrConflict)
+        }
+    }
+    for i := range attachments {
+        if err := tx.Save(&attachments[i]).Error; err != nil {
+            tx.Rollback()
+            return 0, NewError(err, this)
+        }
+    }
+    if err := tx.Commit().Error; err != nil {
+        return 0, NewError(err, this)
+    }
+    return len(views) + len(attachments), nil
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type PolicyTestSuite struct {
+    suite.Suite
+}
+
+// The makeLegacyEntry function stores an entry of the user whose password and attachment are encrypted without
+// additional data, as before fields were bound to their entries.
+func makeLegacyEntry(a *assert.Assertions, u *User, password string) *EntryView {
+    entry, err := NewEntry(u)
+    if !a.NoError(err) || !a.NoError(entry.WriteTitle(password+" title")) || !a.NoError(entry.Save()) {
+        return nil
+    }
+    encrypted, err := u.Encrypt([]byte(password))
+    a.NoError(err)
+    columns := map[string]interface{}{"password": encrypted, "policy": 0}
+    a.NoError(DB.Model(&EntryView{}).Where("id = ?", entry.Id).UpdateColumns(columns).Error)
+
+    attachment := &Attachment{EntryId: entry.EntryId, UserId: u.Id, Size: len(password)}
+    for part, value := range attachment.parts() {
+        *value, err = u.Encrypt([]byte(part + " of " + password))
+        a.NoError(err)
+    }
+    a.NoError(DB.Create(attachment).Error)
+
+    entry, err = LoadEntry(entry.EntryId, u.Id)
+    if !a.NoError(err) {
+        return nil
+    }
+    a.NoError(entry.AttachUser(u))
+    return entry
+}
+
+// The checkUpgraded function ensures that the stored entry and its attachments are bound under the current policy and
+// still hold their original values.
+func checkUpgraded(a *assert.Assertions, u *User, entry *EntryView, password string) {
+    stored := new(EntryView)
+    if !a.NoError(DB.Unscoped().First(stored, entry.Id).Error) || !a.NoError(stored.AttachUser(u)) {
+        return
+    }
+    a.Equal(CurrentPolicy, stored.Policy)
+    a.NotEqual(entry.Password, stored.Password)
+    _, err := u.Decrypt(stored.Password)
+    a.True(errors.Is(err, ErrDecryption))
+    value, err := stored.ReadPassword()
+    if a.NoError(err) {
+        a.Equal(password, value)
+    }
+    value, err = stored.ReadTitle()
+    if a.NoError(err) {
+        a.Equal(password+" title", value)
+    }
+
+    var attachments []Attachment
+    a.NoError(DB.Where("entry_id = ?", entry.EntryId).Find(&attachments).Error)
+    for i := range attachments {
+        a.Equal(CurrentPolicy, attachments[i].Policy)
+        _, err = u.Decrypt(attachments[i].Data)
+        a.Error(err)
+        data, err := stored.ReadAttachment(attachments[i].Id)
+        if a.NoError(err) {
+            a.Equal([]byte("data of "+password), data)
+        }
+    }
+}
+
+func (suite *PolicyTestSuite) TestUpgrade() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Where("user_id = ?", u.Id).Delete(Attachment{})
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    current, err := NewEntry(u)
+    if a.NoError(err) {
+        a.NoError(current.Save())
+    }
+    first := makeLegacyEntry(a, u, "hunter2")
+    second := makeLegacyEntry(a, u, "swordfish")
+    if first == nil || second == nil {
+        return
+    }
+    a.NoError(second.Delete())
+
+    count, err := UpgradeCrypto(u, PolicyV1)
+    a.NoError(err)
+    a.Equal(0, count)
+
+    count, err = UpgradeCrypto(u, CurrentPolicy)
+    a.NoError(err)
+    a.Equal(4, count)
+    checkUpgraded(a, u, first, "hunter2")
+    checkUpgraded(a, u, second, "swordfish")
+
+    // the upgrade advances the version, so that copies loaded before it are not saved over it
+    a.NoError(first.WriteComment("stale"))
+    err = first.Save()
+    if a.Error(err) {
+        a.True(errors.Is(err, ErrConflict))
+    }
+
+    count, err = UpgradeCrypto(u, CurrentPolicy)
+    a.NoError(err)
+    a.Equal(0, count)
+
+    _, err = UpgradeCrypto(u, CurrentPolicy+1)
+    a.Error(err)
+    u.EndSession()
+    _, err = UpgradeCrypto(u, CurrentPolicy)
+    if a.Error(err) {
+        a.True(errors.Is(err, ErrCrypto))
+    }
+}
+
+func (suite *PolicyTestSuite) TestResume() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Where("user_id = ?", u.Id).Delete(Attachment{})
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    first := makeLegacyEntry(a, u, "hunter2")
+    second := makeLegacyEntry(a, u, "swordfish")
+    if first == nil || second == nil {
+        return
+    }
+
+    defer func(size int) { upgradeBatchSize = size }(upgradeBatchSize)
+    upgradeBatchSize = 1
+
+    // a field which fails to decrypt stops the upgrade, keeping the batches already stored
+    a.NoError(DB.Model(&EntryView{}).Where("id = ?", second.Id).UpdateColumn("password", first.Title).Error)
+    count, err := UpgradeCrypto(u, CurrentPolicy)
+    if a.Error(err) {
+        a.True(errors.Is(err, ErrDecryption))
+    }
+    a.Equal(1, count)
+    var stored []EntryView
+    if a.NoError(DB.Where("user_id = ?", u.Id).Order("id").Find(&stored).Error) && a.Len(stored, 2) {
+        a.Equal(CurrentPolicy, stored[0].Policy)
+        a.Equal(PolicyVersion(0), stored[1].Policy)
+    }
+
+    a.NoError(DB.Model(&EntryView{}).Where("id = ?", second.Id).UpdateColumn("password", second.Password).Error)
+    count, err = UpgradeCrypto(u, CurrentPolicy)
+    a.NoError(err)
+    a.Equal(3, count)
+    checkUpgraded(a, u, first, "hunter2")
+    checkUpgraded(a, u, second, "swordfish")
+}
+
+func (suite *PolicyTestSuite) TestLegacyUser() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Where("user_id = ?", u.Id).Delete(Attachment{})
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    // users created before data keys encrypted their data directly under the password-derived key
+    u.keys.DataKey = nil
+    u.WrappedDataKey = ""
+    a.NoError(DB.Model(u).UpdateColumn("wrapped_data_key", "").Error)
+
+    entry := makeLegacyEntry(a, u, "hunter2")
+    if entry == nil {
+        return
+    }
+    count, err := UpgradeCrypto(u, CurrentPolicy)
+    a.NoError(err)
+    a.Equal(2, count)
+    a.NotEmpty(u.WrappedDataKey)
+    checkUpgraded(a, u, entry, "hunter2")
+}
+
+func TestPolicyTestSuite(t *testing.T) {
+    suite.Run(t, new(PolicyTestSuite))
+}
@@ -0,0 +1,34 @@
+package core
+
+import (
+    "fmt"
+)
+
+// The UserResolver interface looks up users for the permission and sharing code, decoupling it from where users are stored.
+type UserResolver interface {
+    // ByName finds the user with the given username.
+    ByName(name string) (*User, error)
+    // ById finds the user with the given database row identifier.
+    ById(id int64) (*User, error)
+}
+
+// The dbResolver type is the default UserResolver, which loads users from the database.
+type dbResolver struct{}
+
+// ByName loads the user with the given username from the database.
+func (dbResolver) ByName(name string) (*User, error) {
+    return LoadUser(name)
+}
+
+// ById loads the user with the given row identifier from the database.
+func (dbResolver) ById(id int64) (*User, error) {
+    user := new(User)
+    if DB.First(user, id).RecordNotFound() {
+        return nil, NewError(fmt.Sprintf("User %d not found", id), ErrNotFound)
+    }
+    return user, nil
+}
+
+// Resolver is the UserResolver used to look up authorities, owners and signers.  It defaults to the database, but may be
+// replaced by embedders which store users elsewhere, or by tests.
+var Resolver UserResolver = dbResolver{}
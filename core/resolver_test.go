@@ -0,0 +1,62 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+// The fakeResolver type resolves users from memory, without touching the database.
+type fakeResolver map[int64]*User
+
+func (this fakeResolver) ByName(name string) (*User, error) {
+    for _, u := range this {
+        if u.Name == name {
+            return u, nil
+        }
+    }
+    return nil, NewError("User '" + name + "' not found")
+}
+
+func (this fakeResolver) ById(id int64) (*User, error) {
+    if u, ok := this[id]; ok {
+        return u, nil
+    }
+    return nil, NewError("User not found")
+}
+
+type ResolverTestSuite struct {
+    suite.Suite
+}
+
+func (suite *ResolverTestSuite) TestFakeResolver() {
+    a := assert.New(suite.T())
+
+    authority := &User{Id: 101, Name: "admin", CryptoSalt: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+    keys, err := MakeKeys(authority, "secret")
+    if !a.NoError(err) {
+        return
+    }
+    authority.keys = keys
+    a.Nil(authority.updatePublicKey())
+    user := &User{Id: 102, Name: "test.user"}
+
+    original := Resolver
+    Resolver = fakeResolver{authority.Id: authority, user.Id: user}
+    defer func() { Resolver = original }()
+
+    permissions, err := authority.Sign([]byte("r"))
+    a.NoError(err)
+    entry := &EntryView{EntryId: "entry", UserId: user.Id, AuthorityId: authority.Id, Permissions: permissions}
+    a.NoError(entry.SignRow(authority))
+    a.True(user.Can("r", entry))
+    a.False(user.Can("w", entry))
+    a.Equal(user, entry.getUser())
+
+    entry.AuthorityId = 103
+    a.False(user.Can("r", entry))
+}
+
+func TestResolverTestSuite(t *testing.T) {
+    suite.Run(t, new(ResolverTestSuite))
+}
@@ -0,0 +1,345 @@
+package core
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "log"
+    "sort"
+    "strings"
+    "time"
+)
+
+// The entryBatchSize is the number of entries loaded at a time by functions which visit every entry of a user, so that
+// large vaults need not be held in memory all at once.
+const entryBatchSize = 100
+
+// MaxPageSize is the largest number of entries returned in one page by the paged listing functions.  Larger limits are
+// reduced to it.
+const MaxPageSize = 500
+
+// The checkPage function validates the offset and limit of a page request, producing the limit with MaxPageSize applied.
+func (this *User) checkPage(offset int, limit int) (int, error) {
+    if offset < 0 {
+        return 0, NewError(fmt.Sprintf("Invalid page offset %d", offset), this)
+    }
+    if limit <= 0 {
+        return 0, NewError(fmt.Sprintf("Invalid page limit %d", limit), this)
+    }
+    if limit > MaxPageSize {
+        limit = MaxPageSize
+    }
+    return limit, nil
+}
+
+// ListEntriesPaged lists one page of the user's entries, excluding archived ones, in order of Id.  The page starts at the
+// offset and holds at most limit entries, where limit must be positive and is reduced to MaxPageSize if larger.  The
+// total number of entries across all pages is returned along with the page.  Entries whose row signature fails to verify
+// are skipped and reported, as by verifiedViews, leaving their page short, though they are still counted in the total.
+func (this *User) ListEntriesPaged(offset int, limit int) ([]*EntryView, int, error) {
+    limit, err := this.checkPage(offset, limit)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var total int
+    if err := DB.Model(EntryView{}).Where("user_id = ? AND archived = ?", this.Id, false).Count(&total).Error; err != nil {
+        return nil, 0, NewError(err, this)
+    }
+    var entries []*EntryView
+    query := DB.Where("user_id = ? AND archived = ?", this.Id, false).Order("id").Offset(offset).Limit(limit)
+    if err := query.Find(&entries).Error; err != nil {
+        return nil, 0, NewError(err, this)
+    }
+    for _, e := range entries {
+        e.user = this
+    }
+    return verifiedViews(entries), total, nil
+}
+
+// RecentlyUsed lists at most n of the user's entries, excluding archived ones, which have been touched, most recently
+// touched first.  The count must be positive and is reduced to MaxPageSize if larger.  Entries whose row signature fails
+// to verify are skipped and reported, as by verifiedViews.
+func (this *User) RecentlyUsed(n int) ([]*EntryView, error) {
+    n, err := this.checkPage(0, n)
+    if err != nil {
+        return nil, err
+    }
+
+    var entries []*EntryView
+    query := DB.Where("user_id = ? AND archived = ? AND last_used_at IS NOT NULL", this.Id, false)
+    if err := query.Order("last_used_at desc, id desc").Limit(n).Find(&entries).Error; err != nil {
+        return nil, NewError(err, this)
+    }
+    for _, e := range entries {
+        e.user = this
+    }
+    return verifiedViews(entries), nil
+}
+
+// The eachEntry function calls the visitor with each entry belonging to the user, in order of Id, loading them from the
+// database in batches.  Archived entries are excluded unless requested through the options, and entries whose row
+// signature fails to verify are skipped and reported, as by verifiedViews.  Visiting stops at the first error returned
+// by the visitor.
+func (this *User) eachEntry(visit func(e *EntryView) error, options ...ListOptions) error {
+    return this.eachEntryBy("id", visit, options...)
+}
+
+// The eachEntryBy function visits the entries of the user as eachEntry does, but in order of the given column, which
+// must be either "id" or "entry_id".
+func (this *User) eachEntryBy(column string, visit func(e *EntryView) error, options ...ListOptions) error {
+    includeArchived := listOptions(options).IncludeArchived
+    var last interface{} = int64(0)
+    if column == "entry_id" {
+        last = ""
+    }
+    for {
+        var batch []*EntryView
+        query := DB.Where("user_id = ? AND "+column+" > ?", this.Id, last)
+        if !includeArchived {
+            query = query.Where("archived = ?", false)
+        }
+        if err := query.Order(column).Limit(entryBatchSize).Find(&batch).Error; err != nil {
+            return NewError(err, this)
+        }
+
+        for _, e := range batch {
+            e.user = this
+            if column == "entry_id" {
+                last = e.EntryId
+            } else {
+                last = e.Id
+            }
+            if !e.verifiedRow() {
+                continue
+            }
+            if err := visit(e); err != nil {
+                return err
+            }
+        }
+        if len(batch) < entryBatchSize {
+            return nil
+        }
+    }
+}
+
+// SearchEntries finds the entries of the user whose title or username contains the query, ignoring case.  Entries which
+// the user is not permitted to read are skipped, as are archived entries unless requested through the options, which
+// may also order the matches by title.  The user must have an active session.  The entries are decrypted one at a time,
+// and the plaintext is discarded as soon as it has been compared.
+func (this *User) SearchEntries(query string, options ...ListOptions) ([]*EntryView, error) {
+    var matches []*EntryView
+    err := this.searchEntries(query, func(e *EntryView) {
+        matches = append(matches, e)
+    }, options...)
+    if err != nil {
+        return nil, err
+    }
+    if err := sortEntries(matches, listOptions(options)); err != nil {
+        return nil, err
+    }
+    return matches, nil
+}
+
+// SearchEntriesPaged finds one page of the entries which SearchEntries would find, starting at the offset and holding at
+// most limit entries, where limit must be positive and is reduced to MaxPageSize if larger.  The total number of matching
+// entries is returned along with the page.  Since the entries must be decrypted to be compared, every entry is still
+// searched, and the paging applies to the matches which remain.
+func (this *User) SearchEntriesPaged(query string, offset int, limit int) ([]*EntryView, int, error) {
+    limit, err := this.checkPage(offset, limit)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var page []*EntryView
+    total := 0
+    err = this.searchEntries(query, func(e *EntryView) {
+        if total >= offset && len(page) < limit {
+            page = append(page, e)
+        }
+        total++
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    return page, total, nil
+}
+
+// The searchEntries function calls the match function with each entry of the user, in order of Id, whose title or
+// username contains the query, as described for SearchEntries.
+func (this *User) searchEntries(query string, match func(e *EntryView), options ...ListOptions) error {
+    needle := bytes.ToLower([]byte(query))
+    return this.eachEntry(func(e *EntryView) error {
+        if !this.Can("r", e) {
+            return nil
+        }
+
+        for _, name := range []string{"title", "username"} {
+            field, _ := findField(encryptedFields, name)
+            if len(*field.value(e)) == 0 {
+                continue
+            }
+            data, err := e.decryptField(name)
+            if err != nil {
+                return err
+            }
+            lowered := bytes.ToLower(data)
+            found := bytes.Contains(lowered, needle)
+            utils.SecureZero(data)
+            utils.SecureZero(lowered)
+            if found {
+                match(e)
+                break
+            }
+        }
+        return nil
+    }, options...)
+}
+
+// The UngroupedName is the group name under which ListGroups and EntriesInGroup place entries with no group.
+var UngroupedName = ""
+
+// The entryGroup function reads the group of the entry, substituting UngroupedName if it has none.
+func (this *EntryView) entryGroup() (string, error) {
+    if len(this.Group) == 0 {
+        return UngroupedName, nil
+    }
+    group, err := this.ReadGroup()
+    if err != nil {
+        return "", err
+    }
+    if len(group) == 0 {
+        return UngroupedName, nil
+    }
+    return group, nil
+}
+
+// ListGroups lists the groups of the user's entries in sorted order.  Groups are paths delimited by slashes, and every
+// ancestor of a group is listed along with it, so that the result describes the whole tree.  Entries with no group are
+// listed under UngroupedName, and entries which the user is not permitted to read are skipped.  The user must have an
+// active session.
+func (this *User) ListGroups() ([]string, error) {
+    var groups []string
+    err := this.eachEntry(func(e *EntryView) error {
+        if !this.Can("r", e) {
+            return nil
+        }
+
+        group, err := e.entryGroup()
+        if err != nil {
+            return err
+        }
+
+        parts := strings.Split(group, "/")
+        for i := 1; i < len(parts); i++ {
+            groups = utils.AppendUnique(groups, strings.Join(parts[:i], "/"))
+        }
+        groups = utils.AppendUnique(groups, group)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(groups)
+    return groups, nil
+}
+
+// EntriesInGroup finds the entries of the user which belong directly to the given group, excluding those in its
+// subgroups.  Entries with no group are found by passing UngroupedName.  Entries which the user is not permitted to read
+// are skipped.  The user must have an active session.
+func (this *User) EntriesInGroup(group string) ([]*EntryView, error) {
+    var entries []*EntryView
+    err := this.eachEntry(func(e *EntryView) error {
+        if !this.Can("r", e) {
+            return nil
+        }
+
+        g, err := e.entryGroup()
+        if err != nil {
+            return err
+        }
+        if g == group {
+            entries = append(entries, e)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
+
+// ExpiringWithin finds the entries of the user whose expiry date falls within the given duration from now, including
+// those which have already expired.  Entries with no expiry date, or which the user is not permitted to read, are skipped.
+// A malformed expiry date is logged and the entry skipped.  The user must have an active session.
+func (this *User) ExpiringWithin(d time.Duration) ([]*EntryView, error) {
+    deadline := time.Now().Add(d)
+    var entries []*EntryView
+    err := this.eachEntry(func(e *EntryView) error {
+        if len(e.Expiry) == 0 || !this.Can("r", e) {
+            return nil
+        }
+
+        data, err := e.decryptField("expiry")
+        if err != nil {
+            return err
+        }
+        var expiry time.Time
+        if err := expiry.UnmarshalText(data); err != nil {
+            log.Print(NewError(fmt.Sprintf("Entry '%s' has a malformed expiry date: %v", e.EntryId, err), this))
+            return nil
+        }
+        if !expiry.After(deadline) {
+            entries = append(entries, e)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
+
+// ReusedPasswords finds the entries of the user which share a password with another of the user's entries.  The entries
+// are grouped under a hash of their password keyed with a random salt chosen afresh for each call, so the keys of the map
+// neither reveal the passwords nor can be compared between calls.  Only groups of more than one entry are included.
+// Entries without a password, or which the user is not permitted to read, are skipped.  The user must have an active
+// session.
+func (this *User) ReusedPasswords() (map[string][]*EntryView, error) {
+    salt := utils.RandomBytes(32)
+    if salt == nil {
+        return nil, NewError("RNG failure!", this)
+    }
+    defer utils.SecureZero(salt)
+
+    groups := make(map[string][]*EntryView)
+    err := this.eachEntry(func(e *EntryView) error {
+        if len(e.Password) == 0 || !this.Can("r", e) {
+            return nil
+        }
+
+        data, err := e.decryptField("password")
+        if err != nil {
+            return err
+        }
+        mac := hmac.New(sha256.New, salt)
+        mac.Write(data)
+        utils.SecureZero(data)
+        key := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+        groups[key] = append(groups[key], e)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for key, entries := range groups {
+        if len(entries) < 2 {
+            delete(groups, key)
+        }
+    }
+    return groups, nil
+}
@@ -0,0 +1,420 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type SearchTestSuite struct {
+    suite.Suite
+}
+
+// The newSearchEntry function stores an entry owned by the user with the given title, username and permissions.
+func newSearchEntry(a *assert.Assertions, user *User, title string, username string, permissions string) *EntryView {
+    entry, err := NewEntry(user)
+    a.NoError(err)
+    a.NoError(entry.WriteTitle(title))
+    a.NoError(entry.WriteUsername(username))
+    if permissions != ValidPermissions {
+        a.NoError(user.GrantPermissions(entry, user, permissions))
+    }
+    a.NoError(entry.Save())
+    return entry
+}
+
+func (suite *SearchTestSuite) TestPaging() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var stored []*EntryView
+        for i := 0; i < 25; i++ {
+            username := "alice"
+            if i%5 == 0 {
+                username = "bob"
+            }
+            stored = append(stored, newSearchEntry(a, u, fmt.Sprintf("Entry %02d", i), username, ValidPermissions))
+        }
+
+        var ids []int64
+        for offset := 0; offset < 30; offset += 10 {
+            page, total, err := u.ListEntriesPaged(offset, 10)
+            if a.NoError(err) {
+                a.Equal(25, total)
+                for _, e := range page {
+                    ids = append(ids, e.Id)
+                }
+            }
+        }
+        a.Len(ids, 25)
+        for i, e := range stored {
+            if i < len(ids) {
+                a.Equal(e.Id, ids[i])
+            }
+        }
+
+        page, total, err := u.ListEntriesPaged(20, 10)
+        if a.NoError(err) {
+            a.Len(page, 5)
+            a.Equal(25, total)
+        }
+        page, _, err = u.ListEntriesPaged(30, 10)
+        a.NoError(err)
+        a.Empty(page)
+        page, _, err = u.ListEntriesPaged(0, MaxPageSize+1)
+        a.NoError(err)
+        a.Len(page, 25)
+        _, _, err = u.ListEntriesPaged(0, 0)
+        a.Error(err)
+        _, _, err = u.ListEntriesPaged(-1, 10)
+        a.Error(err)
+
+        page, total, err = u.SearchEntriesPaged("alice", 10, 10)
+        if a.NoError(err) {
+            a.Equal(20, total)
+            a.Len(page, 10)
+            if a.NotEmpty(page) {
+                // every fifth entry belongs to bob, so the second page of matches starts at the fourteenth entry
+                a.Equal(stored[13].Id, page[0].Id)
+            }
+        }
+        page, total, err = u.SearchEntriesPaged("bob", 0, 10)
+        if a.NoError(err) {
+            a.Equal(5, total)
+            a.Len(page, 5)
+        }
+        _, _, err = u.SearchEntriesPaged("alice", 0, -1)
+        a.Error(err)
+
+        for _, e := range stored {
+            DB.Unscoped().Delete(e)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *SearchTestSuite) TestSearchEntries() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        mail := newSearchEntry(a, u, "Work Mail", "alice", ValidPermissions)
+        bank := newSearchEntry(a, u, "Bank", "ALICE.smith", "r")
+        hidden := newSearchEntry(a, u, "Hidden mail", "alice", "w")
+        other := newSearchEntry(a, u, "Forum", "bob", ValidPermissions)
+
+        entries, err := u.SearchEntries("Alice")
+        if a.NoError(err) {
+            var ids []int64
+            for _, e := range entries {
+                ids = append(ids, e.Id)
+            }
+            a.Equal([]int64{mail.Id, bank.Id}, ids)
+        }
+
+        entries, err = u.SearchEntries("mail")
+        if a.NoError(err) && a.Len(entries, 1) {
+            a.Equal(mail.Id, entries[0].Id)
+        }
+
+        entries, err = u.SearchEntries("nothing")
+        a.NoError(err)
+        a.Empty(entries)
+
+        for _, e := range []*EntryView{mail, bank, hidden, other} {
+            DB.Unscoped().Delete(e)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *SearchTestSuite) TestGroups() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for _, group := range []string{"Internet/Mail", "Internet/Mail", "Internet/Forums/Old", "Bank", ""} {
+            entry, err := NewEntry(u)
+            if a.NoError(err) {
+                if len(group) > 0 {
+                    a.NoError(entry.WriteGroup(group))
+                }
+                a.NoError(entry.Save())
+                entries = append(entries, entry)
+            }
+        }
+
+        groups, err := u.ListGroups()
+        if a.NoError(err) {
+            a.Equal([]string{"", "Bank", "Internet", "Internet/Forums", "Internet/Forums/Old", "Internet/Mail"}, groups)
+        }
+
+        found, err := u.EntriesInGroup("Internet/Mail")
+        if a.NoError(err) && a.Len(found, 2) {
+            a.Equal(entries[0].Id, found[0].Id)
+            a.Equal(entries[1].Id, found[1].Id)
+        }
+        found, err = u.EntriesInGroup("Internet")
+        a.NoError(err)
+        a.Empty(found)
+
+        UngroupedName = "Unfiled"
+        groups, err = u.ListGroups()
+        if a.NoError(err) {
+            a.Equal("Unfiled", groups[len(groups)-1])
+        }
+        found, err = u.EntriesInGroup("Unfiled")
+        if a.NoError(err) && a.Len(found, 1) {
+            a.Equal(entries[4].Id, found[0].Id)
+        }
+        UngroupedName = ""
+
+        for _, e := range entries {
+            DB.Unscoped().Delete(e)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *SearchTestSuite) TestGroupsUnreadable() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    var entries []*EntryView
+    for _, group := range []string{"g", "mine", "old"} {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WriteGroup(group))
+            a.NoError(entry.Save())
+            entries = append(entries, entry)
+        }
+    }
+    if !a.Len(entries, 3) {
+        return
+    }
+
+    // views which can no longer be read, whether revoked or expired, are skipped rather than failing the listing
+    a.NoError(u.RevokePermissions(entries[0], u))
+    a.NoError(u.GrantPermissionsUntil(entries[2], u, "r", time.Now().Add(-time.Minute)))
+    groups, err := u.ListGroups()
+    if a.NoError(err) {
+        a.Equal([]string{"mine"}, groups)
+    }
+    found, err := u.EntriesInGroup("g")
+    a.NoError(err)
+    a.Empty(found)
+    found, err = u.EntriesInGroup("old")
+    a.NoError(err)
+    a.Empty(found)
+    found, err = u.EntriesInGroup("mine")
+    if a.NoError(err) && a.Len(found, 1) {
+        a.Equal(entries[1].Id, found[0].Id)
+    }
+    listed, err := ListEntries(u.Id)
+    a.NoError(err)
+    a.Len(listed, 3)
+}
+
+func (suite *SearchTestSuite) TestTamperedRows() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    good := newSearchEntry(a, u, "Good", "alice", ValidPermissions)
+    tampered := newSearchEntry(a, u, "Tampered", "alice", ValidPermissions)
+    for _, e := range []*EntryView{good, tampered} {
+        a.NoError(e.WriteGroup("g"))
+        a.NoError(e.Touch())
+        a.NoError(e.Save())
+    }
+
+    // an attacker with database access changes the permissions of one entry
+    permissions, err := u.Sign([]byte("r"))
+    a.NoError(err)
+    a.NoError(DB.Model(&EntryView{}).Where("id = ?", tampered.Id).UpdateColumn("permissions", permissions).Error)
+    since := time.Now().Add(-time.Second)
+
+    checkGood := func(name string, entries []*EntryView, err error) {
+        if a.NoError(err, name) && a.Len(entries, 1, name) {
+            a.Equal(good.Id, entries[0].Id, name)
+        }
+    }
+    entries, err := ListEntries(u.Id)
+    checkGood("ListEntries", entries, err)
+    entries, err = AllViews(tampered.EntryId)
+    a.NoError(err)
+    a.Empty(entries)
+    entries, total, err := u.ListEntriesPaged(0, 10)
+    checkGood("ListEntriesPaged", entries, err)
+    a.Equal(2, total)
+    entries, err = u.RecentlyUsed(10)
+    checkGood("RecentlyUsed", entries, err)
+    entries, err = u.SearchEntries("alice")
+    checkGood("SearchEntries", entries, err)
+    entries, err = u.EntriesInGroup("g")
+    checkGood("EntriesInGroup", entries, err)
+
+    _, err = LoadEntry(tampered.EntryId, u.Id)
+    a.True(errors.Is(err, ErrPermission))
+
+    // each skipped row is reported in the audit log
+    records, err := u.AuditLog(since)
+    if a.NoError(err) && a.NotEmpty(records) {
+        for _, record := range records {
+            if record.Action == "verify row" {
+                a.Equal(tampered.EntryId, record.EntryId)
+                a.False(record.Success)
+            }
+        }
+    }
+}
+
+func (suite *SearchTestSuite) TestExpiringWithin() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        now := time.Now()
+        var entries []*EntryView
+        for _, expiry := range []time.Time{now.Add(-time.Hour), now.Add(24 * time.Hour), now.AddDate(1, 0, 0), time.Time{}} {
+            entry, err := NewEntry(u)
+            if a.NoError(err) {
+                if !expiry.IsZero() {
+                    a.NoError(entry.WriteExpiry(expiry))
+                }
+                a.NoError(entry.Save())
+                entries = append(entries, entry)
+            }
+        }
+        malformed, err := NewEntry(u)
+        if a.NoError(err) {
+            malformed.Expiry, err = malformed.encryptField("expiry", []byte("next tuesday"))
+            a.NoError(err)
+            a.NoError(malformed.Save())
+            entries = append(entries, malformed)
+        }
+
+        found, err := u.ExpiringWithin(7 * 24 * time.Hour)
+        if a.NoError(err) && a.Len(found, 2) {
+            a.Equal(entries[0].Id, found[0].Id)
+            a.Equal(entries[1].Id, found[1].Id)
+        }
+
+        for _, e := range entries {
+            DB.Unscoped().Delete(e)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *SearchTestSuite) TestReusedPasswords() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        mail := newSearchEntry(a, u, "Mail", "alice", ValidPermissions)
+        bank := newSearchEntry(a, u, "Bank", "alice", ValidPermissions)
+        forum := newSearchEntry(a, u, "Forum", "alice", ValidPermissions)
+        newSearchEntry(a, u, "Empty", "alice", ValidPermissions)
+        for e, password := range map[*EntryView]string{mail: "hunter2", bank: "hunter2", forum: "correct horse"} {
+            a.NoError(e.WritePassword(password))
+            a.NoError(e.Save())
+        }
+
+        reused, err := u.ReusedPasswords()
+        if a.NoError(err) && a.Len(reused, 1) {
+            for key, entries := range reused {
+                a.NotContains(key, "hunter2")
+                var titles []string
+                for _, e := range entries {
+                    title, err := e.ReadTitle()
+                    a.NoError(err)
+                    titles = append(titles, title)
+                }
+                a.ElementsMatch([]string{"Mail", "Bank"}, titles)
+            }
+        }
+
+        // entries the user may not read are skipped
+        a.NoError(u.GrantPermissions(bank, u, "w"))
+        a.NoError(bank.Save())
+        reused, err = u.ReusedPasswords()
+        a.NoError(err)
+        a.Empty(reused)
+
+        u.Drop()
+    }
+}
+
+func (suite *SearchTestSuite) TestRecentlyUsed() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        mail := newSearchEntry(a, u, "Mail", "alice", ValidPermissions)
+        bank := newSearchEntry(a, u, "Bank", "alice", ValidPermissions)
+        forum := newSearchEntry(a, u, "Forum", "alice", ValidPermissions)
+        newSearchEntry(a, u, "Unused", "alice", ValidPermissions)
+
+        titles := func(n int) []string {
+            entries, err := u.RecentlyUsed(n)
+            a.NoError(err)
+            var result []string
+            for _, e := range entries {
+                title, err := e.ReadTitle()
+                a.NoError(err)
+                result = append(result, title)
+            }
+            return result
+        }
+        a.Empty(titles(10))
+
+        version := mail.Version
+        for _, e := range []*EntryView{mail, bank, forum} {
+            a.NoError(e.Touch())
+        }
+        a.Equal(version, mail.Version)
+        a.NotNil(mail.LastUsedAt)
+        a.Equal([]string{"Forum", "Bank", "Mail"}, titles(10))
+        a.Equal([]string{"Forum", "Bank"}, titles(2))
+
+        a.NoError(mail.Touch())
+        a.Equal([]string{"Mail", "Forum", "Bank"}, titles(10))
+        // the touch leaves the stored entry's version alone, so the loaded copy can still be saved
+        a.NoError(mail.Save())
+
+        a.NoError(forum.Archive())
+        a.Equal([]string{"Mail", "Bank"}, titles(10))
+
+        _, err = u.RecentlyUsed(0)
+        a.Error(err)
+        a.NoError(u.GrantPermissions(bank, u, "w"))
+        a.True(errors.Is(bank.Touch(), ErrPermission))
+        unsaved, err := NewEntry(u)
+        if a.NoError(err) {
+            a.Error(unsaved.Touch())
+        }
+
+        u.Drop()
+    }
+}
+
+func TestSearchTestSuite(t *testing.T) {
+    suite.Run(t, new(SearchTestSuite))
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+    "bytes"
+    "code.google.com/p/go.crypto/pbkdf2"
+    "crypto/sha512"
+    "encoding/base64"
+    "encoding/hex"
+    "github.com/awm/passrep/utils"
+)
+
+// The selfTestIterations is the number of PBKDF2 iterations used for the keys of the users created by SelfTest, which
+// need not resist guessing.
+const selfTestIterations = 1000
+
+// The pbkdf2Vector is the known PBKDF2-HMAC-SHA512 output for the password "password", the salt "salt" and a single
+// iteration.
+const pbkdf2Vector = "867f70cf1ade02cff3752599a3a53dc4af34c7a669815ae5d513554e1c8cf252" +
+    "c02d470a285a0501bad999bfe943c08f050235d7d68b1da55e63f73b60a57fce"
+
+// SelfTest checks that the cryptographic primitives on which the library relies behave as expected on the current
+// platform, so that a broken build or a restricted crypto module is found at startup rather than when data is lost.  It
+// checks that PBKDF2 produces a known result and derives the same keys from the same password, that AES-GCM decrypts what
+// it encrypts and rejects altered data, that ECDSA signatures verify and altered data does not, and that two users agree
+// on the secret they share.  The users are created in memory only, and nothing is stored.  The error describes the first
+// check to fail.
+func SelfTest() error {
+    expected, _ := hex.DecodeString(pbkdf2Vector)
+    if !bytes.Equal(expected, pbkdf2.Key([]byte("password"), []byte("salt"), 1, len(expected), sha512.New)) {
+        return NewError("Self-test failed: PBKDF2 produced an unexpected result", ErrCrypto)
+    }
+
+    alice, err := selfTestUser("self.test.alice")
+    if err != nil {
+        return err
+    }
+    defer alice.EndSession()
+    again, err := MakeKeys(alice, "password")
+    if err != nil {
+        return selfTestFailed(err)
+    }
+    defer again.Wipe()
+    if !bytes.Equal(again.CryptoKey, alice.keys.CryptoKey) || again.SigningKey.D.Cmp(alice.keys.SigningKey.D) != 0 {
+        return NewError("Self-test failed: key derivation is not reproducible", ErrCrypto)
+    }
+
+    data := []byte("self test")
+    encrypted, err := sealWithKey(alice.keys.CryptoKey, data)
+    if err != nil {
+        return selfTestFailed(err)
+    }
+    decrypted, err := openWithKey(alice.keys.CryptoKey, encrypted)
+    if err != nil || !bytes.Equal(data, decrypted) {
+        return NewError("Self-test failed: AES-GCM did not decrypt what it encrypted", ErrCrypto)
+    }
+    raw, _ := base64.StdEncoding.DecodeString(encrypted)
+    raw[len(raw)-1] ^= 1
+    if _, err := openWithKey(alice.keys.CryptoKey, base64.StdEncoding.EncodeToString(raw)); err == nil {
+        return NewError("Self-test failed: AES-GCM accepted altered data", ErrCrypto)
+    }
+
+    signed, err := alice.Sign(data)
+    if err != nil {
+        return selfTestFailed(err)
+    }
+    if ok, signedData, err := alice.Verify(signed); err != nil || !ok || !bytes.Equal(data, signedData) {
+        return NewError("Self-test failed: ECDSA signature did not verify", ErrCrypto)
+    }
+    raw, _ = base64.StdEncoding.DecodeString(signed)
+    raw[len(raw)-1] ^= 1
+    if ok, _, _ := alice.Verify(base64.StdEncoding.EncodeToString(raw)); ok {
+        return NewError("Self-test failed: ECDSA signature verified for altered data", ErrCrypto)
+    }
+
+    bob, err := selfTestUser("self.test.bob")
+    if err != nil {
+        return err
+    }
+    defer bob.EndSession()
+    aliceSecret, err := alice.makeSharedSecret(bob)
+    if err != nil {
+        return selfTestFailed(err)
+    }
+    defer utils.SecureZero(aliceSecret)
+    bobSecret, err := bob.makeSharedSecret(alice)
+    if err != nil {
+        return selfTestFailed(err)
+    }
+    defer utils.SecureZero(bobSecret)
+    if !bytes.Equal(aliceSecret, bobSecret) {
+        return NewError("Self-test failed: shared secrets do not agree", ErrCrypto)
+    }
+    return nil
+}
+
+// The selfTestUser function creates a user in memory, with random salts and its session started, for SelfTest.
+func selfTestUser(name string) (*User, error) {
+    user := &User{Name: name, KdfIterations: selfTestIterations}
+    for _, salt := range []*string{&user.CryptoSalt, &user.SigningSalt} {
+        raw := utils.RandomBytes(32)
+        if raw == nil {
+            return nil, NewError("Self-test failed: RNG failure!", ErrCrypto)
+        }
+        *salt = base64.StdEncoding.EncodeToString(raw)
+    }
+
+    keys, err := MakeKeys(user, "password")
+    if err != nil {
+        return nil, selfTestFailed(err)
+    }
+    user.keys = keys
+    if err := user.updatePublicKey(); err != nil {
+        return nil, selfTestFailed(err)
+    }
+    return user, nil
+}
+
+// The selfTestFailed function wraps an error encountered by SelfTest, noting that the self-test failed.
+func selfTestFailed(err error) *Error {
+    failed := NewError(err, ErrCrypto)
+    failed.Msg = "Self-test failed: " + failed.Msg
+    return failed
+}
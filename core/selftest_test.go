@@ -0,0 +1,26 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type SelfTestTestSuite struct {
+    suite.Suite
+}
+
+func (suite *SelfTestTestSuite) TestSelfTest() {
+    a := assert.New(suite.T())
+
+    var before int
+    DB.Model(&User{}).Count(&before)
+    a.NoError(SelfTest())
+    var after int
+    DB.Model(&User{}).Count(&after)
+    a.Equal(before, after)
+}
+
+func TestSelfTestTestSuite(t *testing.T) {
+    suite.Run(t, new(SelfTestTestSuite))
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+    "golang.org/x/text/collate"
+    "golang.org/x/text/language"
+    "sort"
+)
+
+// The titleSorter type orders entries by their decrypted titles.
+type titleSorter struct {
+    entries []*EntryView
+    titles  []string
+    less    func(a, b string) bool
+}
+
+// Len provides the number of entries being sorted.
+func (this *titleSorter) Len() int {
+    return len(this.entries)
+}
+
+// Less reports whether the title of entry i sorts before that of entry j.
+func (this *titleSorter) Less(i, j int) bool {
+    return this.less(this.titles[i], this.titles[j])
+}
+
+// Swap exchanges entries i and j along with their titles.
+func (this *titleSorter) Swap(i, j int) {
+    this.entries[i], this.entries[j] = this.entries[j], this.entries[i]
+    this.titles[i], this.titles[j] = this.titles[j], this.titles[i]
+}
+
+// SortByTitle orders entries in place by their decrypted titles.  An empty language keeps plain byte ordering, while any
+// other BCP 47 language tag (such as "fr" or "sv") applies the collation rules of that locale.  Entries whose title cannot
+// be read sort as though their title were empty.
+func SortByTitle(entries []*EntryView, lang string) error {
+    sorter := &titleSorter{entries: entries, titles: make([]string, len(entries))}
+    for i, e := range entries {
+        title, err := e.ReadTitle()
+        if err == nil {
+            sorter.titles[i] = title
+        }
+    }
+
+    if len(lang) == 0 {
+        sorter.less = func(a, b string) bool { return a < b }
+    } else {
+        tag, err := language.Parse(lang)
+        if err != nil {
+            return NewError(err)
+        }
+        collator := collate.New(tag)
+        sorter.less = func(a, b string) bool { return collator.CompareString(a, b) < 0 }
+    }
+
+    sort.Stable(sorter)
+    return nil
+}
+
+// The sortEntries function orders listed entries as requested by the list options, leaving them in place unless
+// SortByTitle is set.
+func sortEntries(entries []*EntryView, options ListOptions) error {
+    if !options.SortByTitle {
+        return nil
+    }
+    return SortByTitle(entries, options.Collation)
+}
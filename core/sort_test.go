@@ -0,0 +1,103 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type SortTestSuite struct {
+    suite.Suite
+}
+
+func (suite *SortTestSuite) TestSortByTitle() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for _, title := range []string{"Éclair", "apple", "Zebra"} {
+            entry := newTestEntry(a, u, title)
+            a.NoError(entry.WriteTitle(title))
+            entries = append(entries, entry)
+        }
+        order := func() []string {
+            var result []string
+            for _, e := range entries {
+                result = append(result, e.EntryId)
+            }
+            return result
+        }
+
+        a.NoError(SortByTitle(entries, ""))
+        a.Equal([]string{"Zebra", "apple", "Éclair"}, order())
+
+        a.NoError(SortByTitle(entries, "fr"))
+        a.Equal([]string{"apple", "Éclair", "Zebra"}, order())
+
+        a.Error(SortByTitle(entries, "not a tag!"))
+
+        u.Drop()
+    }
+}
+
+func (suite *SortTestSuite) TestListOptions() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+
+    for _, title := range []string{"Éclair", "apple", "Zebra"} {
+        entry := newTestEntry(a, u, title)
+        a.NoError(entry.WriteTitle(title))
+        a.NoError(entry.WriteUsername("user"))
+        a.NoError(entry.Save())
+    }
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+    order := func(entries []*EntryView) []string {
+        var result []string
+        for _, e := range entries {
+            result = append(result, e.EntryId)
+        }
+        return result
+    }
+
+    entries, err := ListEntries(u.Id, ListOptions{Session: u, SortByTitle: true})
+    if a.NoError(err) {
+        a.Equal([]string{"Zebra", "apple", "Éclair"}, order(entries))
+    }
+    entries, err = ListEntries(u.Id, ListOptions{Session: u, SortByTitle: true, Collation: "fr"})
+    if a.NoError(err) {
+        a.Equal([]string{"apple", "Éclair", "Zebra"}, order(entries))
+    }
+    entries, err = ListEntries(u.Id, ListOptions{Session: u, SortByTitle: true}, ListOptions{Collation: "fr"})
+    if a.NoError(err) {
+        a.Equal([]string{"apple", "Éclair", "Zebra"}, order(entries))
+    }
+    _, err = ListEntries(u.Id, ListOptions{Session: u, SortByTitle: true, Collation: "not a tag!"})
+    a.Error(err)
+    other, err := NewUser("other.user", "password")
+    if a.NoError(err) {
+        _, err = ListEntries(u.Id, ListOptions{Session: other})
+        a.Error(err)
+        other.Drop()
+    }
+
+    entries, err = u.SearchEntries("user", ListOptions{SortByTitle: true, Collation: "fr"})
+    if a.NoError(err) {
+        a.Equal([]string{"apple", "Éclair", "Zebra"}, order(entries))
+    }
+    entries, err = u.SearchEntries("user", ListOptions{SortByTitle: true})
+    if a.NoError(err) {
+        a.Equal([]string{"Zebra", "apple", "Éclair"}, order(entries))
+    }
+    _, err = u.SearchEntries("user", ListOptions{SortByTitle: true, Collation: "not a tag!"})
+    a.Error(err)
+}
+
+func TestSortTestSuite(t *testing.T) {
+    suite.Run(t, new(SortTestSuite))
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+    "math"
+    "strings"
+    "unicode"
+)
+
+// The StrengthResult structure describes the estimated strength of a password.
+type StrengthResult struct {
+    // The Entropy is the estimated entropy of the password in bits.
+    Entropy float64
+    // The Score rates the password from 0, trivially guessable, to 4, very strong.
+    Score int
+    // The Warnings describe the weaknesses found in the password.
+    Warnings []string
+}
+
+// The commonWords variable lists frequently used passwords and password fragments, which an attacker would try first.
+var commonWords = []string{
+    "password", "passw0rd", "letmein", "welcome", "admin", "administrator", "login", "master", "secret", "qwerty",
+    "monkey", "dragon", "football", "baseball", "soccer", "hockey", "shadow", "sunshine", "princess", "superman",
+    "batman", "trustno1", "iloveyou", "love", "hello", "freedom", "whatever", "starwars", "computer", "internet",
+    "michael", "jennifer", "jordan", "charlie", "thomas", "ashley", "daniel", "summer", "winter", "spring", "autumn",
+    "flower", "cheese", "coffee", "banana", "orange", "purple", "matrix", "access", "mustang", "killer", "pepper",
+    "ginger", "hunter", "ranger", "tigger", "buster", "harley", "hannah", "maggie", "cookie", "chocolate",
+    "changeme", "default", "guest", "root", "test", "user", "pass", "abc", "god",
+}
+
+// The sequences variable lists runs of characters which are easily typed or recited in order.
+var sequences = []string{
+    "abcdefghijklmnopqrstuvwxyz",
+    "01234567890",
+    "qwertyuiop",
+    "asdfghjkl",
+    "zxcvbnm",
+    "1qaz2wsx3edc",
+}
+
+// The strengthThresholds variable gives the minimum entropy, in bits, for each score above zero.
+var strengthThresholds = []float64{28, 36, 60, 80}
+
+// EstimateStrength estimates the strength of a password without consulting any external service.  The entropy starts
+// from the size of the character classes used, and is reduced for common words, keyboard or alphabetical sequences and
+// repeated characters, since an attacker would guess those far sooner than random characters.
+func EstimateStrength(password string) StrengthResult {
+    var result StrengthResult
+    runes := []rune(password)
+    if len(runes) == 0 {
+        result.Warnings = append(result.Warnings, "empty password")
+        return result
+    }
+
+    bits := math.Log2(float64(cardinality(runes)))
+    lower := []rune(strings.ToLower(password))
+    covered := make([]bool, len(runes))
+    entropy := float64(len(runes)) * bits
+
+    // The cover function marks a pattern as found, replacing the entropy of its characters with that of the pattern.
+    cover := func(start int, length int, patternBits float64) {
+        entropy -= float64(length) * bits
+        entropy += patternBits
+        for i := start; i < start+length; i++ {
+            covered[i] = true
+        }
+    }
+    // The free function determines whether none of the characters in the range belong to an earlier pattern.
+    free := func(start int, length int) bool {
+        for i := start; i < start+length; i++ {
+            if covered[i] {
+                return false
+            }
+        }
+        return true
+    }
+
+    found := false
+    for _, word := range commonWords {
+        w := []rune(word)
+        for start := 0; start+len(w) <= len(lower); start++ {
+            if string(lower[start:start+len(w)]) == word && free(start, len(w)) {
+                cover(start, len(w), math.Log2(float64(len(commonWords))))
+                found = true
+            }
+        }
+    }
+    if found {
+        result.Warnings = append(result.Warnings, "contains a common word")
+    }
+
+    found = false
+    for start := 0; start < len(lower); {
+        length := sequenceLength(lower[start:])
+        if length >= 3 && free(start, length) {
+            cover(start, length, bits+math.Log2(float64(length)))
+            found = true
+            start += length
+        } else {
+            start++
+        }
+    }
+    if found {
+        result.Warnings = append(result.Warnings, "keyboard pattern or sequence")
+    }
+
+    found = false
+    for start := 0; start < len(runes); {
+        length := 1
+        for start+length < len(runes) && runes[start+length] == runes[start] {
+            length++
+        }
+        if length >= 3 && free(start, length) {
+            cover(start, length, bits+math.Log2(float64(length)))
+            found = true
+        }
+        start += length
+    }
+    if found {
+        result.Warnings = append(result.Warnings, "repeated characters")
+    }
+
+    if len(runes) < 8 {
+        result.Warnings = append(result.Warnings, "shorter than 8 characters")
+    }
+
+    result.Entropy = math.Max(entropy, 0)
+    for _, threshold := range strengthThresholds {
+        if result.Entropy >= threshold {
+            result.Score++
+        }
+    }
+    return result
+}
+
+// The cardinality function determines the size of the character set an attacker would need to search, based on the
+// classes of character present in the password.
+func cardinality(runes []rune) int {
+    var upper, lower, digit, symbol, other bool
+    for _, r := range runes {
+        switch {
+        case r >= 'A' && r <= 'Z':
+            upper = true
+        case r >= 'a' && r <= 'z':
+            lower = true
+        case r >= '0' && r <= '9':
+            digit = true
+        case r < unicode.MaxASCII && unicode.IsPrint(r):
+            symbol = true
+        default:
+            other = true
+        }
+    }
+
+    result := 0
+    if upper {
+        result += 26
+    }
+    if lower {
+        result += 26
+    }
+    if digit {
+        result += 10
+    }
+    if symbol {
+        result += 33
+    }
+    if other {
+        result += 100
+    }
+    return result
+}
+
+// The sequenceLength function determines the length of the longest known sequence, forwards or backwards, which the
+// runes begin with.
+func sequenceLength(runes []rune) int {
+    longest := 0
+    for _, sequence := range sequences {
+        forward := []rune(sequence)
+        backward := make([]rune, len(forward))
+        for i, r := range forward {
+            backward[len(forward)-1-i] = r
+        }
+
+        for _, s := range [][]rune{forward, backward} {
+            for offset := range s {
+                length := 0
+                for length < len(runes) && offset+length < len(s) && runes[length] == s[offset+length] {
+                    length++
+                }
+                if length > longest {
+                    longest = length
+                }
+            }
+        }
+    }
+    return longest
+}
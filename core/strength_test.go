@@ -0,0 +1,44 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type StrengthTestSuite struct {
+    suite.Suite
+}
+
+func (suite *StrengthTestSuite) TestWeakAndStrong() {
+    a := assert.New(suite.T())
+
+    weak := EstimateStrength("password")
+    a.Equal(0, weak.Score)
+    a.Contains(weak.Warnings, "contains a common word")
+
+    random, err := GeneratePassword(20, DefaultPasswordPolicy())
+    if a.NoError(err) {
+        strong := EstimateStrength(random)
+        a.Equal(4, strong.Score)
+        a.True(strong.Entropy > weak.Entropy)
+    }
+}
+
+func (suite *StrengthTestSuite) TestWarnings() {
+    a := assert.New(suite.T())
+
+    a.Contains(EstimateStrength("Xq7#qwerty").Warnings, "contains a common word")
+    a.Contains(EstimateStrength("Xq7#asdfgh").Warnings, "keyboard pattern or sequence")
+    a.Contains(EstimateStrength("Xq7#98765").Warnings, "keyboard pattern or sequence")
+    a.Contains(EstimateStrength("Xq7#zzzzzz").Warnings, "repeated characters")
+    a.Contains(EstimateStrength("Xq7#").Warnings, "shorter than 8 characters")
+    a.Contains(EstimateStrength("").Warnings, "empty password")
+    a.Empty(EstimateStrength("Xq7#Lp2!Vw9$").Warnings)
+
+    a.True(EstimateStrength("Xq7#aaaaaaaa").Entropy < EstimateStrength("Xq7#Lp2!Vw9$").Entropy)
+}
+
+func TestStrengthTestSuite(t *testing.T) {
+    suite.Run(t, new(StrengthTestSuite))
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+    "encoding/json"
+    "github.com/awm/passrep/utils"
+    "strings"
+)
+
+// The normalizeTag function converts a tag to the trimmed, lowercase form in which tags are stored and compared.
+func normalizeTag(tag string) string {
+    return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// The tags function decrypts the tags of the entry without checking permissions.
+func (this *EntryView) tags() ([]string, error) {
+    if len(this.Tags) == 0 {
+        return nil, nil
+    }
+    data, err := this.decryptField("tags")
+    if err != nil {
+        return nil, err
+    }
+
+    var tags []string
+    if err := json.Unmarshal(data, &tags); err != nil {
+        return nil, NewError(err, this.getUser())
+    }
+    return tags, nil
+}
+
+// The writeTags function encrypts and stores the tags of the entry, provided that the user has write permission.
+func (this *EntryView) writeTags(change func(tags []string) []string) error {
+    if !this.getUser().Can("w", this) {
+        return NewError("Tags write permission denied", this.getUser(), ErrPermission)
+    }
+    tags, err := this.tags()
+    if err != nil {
+        return err
+    }
+
+    data, err := json.Marshal(change(tags))
+    if err != nil {
+        return NewError(err, this.getUser())
+    }
+    this.Tags, err = this.encryptField("tags", data)
+    return err
+}
+
+// ReadTags reads the tags of the entry, provided that the user has appropriate permissions.
+func (this *EntryView) ReadTags() (result []string, err error) {
+    defer func() { this.audit("read tags", err) }()
+    if !this.getUser().Can("r", this) {
+        return nil, NewError("Tags read permission denied", this.getUser(), ErrPermission)
+    }
+    return this.tags()
+}
+
+// AddTag adds a tag to the entry, provided that the user has appropriate permissions.  Tags are trimmed and lowercased,
+// and adding a tag which the entry already has does nothing.
+func (this *EntryView) AddTag(tag string) (err error) {
+    defer func() { this.written("tags", err) }()
+    tag = normalizeTag(tag)
+    if len(tag) == 0 {
+        return NewError("Empty tag", this.getUser())
+    }
+    return this.writeTags(func(tags []string) []string {
+        return utils.AppendUnique(tags, tag)
+    })
+}
+
+// RemoveTag removes a tag from the entry, provided that the user has appropriate permissions.  Removing a tag which the
+// entry does not have does nothing.
+func (this *EntryView) RemoveTag(tag string) (err error) {
+    defer func() { this.written("tags", err) }()
+    tag = normalizeTag(tag)
+    return this.writeTags(func(tags []string) []string {
+        result := []string{}
+        for _, t := range tags {
+            if t != tag {
+                result = append(result, t)
+            }
+        }
+        return result
+    })
+}
+
+// EntriesWithTag finds the entries of the user which have the given tag.  Since the tags are encrypted, each entry is
+// decrypted in turn rather than filtered by the database.  Entries which the user is not permitted to read are skipped.
+// The user must have an active session.
+func (this *User) EntriesWithTag(tag string) ([]*EntryView, error) {
+    tag = normalizeTag(tag)
+    var entries []*EntryView
+    err := this.eachEntry(func(e *EntryView) error {
+        if len(e.Tags) == 0 || !this.Can("r", e) {
+            return nil
+        }
+        tags, err := e.tags()
+        if err != nil {
+            return err
+        }
+        if utils.Contains(tags, tag) {
+            entries = append(entries, e)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
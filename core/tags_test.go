@@ -0,0 +1,71 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type TagsTestSuite struct {
+    suite.Suite
+}
+
+func (suite *TagsTestSuite) TestTags() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        work, err := NewEntry(u)
+        a.NoError(err)
+        home, err := NewEntry(u)
+        a.NoError(err)
+
+        a.NoError(work.AddTag("Work"))
+        a.NoError(work.AddTag("  work "))
+        a.NoError(work.AddTag("2FA"))
+        a.Error(work.AddTag("   "))
+        a.NoError(home.AddTag("2fa"))
+        a.NotContains(work.Tags, "work")
+
+        tags, err := work.ReadTags()
+        if a.NoError(err) {
+            a.Equal([]string{"work", "2fa"}, tags)
+        }
+
+        a.NoError(work.RemoveTag("WORK"))
+        a.NoError(work.RemoveTag("missing"))
+        tags, err = work.ReadTags()
+        if a.NoError(err) {
+            a.Equal([]string{"2fa"}, tags)
+        }
+        a.NoError(work.AddTag("work"))
+
+        a.NoError(work.Save())
+        a.NoError(home.Save())
+
+        entries, err := u.EntriesWithTag("2FA")
+        if a.NoError(err) && a.Len(entries, 2) {
+            a.Equal(work.Id, entries[0].Id)
+            a.Equal(home.Id, entries[1].Id)
+        }
+        entries, err = u.EntriesWithTag("work")
+        if a.NoError(err) && a.Len(entries, 1) {
+            a.Equal(work.Id, entries[0].Id)
+        }
+        entries, err = u.EntriesWithTag("none")
+        a.NoError(err)
+        a.Empty(entries)
+
+        home.Permissions, err = u.Sign([]byte("r"))
+        a.NoError(err)
+        a.Error(home.AddTag("other"))
+
+        a.NoError(work.Purge())
+        a.NoError(home.Purge())
+        u.Drop()
+    }
+}
+
+func TestTagsTestSuite(t *testing.T) {
+    suite.Run(t, new(TagsTestSuite))
+}
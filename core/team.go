@@ -0,0 +1,361 @@
+package core
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/awm/passrep/utils"
+    "time"
+)
+
+// The Team structure represents a group of users which share a single symmetric encryption key.  Entries shared with
+// the team are encrypted once under the team key rather than once per recipient.
+type Team struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the team was created.
+    CreatedAt time.Time
+    // UpdatedAt is the time when the team was last updated.
+    UpdatedAt time.Time
+
+    // The Name is the unique name of the team.
+    Name string `sql:"not null;unique"`
+    // The KeyVersion is incremented each time the team key is rotated.
+    KeyVersion int
+}
+
+// The TeamMember structure records a user's membership in a team, along with the team key wrapped for that user.
+type TeamMember struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the membership was created.
+    CreatedAt time.Time
+    // UpdatedAt is the time when the membership was last updated.
+    UpdatedAt time.Time
+
+    // TeamId is the foreign key of the team.
+    TeamId int64
+    // UserId is the foreign key of the member user.
+    UserId int64
+    // WrapperId is the foreign key of the user who wrapped the team key for this member.
+    WrapperId int64
+    // The WrappedKey is the team key encrypted using the secret shared between the wrapper and the member.
+    WrappedKey string
+}
+
+// The TeamEntry structure holds the contents of an entry shared with a team, encrypted under the team key.
+type TeamEntry struct {
+    // The Id is the database row identifier.
+    Id  int64
+    // CreatedAt is the time when the entry was shared.
+    CreatedAt time.Time
+    // UpdatedAt is the time when the shared entry was last updated.
+    UpdatedAt time.Time
+
+    // TeamId is the foreign key of the team the entry is shared with.
+    TeamId int64
+    // The EntryId string is the unique identifier for the shared password entry.
+    EntryId string
+    // The Data field is the encrypted JSON encoding of the shared entry fields.
+    Data string
+}
+
+const (
+    // TeamKeySize is the size in bytes of a team's symmetric encryption key.
+    TeamKeySize = 32
+)
+
+// NewTeam creates a new team with a freshly generated key, with the owner as its first member.
+func NewTeam(name string, owner *User) (*Team, error) {
+    key := utils.RandomBytes(TeamKeySize)
+    if key == nil {
+        return nil, NewError("RNG failure!", owner)
+    }
+
+    team := new(Team)
+    team.Name = name
+    team.KeyVersion = 1
+    if err := DB.Create(team).Error; err != nil {
+        return nil, NewError(err, owner)
+    }
+
+    if err := team.wrapKey(key, owner, owner); err != nil {
+        DB.Delete(team)
+        return nil, err
+    }
+    return team, nil
+}
+
+// LoadTeam instantiates an existing team from the database.
+func LoadTeam(name string) (*Team, error) {
+    team := new(Team)
+    if DB.Where(&Team{Name: name}).First(team).RecordNotFound() {
+        return nil, NewError("Team '" + name + "' not found", ErrNotFound)
+    }
+    return team, nil
+}
+
+// The wrapKey function stores the team key for the member, encrypted with the secret shared between wrapper and member.
+func (this *Team) wrapKey(key []byte, wrapper *User, member *User) error {
+    wrapped, _, err := wrapper.EncryptShared(key, nil, member)
+    if err != nil {
+        return err
+    }
+
+    membership := new(TeamMember)
+    DB.Where(&TeamMember{TeamId: this.Id, UserId: member.Id}).First(membership)
+    membership.TeamId = this.Id
+    membership.UserId = member.Id
+    membership.WrapperId = wrapper.Id
+    membership.WrappedKey = wrapped
+    if err := DB.Save(membership).Error; err != nil {
+        return NewError(err, wrapper)
+    }
+    return nil
+}
+
+// The key function unwraps the team key for the given member, who must have an active session.
+func (this *Team) key(member *User) ([]byte, error) {
+    membership := new(TeamMember)
+    if DB.Where(&TeamMember{TeamId: this.Id, UserId: member.Id}).First(membership).RecordNotFound() {
+        return nil, NewError("Not a member of team '"+this.Name+"'", member)
+    }
+
+    wrapper, err := Resolver.ById(membership.WrapperId)
+    if err != nil {
+        return nil, NewError("Team key wrapper not found", member, ErrNotFound)
+    }
+
+    key, _, err := member.DecryptShared(membership.WrappedKey, "", wrapper)
+    if err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// The rewrapTeamKeys function re-wraps every team key wrapped by or for the user, moving it from the previous keys to the
+// updated keys of the same user.  The changed memberships are returned rather than stored, so that the caller can store
+// them along with its other changes.
+func rewrapTeamKeys(previous *User, updated *User) ([]TeamMember, error) {
+    var memberships []TeamMember
+    if err := DB.Where("user_id = ? OR wrapper_id = ?", previous.Id, previous.Id).Find(&memberships).Error; err != nil {
+        return nil, NewError(err, previous)
+    }
+
+    for i := range memberships {
+        m := &memberships[i]
+        wrapper := previous
+        if m.WrapperId != previous.Id {
+            var err error
+            wrapper, err = Resolver.ById(m.WrapperId)
+            if err != nil {
+                return nil, NewError("Team key wrapper not found", previous, ErrNotFound)
+            }
+        }
+        member := previous
+        if m.UserId != previous.Id {
+            var err error
+            member, err = Resolver.ById(m.UserId)
+            if err != nil {
+                return nil, NewError("Team member not found", previous, ErrNotFound)
+            }
+        }
+
+        // The secret shared between wrapper and member is the same from either side, so the user can always unwrap.
+        other := wrapper
+        if m.WrapperId == previous.Id {
+            other = member
+        }
+        key, _, err := previous.DecryptShared(m.WrappedKey, "", other)
+        if err != nil {
+            return nil, err
+        }
+
+        if m.UserId == previous.Id {
+            other = updated
+        }
+        m.WrappedKey, _, err = updated.EncryptShared(key, nil, other)
+        if err != nil {
+            return nil, err
+        }
+        m.WrapperId = updated.Id
+    }
+    return memberships, nil
+}
+
+// IsMember determines whether the user belongs to the team.
+func (this *Team) IsMember(user *User) bool {
+    return !DB.Where(&TeamMember{TeamId: this.Id, UserId: user.Id}).First(new(TeamMember)).RecordNotFound()
+}
+
+// Members lists the users belonging to the team.
+func (this *Team) Members() ([]*User, error) {
+    var memberships []TeamMember
+    if err := DB.Where(&TeamMember{TeamId: this.Id}).Find(&memberships).Error; err != nil {
+        return nil, NewError(err)
+    }
+
+    members := make([]*User, 0, len(memberships))
+    for _, m := range memberships {
+        user, err := Resolver.ById(m.UserId)
+        if err != nil {
+            continue
+        }
+        members = append(members, user)
+    }
+    return members, nil
+}
+
+// AddMember grants the user access to the team key.  The admin must be an existing member with an active session.
+func (this *Team) AddMember(admin *User, user *User) error {
+    key, err := this.key(admin)
+    if err != nil {
+        return err
+    }
+    return this.wrapKey(key, admin, user)
+}
+
+// RemoveMember revokes the user's membership and rotates the team key, re-encrypting every entry shared with the team
+// and re-wrapping the new key for each remaining member.  The admin must be a remaining member with an active session.
+// As with any revocation, this cannot recall data the removed member has already decrypted.
+func (this *Team) RemoveMember(admin *User, user *User) error {
+    if admin.Id == user.Id {
+        return NewError("Cannot remove self from team '"+this.Name+"'", admin)
+    }
+
+    oldKey, err := this.key(admin)
+    if err != nil {
+        return err
+    }
+    newKey := utils.RandomBytes(TeamKeySize)
+    if newKey == nil {
+        return NewError("RNG failure!", admin)
+    }
+
+    var entries []TeamEntry
+    if err := DB.Where(&TeamEntry{TeamId: this.Id}).Find(&entries).Error; err != nil {
+        return NewError(err, admin)
+    }
+    for i := range entries {
+        data, err := openWithKey(oldKey, entries[i].Data)
+        if err != nil {
+            return NewError(err, admin)
+        }
+        entries[i].Data, err = sealWithKey(newKey, data)
+        if err != nil {
+            return NewError(err, admin)
+        }
+    }
+
+    members, err := this.Members()
+    if err != nil {
+        return err
+    }
+    wrapped := make(map[int64]string)
+    for _, m := range members {
+        if m.Id == user.Id {
+            continue
+        }
+        wrapped[m.Id], _, err = admin.EncryptShared(newKey, nil, m)
+        if err != nil {
+            return err
+        }
+    }
+
+    tx := DB.Begin()
+    for i := range entries {
+        if err := tx.Save(&entries[i]).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, admin)
+        }
+    }
+    for id, w := range wrapped {
+        if err := tx.Model(TeamMember{}).Where(&TeamMember{TeamId: this.Id, UserId: id}).Updates(map[string]interface{}{"wrapper_id": admin.Id, "wrapped_key": w}).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, admin)
+        }
+    }
+    if err := tx.Where(&TeamMember{TeamId: this.Id, UserId: user.Id}).Delete(TeamMember{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, admin)
+    }
+    this.KeyVersion++
+    if err := tx.Save(this).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, admin)
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, admin)
+    }
+    return nil
+}
+
+// ReadEntry decrypts the fields of an entry shared with the team.  The member must have an active session.
+func (this *Team) ReadEntry(member *User, entryId string) (map[string]string, error) {
+    shared := new(TeamEntry)
+    if DB.Where(&TeamEntry{TeamId: this.Id, EntryId: entryId}).First(shared).RecordNotFound() {
+        return nil, NewError("Entry '"+entryId+"' not shared with team '"+this.Name+"'", member)
+    }
+
+    key, err := this.key(member)
+    if err != nil {
+        return nil, err
+    }
+    data, err := openWithKey(key, shared.Data)
+    if err != nil {
+        return nil, NewError(err, member)
+    }
+
+    var fields map[string]string
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return nil, NewError(err, member)
+    }
+    return fields, nil
+}
+
+// ShareWithGroup encrypts the entry's fields once under the team key so that every member of the team can read them.
+// The sharing user must hold delegate permission on the entry and be a member of the team.  Empty fields, and fields
+// which the sharing user is not permitted to read, are left out of the share; any other failure to read a field, such
+// as one which cannot be decrypted, fails the share.
+func (this *EntryView) ShareWithGroup(team *Team) error {
+    user := this.getUser()
+    if !user.Can("d", this) {
+        return NewError("Share permission denied", user, ErrPermission)
+    }
+
+    fields := make(map[string]string)
+    for _, f := range entryFields {
+        if len(*f.value(this)) == 0 {
+            continue
+        }
+        value, err := this.ReadField(f.name)
+        if errors.Is(err, ErrPermission) {
+            continue
+        } else if err != nil {
+            return err
+        }
+        fields[f.name] = value
+    }
+
+    bytes, err := json.Marshal(fields)
+    if err != nil {
+        return NewError(err, user)
+    }
+    key, err := team.key(user)
+    if err != nil {
+        return err
+    }
+    data, err := sealWithKey(key, bytes)
+    if err != nil {
+        return NewError(err, user)
+    }
+
+    shared := new(TeamEntry)
+    DB.Where(&TeamEntry{TeamId: team.Id, EntryId: this.EntryId}).First(shared)
+    shared.TeamId = team.Id
+    shared.EntryId = this.EntryId
+    shared.Data = data
+    if err := DB.Save(shared).Error; err != nil {
+        return NewError(err, user)
+    }
+    return nil
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+)
+
+type TeamTestSuite struct {
+    suite.Suite
+}
+
+func (suite *TeamTestSuite) TestMembership() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("team.owner", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    alice, err := NewUser("alice", "password1")
+    if !a.NoError(err) {
+        return
+    }
+    defer alice.Drop()
+    bob, err := NewUser("bob", "password2")
+    if !a.NoError(err) {
+        return
+    }
+    defer bob.Drop()
+
+    team, err := NewTeam("operations", owner)
+    if !a.NoError(err) {
+        return
+    }
+    a.True(team.IsMember(owner))
+    a.False(team.IsMember(alice))
+
+    entry := newTestEntry(a, owner, "team.entry")
+    a.NoError(entry.WriteTitle("Router"))
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.ShareWithGroup(team))
+
+    a.NoError(team.AddMember(owner, alice))
+    a.NoError(team.AddMember(owner, bob))
+    members, err := team.Members()
+    if a.NoError(err) {
+        a.Len(members, 3)
+    }
+
+    for _, member := range []*User{alice, bob} {
+        fields, err := team.ReadEntry(member, "team.entry")
+        if a.NoError(err) {
+            a.Equal("Router", fields["title"])
+            a.Equal("hunter2", fields["password"])
+        }
+    }
+
+    a.NoError(team.RemoveMember(owner, bob))
+    a.False(team.IsMember(bob))
+    a.Equal(2, team.KeyVersion)
+
+    _, err = team.ReadEntry(bob, "team.entry")
+    a.Error(err)
+    fields, err := team.ReadEntry(alice, "team.entry")
+    if a.NoError(err) {
+        a.Equal("hunter2", fields["password"])
+    }
+
+    // a field which cannot be decrypted fails the share rather than being left out
+    entry.Password = entry.Title
+    a.Error(entry.ShareWithGroup(team))
+    fields, err = team.ReadEntry(alice, "team.entry")
+    if a.NoError(err) {
+        a.Equal("hunter2", fields["password"])
+    }
+}
+
+func TestTeamTestSuite(t *testing.T) {
+    suite.Run(t, new(TeamTestSuite))
+}
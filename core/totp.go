@@ -0,0 +1,230 @@
+package core
+
+import (
+    "crypto/hmac"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "hash"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The totpAlgorithms map gives the hash function of each of the HMAC algorithms supported by TOTP.
+var totpAlgorithms = map[string]func() hash.Hash{
+    "SHA1":   sha1.New,
+    "SHA256": sha256.New,
+    "SHA512": sha512.New,
+}
+
+// The totpEncoding is the unpadded base32 encoding used for TOTP secrets.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// The TOTPConfig structure holds the secret and parameters of a time-based one-time password generator, as described by
+// RFC 6238.
+type TOTPConfig struct {
+    // The Secret is the shared secret key.
+    Secret []byte
+    // The Algorithm is the name of the HMAC hash function, which is one of SHA1, SHA256 and SHA512.
+    Algorithm string
+    // The Digits is the number of digits in each code, from 6 to 8.
+    Digits int
+    // The Period is the number of seconds for which each code is valid.
+    Period int
+    // The Issuer is the optional name of the service which issued the secret.
+    Issuer string
+    // The Account is the optional name of the account at the issuer.
+    Account string
+}
+
+// DefaultTOTPConfig produces the configuration commonly used by services, with HMAC-SHA1, 6 digits and a period of 30
+// seconds.
+func DefaultTOTPConfig(secret []byte) *TOTPConfig {
+    return &TOTPConfig{Secret: secret, Algorithm: "SHA1", Digits: 6, Period: 30}
+}
+
+// ParseTOTP parses either an otpauth://totp/ URI, as commonly presented by services in QR codes, or a bare base32 encoded
+// secret, which uses the default parameters.
+func ParseTOTP(value string) (*TOTPConfig, error) {
+    value = strings.TrimSpace(value)
+    if !strings.HasPrefix(strings.ToLower(value), "otpauth:") {
+        secret, err := decodeTOTPSecret(value)
+        if err != nil {
+            return nil, err
+        }
+        config := DefaultTOTPConfig(secret)
+        return config, config.check()
+    }
+
+    u, err := url.Parse(value)
+    if err != nil {
+        return nil, NewError(err)
+    }
+    if !strings.EqualFold(u.Host, "totp") {
+        return nil, NewError("Unsupported OTP type '" + u.Host + "'")
+    }
+
+    query := u.Query()
+    secret, err := decodeTOTPSecret(query.Get("secret"))
+    if err != nil {
+        return nil, err
+    }
+    config := DefaultTOTPConfig(secret)
+    if algorithm := query.Get("algorithm"); len(algorithm) > 0 {
+        config.Algorithm = strings.ToUpper(algorithm)
+    }
+    if digits := query.Get("digits"); len(digits) > 0 {
+        if config.Digits, err = strconv.Atoi(digits); err != nil {
+            return nil, NewError("Invalid TOTP digits '" + digits + "'")
+        }
+    }
+    if period := query.Get("period"); len(period) > 0 {
+        if config.Period, err = strconv.Atoi(period); err != nil {
+            return nil, NewError("Invalid TOTP period '" + period + "'")
+        }
+    }
+
+    label := strings.TrimPrefix(u.Path, "/")
+    if i := strings.Index(label, ":"); i >= 0 {
+        config.Issuer = strings.TrimSpace(label[:i])
+        label = label[i+1:]
+    }
+    config.Account = strings.TrimSpace(label)
+    if issuer := query.Get("issuer"); len(issuer) > 0 {
+        config.Issuer = issuer
+    }
+    return config, config.check()
+}
+
+// The decodeTOTPSecret function decodes a base32 secret, ignoring case, spaces and padding.
+func decodeTOTPSecret(value string) ([]byte, error) {
+    value = strings.ToUpper(strings.Replace(value, " ", "", -1))
+    secret, err := totpEncoding.DecodeString(strings.TrimRight(value, "="))
+    if err != nil {
+        return nil, NewError("Invalid TOTP secret")
+    }
+    return secret, nil
+}
+
+// The check function ensures that the parameters of the configuration are supported.
+func (this *TOTPConfig) check() error {
+    if len(this.Secret) == 0 {
+        return NewError("Missing TOTP secret")
+    }
+    if _, ok := totpAlgorithms[this.Algorithm]; !ok {
+        return NewError("Unsupported TOTP algorithm '" + this.Algorithm + "'")
+    }
+    if this.Digits < 6 || this.Digits > 8 {
+        return NewError(fmt.Sprintf("Unsupported TOTP digits %d", this.Digits))
+    }
+    if this.Period <= 0 {
+        return NewError(fmt.Sprintf("Invalid TOTP period %d", this.Period))
+    }
+    return nil
+}
+
+// URI produces the otpauth URI describing the configuration.
+func (this *TOTPConfig) URI() string {
+    label := this.Account
+    if len(this.Issuer) > 0 {
+        label = this.Issuer + ":" + label
+    }
+
+    query := url.Values{}
+    query.Set("secret", totpEncoding.EncodeToString(this.Secret))
+    query.Set("algorithm", this.Algorithm)
+    query.Set("digits", strconv.Itoa(this.Digits))
+    query.Set("period", strconv.Itoa(this.Period))
+    if len(this.Issuer) > 0 {
+        query.Set("issuer", this.Issuer)
+    }
+    u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + label, RawQuery: query.Encode()}
+    return u.String()
+}
+
+// Generate computes the code which is valid at the given time.
+func (this *TOTPConfig) Generate(at time.Time) (string, error) {
+    if err := this.check(); err != nil {
+        return "", err
+    }
+    if at.Unix() < 0 {
+        return "", NewError("TOTP time precedes the epoch")
+    }
+
+    var counter [8]byte
+    binary.BigEndian.PutUint64(counter[:], uint64(at.Unix())/uint64(this.Period))
+    mac := hmac.New(totpAlgorithms[this.Algorithm], this.Secret)
+    mac.Write(counter[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    modulus := uint32(1)
+    for i := 0; i < this.Digits; i++ {
+        modulus *= 10
+    }
+    return fmt.Sprintf("%0*d", this.Digits, code%modulus), nil
+}
+
+// WriteTOTP writes the TOTP secret of the entry, provided that the user has appropriate permissions.  The value may be
+// either an otpauth://totp/ URI or a bare base32 encoded secret, and is stored as an otpauth URI.
+func (this *EntryView) WriteTOTP(value string) (err error) {
+    defer func() { this.written("totp", err) }()
+    config, err := ParseTOTP(value)
+    if err != nil {
+        if e, ok := err.(*Error); ok {
+            return e.SetUser(this.getUser())
+        }
+        return err
+    }
+
+    if this.getUser().Can("w", this) {
+        data, err := this.encryptField("totp", []byte(config.URI()))
+        if err != nil {
+            return err
+        }
+        this.TotpSecret = data
+        return nil
+    }
+    return NewError("TOTP secret write permission denied", this.getUser(), ErrPermission)
+}
+
+// ReadTOTP reads the TOTP configuration of the entry, provided that the user has appropriate permissions.
+func (this *EntryView) ReadTOTP() (result *TOTPConfig, err error) {
+    defer func() { this.audit("read totp", err) }()
+    if !this.getUser().Can("r", this) {
+        return nil, NewError("TOTP secret read permission denied", this.getUser(), ErrPermission)
+    }
+    if len(this.TotpSecret) == 0 {
+        return nil, NewError("Entry has no TOTP secret", this.getUser(), ErrNotFound)
+    }
+
+    data, err := this.decryptField("totp")
+    if err != nil {
+        return nil, err
+    }
+    config, err := ParseTOTP(string(data))
+    if err != nil {
+        return nil, NewError(err, this.getUser())
+    }
+    return config, nil
+}
+
+// GenerateTOTP computes the TOTP code of the entry which is valid at the given time, provided that the user has
+// appropriate permissions and an active session.
+func (this *EntryView) GenerateTOTP(at time.Time) (string, error) {
+    config, err := this.ReadTOTP()
+    if err != nil {
+        return "", err
+    }
+    code, err := config.Generate(at)
+    if err != nil {
+        return "", NewError(err, this.getUser())
+    }
+    return code, nil
+}
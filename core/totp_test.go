@@ -0,0 +1,173 @@
+package core
+
+import (
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type TOTPTestSuite struct {
+    suite.Suite
+}
+
+func (suite *TOTPTestSuite) TestRFC6238() {
+    a := assert.New(suite.T())
+
+    secrets := map[string]string{
+        "SHA1":   "12345678901234567890",
+        "SHA256": "12345678901234567890123456789012",
+        "SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+    }
+    vectors := []struct {
+        time  int64
+        codes map[string]string
+    }{
+        {59, map[string]string{"SHA1": "94287082", "SHA256": "46119246", "SHA512": "90693936"}},
+        {1111111109, map[string]string{"SHA1": "07081804", "SHA256": "68084774", "SHA512": "25091201"}},
+        {1111111111, map[string]string{"SHA1": "14050471", "SHA256": "67062674", "SHA512": "99943326"}},
+        {1234567890, map[string]string{"SHA1": "89005924", "SHA256": "91819424", "SHA512": "93441116"}},
+        {2000000000, map[string]string{"SHA1": "69279037", "SHA256": "90698825", "SHA512": "38618901"}},
+        {20000000000, map[string]string{"SHA1": "65353130", "SHA256": "77737706", "SHA512": "47863826"}},
+    }
+
+    for _, v := range vectors {
+        for algorithm, expected := range v.codes {
+            config := &TOTPConfig{Secret: []byte(secrets[algorithm]), Algorithm: algorithm, Digits: 8, Period: 30}
+            code, err := config.Generate(time.Unix(v.time, 0))
+            if a.NoError(err) {
+                a.Equal(expected, code, "%s at %d", algorithm, v.time)
+            }
+        }
+    }
+}
+
+func (suite *TOTPTestSuite) TestParse() {
+    a := assert.New(suite.T())
+
+    config, err := ParseTOTP("otpauth://totp/Example:alice@example.com?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=Example&digits=8")
+    if a.NoError(err) {
+        a.Equal([]byte("12345678901234567890"), config.Secret)
+        a.Equal("SHA1", config.Algorithm)
+        a.Equal(8, config.Digits)
+        a.Equal(30, config.Period)
+        a.Equal("Example", config.Issuer)
+        a.Equal("alice@example.com", config.Account)
+
+        parsed, err := ParseTOTP(config.URI())
+        if a.NoError(err) {
+            a.Equal(config, parsed)
+        }
+    }
+
+    config, err = ParseTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+    if a.NoError(err) {
+        a.Equal([]byte("12345678901234567890"), config.Secret)
+        a.Equal(6, config.Digits)
+    }
+
+    _, err = ParseTOTP("otpauth://hotp/Example?secret=GEZDGNBV&counter=1")
+    a.Error(err)
+    _, err = ParseTOTP("otpauth://totp/Example?secret=GEZDGNBV&digits=4")
+    a.Error(err)
+    _, err = ParseTOTP("otpauth://totp/Example?secret=GEZDGNBV&algorithm=MD5")
+    a.Error(err)
+    _, err = ParseTOTP("not base32!")
+    a.Error(err)
+}
+
+func (suite *TOTPTestSuite) TestEntry() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            _, err = entry.GenerateTOTP(time.Unix(59, 0))
+            if a.Error(err) {
+                a.Equal(ErrNotFound, err.(*Error).Code)
+            }
+
+            a.NoError(entry.WriteTOTP("otpauth://totp/Example?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8"))
+            a.NotContains(entry.TotpSecret, "GEZDGNBV")
+            code, err := entry.GenerateTOTP(time.Unix(59, 0))
+            if a.NoError(err) {
+                a.Equal("94287082", code)
+            }
+
+            permissions, err := u.Sign([]byte("w"))
+            a.NoError(err)
+            entry.Permissions = permissions
+            _, err = entry.GenerateTOTP(time.Unix(59, 0))
+            if a.Error(err) {
+                a.Equal(ErrPermission, err.(*Error).Code)
+            }
+
+            entry.Permissions, err = u.Sign([]byte("rw"))
+            a.NoError(err)
+            u.EndSession()
+            _, err = entry.GenerateTOTP(time.Unix(59, 0))
+            a.Error(err)
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *TOTPTestSuite) TestSharedEntry() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("admin", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer owner.Drop()
+    recipient, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer recipient.Drop()
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WriteTOTP("otpauth://totp/Example?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8"))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+
+    // the secret is stored in the totp_secret column, which is updated when the recipient first reads it
+    _, err = entry.ShareWith(recipient, "r")
+    if a.NoError(err) {
+        loaded, err := LoadEntry("entry", recipient.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(recipient)) {
+            code, err := loaded.GenerateTOTP(time.Unix(59, 0))
+            if a.NoError(err) {
+                a.Equal("94287082", code)
+            }
+        }
+
+        loaded, err = LoadEntry("entry", recipient.Id)
+        if a.NoError(err) && a.NoError(loaded.AttachUser(recipient)) {
+            a.Equal(int64(0), loaded.SharedBy)
+            code, err := loaded.GenerateTOTP(time.Unix(59, 0))
+            if a.NoError(err) {
+                a.Equal("94287082", code)
+            }
+        }
+    }
+
+    previous := entry.TotpSecret
+    if a.NoError(entry.ReencryptField("totp")) {
+        a.NotEqual(previous, entry.TotpSecret)
+        stored := new(EntryView)
+        if a.NoError(DB.First(stored, entry.Id).Error) {
+            a.Equal(entry.TotpSecret, stored.TotpSecret)
+        }
+        code, err := entry.GenerateTOTP(time.Unix(59, 0))
+        if a.NoError(err) {
+            a.Equal("94287082", code)
+        }
+    }
+}
+
+func TestTOTPTestSuite(t *testing.T) {
+    suite.Run(t, new(TOTPTestSuite))
+}
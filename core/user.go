@@ -3,15 +3,21 @@ package core
 import (
     "crypto/aes"
     "crypto/cipher"
-    "crypto/ecdsa"
-    "crypto/elliptic"
-    "crypto/rand"
+    "crypto/hmac"
+    "crypto/sha256"
     "crypto/sha512"
     "encoding/asn1"
     "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
     "github.com/awm/passrep/utils"
+    "github.com/jinzhu/gorm"
+    "log"
     "math/big"
     "strings"
+    "sync"
     "time"
 )
 
@@ -30,12 +36,44 @@ type User struct {
     CryptoSalt string `sql:"not null;unique"`
     // The SigningSalt is a base64 encoded random value used when generating the user's ECDSA keys.
     SigningSalt string `sql:"not null;unique"`
+    // KdfIterations is the number of PBKDF2 iterations used when deriving the user's keys from their password.  Zero means
+    // the count configured for the package, which is how users stored before the column existed are handled.
+    KdfIterations int
+    // The KdfAlgorithm names the function used when deriving the user's keys from their password, either KdfPbkdf2 or
+    // KdfArgon2id.  Empty means KdfPbkdf2.
+    KdfAlgorithm string
+    // KdfTime is the Argon2id time parameter used when deriving the user's keys.
+    KdfTime uint32
+    // KdfMemory is the Argon2id memory parameter, in KiB, used when deriving the user's keys.
+    KdfMemory uint32
+    // KdfParallelism is the Argon2id parallelism parameter used when deriving the user's keys.
+    KdfParallelism uint8
 
     // PublicKey is the user's current public key.
     PublicKey string `sql:"not null;unique"`
+    // The WrappedDataKey is the user's random data encryption key, encrypted under the key derived from their password and
+    // base64 encoded.  The user's own data is encrypted under the data key, so that it can be rotated without changing the
+    // password.  Empty means a legacy user whose data is encrypted directly under the derived key; see RotateDEK.
+    WrappedDataKey string
+    // The NonceCounter is the number of nonces the user has drawn from their counter for encryption while CounterNonces
+    // is set.  It only ever increases, and is advanced in the database directly rather than here, so the value held here
+    // is only that when the user was loaded.
+    NonceCounter int64
+    // FailedLogins is the number of consecutive failed attempts to start a session with a password.
+    FailedLogins int `sql:"not null;default:0"`
+    // LastFailedLogin is the time of the most recent failed attempt to start a session, or nil if there has been none
+    // since the last success.
+    LastFailedLogin *time.Time
 
     // The keys field is a reference to the user's private keys and is only potentially valid while the user has an active session.
     keys *Keys `sql:"-"`
+    // The keysLock guards the keys field, so that a session may be used from several goroutines at once and ended while
+    // in use.  Operations using the keys hold it for reading, while starting, ending and changing the session hold it for
+    // writing.
+    keysLock sync.RWMutex `sql:"-"`
+    // The detached field marks a user read from a vault file rather than loaded from the database, whose Id may belong
+    // to another user or to none, so that its failed logins are counted only in the structure.
+    detached bool `sql:"-"`
 }
 
 const (
@@ -43,22 +81,45 @@ const (
     ValidPermissions = "rwd"
 )
 
+const (
+    // MaxSaltAttempts is the number of times NewUser will generate salts in search of a pair not already in use.
+    MaxSaltAttempts = 3
+)
+
+// The randomBytes variable is the source of random salts, which may be replaced when testing.
+var randomBytes = utils.RandomBytes
+
 // The NewUser function instantiates a new user object and adds the user to the database.
+// Salts must be unique, so on the extremely unlikely event of a collision with an existing user fresh salts are generated,
+// up to MaxSaltAttempts times.  Keys are derived using PBKDF2 with the configured iteration count.
 func NewUser(name string, password string) (*User, error) {
+    return NewUserWithKdf(name, password, KdfPbkdf2, KdfParams{Iterations: config.KdfIterations})
+}
+
+// NewUserWithKdf instantiates a new user object whose keys are derived using the named key derivation function with the
+// given parameters, and adds the user to the database.
+func NewUserWithKdf(name string, password string, algo string, params KdfParams) (*User, error) {
     user := new(User)
     user.Name = name
 
-    cryptoSalt := utils.RandomBytes(32)
-    if cryptoSalt == nil {
-        return nil, NewError("RNG failure!")
+    switch algo {
+    case KdfPbkdf2:
+        if params.Iterations <= 0 {
+            return nil, NewError(fmt.Sprintf("Invalid KDF iteration count %d", params.Iterations), name)
+        }
+        user.KdfIterations = params.Iterations
+    case KdfArgon2id:
+        user.KdfTime = params.Time
+        user.KdfMemory = params.Memory
+        user.KdfParallelism = params.Parallelism
+    default:
+        return nil, NewError("Unknown key derivation function '"+algo+"'", name)
     }
-    user.CryptoSalt = base64.StdEncoding.EncodeToString(cryptoSalt)
+    user.KdfAlgorithm = algo
 
-    signingSalt := utils.RandomBytes(32)
-    if signingSalt == nil {
-        return nil, NewError("RNG failure!")
+    if err := user.generateSalts(); err != nil {
+        return nil, err
     }
-    user.SigningSalt = base64.StdEncoding.EncodeToString(signingSalt)
 
     keys, err := MakeKeys(user, password)
     if err != nil {
@@ -71,41 +132,912 @@ func NewUser(name string, password string) (*User, error) {
         return nil, NewError(e)
     }
 
-    DB.Create(user)
+    keys.DataKey = utils.RandomBytes(32)
+    if keys.DataKey == nil {
+        return nil, NewError("RNG failure!", name)
+    }
+    if user.WrappedDataKey, err = sealWithKey(keys.CryptoKey, keys.DataKey); err != nil {
+        return nil, err
+    }
+
+    if err := DB.Create(user).Error; err != nil {
+        return nil, NewError(err, name)
+    }
     return user, nil
 }
 
+// The generateSalts function replaces the user's salts with fresh random ones which are not in use by any user.
+func (this *User) generateSalts() error {
+    for attempt := 0; attempt < MaxSaltAttempts; attempt++ {
+        cryptoSalt := randomBytes(32)
+        if cryptoSalt == nil {
+            return NewError("RNG failure!")
+        }
+        this.CryptoSalt = base64.StdEncoding.EncodeToString(cryptoSalt)
+
+        signingSalt := randomBytes(32)
+        if signingSalt == nil {
+            return NewError("RNG failure!")
+        }
+        this.SigningSalt = base64.StdEncoding.EncodeToString(signingSalt)
+
+        if this.CryptoSalt != this.SigningSalt && !saltInUse(this.CryptoSalt) && !saltInUse(this.SigningSalt) {
+            return nil
+        }
+    }
+    return NewError("Unable to generate unique salts", this.Name)
+}
+
+// The saltInUse function determines whether any existing user has the given salt as either of their salts.
+func saltInUse(salt string) bool {
+    var count int
+    DB.Model(User{}).Where("crypto_salt = ? OR signing_salt = ?", salt, salt).Count(&count)
+    return count > 0
+}
+
 // LoadUser instantiates an existing user from the database.
 func LoadUser(name string) (*User, error) {
     user := new(User)
     if DB.Where(&User{Name: name}).First(user).RecordNotFound() {
-        return nil, NewError("User '" + name + "' not found")
+        return nil, NewError("User '" + name + "' not found", ErrNotFound)
     }
     return user, nil
 }
 
-// Drop removes the user from the database, but does not delete the corresponding Go structure.
-func (this *User) Drop() {
-    DB.Delete(this)
+// The DependentEntriesError type reports the views of other users which depend upon a user who is to be dropped, either
+// because the user is the authority which signed their permissions, or because the user shared them and they have not
+// yet been accepted, along with the team memberships of other users whose team key the user wrapped.
+type DependentEntriesError struct {
+    // The Err is the underlying error describing the failure.
+    Err *Error
+    // The Entries are the views of other users which depend upon the user.
+    Entries []*EntryView
+    // The Memberships are the team memberships of other users holding a team key wrapped by the user.
+    Memberships []*TeamMember
+}
+
+// Error produces a string describing the error.
+func (this *DependentEntriesError) Error() string {
+    return this.Err.Error()
+}
+
+// Unwrap provides the underlying error.
+func (this *DependentEntriesError) Unwrap() error {
+    return this.Err
+}
+
+// Drop removes the user from the database, along with their entry views, attachments, team memberships, read-only
+// links, and every grant naming them as grantor or grantee, but does not delete the corresponding Go structure.  Audit
+// entries are kept.  A user who is the authority for, or the pending sharer of, entries belonging to other users cannot
+// be dropped, since those entries would become unverifiable or unreadable; nor can a user who wrapped the team key of
+// another member, since that member could no longer unwrap it.  The dependent entries and memberships are reported
+// through a DependentEntriesError.  The entries must be deleted or have their permissions reissued by another authority
+// first, and the memberships must have their keys wrapped again by another member, as by AddMember.  All changes are
+// made in a single transaction.
+func (this *User) Drop() error {
+    var dependents []*EntryView
+    err := DB.Unscoped().Where("user_id <> ? AND (authority_id = ? OR shared_by = ?)", this.Id, this.Id, this.Id).Find(&dependents).Error
+    if err != nil {
+        return NewError(err, this)
+    }
+    var memberships []*TeamMember
+    if err := DB.Where("wrapper_id = ? AND user_id <> ?", this.Id, this.Id).Find(&memberships).Error; err != nil {
+        return NewError(err, this)
+    }
+    if len(dependents) > 0 || len(memberships) > 0 {
+        var reasons []string
+        if len(dependents) > 0 {
+            ids := make([]string, len(dependents))
+            for i, e := range dependents {
+                ids[i] = e.EntryId
+            }
+            msg := fmt.Sprintf("%d entries of other users depend on the user: %s", len(dependents), strings.Join(ids, ", "))
+            reasons = append(reasons, msg)
+        }
+        if len(memberships) > 0 {
+            msg := fmt.Sprintf("%d team memberships of other users hold keys wrapped by the user", len(memberships))
+            reasons = append(reasons, msg)
+        }
+        return &DependentEntriesError{NewError(strings.Join(reasons, "; "), this), dependents, memberships}
+    }
+
+    tx := DB.Begin()
+    if err := tx.Unscoped().Where("user_id = ?", this.Id).Delete(EntryView{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Where("user_id = ?", this.Id).Delete(Attachment{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Where("user_id = ?", this.Id).Delete(TeamMember{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Where("grantor = ? OR grantee = ?", this.Name, this.Name).Delete(Grant{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Where("user_id = ?", this.Id).Delete(SharedLink{}).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Delete(this).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// Rename changes the user's name, which must not already be in use, and updates every stored grant naming the user as
+// grantor or grantee to match.  Grants given by the user are signed afresh, so the user must have an active session.
+// Grants given to the user by others cannot be re-signed without their grantors' keys, so while they are renamed along
+// with the rest their signatures no longer verify until the grantors issue them again.  Read-only links already given
+// out by the user carry the old name and can no longer be redeemed.  All changes are made in a single transaction.
+func (this *User) Rename(newName string) error {
+    if len(newName) == 0 {
+        return NewError("No name given", this)
+    }
+    if !this.CanSign() {
+        return NewError("Private key unavailable", this, ErrCrypto)
+    }
+    var count int
+    if err := DB.Model(User{}).Where("name = ?", newName).Count(&count).Error; err != nil {
+        return NewError(err, this)
+    }
+    if count > 0 {
+        return NewError("User '"+newName+"' already exists", this)
+    }
+
+    var grants []*Grant
+    if err := DB.Where("grantor = ? OR grantee = ?", this.Name, this.Name).Find(&grants).Error; err != nil {
+        return NewError(err, this)
+    }
+    for _, g := range grants {
+        if g.Grantee == this.Name {
+            g.Grantee = newName
+        }
+        if g.Grantor == this.Name {
+            g.Grantor = newName
+            if err := g.sign(this); err != nil {
+                return err
+            }
+        }
+    }
+
+    tx := DB.Begin()
+    for _, g := range grants {
+        if err := tx.Save(g).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    if err := tx.Model(&User{Id: this.Id}).UpdateColumn("name", newName).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+
+    this.Name = newName
+    return nil
+}
+
+// StartSession derives the user's private keys from the password, making them available for encryption and signing.
+// The derived public key must match the stored one, so an incorrect password fails here rather than producing unusable
+// ciphertext or signatures later.
+//
+// Failed attempts are counted in the database, and once the configured number fail in a row the user is locked out for a
+// while, as reported by IsLocked, with each further failure doubling the time.  Attempts made while locked out are
+// refused before the keys are derived, so that guessing costs neither a password check nor the CPU time of one, and are
+// not counted.  A successful attempt resets the count.
+//
+// A user whose keys are derived with fewer PBKDF2 iterations than the configured count is upgraded to that count while the
+// password is at hand, just as by RekeyKdf, so that raising the configured count strengthens existing users as they log
+// in.  Like any change of keys, this invalidates read-only links the user has signed.  Should the upgrade fail, the
+// failure is logged, the session continues under the existing keys, and the upgrade is attempted again at the next
+// session.  A user which has not been stored, or which was read from a vault file, is never upgraded.
+func (this *User) StartSession(password string) error {
+    keys, err := this.checkPassword(password)
+    if err != nil {
+        return err
+    }
+
+    this.keysLock.Lock()
+    if this.keys != nil {
+        this.keys.Wipe()
+    }
+    this.keys = keys
+    this.keysLock.Unlock()
+
+    if this.needsKdfUpgrade() {
+        if err := this.RekeyKdf(password, config.KdfIterations); err != nil {
+            log.Print(err)
+        }
+    }
+    return nil
+}
+
+// IsLocked determines whether the user is locked out after too many failed logins, and if so, for how much longer.
+func (this *User) IsLocked() (bool, time.Duration) {
+    lockout := config.lockoutDuration(this.FailedLogins)
+    if lockout == 0 || this.LastFailedLogin == nil {
+        return false, 0
+    }
+    remaining := this.LastFailedLogin.Add(lockout).Sub(time.Now())
+    if remaining <= 0 {
+        return false, 0
+    }
+    return true, remaining
+}
+
+// The loadFailedLogins function refreshes the count and time of failed logins from the database, so that failures made
+// through other copies of the user are taken into account.  A user which has not been stored, or which was read from a
+// vault file, is left alone.
+func (this *User) loadFailedLogins() error {
+    if !this.isStored() {
+        return nil
+    }
+    var stored User
+    if err := DB.Select("failed_logins, last_failed_login").Where("id = ?", this.Id).First(&stored).Error; err != nil {
+        return NewError(err, this)
+    }
+    this.FailedLogins = stored.FailedLogins
+    this.LastFailedLogin = stored.LastFailedLogin
+    return nil
+}
+
+// The recordFailedLogin function counts a failed login, recording the current time as that of the last failure.  The
+// stored count is incremented in place, so that failures made at the same time through other copies of the user are all
+// counted, and then read back.  Only the database row of a stored user is updated.
+func (this *User) recordFailedLogin() error {
+    now := time.Now()
+    if !this.isStored() {
+        this.FailedLogins++
+        this.LastFailedLogin = &now
+        return nil
+    }
+    columns := map[string]interface{}{"failed_logins": gorm.Expr("failed_logins + ?", 1), "last_failed_login": &now}
+    if err := DB.Model(&User{}).Where("id = ?", this.Id).UpdateColumns(columns).Error; err != nil {
+        return NewError(err, this)
+    }
+    return this.loadFailedLogins()
+}
+
+// The resetFailedLogins function clears the count and time of failed logins.  Only the database row of a stored user is
+// updated.
+func (this *User) resetFailedLogins() error {
+    if this.isStored() {
+        columns := map[string]interface{}{"failed_logins": 0, "last_failed_login": nil}
+        if err := DB.Model(&User{}).Where("id = ?", this.Id).UpdateColumns(columns).Error; err != nil {
+            return NewError(err, this)
+        }
+    }
+    this.FailedLogins = 0
+    this.LastFailedLogin = nil
+    return nil
+}
+
+// The isStored function determines whether the user corresponds to a row of the database, which is neither the case for
+// a user which has not been stored yet nor for one read from a vault file.
+func (this *User) isStored() bool {
+    return this.Id != 0 && !this.detached
+}
+
+// The needsKdfUpgrade function determines whether the user is stored and has keys derived with PBKDF2 using fewer
+// iterations than the configured count.
+func (this *User) needsKdfUpgrade() bool {
+    if !this.isStored() {
+        return false
+    }
+    if this.KdfAlgorithm != "" && this.KdfAlgorithm != KdfPbkdf2 {
+        return false
+    }
+    return this.kdfIterations() < config.KdfIterations
+}
+
+// StartSessionWithKeys starts a session with keys already derived for the user, such as those restored by UnsealKeys,
+// rather than deriving them from the password again.  The keys must match the user's public key.
+func (this *User) StartSessionWithKeys(keys *Keys) error {
+    if keys == nil || keys.SigningKey == nil {
+        return NewError("Keys not available", this)
+    }
+    encoded, err := keys.EncodedPublicKey()
+    if err != nil {
+        return NewError(err, this)
+    }
+    if !utils.ConstantTimeEqual([]byte(encoded), []byte(this.PublicKey)) {
+        return NewError("Keys do not belong to the user", this, ErrAuthentication)
+    }
+    if keys.DataKey == nil {
+        if err := keys.unwrapDataKey(this); err != nil {
+            return err
+        }
+    }
+
+    this.keysLock.Lock()
+    defer this.keysLock.Unlock()
+    if this.keys != nil && this.keys != keys {
+        this.keys.Wipe()
+    }
+    this.keys = keys
+    return nil
+}
+
+// The copyFields function copies the stored fields of another user into this one, leaving the session alone.
+func (this *User) copyFields(from *User) {
+    this.Id = from.Id
+    this.CreatedAt = from.CreatedAt
+    this.UpdatedAt = from.UpdatedAt
+    this.Name = from.Name
+    this.CryptoSalt = from.CryptoSalt
+    this.SigningSalt = from.SigningSalt
+    this.KdfIterations = from.KdfIterations
+    this.KdfAlgorithm = from.KdfAlgorithm
+    this.KdfTime = from.KdfTime
+    this.KdfMemory = from.KdfMemory
+    this.KdfParallelism = from.KdfParallelism
+    this.PublicKey = from.PublicKey
+    this.WrappedDataKey = from.WrappedDataKey
+    this.NonceCounter = from.NonceCounter
+    this.FailedLogins = from.FailedLogins
+    this.LastFailedLogin = from.LastFailedLogin
+}
+
+// The checkPassword function derives the user's keys from the password, and only returns them if the derived public key
+// matches the stored one.  Every check of a password goes through here, so that each is subject to the lockout and
+// counting of failed logins described for StartSession.
+func (this *User) checkPassword(password string) (*Keys, error) {
+    if err := this.loadFailedLogins(); err != nil {
+        return nil, err
+    }
+    if locked, remaining := this.IsLocked(); locked {
+        msg := fmt.Sprintf("Too many failed logins, locked for %v", remaining.Round(time.Second))
+        return nil, NewError(msg, this, ErrAuthentication)
+    }
+
+    keys, err := this.matchPassword(password)
+    if err != nil {
+        if errors.Is(err, ErrAuthentication) {
+            if e := this.recordFailedLogin(); e != nil {
+                return nil, e
+            }
+        }
+        return nil, err
+    }
+    if this.FailedLogins > 0 {
+        if err := this.resetFailedLogins(); err != nil {
+            keys.Wipe()
+            return nil, err
+        }
+    }
+    return keys, nil
+}
+
+// The matchPassword function derives the user's keys from the password for checkPassword, and only returns them if the
+// derived public key matches the stored one.
+func (this *User) matchPassword(password string) (*Keys, error) {
+    keys, err := MakeKeys(this, password)
+    if err != nil {
+        return nil, err
+    }
+
+    encoded, err := keys.EncodedPublicKey()
+    if err != nil {
+        return nil, NewError(err, this)
+    }
+    if !utils.ConstantTimeEqual([]byte(encoded), []byte(this.PublicKey)) {
+        return nil, NewError("Incorrect password", this, ErrAuthentication)
+    }
+    if err := keys.unwrapDataKey(this); err != nil {
+        keys.Wipe()
+        return nil, err
+    }
+    return keys, nil
+}
+
+// VerifyPassword checks whether the password is correct for the user, without starting a session or otherwise
+// retaining the derived keys.  Failed checks count towards the lockout as for StartSession, and a locked out user fails
+// however the password is given.
+func (this *User) VerifyPassword(password string) bool {
+    keys, err := this.checkPassword(password)
+    if err != nil {
+        return false
+    }
+    defer keys.Wipe()
+    return true
+}
+
+// ChangePassword replaces the user's password, which changes both of the user's keys.  Fresh salts are generated, the
+// user's data key, if any, is wrapped under the new password-derived key, every view and attachment belonging to the
+// user is re-encrypted, the permissions of every view for which the user is authority and every grant the user has made
+// are re-signed under the new signing key, as by ResignGrants, and the user's team keys are re-wrapped.  All of the
+// changes are stored in a single transaction, and on success the user's session continues under the new keys.
+// Read-only links signed by the user are invalidated.  The old password is checked as for StartSession, so a locked out
+// user cannot change it, and a wrong one counts as a failed login.
+func (this *User) ChangePassword(oldPassword string, newPassword string) error {
+    return this.rekey(oldPassword, newPassword, func(user *User) error {
+        return user.generateSalts()
+    })
+}
+
+// RekeyKdf changes the number of PBKDF2 iterations used to derive the user's keys from their password, such as to
+// strengthen an older account.  The keys change as a result, so the user's data is moved over to them, and the password
+// is checked, just as for ChangePassword.
+func (this *User) RekeyKdf(password string, iterations int) error {
+    if iterations <= 0 {
+        return NewError(fmt.Sprintf("Invalid KDF iteration count %d", iterations), this)
+    }
+    if this.KdfAlgorithm != "" && this.KdfAlgorithm != KdfPbkdf2 {
+        return NewError("KDF iteration count only applies to "+KdfPbkdf2, this)
+    }
+    return this.rekey(password, password, func(user *User) error {
+        user.KdfIterations = iterations
+        return nil
+    })
+}
+
+// The kdfIterations function determines the number of PBKDF2 iterations to use for the user's keys.
+func (this *User) kdfIterations() int {
+    if this.KdfIterations > 0 {
+        return this.KdfIterations
+    }
+    return config.KdfIterations
+}
+
+// The rekey function verifies the old password, applies the change to a copy of the user, derives new keys for the copy
+// from the new password, and moves all of the user's encrypted and signed data over to the new keys in one transaction.
+// The user's session is locked for writing until the new keys are in place.  Only a stored user may be rekeyed, since the
+// changes are written to the rows holding the user's Id.
+func (this *User) rekey(oldPassword string, newPassword string, change func(*User) error) error {
+    if !this.isStored() {
+        return NewError("User has not been stored", this)
+    }
+    oldKeys, err := this.checkPassword(oldPassword)
+    if err != nil {
+        return err
+    }
+    // the session is held for writing throughout, so that nothing is encrypted under the old keys once they are replaced
+    this.keysLock.Lock()
+    defer this.keysLock.Unlock()
+
+    var previous, updated User
+    previous.copyFields(this)
+    previous.keys = oldKeys
+    defer oldKeys.Wipe()
+
+    updated.copyFields(this)
+    if err := change(&updated); err != nil {
+        return err
+    }
+    newKeys, err := MakeKeys(&updated, newPassword)
+    if err != nil {
+        return err
+    }
+    updated.keys = newKeys
+    if e := updated.updatePublicKey(); e != nil {
+        return e
+    }
+    if oldKeys.DataKey != nil {
+        newKeys.DataKey = append([]byte(nil), oldKeys.DataKey...)
+        if updated.WrappedDataKey, err = sealWithKey(newKeys.CryptoKey, newKeys.DataKey); err != nil {
+            return err
+        }
+    }
+
+    views := make(map[int64]*EntryView)
+    var owned []*EntryView
+    if err := DB.Unscoped().Where("user_id = ?", this.Id).Find(&owned).Error; err != nil {
+        return NewError(err, this)
+    }
+    for _, e := range owned {
+        var sharer *User
+        if e.SharedBy != 0 {
+            sharer, err = Resolver.ById(e.SharedBy)
+            if err != nil {
+                return NewError("Entry sharer not found", this, ErrNotFound)
+            }
+        }
+        for _, f := range encryptedFields {
+            value := f.value(e)
+            if len(*value) == 0 {
+                continue
+            }
+            var data []byte
+            if sharer != nil {
+                data, _, err = previous.DecryptShared(*value, "", sharer)
+            } else {
+                data, err = decryptBound(&previous, e, f.name, *value)
+            }
+            if err != nil {
+                return err
+            }
+            *value, err = updated.EncryptWithAD(data, e.fieldAD(f.name))
+            if err != nil {
+                return err
+            }
+        }
+        e.SharedBy = 0
+        e.Policy = CurrentPolicy
+        views[e.Id] = e
+    }
+
+    // Views this user has shared which the recipient has not yet accessed are encrypted under the secret shared with the
+    // recipient, which changes along with this user's keys.
+    var pending []*EntryView
+    if err := DB.Unscoped().Where("shared_by = ? AND user_id <> ?", this.Id, this.Id).Find(&pending).Error; err != nil {
+        return NewError(err, this)
+    }
+    for _, e := range pending {
+        recipient, err := Resolver.ById(e.UserId)
+        if err != nil {
+            return NewError("Entry recipient not found", this, ErrNotFound)
+        }
+        for _, f := range encryptedFields {
+            value := f.value(e)
+            if len(*value) == 0 {
+                continue
+            }
+            data, _, err := previous.DecryptShared(*value, "", recipient)
+            if err != nil {
+                return err
+            }
+            *value, _, err = updated.EncryptShared(data, nil, recipient)
+            if err != nil {
+                return err
+            }
+        }
+        views[e.Id] = e
+    }
+
+    grants, _, err := resignGrants(&previous, &updated, views)
+    if err != nil {
+        return err
+    }
+
+    memberships, err := rewrapTeamKeys(&previous, &updated)
+    if err != nil {
+        return err
+    }
+    attachments, err := reencryptAttachments(&previous, &updated)
+    if err != nil {
+        return err
+    }
+
+    tx := DB.Begin()
+    for _, e := range views {
+        // copies loaded before the change hold ciphertext under the old keys, so advance the version to make them conflict
+        e.Version++
+        if err := tx.Unscoped().Save(e).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    for i := range memberships {
+        if err := tx.Save(&memberships[i]).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    for i := range attachments {
+        if err := tx.Save(&attachments[i]).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    for _, g := range grants {
+        if err := tx.Save(g).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    // the nonce counter and failed logins are updated in the database directly, so the copy held here may be stale
+    if err := tx.Omit("nonce_counter", "failed_logins", "last_failed_login").Save(&updated).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+
+    if this.keys != nil {
+        this.keys.Wipe()
+    }
+    this.copyFields(&updated)
+    this.keys = updated.keys
+    return nil
+}
+
+// ResignGrants signs again, with the user's current signing key, the permissions of every entry view for which the user
+// is the authority and every grant the user has made, so that the access the user has given others rests on the current
+// key alone.  ChangePassword does the same as part of moving the user over to their new keys, verifying against the old
+// key what it signs with the new one.  The user must have an active session.  Signatures which do not verify against the
+// current key cannot be trusted and are left alone; the views holding them are reported through a StaleSignaturesError,
+// after the rest have been stored, so that the access they describe can be granted afresh.
+func (this *User) ResignGrants() error {
+    if !this.CanSign() {
+        return NewError("Private key unavailable", this, ErrCrypto)
+    }
+
+    views := make(map[int64]*EntryView)
+    grants, stale, err := resignGrants(this, this, views)
+    if err != nil {
+        return err
+    }
+
+    tx := DB.Begin()
+    for _, e := range views {
+        // copies loaded before now hold the old signatures, so advance the version to make them conflict
+        e.Version++
+        if err := tx.Unscoped().Save(e).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    for _, g := range grants {
+        if err := tx.Save(g).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+
+    if len(stale) > 0 {
+        msg := fmt.Sprintf("%d signed entries no longer verify", len(stale))
+        return &StaleSignaturesError{NewError(msg, this), stale}
+    }
+    return nil
+}
+
+// The resignGrants function verifies against the previous user's public key the permissions of each entry view for which
+// the user is the authority, and each grant the user has made, and signs again with the updated user's keys those which
+// verify.  The views are added to the map, taking the place of any copy already there, and the grants are produced, so
+// that the caller can store them; neither is stored here.  The views whose permissions do not verify are produced too.
+func resignGrants(previous *User, updated *User, views map[int64]*EntryView) ([]*Grant, []*EntryView, error) {
+    var signed []*EntryView
+    if err := DB.Unscoped().Where("authority_id = ?", previous.Id).Find(&signed).Error; err != nil {
+        return nil, nil, NewError(err, previous)
+    }
+    var stale []*EntryView
+    for _, e := range signed {
+        if v, ok := views[e.Id]; ok {
+            e = v
+        }
+        ok, permissions, err := previous.Verify(e.Permissions)
+        if err != nil || !ok {
+            stale = append(stale, e)
+            continue
+        }
+        if e.Permissions, err = updated.Sign(permissions); err != nil {
+            return nil, nil, err
+        }
+        if err := e.SignRow(updated); err != nil {
+            return nil, nil, err
+        }
+        views[e.Id] = e
+    }
+
+    var made []*Grant
+    if err := DB.Where(&Grant{Grantor: previous.Name}).Find(&made).Error; err != nil {
+        return nil, nil, NewError(err, previous)
+    }
+    key, err := base64.StdEncoding.DecodeString(previous.PublicKey)
+    if err != nil {
+        return nil, nil, NewError(err, previous)
+    }
+    var grants []*Grant
+    for _, g := range made {
+        data, err := g.content()
+        if err != nil {
+            return nil, nil, NewError(err, previous)
+        }
+        if ok, err := Verify(data, g.Signature, key); err != nil || !ok {
+            continue
+        }
+        if err := g.sign(updated); err != nil {
+            return nil, nil, err
+        }
+        grants = append(grants, g)
+    }
+    return grants, stale, nil
+}
+
+// RotateDEK replaces the user's data encryption key with a fresh random one without changing the password.  Every view
+// and attachment belonging to the user is re-encrypted under the new data key, which is then wrapped under the key
+// derived from the user's password.  For a legacy user, whose data is encrypted directly under the derived key, this
+// moves the data over to a data key for the first time.  Fields and attachments still encrypted without additional data
+// are bound to their entries as they are re-encrypted, and marked as such.  The user must have an active session, which
+// is locked for writing until the changes are stored in a single transaction.  Vault backups exported before the
+// rotation can no longer be imported.
+func (this *User) RotateDEK() error {
+    this.keysLock.Lock()
+    defer this.keysLock.Unlock()
+    if this.keys == nil || this.keys.CryptoKey == nil {
+        return NewError("Private key unavailable", this, ErrCrypto)
+    }
+
+    dataKey := utils.RandomBytes(32)
+    if dataKey == nil {
+        return NewError("RNG failure!", this)
+    }
+    wrapped, err := sealWithKey(this.keys.CryptoKey, dataKey)
+    if err != nil {
+        return err
+    }
+
+    var previous, updated User
+    previous.copyFields(this)
+    previous.keys = &Keys{CryptoKey: this.keys.CryptoKey, DataKey: this.keys.DataKey}
+    updated.copyFields(this)
+    updated.WrappedDataKey = wrapped
+    updated.keys = &Keys{CryptoKey: this.keys.CryptoKey, DataKey: dataKey}
+
+    // views shared with the user which have not yet been accessed are encrypted under a shared secret instead
+    var views []*EntryView
+    if err := DB.Unscoped().Where("user_id = ? AND shared_by = ?", this.Id, 0).Find(&views).Error; err != nil {
+        return NewError(err, this)
+    }
+    for _, e := range views {
+        for _, f := range encryptedFields {
+            value := f.value(e)
+            if len(*value) == 0 {
+                continue
+            }
+            data, err := decryptBound(&previous, e, f.name, *value)
+            if err != nil {
+                return err
+            }
+            *value, err = updated.EncryptWithAD(data, e.fieldAD(f.name))
+            utils.SecureZero(data)
+            if err != nil {
+                return err
+            }
+        }
+        e.Policy = CurrentPolicy
+    }
+    attachments, err := reencryptAttachments(&previous, &updated)
+    if err != nil {
+        return err
+    }
+
+    tx := DB.Begin()
+    for _, e := range views {
+        e.Version++
+        if err := tx.Unscoped().Save(e).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    for i := range attachments {
+        if err := tx.Save(&attachments[i]).Error; err != nil {
+            tx.Rollback()
+            return NewError(err, this)
+        }
+    }
+    if err := tx.Model(&User{Id: this.Id}).UpdateColumn("wrapped_data_key", wrapped).Error; err != nil {
+        tx.Rollback()
+        return NewError(err, this)
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+
+    utils.SecureZero(this.keys.DataKey)
+    this.keys.DataKey = dataKey
+    this.WrappedDataKey = wrapped
+    return nil
+}
+
+// EndSession discards the user's private keys, wiping them first.
+func (this *User) EndSession() {
+    this.keysLock.Lock()
+    defer this.keysLock.Unlock()
+    if this.keys != nil {
+        this.keys.Wipe()
+        this.keys.SigningKey = nil
+        this.keys = nil
+    }
+}
+
+// Trash lists the user's deleted entries, which can still be restored or purged.
+func (this *User) Trash() ([]*EntryView, error) {
+    var entries []*EntryView
+    if err := DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", this.Id).Find(&entries).Error; err != nil {
+        return nil, NewError(err, this)
+    }
+    for _, e := range entries {
+        e.user = this
+    }
+    return entries, nil
+}
+
+// PendingShares lists the entries shared with the user by another authority which the user has not yet acknowledged.
+// Archived entries are excluded unless requested through the options.
+func (this *User) PendingShares(options ...ListOptions) ([]*EntryView, error) {
+    var entries []*EntryView
+    query := DB.Where("user_id = ? AND authority_id <> ? AND acknowledged = ?", this.Id, this.Id, false)
+    if !listOptions(options).IncludeArchived {
+        query = query.Where("archived = ?", false)
+    }
+    if err := query.Find(&entries).Error; err != nil {
+        return nil, NewError(err, this)
+    }
+    for _, e := range entries {
+        e.user = this
+    }
+    return entries, nil
+}
+
+// The StaleSignaturesError type reports entries whose permissions name the user as authority but whose signature no
+// longer verifies against the user's current public key, such as after the user's keys have changed.
+type StaleSignaturesError struct {
+    // The Err is the underlying error describing the failure.
+    Err *Error
+    // The Entries are the views whose permissions signature is stale.
+    Entries []*EntryView
+}
+
+// Error produces a string describing the error.
+func (this *StaleSignaturesError) Error() string {
+    return this.Err.Error()
+}
+
+// Unwrap provides the underlying error.
+func (this *StaleSignaturesError) Unwrap() error {
+    return this.Err
+}
+
+// SignedEntries lists every entry view whose permissions this user has validly signed as authority, allowing the full
+// footprint of the user's signing key to be audited.  Views naming the user as authority whose signature no longer
+// verifies are not included in the list, and are instead reported through a StaleSignaturesError.
+func (this *User) SignedEntries() ([]*EntryView, error) {
+    var entries []*EntryView
+    if err := DB.Where("authority_id = ?", this.Id).Find(&entries).Error; err != nil {
+        return nil, NewError(err, this)
+    }
+
+    var valid, stale []*EntryView
+    for _, e := range entries {
+        ok, _, err := this.Verify(e.Permissions)
+        if ok && err == nil {
+            valid = append(valid, e)
+        } else {
+            stale = append(stale, e)
+        }
+    }
+
+    if len(stale) > 0 {
+        msg := fmt.Sprintf("%d signed entries no longer verify", len(stale))
+        return valid, &StaleSignaturesError{NewError(msg, this), stale}
+    }
+    return valid, nil
 }
 
 // The updatePublicKey function encodes the public key stored in the keys member and populates the PublicKey member with it.
 func (this *User) updatePublicKey() *Error {
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
     if this.keys == nil {
         return NewError("Keys not available", this)
     } else {
-        raw, err := asn1.Marshal(*this.keys.PublicSigningKeyNoCurve())
+        encoded, err := this.keys.EncodedPublicKey()
         if err != nil {
             return NewError(err, this)
         }
 
-        this.PublicKey = base64.StdEncoding.EncodeToString(raw)
+        this.PublicKey = encoded
         return nil
     }
 }
 
 // GetCryptoSalt decodes to a byte slice the base64 encoded CryptoSalt.
-func (this *User) GetCryptoSalt() ([]byte, *Error) {
+func (this *User) GetCryptoSalt() ([]byte, error) {
     raw, err := base64.StdEncoding.DecodeString(this.CryptoSalt)
     if err != nil {
         return nil, NewError(err, this)
@@ -114,7 +1046,7 @@ func (this *User) GetCryptoSalt() ([]byte, *Error) {
 }
 
 // GetSigningSalt decodes to a byte slice the base64 encoded SigningSalt.
-func (this *User) GetSigningSalt() ([]byte, *Error) {
+func (this *User) GetSigningSalt() ([]byte, error) {
     raw, err := base64.StdEncoding.DecodeString(this.SigningSalt)
     if err != nil {
         return nil, NewError(err, this)
@@ -124,36 +1056,239 @@ func (this *User) GetSigningSalt() ([]byte, *Error) {
 
 // Can tests whether the user has at least one of the passed in permissions on the given entry.
 // The special value "*" may be used for the query to determine if the user has any permissions
-// on the entry.
+// on the entry.  No permissions are granted by an entry whose row signature does not verify, or whose grant has expired.
 func (this *User) Can(query string, entry *EntryView) bool {
-    ok, raw, err := entry.getAuthority().Verify(entry.Permissions)
-    if !ok || err != nil {
+    held, ok := entry.heldPermissions()
+    if !ok {
+        return false
+    }
+    if query == "*" {
+        return !held.Empty()
+    }
+    wanted, err := ParsePermissions(query)
+    if err != nil {
         return false
     }
-    // if !entry.getAuthority().Can("d", entry) {
-    //     return false
-    // }
+    return wanted.Intersects(held)
+}
 
-    permissions := string(raw)
-    for _, p := range permissions {
-        if !strings.Contains(ValidPermissions, string(p)) {
-            return false
-        }
+// The heldPermissions function verifies and parses the permissions granted for the entry, failing if their signature does
+// not verify or they have expired.
+func (this *EntryView) heldPermissions() (PermSet, bool) {
+    permissions, validUntil, err := this.grantedPermissions()
+    if err != nil {
+        return PermSet{}, false
+    }
+    if !validUntil.IsZero() && time.Now().UTC().After(validUntil) {
+        return PermSet{}, false
+    }
+
+    held, err := ParsePermissions(permissions)
+    if err != nil {
+        return PermSet{}, false
     }
+    return held, true
+}
 
-    if query == "*" && len(permissions) > 0 {
-        return true
+// GrantPermissions signs the permissions and stores them in the target view, which must belong to the recipient, making
+// this user the view's authority.  The user must have an active session and hold delegate permission along with every
+// permission granted through their own view of the entry, except when granting to themselves on a view which has no
+// permissions yet, as when creating a new entry.  Permissions granted to another user are also recorded in a signed Grant,
+// which is stored along with the view.
+func (this *User) GrantPermissions(entry *EntryView, to *User, perms string) error {
+    return this.GrantPermissionsUntil(entry, to, perms, time.Time{})
+}
+
+// GrantPermissionsUntil grants permissions as GrantPermissions does, but only until the given time, after which Can no
+// longer honours them.  A zero time never expires.  A user whose own permissions expire may not grant beyond that time.
+func (this *User) GrantPermissionsUntil(entry *EntryView, to *User, perms string, validUntil time.Time) error {
+    if entry.UserId != to.Id {
+        return NewError("Entry does not belong to the recipient", this)
     }
-    for _, p := range query {
-        if !strings.Contains(ValidPermissions, string(p)) {
-            return false
+
+    own := entry
+    if to.Id != this.Id {
+        var err error
+        own, err = LoadEntry(entry.EntryId, this.Id)
+        if err != nil {
+            return NewError("Grant permission denied", this, ErrPermission)
         }
-        if strings.Contains(permissions, string(p)) {
-            return true
+        own.user = this
+    }
+    if err := this.grant(own, entry, perms, validUntil); err != nil {
+        return err
+    }
+
+    if entry.Id != 0 {
+        return entry.Save()
+    }
+    return nil
+}
+
+// GrantPermissionsBulk grants the same permissions on the entry to each of the recipients.  The entry is the granting
+// user's own view, and the user must hold delegate permission along with every permission being granted, and have an
+// active session.  A recipient who already has a view of the entry has its permissions replaced, while any other
+// recipient is given a new view as with ShareWith.  Each recipient's view is stored in its own transaction, and a failure
+// for one recipient does not stop the rest; the returned slice holds the error for each recipient in order, or nil where
+// the grant succeeded.  The second result reports a problem affecting every recipient, in which case nothing is granted.
+func (this *User) GrantPermissionsBulk(entry *EntryView, recipients []*User, perms string) ([]error, error) {
+    if entry.UserId != this.Id {
+        return nil, NewError("Entry does not belong to the granter", this)
+    }
+    if err := entry.AttachUser(this); err != nil {
+        return nil, err
+    }
+    if err := this.checkPermissions(perms); err != nil {
+        return nil, err
+    }
+    if err := this.checkGrantable(entry, perms, time.Time{}); err != nil {
+        return nil, err
+    }
+
+    errs := make([]error, len(recipients))
+    for i, recipient := range recipients {
+        errs[i] = this.grantTo(entry, recipient, perms)
+    }
+    return errs, nil
+}
+
+// The grantTo function grants the permissions to a single recipient for GrantPermissionsBulk.
+func (this *User) grantTo(own *EntryView, recipient *User, perms string) error {
+    if recipient == nil || recipient.Id == 0 {
+        return NewError("Recipient not found", this, ErrNotFound)
+    }
+    if _, err := Resolver.ById(recipient.Id); err != nil {
+        return NewError("Recipient not found", this, ErrNotFound)
+    }
+    if recipient.Id == this.Id {
+        return NewError("Cannot grant permissions to the entry's own user", this)
+    }
+
+    view, err := LoadEntry(own.EntryId, recipient.Id)
+    if err == nil {
+        view.user = recipient
+        err = this.grant(own, view, perms, time.Time{})
+    } else if errors.Is(err, ErrNotFound) {
+        view, err = own.shareView(recipient, perms)
+    }
+    if err != nil {
+        return err
+    }
+    if err := view.checkSave(); err != nil {
+        return err
+    }
+
+    tx := DB.Begin()
+    if err := view.store(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Commit().Error; err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// RevokePermissions removes every permission of the user on their view of the entry, by signing an empty set of
+// permissions in place of the current ones.  Only the view's authority may revoke, and must have an active session.
+// Revocation prevents future reads only; it cannot recall fields the user has already decrypted.  The revocation is
+// recorded as a grant of no permissions, which is stored along with the view.
+func (this *User) RevokePermissions(entry *EntryView, from *User) error {
+    if entry.UserId != from.Id {
+        return NewError("Entry does not belong to the user", this)
+    }
+    if entry.AuthorityId != this.Id {
+        return NewError("Only the entry authority may revoke permissions", this, ErrPermission)
+    }
+
+    signed, err := this.Sign([]byte(""))
+    if err != nil {
+        return err
+    }
+    entry.Permissions = signed
+    if err := entry.SignRow(this); err != nil {
+        return err
+    }
+    if err := this.recordGrant(entry, from, ""); err != nil {
+        return err
+    }
+
+    if entry.Id != 0 {
+        return entry.Save()
+    }
+    return nil
+}
+
+// The grant function checks that the permissions are valid and may be granted by this user, who holds them through their
+// own view of the entry, and then signs them into the target view with this user as its authority.
+func (this *User) grant(own *EntryView, target *EntryView, perms string, validUntil time.Time) error {
+    if err := this.checkPermissions(perms); err != nil {
+        return err
+    }
+    creating := own == target && own.UserId == this.Id && len(own.Permissions) == 0
+    if !creating {
+        if err := this.checkGrantable(own, perms, validUntil); err != nil {
+            return err
         }
     }
 
-    return false
+    signed, err := this.Sign(formatPermissions(perms, validUntil))
+    if err != nil {
+        return err
+    }
+    target.Permissions = signed
+    target.AuthorityId = this.Id
+    if err := target.SignRow(this); err != nil {
+        return err
+    }
+    return this.recordGrant(target, target.getUser(), perms)
+}
+
+// The recordGrant function prepares the signed grant of the permissions on the view to its user, to be stored along with
+// the view.  Permissions a user gives to themselves need no grant.
+func (this *User) recordGrant(target *EntryView, to *User, perms string) error {
+    if to.Id == this.Id {
+        return nil
+    }
+    grant, err := NewGrant(this, to, target.EntryId, perms)
+    if err != nil {
+        return err
+    }
+    target.grant = grant
+    return nil
+}
+
+// The checkPermissions function ensures that the permissions string is non-empty and holds only valid permissions.
+func (this *User) checkPermissions(perms string) error {
+    if len(perms) == 0 {
+        return NewError("No permissions given", this)
+    }
+    if _, err := ParsePermissions(perms); err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// The checkGrantable function ensures that the user may grant the permissions until the given time through their own
+// view of the entry, which requires delegate permission along with every permission being granted, held for at least as
+// long as the grant lasts.
+func (this *User) checkGrantable(own *EntryView, perms string, validUntil time.Time) error {
+    if !this.Can("d", own) {
+        return NewError("Grant permission denied", this, ErrPermission)
+    }
+    for _, p := range perms {
+        if !this.Can(string(p), own) {
+            return NewError("Cannot grant permission '"+string(p)+"' which is not held", this, ErrPermission)
+        }
+    }
+    _, ownUntil, err := own.grantedPermissions()
+    if err != nil {
+        return err
+    }
+    if !ownUntil.IsZero() && (validUntil.IsZero() || validUntil.After(ownUntil)) {
+        return NewError("Cannot grant permissions beyond their own expiry", this, ErrPermission)
+    }
+    return nil
 }
 
 // The makeGCM function initializes a new GCM instance with the given key.
@@ -171,77 +1306,190 @@ func (this *User) makeGCM(key []byte) (cipher.AEAD, *Error) {
     return gcm, nil
 }
 
-// The getEncryptionKey function obtains the user's private symmetric encryption key, if available.
+// The getEncryptionKey function obtains a copy of the user's private symmetric encryption key, if available, so that
+// the key held by the session cannot be altered through the returned slice.
 func (this *User) getEncryptionKey() []byte {
-    if this.keys != nil {
-        return this.keys.CryptoKey
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    if this.keys != nil && this.keys.CryptoKey != nil {
+        return append([]byte(nil), this.keys.dataKey()...)
     }
     return nil
 }
 
 // The Decrypt function decrypts a base64 encoded string that was encrypted with the user's private symmetric encryption key.
+// The returned buffer is freshly allocated and belongs to the caller, who may wipe it once the plaintext is no longer needed.
+// Malformed input, whether invalid base64 or too short to hold a nonce and authentication tag, fails with ErrDecryption.
 func (this *User) Decrypt(encrypted string) ([]byte, error) {
-    raw, err := base64.StdEncoding.DecodeString(encrypted)
-    if err != nil {
-        return nil, NewError(err, this)
-    }
+    return this.DecryptWithAD(encrypted, nil)
+}
 
+// DecryptWithAD decrypts a base64 encoded string that was encrypted by EncryptWithAD, failing with ErrDecryption unless
+// the additional data is the same as when it was encrypted.
+func (this *User) DecryptWithAD(encrypted string, ad []byte) ([]byte, error) {
     key := this.getEncryptionKey()
     if key == nil {
-        return nil, NewError("Private key unavailable", this)
+        return nil, NewError("Private key unavailable", this, ErrCrypto)
     }
+    defer utils.SecureZero(key)
 
     gcm, e := this.makeGCM(key)
     if e != nil {
         return nil, e
     }
+    return this.openGCM(gcm, encrypted, ad)
+}
+
+// The openGCM function decrypts a base64 encoded string that was encrypted by EncryptWithAD using a GCM instance already
+// made from the user's key, so that several values can be decrypted without setting up the cipher for each.
+func (this *User) openGCM(gcm cipher.AEAD, encrypted string, ad []byte) ([]byte, error) {
+    raw, err := base64.StdEncoding.DecodeString(encrypted)
+    if err != nil {
+        return nil, NewError(err, this, ErrDecryption)
+    }
 
     nonceLen := gcm.NonceSize()
-    if len(raw) < nonceLen {
-        return nil, NewError("Data too short", this)
+    if len(raw) < nonceLen+gcm.Overhead() {
+        return nil, NewError("Data too short", this, ErrDecryption)
     }
 
-    data, err := gcm.Open(raw[nonceLen:], raw[:nonceLen], raw[nonceLen:], nil)
+    data, err := gcm.Open(nil, raw[:nonceLen], raw[nonceLen:], ad)
     if err != nil {
-        return nil, NewError(err, this)
+        return nil, NewError(err, this, ErrDecryption)
     }
     return data, nil
 }
 
 // The Encrypt function encrypts and base64 encodes data with the user's private symmetric encryption key.
 func (this *User) Encrypt(data []byte) (string, error) {
+    return this.EncryptWithAD(data, nil)
+}
+
+// CounterNonces causes User.EncryptWithAD to draw its nonces from a counter kept for each user in the database, rather
+// than generating them at random, which rules out the small chance of random nonces repeating over a user's lifetime at
+// the cost of a database update for each encryption.  The user must be stored in the database.  Ciphertext encrypted with
+// either kind of nonce may be decrypted regardless of the setting.
+var CounterNonces = false
+
+// The maxNonceAttempts is the number of times counterNonce tries to advance the counter before giving up, should other
+// encryptions for the same user keep advancing it first.
+const maxNonceAttempts = 100
+
+// The counterNonce function advances the user's nonce counter in the database and produces a nonce of the given size
+// holding the new count, big-endian, in its last eight bytes.  The counter is advanced by a conditional update of the
+// value just read, so that each count is handed out once, however many encryptions for the user are under way at once.
+// The user must be stored, since the row of a user read from a vault file may belong to another user or database, whose
+// counter would hand out counts already used under this user's key.
+func (this *User) counterNonce(size int) ([]byte, *Error) {
+    if !this.isStored() {
+        return nil, NewError("Counter nonces require a stored user", this, ErrEncryption)
+    }
+    for attempt := 0; attempt < maxNonceAttempts; attempt++ {
+        var stored User
+        if err := DB.Select("nonce_counter").Where("id = ?", this.Id).First(&stored).Error; err != nil {
+            return nil, NewError(err, this, ErrEncryption)
+        }
+        next := stored.NonceCounter + 1
+        result := DB.Model(&User{}).Where("id = ? AND nonce_counter = ?", this.Id, stored.NonceCounter).UpdateColumn("nonce_counter", next)
+        if result.Error != nil {
+            return nil, NewError(result.Error, this, ErrEncryption)
+        }
+        if result.RowsAffected == 1 {
+            nonce := make([]byte, size)
+            binary.BigEndian.PutUint64(nonce[size-8:], uint64(next))
+            return nonce, nil
+        }
+    }
+    return nil, NewError("Nonce counter contention", this, ErrEncryption)
+}
+
+// EncryptWithAD encrypts and base64 encodes data with the user's private symmetric encryption key, authenticating the
+// additional data along with it.  The result can only be decrypted by DecryptWithAD given the same additional data, which
+// binds the ciphertext to its context, such as the entry and field where it is stored.
+func (this *User) EncryptWithAD(data []byte, ad []byte) (string, error) {
     key := this.getEncryptionKey()
     if key == nil {
-        return "", NewError("Private key unavailable", this)
+        return "", NewError("Private key unavailable", this, ErrCrypto)
     }
+    defer utils.SecureZero(key)
 
     gcm, err := this.makeGCM(key)
     if err != nil {
         return "", err
     }
 
-    nonce := utils.RandomBytes(gcm.NonceSize())
+    var nonce []byte
+    if CounterNonces {
+        if nonce, err = this.counterNonce(gcm.NonceSize()); err != nil {
+            return "", err
+        }
+    } else {
+        nonce = utils.RandomBytes(gcm.NonceSize())
+    }
     if nonce == nil {
-        return "", NewError("Nonce generation failed", this)
+        return "", NewError("Nonce generation failed", this, ErrEncryption)
     }
 
-    raw := gcm.Seal(data, nonce, data, nil)
+    raw := gcm.Seal(nil, nonce, data, ad)
     result := base64.StdEncoding.EncodeToString(append(nonce, raw...))
     return result, nil
 }
 
+// The encryptSynthetic function encrypts and base64 encodes data as EncryptWithAD does, except that the nonce is
+// derived from the data and additional data by HMAC rather than drawn at random.  The same data and additional data
+// therefore always encrypt to the same result, which reveals when two encryptions are equal, so this is only used where
+// reproducible output is wanted, such as for backups.  The HMAC key is derived from the user's key by syntheticNonceKey,
+// so that the encryption key itself serves only AES-GCM.
+func (this *User) encryptSynthetic(data []byte, ad []byte) (string, error) {
+    key := this.getEncryptionKey()
+    if key == nil {
+        return "", NewError("Private key unavailable", this, ErrCrypto)
+    }
+    defer utils.SecureZero(key)
+
+    gcm, err := this.makeGCM(key)
+    if err != nil {
+        return "", err
+    }
+
+    nonceKey := syntheticNonceKey(key)
+    defer utils.SecureZero(nonceKey)
+    mac := hmac.New(sha256.New, nonceKey)
+    mac.Write([]byte("passrep synthetic nonce\x00"))
+    binary.Write(mac, binary.BigEndian, uint64(len(ad)))
+    mac.Write(ad)
+    mac.Write(data)
+    nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+    raw := gcm.Seal(nil, nonce, data, ad)
+    return base64.StdEncoding.EncodeToString(append(nonce, raw...)), nil
+}
+
+// The syntheticNonceKey function derives the key under which encryptSynthetic computes its nonces from the encryption
+// key, by HMAC over a fixed label.
+func syntheticNonceKey(key []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte("passrep synthetic nonce key"))
+    return mac.Sum(nil)
+}
+
 // The makeSharedSecret function generates a symmetric encryption key from this user's private key and the
-// other user's public key.
+// other user's public key.  A public key which is malformed or not on the curve fails with ErrCrypto.
 func (this *User) makeSharedSecret(other *User) ([]byte, error) {
     rawPubKey, err := base64.StdEncoding.DecodeString(other.PublicKey)
     if err != nil {
-        return nil, NewError(err, this)
+        return nil, NewError(err, this, ErrCrypto)
     }
-
-    var pubKey ecdsa.PublicKey
-    _, err = asn1.Unmarshal(rawPubKey, &pubKey)
+    // the point must be checked before use, since a point off the curve is rejected only by a panic
+    pubKey, err := unmarshalPublicKey(rawPubKey)
     if err != nil {
-        return nil, NewError(err, this)
+        return nil, NewError(err, this, ErrCrypto)
+    }
+
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    if this.keys == nil {
+        return nil, NewError("Private key unavailable", this, ErrCrypto)
     }
 
     x, y := this.keys.SigningKey.ScalarMult(pubKey.X, pubKey.Y, this.keys.SigningKey.D.Bytes())
@@ -250,29 +1498,32 @@ func (this *User) makeSharedSecret(other *User) ([]byte, error) {
         return nil, NewError("Invalid point", this)
     }
 
-    secret := x.Bytes()
+    point := x.Bytes()
+    defer utils.SecureZero(point)
+    secret := point
     for i := 0; i < 10000; i++ {
         hash := sha512.Sum512(secret)
         secret = hash[:]
     }
-    return secret, nil
+    return secret[:32], nil
 }
 
 // The DecryptShared function base64 decodes and decrypts data using a shared secret determined between two users.
 func (this *User) DecryptShared(encrypted string, signed string, other *User) ([]byte, []byte, error) {
     rawEncrypted, err := base64.StdEncoding.DecodeString(encrypted)
     if err != nil {
-        return nil, nil, NewError(err, this)
+        return nil, nil, NewError(err, this, ErrDecryption)
     }
     rawSigned, err := base64.StdEncoding.DecodeString(signed)
     if err != nil {
-        return nil, nil, NewError(err, this)
+        return nil, nil, NewError(err, this, ErrDecryption)
     }
 
     key, err := this.makeSharedSecret(other)
     if err != nil {
         return nil, nil, err
     }
+    defer utils.SecureZero(key)
 
     gcm, e := this.makeGCM(key)
     if e != nil {
@@ -280,13 +1531,13 @@ func (this *User) DecryptShared(encrypted string, signed string, other *User) ([
     }
 
     nonceLen := gcm.NonceSize()
-    if len(rawEncrypted) < nonceLen {
-        return nil, nil, NewError("Data too short", this)
+    if len(rawEncrypted) < nonceLen+gcm.Overhead() {
+        return nil, nil, NewError("Data too short", this, ErrDecryption)
     }
 
-    data, err := gcm.Open(rawEncrypted[nonceLen:], rawEncrypted[:nonceLen], rawEncrypted[nonceLen:], rawSigned)
+    data, err := gcm.Open(nil, rawEncrypted[:nonceLen], rawEncrypted[nonceLen:], rawSigned)
     if err != nil {
-        return nil, nil, NewError(err, this)
+        return nil, nil, NewError(err, this, ErrDecryption)
     }
 
     return data, rawSigned, nil
@@ -298,18 +1549,19 @@ func (this *User) EncryptShared(data []byte, sign []byte, other *User) (string,
     if err != nil {
         return "", "", err
     }
+    defer utils.SecureZero(key)
 
-    gcm, err := this.makeGCM(key)
-    if err != nil {
-        return "", "", err
+    gcm, e := this.makeGCM(key)
+    if e != nil {
+        return "", "", e
     }
 
     nonce := utils.RandomBytes(gcm.NonceSize())
     if nonce == nil {
-        return "", "", NewError("Nonce generation failed", this)
+        return "", "", NewError("Nonce generation failed", this, ErrEncryption)
     }
 
-    raw := gcm.Seal(data, nonce, data, sign)
+    raw := gcm.Seal(nil, nonce, data, sign)
     result := base64.StdEncoding.EncodeToString(append(nonce, raw...))
     encoded := base64.StdEncoding.EncodeToString(sign)
     return result, encoded, nil
@@ -326,13 +1578,10 @@ func (this *User) Verify(signed string) (bool, []byte, error) {
     if err != nil {
         return false, nil, NewError(err, this)
     }
-
-    var key SigningKey
-    _, err = asn1.Unmarshal(rawKey, &key)
+    key, err := unmarshalPublicKey(rawKey)
     if err != nil {
         return false, nil, NewError(err, this)
     }
-    var ecdsaKey = ecdsa.PublicKey{elliptic.P521(), key.X, key.Y}
 
     var sig Signature
     remaining, err := asn1.Unmarshal(raw, &sig)
@@ -340,22 +1589,60 @@ func (this *User) Verify(signed string) (bool, []byte, error) {
         return false, nil, NewError(err, this)
     }
 
-    hash := sha512.Sum512(remaining)
-    return ecdsa.Verify(&ecdsaKey, hash[:], sig.R, sig.S), remaining, nil
+    return verifySignature(key, remaining, &sig), remaining, nil
+}
+
+// The fingerprintGroupSize is the number of hexadecimal digits in each group of a fingerprint.
+const fingerprintGroupSize = 4
+
+// Fingerprint produces the SHA-256 hash of the user's public key as space-separated groups of hexadecimal digits, which
+// two users can read to each other over another channel to confirm that each holds the other's genuine public key, and so
+// that the secrets they share cannot be intercepted.  An empty string is produced if the public key cannot be decoded.
+func (this *User) Fingerprint() string {
+    rawKey, err := base64.StdEncoding.DecodeString(this.PublicKey)
+    if err != nil || len(rawKey) == 0 {
+        return ""
+    }
+    sum := sha256.Sum256(rawKey)
+    digits := hex.EncodeToString(sum[:])
+
+    var groups []string
+    for i := 0; i < len(digits); i += fingerprintGroupSize {
+        groups = append(groups, digits[i:i+fingerprintGroupSize])
+    }
+    return strings.Join(groups, " ")
+}
+
+// VerifyFingerprint determines whether the expected fingerprint, as produced by Fingerprint, matches the user's public
+// key.  Case and spacing are ignored, and the comparison takes constant time.
+func (this *User) VerifyFingerprint(expected string) bool {
+    actual := this.Fingerprint()
+    if len(actual) == 0 {
+        return false
+    }
+    normalize := func(fingerprint string) []byte {
+        return []byte(strings.ToLower(strings.Join(strings.Fields(fingerprint), "")))
+    }
+    return utils.ConstantTimeEqual(normalize(actual), normalize(expected))
+}
+
+// CanSign determines whether the user's private signing key is loaded, so that callers can check before beginning
+// an operation which will need to sign.
+func (this *User) CanSign() bool {
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    return this.keys != nil && this.keys.SigningKey != nil
 }
 
 // Sign encodes the provided data and adds a signature generated from the user's private signing key.
 func (this *User) Sign(data []byte) (string, error) {
-    hash := sha512.Sum512(data)
-
-    var err error
-    var sig Signature
-    sig.R, sig.S, err = ecdsa.Sign(rand.Reader, this.keys.SigningKey, hash[:])
-    if err != nil {
-        return "", NewError(err, this)
+    this.keysLock.RLock()
+    defer this.keysLock.RUnlock()
+    if this.keys == nil || this.keys.SigningKey == nil {
+        return "", NewError("Private key unavailable", this, ErrCrypto)
     }
 
-    rawSig, err := asn1.Marshal(&sig)
+    rawSig, err := signData(this.keys.SigningKey, data)
     if err != nil {
         return "", NewError(err, this)
     }
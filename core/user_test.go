@@ -1,8 +1,17 @@
 package core
 
 import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "github.com/awm/passrep/utils"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/suite"
+    "strings"
+    "sync"
     "testing"
     "time"
 )
@@ -45,7 +54,9 @@ func (suite *UserTestSuite) TestLoading() {
 
         original.Drop()
         loaded, err = LoadUser("test.user")
-        a.Error(err)
+        if a.Error(err) {
+            a.Equal(ErrNotFound, err.(*Error).Code)
+        }
     }
 }
 
@@ -69,47 +80,1250 @@ func (suite *UserTestSuite) TestSaltAccess() {
     }
 }
 
-// func (suite *UserTestSuite) TestCan() {
-//     a := assert.New(suite.T())
-
-//     authority, err := NewUser("admin", "secret")
-//     if a.NoError(err) {
-//         user, err := NewUser("test.user", "password")
-//         if a.NoError(err) {
-
-//             entry1 := Entry{AuthorityId: authority.Id, Permissions: "...rwd"}
-//             entry2 := Entry{AuthorityId: authority.Id, Permissions: "...r"}
-//             entry3 := Entry{AuthorityId: authority.Id, Permissions: "...$"}
-
-//             a.True(user.Can("*", &entry1))
-//             a.True(user.Can("r", &entry1))
-//             a.True(user.Can("w", &entry1))
-//             a.True(user.Can("d", &entry1))
-//             a.True(user.Can("rw", &entry1))
-//             a.True(user.Can("rd", &entry1))
-//             a.True(user.Can("wd", &entry1))
-//             a.True(user.Can("rwd", &entry1))
-//             a.False(user.Can("$", &entry1))
-//             a.False(user.Can("r?", &entry1))
-
-//             a.True(user.Can("*", &entry2))
-//             a.True(user.Can("r", &entry2))
-//             a.False(user.Can("w", &entry2))
-//             a.False(user.Can("d", &entry2))
-//             a.True(user.Can("rw", &entry2))
-//             a.True(user.Can("rd", &entry2))
-//             a.False(user.Can("wd", &entry2))
-//             a.True(user.Can("rwd", &entry2))
-//             a.False(user.Can("$", &entry2))
-//             a.False(user.Can("r?", &entry2))
-
-//             a.False(user.Can("*", &entry3))
-
-//             user.Drop()
-//         }
-//         authority.Drop()
-//     }
-// }
+func (suite *UserTestSuite) TestSession() {
+    a := assert.New(suite.T())
+
+    original, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        u, err := LoadUser("test.user")
+        if a.NoError(err) {
+            _, err = u.Encrypt([]byte("data"))
+            a.Error(err)
+            _, err = u.Sign([]byte("data"))
+            a.Error(err)
+
+            a.Error(u.StartSession("wrong"))
+            a.Nil(u.keys)
+
+            if a.NoError(u.StartSession("password")) {
+                encrypted, err := u.Encrypt([]byte("data"))
+                if a.NoError(err) {
+                    decrypted, err := original.Decrypt(encrypted)
+                    a.NoError(err)
+                    a.Equal([]byte("data"), decrypted)
+                }
+
+                key := u.keys.CryptoKey
+                u.EndSession()
+                a.Nil(u.keys)
+                a.Equal(make([]byte, len(key)), key)
+                _, err = u.Decrypt(encrypted)
+                a.Error(err)
+            }
+        }
+
+        original.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestEncryption() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        plaintext := []byte("a recognizable secret value")
+        encrypted, err := u.Encrypt(plaintext)
+        if a.NoError(err) {
+            raw, err := base64.StdEncoding.DecodeString(encrypted)
+            if a.NoError(err) {
+                a.False(bytes.Contains(raw, plaintext))
+            }
+
+            decrypted, err := u.Decrypt(encrypted)
+            a.NoError(err)
+            a.Equal(plaintext, decrypted)
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestDeterministicEncryption() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        previous := utils.Rand
+        defer func() { utils.Rand = previous }()
+
+        plaintext := []byte("a recognizable secret value")
+        var results []string
+        for i := 0; i < 2; i++ {
+            utils.Rand = bytes.NewReader(bytes.Repeat([]byte{0x5a}, 64))
+            encrypted, err := u.Encrypt(plaintext)
+            if a.NoError(err) {
+                results = append(results, encrypted)
+            }
+        }
+        if a.Len(results, 2) {
+            a.Equal(results[0], results[1])
+            raw, err := base64.StdEncoding.DecodeString(results[0])
+            if a.NoError(err) {
+                a.Equal(bytes.Repeat([]byte{0x5a}, 12), raw[:12])
+            }
+            decrypted, err := u.Decrypt(results[0])
+            a.NoError(err)
+            a.Equal(plaintext, decrypted)
+        }
+
+        utils.Rand = previous
+        encrypted, err := u.Encrypt(plaintext)
+        if a.NoError(err) && len(results) > 0 {
+            a.NotEqual(results[0], encrypted)
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestConcurrentSession() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        plaintext := []byte("a recognizable secret value")
+        var wg sync.WaitGroup
+        failures := make(chan error, 8*25*3)
+        work := func() {
+            defer wg.Done()
+            for i := 0; i < 25; i++ {
+                encrypted, err := u.Encrypt(plaintext)
+                if err != nil {
+                    failures <- err
+                    continue
+                }
+                decrypted, err := u.Decrypt(encrypted)
+                if err != nil {
+                    failures <- err
+                } else if !bytes.Equal(plaintext, decrypted) {
+                    failures <- NewError("Decrypted data does not match")
+                }
+                if _, err := u.Sign(plaintext); err != nil {
+                    failures <- err
+                }
+            }
+        }
+
+        for i := 0; i < 8; i++ {
+            wg.Add(1)
+            go work()
+        }
+        wg.Wait()
+        close(failures)
+        for err := range failures {
+            a.NoError(err)
+        }
+
+        // ending the session while it is in use only causes the operations which follow to fail
+        failures = make(chan error, 8*25*3)
+        for i := 0; i < 8; i++ {
+            wg.Add(1)
+            go work()
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            u.EndSession()
+            a.NoError(u.StartSession("password"))
+            u.EndSession()
+        }()
+        wg.Wait()
+        close(failures)
+        for err := range failures {
+            a.True(errors.Is(err, ErrCrypto) || errors.Is(err, ErrDecryption), err.Error())
+        }
+        a.False(u.CanSign())
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestChangePassword() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    other, err := NewUser("other.user", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer other.Drop()
+
+    owned := newTestEntry(a, u, "owned")
+    a.NoError(owned.WriteTitle("Owned"))
+    a.NoError(owned.WritePassword("hunter2"))
+    a.NoError(owned.Save())
+    defer DB.Unscoped().Delete(owned)
+
+    permissions, err := u.Sign([]byte("rw"))
+    a.NoError(err)
+    shared := &EntryView{EntryId: "owned", UserId: other.Id, AuthorityId: u.Id, Permissions: permissions, user: other}
+    a.NoError(shared.SignRow(u))
+    a.NoError(shared.WriteTitle("Shared"))
+    a.NoError(shared.Save())
+    defer DB.Unscoped().Delete(shared)
+
+    team, err := NewTeam("password.change", u)
+    if !a.NoError(err) {
+        return
+    }
+    a.NoError(team.AddMember(u, other))
+    a.NoError(owned.ShareWithGroup(team))
+
+    oldSalt := u.CryptoSalt
+    oldKey := u.PublicKey
+    a.Error(u.ChangePassword("wrong", "changed"))
+    a.Equal(oldKey, u.PublicKey)
+
+    if a.NoError(u.ChangePassword("password", "changed")) {
+        a.NotEqual(oldSalt, u.CryptoSalt)
+        a.NotEqual(oldKey, u.PublicKey)
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(u.PublicKey, loaded.PublicKey)
+            a.Error(loaded.StartSession("password"))
+            a.NoError(loaded.StartSession("changed"))
+
+            entry, err := LoadEntry("owned", loaded.Id)
+            if a.NoError(err) && a.NoError(entry.AttachUser(loaded)) {
+                title, err := entry.ReadTitle()
+                a.NoError(err)
+                a.Equal("Owned", title)
+                password, err := entry.ReadPassword()
+                a.NoError(err)
+                a.Equal("hunter2", password)
+            }
+
+            fields, err := team.ReadEntry(loaded, "owned")
+            if a.NoError(err) {
+                a.Equal("hunter2", fields["password"])
+            }
+        }
+
+        entry, err := LoadEntry("owned", other.Id)
+        if a.NoError(err) && a.NoError(entry.AttachUser(other)) {
+            a.True(other.Can("r", entry))
+            title, err := entry.ReadTitle()
+            a.NoError(err)
+            a.Equal("Shared", title)
+        }
+        fields, err := team.ReadEntry(other, "owned")
+        if a.NoError(err) {
+            a.Equal("Owned", fields["title"])
+        }
+    }
+}
+
+// The checkRotatedEntry function reloads the user and the entry, and checks that the entry's password and attachment can
+// still be read in a fresh session.
+func checkRotatedEntry(a *assert.Assertions, user *User, entry *EntryView) {
+    loaded, err := LoadUser(user.Name)
+    if a.NoError(err) && a.NoError(loaded.StartSession("password")) {
+        a.NotNil(loaded.keys.DataKey)
+        view, err := LoadEntry(entry.EntryId, loaded.Id)
+        if a.NoError(err) && a.NoError(view.AttachUser(loaded)) {
+            password, err := view.ReadPassword()
+            a.NoError(err)
+            a.Equal("hunter2", password)
+            attachments, err := view.Attachments()
+            if a.NoError(err) && a.Len(attachments, 1) {
+                data, err := view.ReadAttachment(attachments[0].Id)
+                a.NoError(err)
+                a.Equal([]byte("1234"), data)
+            }
+        }
+    }
+}
+
+func (suite *UserTestSuite) TestRotateDEK() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        a.NotEmpty(u.WrappedDataKey)
+        a.NotEqual(u.keys.CryptoKey, u.keys.DataKey)
+
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WritePassword("hunter2"))
+            a.NoError(entry.Save())
+            a.NoError(entry.AddAttachment("codes.txt", "text/plain", []byte("1234")))
+            encrypted := entry.Password
+
+            wrapped := u.WrappedDataKey
+            dataKey := append([]byte(nil), u.keys.DataKey...)
+            if a.NoError(u.RotateDEK()) {
+                a.NotEqual(wrapped, u.WrappedDataKey)
+                a.NotEqual(dataKey, u.keys.DataKey)
+                _, err = u.DecryptWithAD(encrypted, entry.fieldAD("password"))
+                a.Error(err)
+                checkRotatedEntry(a, u, entry)
+            }
+
+            // changing the password keeps the data key
+            dataKey = append([]byte(nil), u.keys.DataKey...)
+            if a.NoError(u.ChangePassword("password", "changed")) {
+                a.Equal(dataKey, u.keys.DataKey)
+                a.NoError(u.ChangePassword("changed", "password"))
+            }
+
+            u.EndSession()
+            a.Error(u.RotateDEK())
+
+            DB.Unscoped().Where("entry_id = ?", entry.EntryId).Delete(EntryView{})
+            DB.Where("entry_id = ?", entry.EntryId).Delete(Attachment{})
+        }
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestLegacyDEKMigration() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        // users created before data keys encrypted their data directly under the password-derived key
+        u.keys.DataKey = nil
+        u.WrappedDataKey = ""
+        a.NoError(DB.Model(u).UpdateColumn("wrapped_data_key", "").Error)
+
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WritePassword("hunter2"))
+            a.NoError(entry.Save())
+            a.NoError(entry.AddAttachment("codes.txt", "text/plain", []byte("1234")))
+
+            legacy, err := LoadUser("test.user")
+            if a.NoError(err) && a.NoError(legacy.StartSession("password")) {
+                a.Nil(legacy.keys.DataKey)
+                password, err := legacy.DecryptWithAD(entry.Password, entry.fieldAD("password"))
+                a.NoError(err)
+                a.Equal([]byte("hunter2"), password)
+
+                if a.NoError(legacy.RotateDEK()) {
+                    a.NotEmpty(legacy.WrappedDataKey)
+                    _, err = legacy.DecryptWithAD(entry.Password, entry.fieldAD("password"))
+                    a.Error(err)
+                    checkRotatedEntry(a, legacy, entry)
+                }
+            }
+
+            DB.Unscoped().Where("entry_id = ?", entry.EntryId).Delete(EntryView{})
+            DB.Where("entry_id = ?", entry.EntryId).Delete(Attachment{})
+        }
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestRekeyKdf() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        a.Equal(100000, u.KdfIterations)
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WritePassword("hunter2"))
+        a.NoError(entry.Save())
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.NoError(loaded.StartSession("password"))
+        }
+
+        a.Error(u.RekeyKdf("password", 0))
+        a.Error(u.RekeyKdf("wrong", 250000))
+        oldKey := u.PublicKey
+        if a.NoError(u.RekeyKdf("password", 250000)) {
+            a.Equal(250000, u.KdfIterations)
+            a.NotEqual(oldKey, u.PublicKey)
+
+            loaded, err = LoadUser("test.user")
+            if a.NoError(err) {
+                a.Equal(250000, loaded.KdfIterations)
+                if a.NoError(loaded.StartSession("password")) {
+                    entry, err := LoadEntry("entry", loaded.Id)
+                    if a.NoError(err) && a.NoError(entry.AttachUser(loaded)) {
+                        password, err := entry.ReadPassword()
+                        a.NoError(err)
+                        a.Equal("hunter2", password)
+                    }
+                }
+            }
+        }
+
+        DB.Unscoped().Delete(entry)
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestKdfUpgrade() {
+    a := assert.New(suite.T())
+
+    u, err := NewUserWithKdf("test.user", "password", KdfPbkdf2, KdfParams{Iterations: 50000})
+    if a.NoError(err) {
+        a.Equal(50000, u.KdfIterations)
+        entry := newTestEntry(a, u, "entry")
+        a.NoError(entry.WritePassword("hunter2"))
+        a.NoError(entry.Save())
+
+        // a user which is not backed by its database row is never rekeyed
+        var detached User
+        detached.copyFields(u)
+        detached.detached = true
+        if a.NoError(detached.StartSession("password")) {
+            a.Equal(50000, detached.KdfIterations)
+            a.Error(detached.RekeyKdf("password", config.KdfIterations))
+            detached.EndSession()
+        }
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Error(loaded.StartSession("wrong"))
+            a.Equal(50000, loaded.KdfIterations)
+
+            if a.NoError(loaded.StartSession("password")) {
+                a.Equal(config.KdfIterations, loaded.KdfIterations)
+                a.NotEqual(u.PublicKey, loaded.PublicKey)
+                entry, err := LoadEntry("entry", loaded.Id)
+                if a.NoError(err) && a.NoError(entry.AttachUser(loaded)) {
+                    password, err := entry.ReadPassword()
+                    a.NoError(err)
+                    a.Equal("hunter2", password)
+                }
+            }
+        }
+
+        stored, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(config.KdfIterations, stored.KdfIterations)
+            publicKey := stored.PublicKey
+            a.NoError(stored.StartSession("password"))
+            a.Equal(publicKey, stored.PublicKey)
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestVerifyPassword() {
+    a := assert.New(suite.T())
+
+    original, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        u, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.True(u.VerifyPassword("password"))
+            a.False(u.VerifyPassword("wrong"))
+            a.Nil(u.keys)
+
+            a.True(original.VerifyPassword("password"))
+            a.NotNil(original.keys)
+
+            u.CryptoSalt = "not base64!"
+            a.False(u.VerifyPassword("password"))
+        }
+
+        original.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestSaltCollision() {
+    a := assert.New(suite.T())
+
+    existing, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        salt, err := existing.GetCryptoSalt()
+        a.NoError(err)
+
+        // the first salt generated collides with the existing user's, after which the real RNG is used
+        original := randomBytes
+        calls := 0
+        randomBytes = func(size int) []byte {
+            calls++
+            if calls == 1 {
+                return salt
+            }
+            return original(size)
+        }
+        u, err := NewUser("test.user", "password")
+        randomBytes = original
+
+        if a.NoError(err) {
+            a.Equal(4, calls)
+            a.NotEqual(existing.CryptoSalt, u.CryptoSalt)
+            u.Drop()
+        }
+
+        randomBytes = func(size int) []byte { return salt }
+        _, err = NewUser("test.user", "password")
+        randomBytes = original
+        a.Error(err)
+
+        existing.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestSignedEntries() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := authority.Sign([]byte("r"))
+            a.NoError(err)
+            valid := EntryView{EntryId: "valid", UserId: user.Id, AuthorityId: authority.Id, Permissions: permissions}
+            a.NoError(DB.Create(&valid).Error)
+
+            // signed by another key, as though the authority's keys had since changed
+            permissions, err = user.Sign([]byte("r"))
+            a.NoError(err)
+            stale := EntryView{EntryId: "stale", UserId: user.Id, AuthorityId: authority.Id, Permissions: permissions}
+            a.NoError(DB.Create(&stale).Error)
+
+            entries, err := authority.SignedEntries()
+            if a.Len(entries, 1) {
+                a.Equal("valid", entries[0].EntryId)
+            }
+            if a.Error(err) {
+                se, ok := err.(*StaleSignaturesError)
+                if a.True(ok) && a.Len(se.Entries, 1) {
+                    a.Equal("stale", se.Entries[0].EntryId)
+                }
+            }
+
+            entries, err = user.SignedEntries()
+            a.NoError(err)
+            a.Empty(entries)
+
+            DB.Delete(&valid)
+            DB.Delete(&stale)
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestCanSign() {
+    a := assert.New(suite.T())
+
+    created, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        a.True(created.CanSign())
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.False(loaded.CanSign())
+            _, err = loaded.Sign([]byte("data"))
+            a.Error(err)
+        }
+
+        created.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestPendingShares() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            permissions, err := authority.Sign([]byte("r"))
+            a.NoError(err)
+            shared := EntryView{EntryId: "shared", UserId: user.Id, AuthorityId: authority.Id, Permissions: permissions}
+            a.NoError(DB.Create(&shared).Error)
+            owned := newTestEntry(a, user, "owned")
+            a.NoError(DB.Create(owned).Error)
+
+            pending, err := user.PendingShares()
+            if a.NoError(err) && a.Len(pending, 1) {
+                a.Equal("shared", pending[0].EntryId)
+                a.NoError(pending[0].Acknowledge())
+            }
+
+            pending, err = user.PendingShares()
+            if a.NoError(err) {
+                a.Empty(pending)
+            }
+
+            DB.Delete(&shared)
+            DB.Delete(owned)
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestCan() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            owned := &EntryView{EntryId: "entry", UserId: authority.Id, user: authority}
+            a.NoError(authority.GrantPermissions(owned, authority, "rwd"))
+            a.NoError(owned.Save())
+
+            entry1 := &EntryView{EntryId: "entry", UserId: user.Id}
+            entry2 := &EntryView{EntryId: "entry", UserId: user.Id}
+            entry3 := &EntryView{EntryId: "entry", UserId: user.Id}
+            a.NoError(authority.GrantPermissions(entry1, user, "rwd"))
+            a.NoError(authority.GrantPermissions(entry2, user, "r"))
+            a.Error(authority.GrantPermissions(entry3, user, "$"))
+            a.Error(authority.GrantPermissions(entry3, authority, "r"))
+            a.Equal(authority.Id, entry1.AuthorityId)
+
+            a.True(user.Can("*", entry1))
+            a.True(user.Can("r", entry1))
+            a.True(user.Can("w", entry1))
+            a.True(user.Can("d", entry1))
+            a.True(user.Can("rw", entry1))
+            a.True(user.Can("rd", entry1))
+            a.True(user.Can("wd", entry1))
+            a.True(user.Can("rwd", entry1))
+            a.False(user.Can("$", entry1))
+            a.False(user.Can("r?", entry1))
+
+            a.True(user.Can("*", entry2))
+            a.True(user.Can("r", entry2))
+            a.False(user.Can("w", entry2))
+            a.False(user.Can("d", entry2))
+            a.True(user.Can("rw", entry2))
+            a.True(user.Can("rd", entry2))
+            a.False(user.Can("wd", entry2))
+            a.True(user.Can("rwd", entry2))
+            a.False(user.Can("$", entry2))
+            a.False(user.Can("r?", entry2))
+
+            a.False(user.Can("*", entry3))
+
+            // the user may delegate what they hold, but no more
+            entry2.user = user
+            a.NoError(entry2.Save())
+            other := &EntryView{EntryId: "entry", UserId: authority.Id}
+            a.Error(user.GrantPermissions(other, authority, "r"))
+            a.NoError(authority.GrantPermissions(entry2, user, "rd"))
+            a.NoError(user.GrantPermissions(other, authority, "r"))
+            a.Error(user.GrantPermissions(other, authority, "rw"))
+            a.Error(user.GrantPermissions(entry2, user, "rwd"))
+
+            DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestRevokePermissions() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            owned := newTestEntry(a, authority, "entry")
+            a.NoError(owned.WritePassword("hunter2"))
+            a.NoError(owned.Save())
+
+            shared, err := owned.ShareWith(user, "r")
+            if a.NoError(err) {
+                password, err := shared.ReadPassword()
+                a.NoError(err)
+                a.Equal("hunter2", password)
+
+                a.Error(user.RevokePermissions(shared, user))
+                a.Error(authority.RevokePermissions(shared, authority))
+                a.NoError(authority.RevokePermissions(shared, user))
+
+                loaded, err := LoadEntry("entry", user.Id)
+                if a.NoError(err) && a.NoError(loaded.AttachUser(user)) {
+                    a.False(user.Can("*", loaded))
+                    _, err = loaded.ReadPassword()
+                    if a.Error(err) {
+                        a.Equal(ErrPermission, err.(*Error).Code)
+                    }
+                }
+            }
+
+            DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestGrantExpiry() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            owned := newTestEntry(a, authority, "entry")
+            a.NoError(owned.Save())
+
+            expired := &EntryView{EntryId: "entry", UserId: user.Id, user: user}
+            a.NoError(authority.GrantPermissionsUntil(expired, user, "r", time.Now().Add(-time.Minute)))
+            a.False(user.Can("r", expired))
+            a.False(user.Can("*", expired))
+
+            future := &EntryView{EntryId: "entry", UserId: user.Id, user: user}
+            until := time.Now().Add(24 * 365 * time.Hour)
+            a.NoError(authority.GrantPermissionsUntil(future, user, "rd", until))
+            a.True(user.Can("r", future))
+            validUntil, err := future.ValidUntil()
+            a.NoError(err)
+            a.WithinDuration(until, validUntil, time.Second)
+
+            never := &EntryView{EntryId: "entry", UserId: user.Id, user: user}
+            a.NoError(authority.GrantPermissions(never, user, "r"))
+            a.True(user.Can("r", never))
+            validUntil, err = never.ValidUntil()
+            a.NoError(err)
+            a.True(validUntil.IsZero())
+
+            // a delegate may not grant beyond the expiry of their own permissions
+            a.NoError(future.Save())
+            delegated := &EntryView{EntryId: "entry", UserId: authority.Id}
+            a.Error(user.GrantPermissions(delegated, authority, "r"))
+            a.Error(user.GrantPermissionsUntil(delegated, authority, "r", until.Add(time.Hour)))
+            a.NoError(user.GrantPermissionsUntil(delegated, authority, "r", until.Add(-time.Hour)))
+
+            DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestGrantPermissionsBulk() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            other, err := NewUser("other.user", "secret")
+            if a.NoError(err) {
+                owned := newTestEntry(a, authority, "entry")
+                a.NoError(owned.WritePassword("hunter2"))
+                a.NoError(owned.Save())
+                _, err = owned.ShareWith(user, "r")
+                a.NoError(err)
+
+                _, err = authority.GrantPermissionsBulk(owned, []*User{user}, "$")
+                a.Error(err)
+                _, err = authority.GrantPermissionsBulk(owned, []*User{user}, "")
+                a.Error(err)
+
+                recipients := []*User{user, &User{Id: 9999}, other, nil, authority}
+                errs, err := authority.GrantPermissionsBulk(owned, recipients, "rw")
+                if a.NoError(err) && a.Len(errs, len(recipients)) {
+                    a.NoError(errs[0])
+                    a.True(errors.Is(errs[1], ErrNotFound))
+                    a.NoError(errs[2])
+                    a.True(errors.Is(errs[3], ErrNotFound))
+                    a.Error(errs[4])
+                }
+
+                for _, recipient := range []*User{user, other} {
+                    loaded, err := LoadEntry("entry", recipient.Id)
+                    if a.NoError(err) && a.NoError(loaded.AttachUser(recipient)) {
+                        a.True(recipient.Can("w", loaded))
+                        a.False(recipient.Can("d", loaded))
+                        password, err := loaded.ReadPassword()
+                        a.NoError(err)
+                        a.Equal("hunter2", password)
+                    }
+                }
+
+                // a recipient without delegate permission may not grant to others
+                shared, err := LoadEntry("entry", user.Id)
+                if a.NoError(err) {
+                    _, err = user.GrantPermissionsBulk(shared, []*User{other}, "r")
+                    a.True(errors.Is(err, ErrPermission))
+                }
+                _, err = user.GrantPermissionsBulk(owned, []*User{other}, "r")
+                a.Error(err)
+
+                DB.Unscoped().Where("entry_id = ?", "entry").Delete(EntryView{})
+                other.Drop()
+            }
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestRename() {
+    a := assert.New(suite.T())
+
+    authority, err := NewUser("admin", "secret")
+    if a.NoError(err) {
+        user, err := NewUser("test.user", "password")
+        if a.NoError(err) {
+            issued, err := NewGrant(authority, user, "entry", "rw")
+            if a.NoError(err) {
+                a.NoError(SaveGrant(issued))
+            }
+            received, err := NewGrant(user, authority, "entry", "r")
+            if a.NoError(err) {
+                a.NoError(SaveGrant(received))
+            }
+
+            a.Error(authority.Rename("test.user"))
+            a.Error(authority.Rename(""))
+            loaded, err := LoadUser("admin")
+            if a.NoError(err) {
+                a.Error(loaded.Rename("root"))
+            }
+
+            if a.NoError(authority.Rename("root")) {
+                a.Equal("root", authority.Name)
+                _, err = LoadUser("admin")
+                a.True(errors.Is(err, ErrNotFound))
+                loaded, err = LoadUser("root")
+                if a.NoError(err) {
+                    a.Equal(authority.Id, loaded.Id)
+                    a.NoError(loaded.StartSession("secret"))
+                }
+
+                grants, err := GrantsFor("entry")
+                if a.NoError(err) && a.Len(grants, 2) {
+                    for _, g := range grants {
+                        ok, err := g.Verify()
+                        a.NoError(err)
+                        if g.Grantor == "root" {
+                            a.Equal("test.user", g.Grantee)
+                            a.True(ok)
+                        } else {
+                            // grants from other users cannot be re-signed on their behalf
+                            a.Equal("root", g.Grantee)
+                            a.False(ok)
+                        }
+                    }
+                }
+            }
+
+            DB.Where("entry_id = ?", "entry").Delete(Grant{})
+            user.Drop()
+        }
+        authority.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestDrop() {
+    a := assert.New(suite.T())
+
+    owner, err := NewUser("owner", "password")
+    if !a.NoError(err) {
+        return
+    }
+    other, err := NewUser("other", "password")
+    if !a.NoError(err) {
+        owner.Drop()
+        return
+    }
+
+    entry := newTestEntry(a, owner, "entry")
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.Save())
+    a.NoError(entry.AddAttachment("notes.txt", "text/plain", []byte("notes")))
+    grant, err := NewGrant(owner, other, "entry", "r")
+    if a.NoError(err) {
+        a.NoError(SaveGrant(grant))
+    }
+    _, err = entry.ShareWith(other, "r")
+    a.NoError(err)
+    _, err = entry.ReadOnlyLink(time.Hour)
+    a.NoError(err)
+    team, err := NewTeam("drop", owner)
+    if a.NoError(err) {
+        defer DB.Delete(team)
+        a.NoError(team.AddMember(owner, other))
+    }
+
+    // the shared view and the membership depend on the owner, so the owner cannot be dropped first
+    err = owner.Drop()
+    if a.Error(err) {
+        de, ok := err.(*DependentEntriesError)
+        if a.True(ok) && a.Len(de.Entries, 1) && a.Len(de.Memberships, 1) {
+            a.Equal("entry", de.Entries[0].EntryId)
+            a.Equal(other.Id, de.Entries[0].UserId)
+            a.Equal(other.Id, de.Memberships[0].UserId)
+        }
+        a.Contains(err.Error(), "entry")
+        a.Contains(err.Error(), "team memberships")
+    }
+    _, err = LoadUser("owner")
+    a.NoError(err)
+
+    a.NoError(other.Drop())
+    a.NoError(owner.Drop())
+
+    var count int
+    a.NoError(DB.Model(User{}).Where("id IN (?)", []int64{owner.Id, other.Id}).Count(&count).Error)
+    a.Equal(0, count)
+    a.NoError(DB.Unscoped().Model(EntryView{}).Where("entry_id = ?", "entry").Count(&count).Error)
+    a.Equal(0, count)
+    a.NoError(DB.Model(Attachment{}).Where("entry_id = ?", "entry").Count(&count).Error)
+    a.Equal(0, count)
+    a.NoError(DB.Model(Grant{}).Where("entry_id = ?", "entry").Count(&count).Error)
+    a.Equal(0, count)
+    a.NoError(DB.Model(TeamMember{}).Where("user_id IN (?)", []int64{owner.Id, other.Id}).Count(&count).Error)
+    a.Equal(0, count)
+    a.NoError(DB.Model(SharedLink{}).Where("user_id = ?", owner.Id).Count(&count).Error)
+    a.Equal(0, count)
+}
+
+func (suite *UserTestSuite) TestSyntheticNonces() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+
+    ad := []byte("context")
+    first, err := u.encryptSynthetic([]byte("data"), ad)
+    a.NoError(err)
+    second, err := u.encryptSynthetic([]byte("data"), ad)
+    a.NoError(err)
+    a.Equal(first, second)
+    other, err := u.encryptSynthetic([]byte("other"), ad)
+    a.NoError(err)
+    a.NotEqual(first, other)
+    data, err := u.DecryptWithAD(first, ad)
+    if a.NoError(err) {
+        a.Equal([]byte("data"), data)
+    }
+
+    // the nonce is computed under a key derived from the encryption key, never under the encryption key itself
+    raw, err := base64.StdEncoding.DecodeString(first)
+    if a.NoError(err) && a.True(len(raw) > 12) {
+        key := u.getEncryptionKey()
+        mac := hmac.New(sha256.New, key)
+        mac.Write([]byte("passrep synthetic nonce\x00"))
+        binary.Write(mac, binary.BigEndian, uint64(len(ad)))
+        mac.Write(ad)
+        mac.Write([]byte("data"))
+        a.NotEqual(mac.Sum(nil)[:12], raw[:12])
+        a.NotEqual(key, syntheticNonceKey(key))
+        utils.SecureZero(key)
+    }
+}
+
+func (suite *UserTestSuite) TestCounterNonces() {
+    a := assert.New(suite.T())
+
+    CounterNonces = true
+    defer func() { CounterNonces = false }()
+
+    // the count is held in the last eight bytes of the nonce
+    counter := func(encrypted string) uint64 {
+        raw, err := base64.StdEncoding.DecodeString(encrypted)
+        if a.NoError(err) && a.True(len(raw) >= 12) {
+            a.Equal(make([]byte, 4), raw[:4])
+            return binary.BigEndian.Uint64(raw[4:12])
+        }
+        return 0
+    }
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var previous uint64
+        for i := 0; i < 5; i++ {
+            encrypted, err := u.Encrypt([]byte("data"))
+            if a.NoError(err) {
+                next := counter(encrypted)
+                a.True(next > previous)
+                previous = next
+                data, err := u.Decrypt(encrypted)
+                a.NoError(err)
+                a.Equal([]byte("data"), data)
+            }
+        }
+
+        var wg sync.WaitGroup
+        nonces := make(chan uint64, 20)
+        for i := 0; i < 20; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                encrypted, err := u.Encrypt([]byte("data"))
+                if a.NoError(err) {
+                    nonces <- counter(encrypted)
+                }
+            }()
+        }
+        wg.Wait()
+        close(nonces)
+        seen := make(map[uint64]bool)
+        for n := range nonces {
+            a.False(seen[n])
+            a.True(n > previous)
+            seen[n] = true
+        }
+        a.Len(seen, 20)
+
+        // the counter survives a change of keys, which stores the rest of the user
+        a.NoError(u.ChangePassword("password", "new password"))
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(previous+20, uint64(loaded.NonceCounter))
+            a.NoError(loaded.StartSession("new password"))
+            encrypted, err := loaded.Encrypt([]byte("data"))
+            if a.NoError(err) {
+                a.Equal(uint64(loaded.NonceCounter)+1, counter(encrypted))
+            }
+        }
+
+        // a user read from a vault file has no counter of its own, even when its Id matches a stored row
+        detached := new(User)
+        detached.copyFields(u)
+        detached.keys = u.keys
+        detached.detached = true
+        _, err = detached.Encrypt([]byte("data"))
+        if a.Error(err) {
+            a.True(errors.Is(err, ErrEncryption))
+        }
+        _, err = (&User{keys: u.keys}).Encrypt([]byte("data"))
+        if a.Error(err) {
+            a.True(errors.Is(err, ErrEncryption))
+        }
+
+        CounterNonces = false
+        encrypted, err := u.Encrypt([]byte("random"))
+        a.NoError(err)
+        data, err := u.Decrypt(encrypted)
+        a.NoError(err)
+        a.Equal([]byte("random"), data)
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestFingerprint() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        fingerprint := u.Fingerprint()
+        a.Regexp("^[0-9a-f]{4}( [0-9a-f]{4}){15}$", fingerprint)
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(fingerprint, loaded.Fingerprint())
+            a.True(loaded.VerifyFingerprint(fingerprint))
+            a.True(loaded.VerifyFingerprint(strings.ToUpper(strings.Replace(fingerprint, " ", "", -1))))
+            a.False(loaded.VerifyFingerprint(fingerprint[:len(fingerprint)-1]))
+            a.False(loaded.VerifyFingerprint(""))
+        }
+
+        other, err := NewUser("other.user", "password")
+        if a.NoError(err) {
+            a.NotEqual(fingerprint, other.Fingerprint())
+            a.False(other.VerifyFingerprint(fingerprint))
+            other.Drop()
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestResignGrants() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    other, err := NewUser("other.user", "secret")
+    if !a.NoError(err) {
+        return
+    }
+    defer other.Drop()
+
+    entry, err := NewEntry(u)
+    if !a.NoError(err) {
+        return
+    }
+    a.NoError(entry.WritePassword("hunter2"))
+    a.NoError(entry.Save())
+    defer DB.Unscoped().Delete(EntryView{}, "entry_id = ?", entry.EntryId)
+    _, err = entry.ShareWith(other, "r")
+    a.NoError(err)
+
+    a.NoError(u.ResignGrants())
+    a.NoError(u.ChangePassword("password", "changed"))
+
+    shared, err := LoadEntry(entry.EntryId, other.Id)
+    if a.NoError(err) && a.NoError(shared.AttachUser(other)) {
+        password, err := shared.ReadPassword()
+        a.NoError(err)
+        a.Equal("hunter2", password)
+    }
+    grants, err := GrantsFor(entry.EntryId)
+    if a.NoError(err) && a.Len(grants, 1) {
+        ok, err := grants[0].Verify()
+        a.NoError(err)
+        a.True(ok)
+    }
+
+    // a signature which does not verify is reported rather than signed again
+    forged := newTestEntry(a, other, "forged")
+    forged.AuthorityId = u.Id
+    a.NoError(DB.Create(forged).Error)
+    defer DB.Unscoped().Delete(forged)
+    err = u.ResignGrants()
+    var staleErr *StaleSignaturesError
+    if a.True(errors.As(err, &staleErr)) && a.Len(staleErr.Entries, 1) {
+        a.Equal("forged", staleErr.Entries[0].EntryId)
+    }
+    shared, err = LoadEntry(entry.EntryId, other.Id)
+    if a.NoError(err) && a.NoError(shared.AttachUser(other)) {
+        a.True(other.Can("r", shared))
+    }
+
+    u.EndSession()
+    a.True(errors.Is(u.ResignGrants(), ErrCrypto))
+}
+
+func (suite *UserTestSuite) TestLockout() {
+    a := assert.New(suite.T())
+
+    lockout := config.LockoutDuration
+    config.LockoutDuration = 500 * time.Millisecond
+    defer func() { config.LockoutDuration = lockout }()
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        for i := 0; i < config.MaxFailedLogins; i++ {
+            locked, _ := u.IsLocked()
+            a.False(locked)
+            err := u.StartSession("wrong")
+            a.True(errors.Is(err, ErrAuthentication))
+        }
+        locked, remaining := u.IsLocked()
+        a.True(locked)
+        a.True(remaining > 0 && remaining <= config.LockoutDuration)
+
+        // the lockout applies to every copy of the user, and even the correct password is refused
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(config.MaxFailedLogins, loaded.FailedLogins)
+            err = loaded.StartSession("password")
+            a.True(errors.Is(err, ErrAuthentication))
+            a.Contains(err.Error(), "Too many failed logins")
+            a.False(loaded.CanSign())
+        }
+
+        // a further failure once the lockout has passed doubles it
+        time.Sleep(config.LockoutDuration)
+        a.Error(u.StartSession("wrong"))
+        locked, remaining = u.IsLocked()
+        a.True(locked)
+        a.True(remaining > config.LockoutDuration)
+
+        time.Sleep(2 * config.LockoutDuration)
+        if a.NoError(u.StartSession("password")) {
+            a.Equal(0, u.FailedLogins)
+            a.Nil(u.LastFailedLogin)
+            loaded, err = LoadUser("test.user")
+            if a.NoError(err) {
+                a.Equal(0, loaded.FailedLogins)
+            }
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *UserTestSuite) TestLockoutPasswordChecks() {
+    a := assert.New(suite.T())
+
+    lockout := config.LockoutDuration
+    config.LockoutDuration = 500 * time.Millisecond
+    defer func() { config.LockoutDuration = lockout }()
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+
+    // failures of every kind of password check count towards the lockout
+    a.False(u.VerifyPassword("wrong"))
+    a.True(errors.Is(u.ChangePassword("wrong", "changed"), ErrAuthentication))
+    a.True(errors.Is(u.RekeyKdf("wrong", config.KdfIterations), ErrAuthentication))
+    a.Equal(3, u.FailedLogins)
+    for i := 3; i < config.MaxFailedLogins; i++ {
+        a.False(u.VerifyPassword("wrong"))
+    }
+    locked, _ := u.IsLocked()
+    a.True(locked)
+
+    // and while locked out, even the correct password is refused by each of them
+    a.False(u.VerifyPassword("password"))
+    err = u.ChangePassword("password", "changed")
+    if a.Error(err) {
+        a.Contains(err.Error(), "Too many failed logins")
+    }
+    err = u.RekeyKdf("password", config.KdfIterations)
+    if a.Error(err) {
+        a.Contains(err.Error(), "Too many failed logins")
+    }
+    a.Equal(config.MaxFailedLogins, u.FailedLogins)
+
+    time.Sleep(config.LockoutDuration)
+    a.True(u.VerifyPassword("password"))
+    a.Equal(0, u.FailedLogins)
+    loaded, err := LoadUser("test.user")
+    if a.NoError(err) {
+        a.Equal(0, loaded.FailedLogins)
+    }
+}
+
+func (suite *UserTestSuite) TestConcurrentFailedLogins() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        // each failure is counted, even when several copies of the user fail at the same time
+        attempts := config.MaxFailedLogins - 1
+        var wg sync.WaitGroup
+        for i := 0; i < attempts; i++ {
+            loaded, err := LoadUser("test.user")
+            if !a.NoError(err) {
+                continue
+            }
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                a.True(errors.Is(loaded.StartSession("wrong"), ErrAuthentication))
+            }()
+        }
+        wg.Wait()
+
+        loaded, err := LoadUser("test.user")
+        if a.NoError(err) {
+            a.Equal(attempts, loaded.FailedLogins)
+        }
+        a.Error(u.StartSession("wrong"))
+        locked, _ := u.IsLocked()
+        a.True(locked)
+
+        u.Drop()
+    }
+}
 
 func TestUserTestSuite(t *testing.T) {
     suite.Run(t, new(UserTestSuite))
@@ -0,0 +1,348 @@
+package core
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// The VaultFormatVersion is the version of the format produced by ExportVault.  It is incremented whenever the format
+// changes, and ImportVault accepts exports of this version or earlier.  Version 1 held the whole vault as a single
+// encrypted JSON document, while version 2 holds a separately encrypted record for each entry, so that exports can be
+// streamed.  Version 3 orders the entries by EntryId and encrypts each record reproducibly, so that exporting the same
+// vault twice produces the same bytes, and ends with a checksum of the whole export.
+const VaultFormatVersion = 3
+
+// The vaultDocument structure is the JSON document holding a vault exported in version 1 of the format.
+type vaultDocument struct {
+    Version int          `json:"version"`
+    User    string       `json:"user"`
+    Entries []vaultEntry `json:"entries"`
+}
+
+// The vaultHeader structure is the first record of a streamed export, identifying the format version and the exporting
+// user.  Exports of version 2 also carry a random identifier of the export itself, to which their records are bound.
+type vaultHeader struct {
+    Version int    `json:"version"`
+    User    string `json:"user"`
+    Export  string `json:"export,omitempty"`
+}
+
+// The vaultTrailer structure is the last record of a streamed export, without which the export is incomplete.  From
+// version 3, it holds the hexadecimal SHA-256 checksum of every line of the export preceding it.
+type vaultTrailer struct {
+    Count    int    `json:"count"`
+    Checksum string `json:"checksum,omitempty"`
+}
+
+const (
+    // The vaultHeaderTag marks the header record of a streamed export.
+    vaultHeaderTag = "H "
+    // The vaultEntryTag marks an entry record of a streamed export.
+    vaultEntryTag = "E "
+    // The vaultTrailerTag marks the trailer record of a streamed export.
+    vaultTrailerTag = "T "
+)
+
+// The vaultRecordAD function produces the additional data binding a record of a streamed export to its export and its
+// position, so that records cannot be dropped or reordered without detection.  The header, which holds the export
+// identifier, is bound to its position alone.  From version 3, which has no export identifier, records moved between
+// exports are instead detected by the checksum.
+func vaultRecordAD(export string, position string) []byte {
+    return []byte("passrep vault\x00" + export + "\x00" + position)
+}
+
+// The vaultEntry structure holds the decrypted fields of a single exported entry.  The string fields, including the TOTP
+// secret, are keyed by field name, while the JSON fields are embedded as they are.
+type vaultEntry struct {
+    Fields   map[string]string `json:"fields"`
+    Expiry   string            `json:"expiry,omitempty"`
+    Extras   json.RawMessage   `json:"extras,omitempty"`
+    Userdata json.RawMessage   `json:"userdata,omitempty"`
+    Archived bool              `json:"archived,omitempty"`
+}
+
+// The vaultJSONFields map gives the vaultEntry member holding each of the encrypted fields which are not plain strings.
+var vaultJSONFields = map[string]func(e *vaultEntry) *json.RawMessage{
+    "extras":   func(e *vaultEntry) *json.RawMessage { return &e.Extras },
+    "userdata": func(e *vaultEntry) *json.RawMessage { return &e.Userdata },
+}
+
+// ExportVault produces a backup of every entry of the user, as written by ExportVaultTo.  The whole backup is held in
+// memory, so ExportVaultTo should be preferred for large vaults.
+func (this *User) ExportVault() ([]byte, error) {
+    var buffer bytes.Buffer
+    if err := this.ExportVaultTo(&buffer); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+// ExportVaultTo writes a backup of every entry of the user, including archived ones, in order of EntryId.  The fields
+// of each entry which the user is permitted to read are decrypted and assembled into a JSON record, which is encrypted
+// with the user's symmetric key and written as a line of base64 before the next entry is loaded, so only a batch of
+// entries is held in memory at a time.  The entries are preceded by a header and followed by a trailer holding their
+// count and a checksum of the export, and each record is bound to its position, so that ImportVault rejects a backup
+// which was cut short or altered.  The records are encrypted reproducibly, so exporting an unchanged vault again
+// produces the same bytes.  The user must have an active session.  Should the export fail part way through, the error
+// reports how many entries were written, and the output, lacking its trailer, cannot be imported.
+func (this *User) ExportVaultTo(w io.Writer) error {
+    writer := bufio.NewWriter(w)
+    checksum := sha256.New()
+    document := io.MultiWriter(writer, checksum)
+    header := vaultHeader{Version: VaultFormatVersion, User: this.Name}
+    if err := this.writeVaultRecord(document, vaultHeaderTag, &header, vaultRecordAD("", "header")); err != nil {
+        return err
+    }
+
+    count := 0
+    err := this.eachEntryBy("entry_id", func(e *EntryView) error {
+        exported, err := this.exportVaultEntry(e)
+        if err != nil {
+            return err
+        }
+        if err := this.writeVaultRecord(document, vaultEntryTag, &exported, vaultRecordAD("", strconv.Itoa(count))); err != nil {
+            return err
+        }
+        count++
+        return nil
+    }, ListOptions{IncludeArchived: true})
+    if err != nil {
+        writer.Flush()
+        return this.exportFailed(count, err)
+    }
+
+    trailer := vaultTrailer{Count: count, Checksum: hex.EncodeToString(checksum.Sum(nil))}
+    if err := this.writeVaultRecord(writer, vaultTrailerTag, &trailer, vaultRecordAD("", "trailer")); err != nil {
+        return err
+    }
+    if err := writer.Flush(); err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// The writeVaultRecord function encrypts the JSON encoding of the record reproducibly, bound to the additional data,
+// and writes it as a line of base64 following the tag.
+func (this *User) writeVaultRecord(w io.Writer, tag string, record interface{}, ad []byte) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return NewError(err, this)
+    }
+    defer utils.SecureZero(data)
+    encrypted, err := this.encryptSynthetic(data, ad)
+    if err != nil {
+        return err
+    }
+    if _, err := io.WriteString(w, tag+encrypted+"\n"); err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// The exportVaultEntry function decrypts the fields of the entry which the user is permitted to read for export.
+func (this *User) exportVaultEntry(e *EntryView) (vaultEntry, error) {
+    exported := vaultEntry{Fields: make(map[string]string), Archived: e.Archived}
+    for _, f := range encryptedFields {
+        if len(*f.value(e)) == 0 || (len(f.query) > 0 && !this.Can(f.query, e)) {
+            continue
+        }
+        data, err := e.decryptField(f.name)
+        if err != nil {
+            return exported, NewError(fmt.Sprintf("Entry '%s': %v", e.EntryId, err), this)
+        }
+
+        if member, ok := vaultJSONFields[f.name]; ok {
+            *member(&exported) = json.RawMessage(data)
+        } else if f.name == "expiry" {
+            exported.Expiry = string(data)
+        } else {
+            exported.Fields[f.name] = string(data)
+        }
+    }
+    return exported, nil
+}
+
+// ImportVault restores a backup produced by ExportVault or ExportVaultTo, creating a new entry owned by the user for
+// each exported entry.  The backup must have been exported by the same user, whose session must be active.  Nothing is
+// stored unless the whole backup can be read and its checksum verified, and a backup which was cut short or altered is
+// rejected with ErrDecryption.  The entries are then stored in a single transaction.
+func (this *User) ImportVault(blob []byte) ([]*EntryView, error) {
+    if !bytes.HasPrefix(blob, []byte(vaultHeaderTag)) {
+        return this.importVaultDocument(blob)
+    }
+    return this.ImportVaultFrom(bytes.NewReader(blob))
+}
+
+// ImportVaultFrom restores a backup written by ExportVaultTo, reading it from the reader, as described for ImportVault.
+func (this *User) ImportVaultFrom(r io.Reader) ([]*EntryView, error) {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(nil, maxVaultRecordSize)
+
+    var header vaultHeader
+    var views []*EntryView
+    checksum := sha256.New()
+    complete := false
+    for line := 0; scanner.Scan(); line++ {
+        text := scanner.Text()
+        if complete {
+            return nil, NewError("Data follows the end of the vault export", this, ErrDecryption)
+        }
+        if !strings.HasPrefix(text, vaultTrailerTag) {
+            io.WriteString(checksum, text+"\n")
+        }
+
+        switch {
+        case line == 0:
+            if err := this.readVaultRecord(text, vaultHeaderTag, &header, vaultRecordAD("", "header")); err != nil {
+                return nil, err
+            }
+            if header.Version < 2 || header.Version > VaultFormatVersion {
+                return nil, NewError(fmt.Sprintf("Unsupported vault format version %d", header.Version), this)
+            }
+        case strings.HasPrefix(text, vaultTrailerTag):
+            var trailer vaultTrailer
+            if err := this.readVaultRecord(text, vaultTrailerTag, &trailer, vaultRecordAD(header.Export, "trailer")); err != nil {
+                return nil, err
+            }
+            if trailer.Count != len(views) {
+                return nil, NewError(fmt.Sprintf("Vault export holds %d entries rather than %d", len(views), trailer.Count), this, ErrDecryption)
+            }
+            if header.Version >= 3 && trailer.Checksum != hex.EncodeToString(checksum.Sum(nil)) {
+                return nil, NewError("Vault export checksum does not match", this, ErrDecryption)
+            }
+            complete = true
+        default:
+            var exported vaultEntry
+            if err := this.readVaultRecord(text, vaultEntryTag, &exported, vaultRecordAD(header.Export, strconv.Itoa(len(views)))); err != nil {
+                return nil, err
+            }
+            view, err := this.importVaultEntry(&exported)
+            if err != nil {
+                return nil, err
+            }
+            views = append(views, view)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, NewError(err, this)
+    }
+    if !complete {
+        return nil, NewError("Vault export is truncated", this, ErrDecryption)
+    }
+    return views, this.saveImported(views)
+}
+
+// The maxVaultRecordSize is the length of the longest record ImportVaultFrom accepts.
+const maxVaultRecordSize = 64 << 20
+
+// The readVaultRecord function decrypts a line of a streamed export, which must begin with the tag, and decodes the JSON
+// record within.
+func (this *User) readVaultRecord(line string, tag string, record interface{}, ad []byte) error {
+    if !strings.HasPrefix(line, tag) {
+        return NewError("Malformed vault export record", this, ErrDecryption)
+    }
+    data, err := this.DecryptWithAD(strings.TrimPrefix(line, tag), ad)
+    if err != nil {
+        return err
+    }
+    defer utils.SecureZero(data)
+    if err := json.Unmarshal(data, record); err != nil {
+        return NewError(err, this)
+    }
+    return nil
+}
+
+// The importVaultDocument function restores a backup exported as a single document by version 1 of the format.
+func (this *User) importVaultDocument(blob []byte) ([]*EntryView, error) {
+    data, err := this.Decrypt(string(blob))
+    if err != nil {
+        return nil, err
+    }
+    defer utils.SecureZero(data)
+
+    var document vaultDocument
+    if err := json.Unmarshal(data, &document); err != nil {
+        return nil, NewError(err, this)
+    }
+    if document.Version != 1 {
+        return nil, NewError(fmt.Sprintf("Unsupported vault format version %d", document.Version), this)
+    }
+
+    var views []*EntryView
+    for i := range document.Entries {
+        view, err := this.importVaultEntry(&document.Entries[i])
+        if err != nil {
+            return nil, err
+        }
+        views = append(views, view)
+    }
+    return views, this.saveImported(views)
+}
+
+// The importVaultEntry function produces a new, unsaved entry owned by the user holding the fields of the exported entry.
+func (this *User) importVaultEntry(exported *vaultEntry) (*EntryView, error) {
+    view, err := NewEntry(this)
+    if err != nil {
+        return nil, err
+    }
+    encrypted := map[string][]byte{"expiry": []byte(exported.Expiry)}
+    for name, value := range exported.Fields {
+        encrypted[name] = []byte(value)
+    }
+    for name, member := range vaultJSONFields {
+        encrypted[name] = *member(exported)
+    }
+    for name, value := range encrypted {
+        field, ok := findField(encryptedFields, name)
+        if !ok {
+            return nil, NewError("Unknown field '"+name+"'", this)
+        }
+        if len(value) == 0 {
+            continue
+        }
+        if *field.value(view), err = view.encryptField(field.name, value); err != nil {
+            return nil, err
+        }
+    }
+    view.Archived = exported.Archived
+    return view, nil
+}
+
+// The saveImported function saves all of the imported entries in a single transaction, so that either every entry is
+// imported or, should any fail, none are.  The entries are left unsaved on failure.
+func (this *User) saveImported(views []*EntryView) error {
+    for _, view := range views {
+        if err := view.checkSave(); err != nil {
+            return err
+        }
+    }
+
+    tx := DB.Begin()
+    for _, view := range views {
+        if err := view.store(tx); err != nil {
+            tx.Rollback()
+            for _, v := range views {
+                v.Id = 0
+            }
+            return err
+        }
+    }
+    if err := tx.Commit().Error; err != nil {
+        for _, v := range views {
+            v.Id = 0
+        }
+        return NewError(err, this)
+    }
+    for _, view := range views {
+        view.changed("")
+    }
+    return nil
+}
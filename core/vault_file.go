@@ -0,0 +1,258 @@
+package core
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha512"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "github.com/awm/passrep/utils"
+    "io"
+)
+
+const (
+    // VaultFileVersion is the version of the single-file vault format produced by WriteVault.
+    VaultFileVersion = 1
+    // MaxVaultFileSize is the largest payload, in bytes, which ReadVault accepts, so that a corrupted length cannot
+    // cause an enormous allocation.
+    MaxVaultFileSize = 256 << 20
+)
+
+// The vaultFileMagic identifies a single-file vault.
+var vaultFileMagic = [8]byte{'P', 'A', 'S', 'S', 'R', 'E', 'P', 'V'}
+
+// The vaultFileKdfs map gives the code recorded in a vault file header for each key derivation function.
+var vaultFileKdfs = map[string]uint8{
+    KdfPbkdf2:   1,
+    KdfArgon2id: 2,
+}
+
+// The vaultFileHeader structure is the fixed-size header at the start of a single-file vault, encoded in big-endian byte
+// order.  It is followed by the payload of the given length, and then by an HMAC-SHA512 over the header and payload.
+type vaultFileHeader struct {
+    Magic       [8]byte
+    Version     uint8
+    Kdf         uint8
+    Iterations  uint32
+    Time        uint32
+    Memory      uint32
+    Parallelism uint8
+    Salt        [32]byte
+    Length      uint32
+}
+
+// The vaultFilePayload structure is the JSON document held in a single-file vault.
+type vaultFilePayload struct {
+    User    *User        `json:"user"`
+    Entries []*EntryView `json:"entries"`
+}
+
+// The kdfUser function produces a user carrying only the key derivation parameters recorded in the header, so that the
+// MAC key can be derived with deriveKey.
+func (this *vaultFileHeader) kdfUser() (*User, error) {
+    user := &User{
+        KdfIterations:  int(this.Iterations),
+        KdfTime:        this.Time,
+        KdfMemory:      this.Memory,
+        KdfParallelism: this.Parallelism,
+    }
+    for name, code := range vaultFileKdfs {
+        if code == this.Kdf {
+            user.KdfAlgorithm = name
+        }
+    }
+    if len(user.KdfAlgorithm) == 0 {
+        return nil, NewError(fmt.Sprintf("Unknown vault key derivation function %d", this.Kdf), ErrDecryption)
+    }
+    switch user.KdfAlgorithm {
+    case KdfPbkdf2:
+        if user.KdfIterations <= 0 || user.KdfIterations > vaultFileMaxIterations() {
+            return nil, NewError("Invalid vault PBKDF2 parameters", ErrDecryption)
+        }
+    case KdfArgon2id:
+        if user.KdfTime == 0 || user.KdfTime > vaultFileMaxArgon2Time || user.KdfMemory == 0 ||
+            user.KdfMemory > vaultFileMaxArgon2Memory || user.KdfParallelism == 0 {
+            return nil, NewError("Invalid vault Argon2id parameters", ErrDecryption)
+        }
+    }
+    return user, nil
+}
+
+// The limits on the key derivation parameters ReadVault accepts from a vault file header.  The parameters are needed to
+// check the MAC, so they must be trusted before anything else in the file can be, and these limits keep a crafted
+// header from making the reader spend unbounded time or memory deriving the MAC key.
+const (
+    // The vaultFileIterationsFactor is how many times the configured PBKDF2 iteration count a vault may require.
+    vaultFileIterationsFactor = 100
+    // The vaultFileMaxArgon2Time is the largest Argon2id time parameter a vault may require.
+    vaultFileMaxArgon2Time = 64
+    // The vaultFileMaxArgon2Memory is the largest Argon2id memory parameter, in KiB, a vault may require.
+    vaultFileMaxArgon2Memory = 2 << 20
+)
+
+// The vaultFileMaxIterations function provides the largest PBKDF2 iteration count a vault may require, a multiple of
+// the larger of the configured and default counts.
+func vaultFileMaxIterations() int {
+    iterations := DefaultConfig().KdfIterations
+    if config.KdfIterations > iterations {
+        iterations = config.KdfIterations
+    }
+    return vaultFileIterationsFactor * iterations
+}
+
+// The vaultFileMac function derives the MAC key from the password using the parameters in the header, and computes the
+// MAC over the encoded header and payload.
+func vaultFileMac(header *vaultFileHeader, encoded []byte, payload []byte, password string) ([]byte, error) {
+    kdf, err := header.kdfUser()
+    if err != nil {
+        return nil, err
+    }
+    pwbytes := []byte(password)
+    defer utils.SecureZero(pwbytes)
+    key, err := deriveKey(kdf, pwbytes, header.Salt[:], sha512.Size)
+    if err != nil {
+        return nil, err
+    }
+    defer utils.SecureZero(key)
+
+    mac := hmac.New(sha512.New, key)
+    mac.Write(encoded)
+    mac.Write(payload)
+    return mac.Sum(nil), nil
+}
+
+// WriteVault writes the user and every one of the user's entry views to a self-contained vault file, which ReadVault can
+// open without a database.  The entries are written as they are stored, so their fields remain encrypted under the user's
+// keys.  The password must be the user's, and is also used, with the user's key derivation function and a fresh salt, to
+// derive the key of the HMAC which protects the file against corruption and tampering.  Attachments and team entries are
+// not included.
+func WriteVault(w io.Writer, user *User, password string) error {
+    keys, err := user.checkPassword(password)
+    if err != nil {
+        return err
+    }
+    keys.Wipe()
+
+    var entries []*EntryView
+    if err := DB.Where("user_id = ?", user.Id).Order("entry_id").Find(&entries).Error; err != nil {
+        return NewError(err, user)
+    }
+    payload, err := json.Marshal(&vaultFilePayload{user, entries})
+    if err != nil {
+        return NewError(err, user)
+    }
+    if len(payload) > MaxVaultFileSize {
+        return NewError(fmt.Sprintf("Vault of %d bytes exceeds the limit of %d bytes", len(payload), MaxVaultFileSize), user)
+    }
+
+    header := vaultFileHeader{
+        Magic:       vaultFileMagic,
+        Version:     VaultFileVersion,
+        Iterations:  uint32(user.kdfIterations()),
+        Time:        user.KdfTime,
+        Memory:      user.KdfMemory,
+        Parallelism: user.KdfParallelism,
+        Length:      uint32(len(payload)),
+    }
+    algorithm := user.KdfAlgorithm
+    if len(algorithm) == 0 {
+        algorithm = KdfPbkdf2
+    }
+    header.Kdf = vaultFileKdfs[algorithm]
+    salt := utils.RandomBytes(len(header.Salt))
+    if salt == nil {
+        return NewError("RNG failure!", user)
+    }
+    copy(header.Salt[:], salt)
+
+    var encoded bytes.Buffer
+    if err := binary.Write(&encoded, binary.BigEndian, &header); err != nil {
+        return NewError(err, user)
+    }
+    mac, err := vaultFileMac(&header, encoded.Bytes(), payload, password)
+    if err != nil {
+        return err
+    }
+
+    for _, part := range [][]byte{encoded.Bytes(), payload, mac} {
+        if _, err := w.Write(part); err != nil {
+            return NewError(err, user)
+        }
+    }
+    return nil
+}
+
+// ReadVault reads a vault file written by WriteVault, checking its MAC before trusting any of its contents, and starts
+// a session for the user with the password.  Neither the user nor the entries are stored in the database; they keep the
+// identifiers they were written with, the database is not consulted for the user's failed logins, and the user's keys
+// are not upgraded to the configured key derivation as StartSession would.  The entries are attached to the user, and to
+// the user as authority where the user signed their permissions, so that they may be read without a database.  A
+// truncated file, or one whose key derivation parameters exceed the limits checked before the MAC key is derived, is
+// rejected with ErrDecryption, and a wrong password or corrupted file with ErrAuthentication.
+func ReadVault(r io.Reader, password string) (*User, []*EntryView, error) {
+    encoded := make([]byte, binary.Size(vaultFileHeader{}))
+    if _, err := io.ReadFull(r, encoded); err != nil {
+        return nil, nil, NewError("Vault file truncated", ErrDecryption)
+    }
+    var header vaultFileHeader
+    if err := binary.Read(bytes.NewReader(encoded), binary.BigEndian, &header); err != nil {
+        return nil, nil, NewError(err, ErrDecryption)
+    }
+    if header.Magic != vaultFileMagic {
+        return nil, nil, NewError("Not a vault file", ErrDecryption)
+    }
+    if header.Version < 1 || header.Version > VaultFileVersion {
+        return nil, nil, NewError(fmt.Sprintf("Unsupported vault file version %d", header.Version), ErrDecryption)
+    }
+    if header.Length > MaxVaultFileSize {
+        return nil, nil, NewError(fmt.Sprintf("Vault of %d bytes exceeds the limit of %d bytes", header.Length, MaxVaultFileSize), ErrDecryption)
+    }
+
+    payload := make([]byte, header.Length)
+    mac := make([]byte, sha512.Size)
+    for _, part := range [][]byte{payload, mac} {
+        if _, err := io.ReadFull(r, part); err != nil {
+            return nil, nil, NewError("Vault file truncated", ErrDecryption)
+        }
+    }
+    expected, err := vaultFileMac(&header, encoded, payload, password)
+    if err != nil {
+        return nil, nil, err
+    }
+    if !hmac.Equal(mac, expected) {
+        return nil, nil, NewError("Incorrect password or corrupted vault file", ErrAuthentication)
+    }
+
+    var document vaultFilePayload
+    if err := json.Unmarshal(payload, &document); err != nil {
+        return nil, nil, NewError(err, ErrDecryption)
+    }
+    user := document.User
+    if user == nil {
+        return nil, nil, NewError("Vault file has no user", ErrDecryption)
+    }
+    // the user is not the one in the database, if any, so failed logins stored there or in the file do not apply
+    user.detached = true
+    user.FailedLogins = 0
+    user.LastFailedLogin = nil
+    for _, e := range document.Entries {
+        if e.UserId != user.Id {
+            return nil, nil, NewError(fmt.Sprintf("Entry '%s' belongs to another user", e.EntryId), user, ErrDecryption)
+        }
+        e.user = user
+        if e.AuthorityId == user.Id {
+            e.authority = user
+        }
+    }
+    // upgrading the keys would write them to whichever database row holds the user's Id
+    keys, err := user.checkPassword(password)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err := user.StartSessionWithKeys(keys); err != nil {
+        keys.Wipe()
+        return nil, nil, err
+    }
+    return user, document.Entries, nil
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "testing"
+    "time"
+)
+
+type VaultFileTestSuite struct {
+    suite.Suite
+}
+
+func (suite *VaultFileTestSuite) TestRoundTrip() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        titles := []string{"Mail", "Bank"}
+        for _, title := range titles {
+            entry, err := NewEntry(u)
+            if a.NoError(err) {
+                a.NoError(entry.WriteTitle(title))
+                a.NoError(entry.WritePassword("secret " + title))
+                a.NoError(entry.Save())
+            }
+        }
+
+        var file bytes.Buffer
+        a.Error(WriteVault(&file, u, "wrong"))
+        a.Zero(file.Len())
+        if a.NoError(WriteVault(&file, u, "password")) {
+            a.True(bytes.HasPrefix(file.Bytes(), vaultFileMagic[:]))
+            a.NotContains(file.String(), "secret")
+
+            // the vault is read without the database
+            saved := Resolver
+            Resolver = fakeResolver{}
+            loaded, entries, err := ReadVault(bytes.NewReader(file.Bytes()), "password")
+            if a.NoError(err) && a.Len(entries, 2) {
+                a.Equal(u.Name, loaded.Name)
+                a.True(loaded.CanSign())
+                read := make(map[string]string)
+                for _, e := range entries {
+                    title, err := e.ReadTitle()
+                    a.NoError(err)
+                    password, err := e.ReadPassword()
+                    a.NoError(err)
+                    read[title] = password
+                }
+                a.Equal(map[string]string{"Mail": "secret Mail", "Bank": "secret Bank"}, read)
+            }
+            Resolver = saved
+
+            _, _, err = ReadVault(bytes.NewReader(file.Bytes()), "wrong")
+            a.True(errors.Is(err, ErrAuthentication))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *VaultFileTestSuite) TestCorruption() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WritePassword("secret"))
+            a.NoError(entry.Save())
+        }
+
+        var file bytes.Buffer
+        if a.NoError(WriteVault(&file, u, "password")) {
+            data := file.Bytes()
+            kdf := len(vaultFileMagic) + 1
+
+            for _, offset := range []int{0, kdf, 30, 60, len(data) / 2, len(data) - 65, len(data) - 1} {
+                tampered := append([]byte{}, data...)
+                tampered[offset] ^= 1
+                _, _, err := ReadVault(bytes.NewReader(tampered), "password")
+                a.Error(err, "offset %d", offset)
+            }
+            tampered := append([]byte{}, data...)
+            tampered[len(data)/2] ^= 1
+            _, _, err := ReadVault(bytes.NewReader(tampered), "password")
+            a.True(errors.Is(err, ErrAuthentication))
+
+            for _, length := range []int{0, 10, 59, len(data) / 2, len(data) - 1} {
+                _, _, err := ReadVault(bytes.NewReader(data[:length]), "password")
+                if a.Error(err, "length %d", length) {
+                    a.Contains(err.Error(), "truncated", "length %d", length)
+                }
+            }
+
+            tampered = append([]byte{}, data...)
+            tampered[len(vaultFileMagic)] = VaultFileVersion + 1
+            _, _, err = ReadVault(bytes.NewReader(tampered), "password")
+            if a.Error(err) {
+                a.Contains(err.Error(), "version")
+            }
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *VaultFileTestSuite) TestDroppedUser() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    entry, err := NewEntry(u)
+    if a.NoError(err) {
+        a.NoError(entry.WriteTitle("Mail"))
+        a.NoError(entry.Save())
+    }
+    var file bytes.Buffer
+    a.NoError(WriteVault(&file, u, "password"))
+    a.NoError(u.Drop())
+
+    // another user, locked out, now holds the dropped user's id
+    other, err := NewUser("other.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    now := time.Now()
+    update := "UPDATE users SET id = ?, failed_logins = ?, last_failed_login = ? WHERE id = ?"
+    a.NoError(DB.Exec(update, u.Id, 100, &now, other.Id).Error)
+    other.Id = u.Id
+    defer other.Drop()
+
+    loaded, entries, err := ReadVault(bytes.NewReader(file.Bytes()), "password")
+    if a.NoError(err) && a.Len(entries, 1) {
+        a.True(loaded.CanSign())
+        title, err := entries[0].ReadTitle()
+        a.NoError(err)
+        a.Equal("Mail", title)
+    }
+
+    stored, err := LoadUser("other.user")
+    if a.NoError(err) {
+        a.Equal(100, stored.FailedLogins)
+    }
+}
+
+func (suite *VaultFileTestSuite) TestKdfLimits() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+
+    var file bytes.Buffer
+    if !a.NoError(WriteVault(&file, u, "password")) {
+        return
+    }
+    data := file.Bytes()
+    size := binary.Size(vaultFileHeader{})
+    var original vaultFileHeader
+    a.NoError(binary.Read(bytes.NewReader(data), binary.BigEndian, &original))
+
+    for _, change := range []func(h *vaultFileHeader){
+        func(h *vaultFileHeader) { h.Iterations = 0 },
+        func(h *vaultFileHeader) { h.Iterations = 1 << 31 },
+        func(h *vaultFileHeader) { h.Kdf, h.Time, h.Memory, h.Parallelism = 2, 1<<20, 64, 1 },
+        func(h *vaultFileHeader) { h.Kdf, h.Time, h.Memory, h.Parallelism = 2, 1, 1 << 30, 1 },
+        func(h *vaultFileHeader) { h.Kdf, h.Time, h.Memory, h.Parallelism = 2, 1, 64, 0 },
+    } {
+        header := original
+        change(&header)
+        var encoded bytes.Buffer
+        a.NoError(binary.Write(&encoded, binary.BigEndian, &header))
+        tampered := append(encoded.Bytes(), data[size:]...)
+
+        _, _, err := ReadVault(bytes.NewReader(tampered), "password")
+        if a.Error(err) {
+            a.True(errors.Is(err, ErrDecryption))
+            a.Contains(err.Error(), "parameters")
+        }
+    }
+}
+
+func (suite *VaultFileTestSuite) TestKdfNotUpgraded() {
+    a := assert.New(suite.T())
+
+    u, err := NewUserWithKdf("test.user", "password", KdfPbkdf2, KdfParams{Iterations: 1000})
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    entry, err := NewEntry(u)
+    if a.NoError(err) {
+        a.NoError(entry.WriteTitle("Mail"))
+        a.NoError(entry.Save())
+    }
+    var file bytes.Buffer
+    if !a.NoError(WriteVault(&file, u, "password")) {
+        return
+    }
+
+    iterations := config.KdfIterations
+    config.KdfIterations = 2000
+    defer func() { config.KdfIterations = iterations }()
+    loaded, entries, err := ReadVault(bytes.NewReader(file.Bytes()), "password")
+    if a.NoError(err) && a.Len(entries, 1) {
+        a.Equal(1000, loaded.KdfIterations)
+        title, err := entries[0].ReadTitle()
+        a.NoError(err)
+        a.Equal("Mail", title)
+    }
+
+    stored, err := LoadUser("test.user")
+    if a.NoError(err) {
+        a.Equal(1000, stored.KdfIterations)
+        a.Equal(u.PublicKey, stored.PublicKey)
+    }
+}
+
+func TestVaultFileTestSuite(t *testing.T) {
+    suite.Run(t, new(VaultFileTestSuite))
+}
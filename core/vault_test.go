@@ -0,0 +1,322 @@
+package core
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "strings"
+    "testing"
+    "time"
+)
+
+type VaultTestSuite struct {
+    suite.Suite
+}
+
+func (suite *VaultTestSuite) TestRoundTrip() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+        entry, err := NewEntry(u)
+        if a.NoError(err) {
+            a.NoError(entry.WriteGroup("Personal"))
+            a.NoError(entry.WriteIcon("key.png"))
+            a.NoError(entry.WriteTitle("Mail"))
+            a.NoError(entry.WriteUsername("alice"))
+            a.NoError(entry.WritePassword("secret"))
+            a.NoError(entry.WriteUrl("https://mail.example.com/"))
+            a.NoError(entry.WriteComment("first line\nsecond line"))
+            a.NoError(entry.WriteExpiry(expiry))
+            a.NoError(entry.WriteExtras(map[string]interface{}{"pin": "1234", "questions": []interface{}{"a", "b"}}))
+            a.NoError(entry.WriteTOTP("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"))
+            a.NoError(entry.WriteUserdata(map[string]interface{}{"favourite": true}))
+            entry.Archived = true
+            a.NoError(entry.Save())
+        }
+
+        blob, err := u.ExportVault()
+        if a.NoError(err) {
+            a.NotContains(string(blob), "secret")
+            DB.Unscoped().Delete(entry)
+
+            entries, err := u.ImportVault(blob)
+            if a.NoError(err) && a.Len(entries, 1) {
+                imported := entries[0]
+                a.NotEqual(0, imported.Id)
+                a.True(imported.Archived)
+                for _, name := range []string{"group", "icon", "title", "username", "password", "url", "comment"} {
+                    original, _ := entry.ReadField(name)
+                    value, err := imported.ReadField(name)
+                    a.NoError(err)
+                    a.Equal(original, value, name)
+                }
+                value, err := imported.ReadExpiry()
+                if a.NoError(err) {
+                    a.True(expiry.Equal(value))
+                }
+                extras, err := imported.ReadExtras()
+                if a.NoError(err) {
+                    a.Equal(map[string]interface{}{"pin": "1234", "questions": []interface{}{"a", "b"}}, extras)
+                }
+                code, err := imported.GenerateTOTP(time.Unix(59, 0))
+                if a.NoError(err) {
+                    a.Equal("287082", code)
+                }
+                userdata, err := imported.ReadUserdata()
+                if a.NoError(err) {
+                    a.Equal(map[string]interface{}{"favourite": true}, userdata)
+                }
+                DB.Unscoped().Delete(imported)
+            }
+
+            tampered := append([]byte{}, blob...)
+            tampered[len(tampered)/2] ^= 1
+            _, err = u.ImportVault(tampered)
+            a.Error(err)
+        }
+
+        other, err := NewUser("other.user", "password")
+        if a.NoError(err) {
+            _, err = other.ImportVault(blob)
+            a.Error(err)
+            other.Drop()
+        }
+
+        u.Drop()
+    }
+}
+
+// The countingWriter type discards what is written to it, recording the number of writes, the total size and the size of
+// the largest single write.
+type countingWriter struct {
+    writes  int
+    total   int
+    largest int
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+    this.writes++
+    this.total += len(p)
+    if len(p) > this.largest {
+        this.largest = len(p)
+    }
+    return len(p), nil
+}
+
+func (suite *VaultTestSuite) TestStreaming() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for i := 0; i < 1000; i++ {
+            entry := newTestEntry(a, u, fmt.Sprintf("entry-%d", i))
+            a.NoError(entry.WriteTitle(fmt.Sprintf("Entry %d", i)))
+            a.NoError(entry.WritePassword(strings.Repeat("p", 64)))
+            a.NoError(entry.Save())
+            entries = append(entries, entry)
+        }
+
+        // the exports are written in pieces no larger than a buffer, rather than assembled in memory and written at once
+        vault := &countingWriter{}
+        if a.NoError(u.ExportVaultTo(vault)) {
+            a.True(vault.total > 1000*64)
+            a.True(vault.largest <= 4096)
+            a.True(vault.writes >= vault.total/4096)
+        }
+        csv := &countingWriter{}
+        if a.NoError(u.ExportCSV(csv)) {
+            a.True(csv.total > 1000*64)
+            a.True(csv.largest <= 4096)
+            a.True(csv.writes >= csv.total/4096)
+        }
+
+        for _, entry := range entries {
+            DB.Unscoped().Delete(entry)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *VaultTestSuite) TestTruncated() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for i := 0; i < 3; i++ {
+            entry := newTestEntry(a, u, fmt.Sprintf("entry-%d", i))
+            a.NoError(entry.WriteTitle(fmt.Sprintf("Entry %d", i)))
+            a.NoError(entry.Save())
+            entries = append(entries, entry)
+        }
+
+        var exported bytes.Buffer
+        if a.NoError(u.ExportVaultTo(&exported)) {
+            lines := strings.SplitAfter(exported.String(), "\n")
+            lines = lines[:len(lines)-1]
+            if a.Len(lines, 5) {
+                join := func(parts ...[]string) []byte {
+                    var joined []string
+                    for _, part := range parts {
+                        joined = append(joined, part...)
+                    }
+                    return []byte(strings.Join(joined, ""))
+                }
+                withoutTrailer := join(lines[:4])
+                _, err = u.ImportVault(withoutTrailer)
+                a.True(errors.Is(err, ErrDecryption))
+                _, err = u.ImportVault(withoutTrailer[:len(withoutTrailer)-10])
+                a.True(errors.Is(err, ErrDecryption))
+                _, err = u.ImportVault(join(lines[:2], lines[3:]))
+                a.True(errors.Is(err, ErrDecryption))
+                _, err = u.ImportVault(join(lines[:1], lines[2:3], lines[1:2], lines[3:]))
+                a.True(errors.Is(err, ErrDecryption))
+                _, err = u.ImportVault(join(lines, lines[4:]))
+                a.True(errors.Is(err, ErrDecryption))
+
+                // records cannot be moved between exports of different vaults
+                a.NoError(entries[2].WriteTitle("Changed"))
+                a.NoError(entries[2].Save())
+                var other bytes.Buffer
+                if a.NoError(u.ExportVaultTo(&other)) {
+                    otherLines := strings.SplitAfter(other.String(), "\n")
+                    _, err = u.ImportVault(join(lines[:3], otherLines[3:4], lines[4:]))
+                    a.True(errors.Is(err, ErrDecryption))
+                    _, err = u.ImportVault(join(lines[:4], otherLines[4:]))
+                    a.True(errors.Is(err, ErrDecryption))
+                }
+
+                imported, err := u.ImportVault(join(lines))
+                if a.NoError(err) && a.Len(imported, 3) {
+                    for _, view := range imported {
+                        DB.Unscoped().Delete(view)
+                    }
+                }
+            }
+        }
+
+        for _, entry := range entries {
+            DB.Unscoped().Delete(entry)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *VaultTestSuite) TestReproducible() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        var entries []*EntryView
+        for _, id := range []string{"charlie", "alpha", "bravo"} {
+            entry := newTestEntry(a, u, id)
+            a.NoError(entry.WriteTitle(strings.Title(id)))
+            a.NoError(entry.WritePassword("secret"))
+            a.NoError(entry.Save())
+            entries = append(entries, entry)
+        }
+
+        first, err := u.ExportVault()
+        a.NoError(err)
+        second, err := u.ExportVault()
+        a.NoError(err)
+        a.Equal(first, second)
+
+        // the entries are exported in order of EntryId rather than of creation
+        if imported, err := u.ImportVault(first); a.NoError(err) && a.Len(imported, 3) {
+            for i, title := range []string{"Alpha", "Bravo", "Charlie"} {
+                value, err := imported[i].ReadTitle()
+                a.NoError(err)
+                a.Equal(title, value)
+                DB.Unscoped().Delete(imported[i])
+            }
+        }
+
+        for _, offset := range []int{0, len(first) / 3, len(first) / 2, len(first) - 10} {
+            corrupted := append([]byte{}, first...)
+            corrupted[offset] ^= 1
+            _, err = u.ImportVault(corrupted)
+            a.True(errors.Is(err, ErrDecryption), "offset %d", offset)
+        }
+        var count int
+        DB.Model(EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+        a.Equal(3, count)
+
+        for _, entry := range entries {
+            DB.Unscoped().Delete(entry)
+        }
+        u.Drop()
+    }
+}
+
+func (suite *VaultTestSuite) TestVersion1() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if a.NoError(err) {
+        document, err := json.Marshal(vaultDocument{Version: 1, User: u.Name, Entries: []vaultEntry{
+            {Fields: map[string]string{"title": "Mail", "password": "secret"}},
+        }})
+        a.NoError(err)
+        blob, err := u.Encrypt(document)
+        if a.NoError(err) {
+            imported, err := u.ImportVault([]byte(blob))
+            if a.NoError(err) && a.Len(imported, 1) {
+                password, err := imported[0].ReadPassword()
+                a.NoError(err)
+                a.Equal("secret", password)
+                DB.Unscoped().Delete(imported[0])
+            }
+        }
+        u.Drop()
+    }
+}
+
+func (suite *VaultTestSuite) TestImportAtomic() {
+    a := assert.New(suite.T())
+
+    u, err := NewUser("test.user", "password")
+    if !a.NoError(err) {
+        return
+    }
+    defer u.Drop()
+    defer DB.Unscoped().Where("user_id = ?", u.Id).Delete(EntryView{})
+
+    var views []*EntryView
+    for _, title := range []string{"first", "second", "duplicate"} {
+        view, err := NewEntry(u)
+        if !a.NoError(err) {
+            return
+        }
+        a.NoError(view.WriteTitle(title))
+        views = append(views, view)
+    }
+    views[2].EntryId = views[0].EntryId
+    a.NoError(views[2].SignRow(u))
+
+    err = u.saveImported(views)
+    if a.Error(err) {
+        a.Equal(ErrConflict, err.(*Error).Code)
+    }
+    for _, view := range views {
+        a.Zero(view.Id)
+    }
+    var count int
+    DB.Model(&EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+    a.Equal(0, count)
+
+    if a.NoError(u.saveImported(views[:2])) {
+        DB.Model(&EntryView{}).Where("user_id = ?", u.Id).Count(&count)
+        a.Equal(2, count)
+    }
+}
+
+func TestVaultTestSuite(t *testing.T) {
+    suite.Run(t, new(VaultTestSuite))
+}
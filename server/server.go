@@ -0,0 +1,313 @@
+// Package server exposes the entries of PassRep users over an HTTP REST API.
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/awm/passrep/core"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// DefaultIdleTimeout is how long a session may go unused before it expires, unless configured otherwise.
+const DefaultIdleTimeout = 15 * time.Minute
+
+// The entryFields table gives the name of each string field of an entry which is exchanged with clients, along with the
+// stored value of the field, so that fields which have never been written can be told apart.
+var entryFields = []struct {
+    name  string
+    value func(e *core.EntryView) string
+}{
+    {"group", func(e *core.EntryView) string { return e.Group }},
+    {"icon", func(e *core.EntryView) string { return e.Icon }},
+    {"title", func(e *core.EntryView) string { return e.Title }},
+    {"username", func(e *core.EntryView) string { return e.Username }},
+    {"password", func(e *core.EntryView) string { return e.Password }},
+    {"url", func(e *core.EntryView) string { return e.Url }},
+    {"comment", func(e *core.EntryView) string { return e.Comment }},
+}
+
+// The Options structure configures the handler produced by NewHandler.
+type Options struct {
+    // IdleTimeout is how long a session may go unused before it expires.  Zero selects DefaultIdleTimeout.
+    IdleTimeout time.Duration
+}
+
+// The handler type serves the REST API.
+type handler struct {
+    sessions *sessionStore
+}
+
+// NewHandler produces an http.Handler serving the REST API:
+//
+//     POST /login                    starts a session, given the username and password, and returns its token
+//     GET  /entries                  lists the id of each of the user's entries, and the title of those it may read
+//     GET  /entries/{id}             returns the fields of an entry
+//     POST /entries                  creates an entry from the given fields and returns its id
+//     PUT  /entries/{id}/password    replaces the password of an entry
+//
+// Requests other than login must carry the session token as a bearer token in the Authorization header.  Access to
+// entries is governed by the user's permissions, so a user without read permission on an entry is refused its fields.
+// Sessions keep the user's keys in memory until they have been idle for the configured time.
+func NewHandler(opts Options) http.Handler {
+    idleTimeout := opts.IdleTimeout
+    if idleTimeout <= 0 {
+        idleTimeout = DefaultIdleTimeout
+    }
+    return &handler{sessions: newSessionStore(idleTimeout)}
+}
+
+// ServeHTTP routes a request to the function handling it.
+func (this *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.Trim(r.URL.Path, "/")
+    if path == "login" {
+        if r.Method != http.MethodPost {
+            writeStatus(w, http.StatusMethodNotAllowed)
+            return
+        }
+        this.login(w, r)
+        return
+    }
+
+    parts := strings.Split(path, "/")
+    if parts[0] != "entries" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "password") {
+        writeStatus(w, http.StatusNotFound)
+        return
+    }
+    user, ok := this.authenticate(r)
+    if !ok {
+        writeStatus(w, http.StatusUnauthorized)
+        return
+    }
+
+    switch {
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        listEntries(w, user)
+    case len(parts) == 1 && r.Method == http.MethodPost:
+        createEntry(w, r, user)
+    case len(parts) == 2 && r.Method == http.MethodGet:
+        getEntry(w, user, parts[1])
+    case len(parts) == 3 && r.Method == http.MethodPut:
+        putPassword(w, r, user, parts[1])
+    default:
+        writeStatus(w, http.StatusMethodNotAllowed)
+    }
+}
+
+// The authenticate function finds the user of the session named by the request's bearer token.
+func (this *handler) authenticate(r *http.Request) (*core.User, bool) {
+    const prefix = "Bearer "
+    header := r.Header.Get("Authorization")
+    if !strings.HasPrefix(header, prefix) {
+        return nil, false
+    }
+    return this.sessions.lookup(strings.TrimPrefix(header, prefix))
+}
+
+// The unknownUser variable stands in for a user who does not exist when logging in, so that keys can be derived for them
+// just as for a user who does.
+var unknownUser = core.User{
+    CryptoSalt:  "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+    SigningSalt: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=",
+}
+
+// The login function starts a session for the user named in the request, provided that the password is correct.  An
+// unknown user and a wrong password are refused alike, and keys are derived from the password either way, so that neither
+// the response nor the time it takes reveals which users exist.
+func (this *handler) login(w http.ResponseWriter, r *http.Request) {
+    var credentials struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+        writeError(w, core.NewError(err), http.StatusBadRequest)
+        return
+    }
+
+    user, err := core.LoadUser(credentials.Username)
+    if err == nil {
+        err = user.StartSession(credentials.Password)
+    } else if errors.Is(err, core.ErrNotFound) {
+        // keys are derived for an unknown user too, so that the time taken does not reveal whether the user exists
+        if keys, e := core.MakeKeys(&unknownUser, credentials.Password); e == nil {
+            keys.Wipe()
+        }
+    }
+    if err != nil {
+        writeError(w, core.NewError("Incorrect username or password", core.ErrAuthentication), http.StatusUnauthorized)
+        return
+    }
+    token, err := this.sessions.start(user)
+    if err != nil {
+        user.EndSession()
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// The loadEntry function loads the user's view of the entry and attaches the session's user to it.
+func loadEntry(user *core.User, id string) (*core.EntryView, error) {
+    entry, err := core.LoadEntry(id, user.Id)
+    if err != nil {
+        return nil, err
+    }
+    if err := entry.AttachUser(user); err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+// The listEntries function responds with the id of each of the user's entries, along with the title of each entry the
+// user has read permission on.  Although the core permits reading the title with any permission, no decrypted field is
+// given to a client without read permission.
+func listEntries(w http.ResponseWriter, user *core.User) {
+    entries, err := core.ListEntries(user.Id)
+    if err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+
+    type summary struct {
+        Id    string `json:"id"`
+        Title string `json:"title,omitempty"`
+    }
+    summaries := []summary{}
+    for _, e := range entries {
+        if err := e.AttachUser(user); err != nil {
+            writeError(w, err, http.StatusInternalServerError)
+            return
+        }
+        listed := summary{Id: e.EntryId}
+        if len(e.Title) > 0 && user.Can("r", e) {
+            if listed.Title, err = e.ReadTitle(); err != nil {
+                writeError(w, err, http.StatusInternalServerError)
+                return
+            }
+        }
+        summaries = append(summaries, listed)
+    }
+    writeJSON(w, http.StatusOK, summaries)
+}
+
+// The getEntry function responds with the fields of the entry which have been written, provided that the user has read
+// permission on it.
+func getEntry(w http.ResponseWriter, user *core.User, id string) {
+    entry, err := loadEntry(user, id)
+    if err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    if !user.Can("r", entry) {
+        writeError(w, core.NewError("Entry read permission denied", user, core.ErrPermission), http.StatusForbidden)
+        return
+    }
+
+    fields := map[string]string{"id": entry.EntryId}
+    for _, f := range entryFields {
+        if len(f.value(entry)) == 0 {
+            continue
+        }
+        value, err := entry.ReadField(f.name)
+        if err != nil {
+            writeError(w, err, http.StatusInternalServerError)
+            return
+        }
+        fields[f.name] = value
+    }
+    writeJSON(w, http.StatusOK, fields)
+}
+
+// The createEntry function creates an entry owned by the user from the fields in the request, and responds with its id.
+func createEntry(w http.ResponseWriter, r *http.Request, user *core.User) {
+    var fields map[string]string
+    if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+        writeError(w, core.NewError(err, user), http.StatusBadRequest)
+        return
+    }
+
+    entry, err := core.NewEntry(user)
+    if err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    for name, value := range fields {
+        if err := entry.WriteField(name, value); err != nil {
+            writeError(w, err, http.StatusBadRequest)
+            return
+        }
+    }
+    if err := entry.Save(); err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusCreated, map[string]string{"id": entry.EntryId})
+}
+
+// The putPassword function replaces the password of the entry, provided that the user has write permission on it.
+func putPassword(w http.ResponseWriter, r *http.Request, user *core.User, id string) {
+    var body struct {
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, core.NewError(err, user), http.StatusBadRequest)
+        return
+    }
+
+    entry, err := loadEntry(user, id)
+    if err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    if err := entry.WritePassword(body.Password); err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    if err := entry.Save(); err != nil {
+        writeError(w, err, http.StatusInternalServerError)
+        return
+    }
+    writeStatus(w, http.StatusNoContent)
+}
+
+// The errorStatuses map gives the HTTP status for each error code which has one of its own.
+var errorStatuses = map[core.ErrorCode]int{
+    core.ErrPermission:     http.StatusForbidden,
+    core.ErrNotFound:       http.StatusNotFound,
+    core.ErrAuthentication: http.StatusUnauthorized,
+    core.ErrConflict:       http.StatusConflict,
+}
+
+// The writeError function responds with the error, using the status of its code if it has one, or the fallback status
+// otherwise.
+func writeError(w http.ResponseWriter, err error, fallback int) {
+    status := fallback
+    for code, s := range errorStatuses {
+        if errors.Is(err, code) {
+            status = s
+        }
+    }
+
+    var e *core.Error
+    if !errors.As(err, &e) {
+        e = core.NewError(err)
+    }
+    writeJSON(w, status, map[string]*core.Error{"error": e})
+}
+
+// The writeStatus function responds with the status and its standard description.
+func writeStatus(w http.ResponseWriter, status int) {
+    if status == http.StatusNoContent {
+        w.WriteHeader(status)
+        return
+    }
+    writeJSON(w, status, map[string]string{"status": http.StatusText(status)})
+}
+
+// The writeJSON function responds with the status and the JSON encoding of the value.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(value)
+}
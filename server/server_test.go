@@ -0,0 +1,172 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/awm/passrep/core"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/suite"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+type ServerTestSuite struct {
+    suite.Suite
+}
+
+// The request function sends a request with an optional JSON body and bearer token to the handler, and decodes any JSON
+// response into the result.
+func request(handler http.Handler, method string, path string, token string, body interface{}, result interface{}) int {
+    var encoded bytes.Buffer
+    if body != nil {
+        json.NewEncoder(&encoded).Encode(body)
+    }
+    r := httptest.NewRequest(method, path, &encoded)
+    if len(token) > 0 {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    if result != nil {
+        json.Unmarshal(w.Body.Bytes(), result)
+    }
+    return w.Code
+}
+
+// The login function logs in through the handler and produces the session token.
+func login(handler http.Handler, username string, password string) (int, string) {
+    var response map[string]string
+    status := request(handler, "POST", "/login", "", map[string]string{"username": username, "password": password}, &response)
+    return status, response["token"]
+}
+
+func (suite *ServerTestSuite) TestAuth() {
+    a := assert.New(suite.T())
+
+    u, err := core.NewUser("test.user", "password")
+    if a.NoError(err) {
+        handler := NewHandler(Options{})
+
+        status, token := login(handler, "test.user", "wrong")
+        a.Equal(http.StatusUnauthorized, status)
+        a.Empty(token)
+        status, _ = login(handler, "nobody", "password")
+        a.Equal(http.StatusUnauthorized, status)
+
+        a.Equal(http.StatusUnauthorized, request(handler, "GET", "/entries", "", nil, nil))
+        a.Equal(http.StatusUnauthorized, request(handler, "GET", "/entries", "bogus", nil, nil))
+
+        status, token = login(handler, "test.user", "password")
+        if a.Equal(http.StatusOK, status) && a.NotEmpty(token) {
+            var entries []map[string]string
+            a.Equal(http.StatusOK, request(handler, "GET", "/entries", token, nil, &entries))
+            a.Empty(entries)
+            a.Equal(http.StatusNotFound, request(handler, "GET", "/other", token, nil, nil))
+            a.Equal(http.StatusMethodNotAllowed, request(handler, "DELETE", "/entries", token, nil, nil))
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *ServerTestSuite) TestIdleTimeout() {
+    a := assert.New(suite.T())
+
+    u, err := core.NewUser("test.user", "password")
+    if a.NoError(err) {
+        served := NewHandler(Options{IdleTimeout: 50 * time.Millisecond})
+        status, token := login(served, "test.user", "password")
+        if a.Equal(http.StatusOK, status) {
+            a.Equal(http.StatusOK, request(served, "GET", "/entries", token, nil, nil))
+            time.Sleep(100 * time.Millisecond)
+            a.Equal(http.StatusUnauthorized, request(served, "GET", "/entries", token, nil, nil))
+        }
+
+        // an idle session is ended, and its keys wiped, without waiting for another request
+        sessions := served.(*handler).sessions
+        status, token = login(served, "test.user", "password")
+        if a.Equal(http.StatusOK, status) {
+            user, ok := sessions.lookup(token)
+            if a.True(ok) && a.True(user.CanSign()) {
+                time.Sleep(100 * time.Millisecond)
+                a.False(user.CanSign())
+                sessions.Lock()
+                a.Empty(sessions.sessions)
+                sessions.Unlock()
+            }
+        }
+
+        u.Drop()
+    }
+}
+
+func (suite *ServerTestSuite) TestEntries() {
+    a := assert.New(suite.T())
+
+    owner, err := core.NewUser("owner", "password")
+    if !a.NoError(err) {
+        return
+    }
+    reader, err := core.NewUser("reader", "password")
+    if !a.NoError(err) {
+        owner.Drop()
+        return
+    }
+
+    handler := NewHandler(Options{})
+    _, ownerToken := login(handler, "owner", "password")
+    _, readerToken := login(handler, "reader", "password")
+
+    var created map[string]string
+    fields := map[string]string{"title": "Mail", "username": "alice", "password": "hunter2"}
+    if a.Equal(http.StatusCreated, request(handler, "POST", "/entries", ownerToken, fields, &created)) {
+        id := created["id"]
+        a.NotEmpty(id)
+
+        var entry map[string]string
+        if a.Equal(http.StatusOK, request(handler, "GET", "/entries/"+id, ownerToken, nil, &entry)) {
+            a.Equal("Mail", entry["title"])
+            a.Equal("alice", entry["username"])
+            a.Equal("hunter2", entry["password"])
+        }
+
+        update := map[string]string{"password": "correct horse"}
+        a.Equal(http.StatusNoContent, request(handler, "PUT", "/entries/"+id+"/password", ownerToken, update, nil))
+        entry = nil
+        if a.Equal(http.StatusOK, request(handler, "GET", "/entries/"+id, ownerToken, nil, &entry)) {
+            a.Equal("correct horse", entry["password"])
+        }
+
+        // the reader may write but not read
+        view, err := core.LoadEntry(id, owner.Id)
+        if a.NoError(err) && a.NoError(view.AttachUser(owner)) {
+            _, err = view.ShareWith(reader, "w")
+            a.NoError(err)
+        }
+        var denied map[string]interface{}
+        a.Equal(http.StatusForbidden, request(handler, "GET", "/entries/"+id, readerToken, nil, &denied))
+        a.NotContains(denied, "password")
+        a.Equal(map[string]interface{}{"code": "permission", "message": "Entry read permission denied", "user": "reader"}, denied["error"])
+
+        var listed []map[string]string
+        if a.Equal(http.StatusOK, request(handler, "GET", "/entries", readerToken, nil, &listed)) {
+            a.Equal([]map[string]string{{"id": id}}, listed)
+        }
+        listed = nil
+        if a.Equal(http.StatusOK, request(handler, "GET", "/entries", ownerToken, nil, &listed)) {
+            a.Equal([]map[string]string{{"id": id, "title": "Mail"}}, listed)
+        }
+
+        a.Equal(http.StatusNotFound, request(handler, "GET", "/entries/missing", ownerToken, nil, nil))
+    }
+    a.Equal(http.StatusBadRequest, request(handler, "POST", "/entries", ownerToken, map[string]string{"bogus": "x"}, nil))
+
+    reader.Drop()
+    owner.Drop()
+}
+
+func TestServerTestSuite(t *testing.T) {
+    suite.Run(t, new(ServerTestSuite))
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+    "encoding/base64"
+    "github.com/awm/passrep/core"
+    "github.com/awm/passrep/utils"
+    "sync"
+    "time"
+)
+
+// The session structure holds a logged in user, whose keys remain available until the session expires, along with the
+// timer which ends the session once it has been idle for too long, and the time it was last used.
+type session struct {
+    user     *core.User
+    timer    *time.Timer
+    lastUsed time.Time
+}
+
+// The sessionStore structure maps session tokens to sessions.
+type sessionStore struct {
+    sync.Mutex
+    sessions    map[string]*session
+    idleTimeout time.Duration
+}
+
+// The newSessionStore function creates an empty session store whose sessions expire after the given idle time.
+func newSessionStore(idleTimeout time.Duration) *sessionStore {
+    return &sessionStore{sessions: make(map[string]*session), idleTimeout: idleTimeout}
+}
+
+// The start function creates a session for the user, who must already have an active session in the core sense, and
+// produces its token.  The session is ended, wiping the user's keys, once it has gone unused for the idle time, whether
+// or not any further request arrives.
+func (this *sessionStore) start(user *core.User) (string, error) {
+    raw := utils.RandomBytes(32)
+    if raw == nil {
+        return "", core.NewError("Token generation failed", user)
+    }
+    token := base64.RawURLEncoding.EncodeToString(raw)
+
+    this.Lock()
+    defer this.Unlock()
+    s := &session{user: user, lastUsed: time.Now()}
+    s.timer = time.AfterFunc(this.idleTimeout, func() {
+        this.Lock()
+        defer this.Unlock()
+        if this.sessions[token] != s {
+            return
+        }
+        // the session may have been used while the timer was firing, in which case it must wait out the rest of the
+        // idle time
+        if remaining := this.idleTimeout - time.Since(s.lastUsed); remaining > 0 {
+            s.timer.Reset(remaining)
+            return
+        }
+        this.end(token)
+    })
+    this.sessions[token] = s
+    return token, nil
+}
+
+// The lookup function finds the user of the session with the given token and marks the session as used, restarting its
+// idle time, or reports that there is no such session.  A session which has been idle for too long is ended rather than
+// produced, should its timer not have fired yet.
+func (this *sessionStore) lookup(token string) (*core.User, bool) {
+    this.Lock()
+    defer this.Unlock()
+    s, ok := this.sessions[token]
+    if !ok {
+        return nil, false
+    }
+    now := time.Now()
+    if now.Sub(s.lastUsed) > this.idleTimeout {
+        this.end(token)
+        return nil, false
+    }
+    s.lastUsed = now
+    s.timer.Reset(this.idleTimeout)
+    return s.user, true
+}
+
+// The end function removes the session with the given token, stops its timer and wipes its user's keys.  The store must
+// be locked.
+func (this *sessionStore) end(token string) {
+    if s, ok := this.sessions[token]; ok {
+        delete(this.sessions, token)
+        s.timer.Stop()
+        s.user.EndSession()
+    }
+}
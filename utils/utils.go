@@ -3,6 +3,10 @@ package utils
 
 import (
     "crypto/rand"
+    "crypto/subtle"
+    "io"
+    "net/url"
+    "strings"
 )
 
 // Contains determines if the given string is contained in the slice of strings.
@@ -23,12 +27,90 @@ func AppendUnique(slice []string, value string) []string {
     return slice
 }
 
-// RandomBytes produces a buffer of specified length containing cryptographically secure pseudorandom data.
+// Rand is the source of the data produced by RandomBytes, and so of every key, salt and nonce generated by PassRep.  Tests
+// may replace it with a deterministic reader in order to check exact ciphertext, provided that they restore it afterwards.
+//
+// WARNING: Rand must never be replaced outside of tests.  Any other source reuses nonces and produces predictable keys,
+// which destroys the security of everything encrypted while it is in effect.
+var Rand io.Reader = rand.Reader
+
+// RandomBytes produces a buffer of specified length containing cryptographically secure pseudorandom data drawn from Rand.
+// If Rand fails to fill the buffer the result is nil.
 func RandomBytes(size int) []byte {
     result := make([]byte, size)
-    _, err := rand.Read(result)
+    _, err := io.ReadFull(Rand, result)
     if err != nil {
         result = nil
     }
     return result
 }
+
+// SecureZero overwrites every byte of the buffer with zero, so that a key or other secret held in it does not linger in
+// memory after it is no longer needed.
+func SecureZero(buffer []byte) {
+    for i := range buffer {
+        buffer[i] = 0
+    }
+}
+
+// ConstantTimeEqual determines whether two buffers hold the same data, taking time which depends only on their lengths
+// rather than on their contents, so that comparing secrets does not leak where they differ.
+func ConstantTimeEqual(a []byte, b []byte) bool {
+    return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// The defaultPorts map gives the port implied by each scheme, which NormalizeUrl removes.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// NormalizeUrl converts a URL to a canonical form so that equivalent addresses are stored identically.  A bare host,
+// with an optional port and path, is given the https scheme, and http is converted to https, so that a site is stored
+// the same way however it was entered.  The scheme and host are lowercased, the port is removed if it is the default
+// for the scheme it was given with, and trailing slashes are stripped from the path, while any user information is
+// kept.  Values which are neither a bare host nor a URL with a host, such as mailto addresses, are returned trimmed but
+// otherwise unchanged.
+func NormalizeUrl(raw string) string {
+    trimmed := strings.TrimSpace(raw)
+    if len(trimmed) == 0 {
+        return trimmed
+    }
+
+    s := trimmed
+    if !strings.Contains(s, "://") {
+        authority := s
+        if end := strings.IndexAny(s, "/?#"); end >= 0 {
+            authority = s[:end]
+        }
+        if strings.Contains(authority, "@") {
+            return trimmed
+        }
+        s = "https://" + s
+    }
+    u, err := url.Parse(s)
+    if err != nil || len(u.Hostname()) == 0 {
+        return trimmed
+    }
+
+    scheme := strings.ToLower(u.Scheme)
+    host := strings.ToLower(u.Hostname())
+    if strings.Contains(host, ":") {
+        host = "[" + host + "]"
+    }
+    if port := u.Port(); len(port) > 0 && port != defaultPorts[scheme] {
+        host += ":" + port
+    }
+    if u.User != nil {
+        host = u.User.String() + "@" + host
+    }
+    if scheme == "http" {
+        scheme = "https"
+    }
+
+    result := scheme + "://" + host + strings.TrimRight(u.EscapedPath(), "/")
+    if len(u.RawQuery) > 0 {
+        result += "?" + u.RawQuery
+    }
+    if len(u.Fragment) > 0 {
+        result += "#" + u.EscapedFragment()
+    }
+    return result
+}
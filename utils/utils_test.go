@@ -1,6 +1,7 @@
 package utils
 
 import (
+    "bytes"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/suite"
     "testing"
@@ -43,6 +44,60 @@ func (suite *UtilsTestSuite) TestRandomBytes() {
     a.False(assert.ObjectsAreEqual(beta, gamma), "Expected one random data set to not equal another")
 }
 
+func (suite *UtilsTestSuite) TestRandomSource() {
+    a := assert.New(suite.T())
+
+    previous := Rand
+    defer func() { Rand = previous }()
+
+    Rand = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6})
+    a.Equal([]byte{1, 2, 3, 4}, RandomBytes(4))
+    a.Nil(RandomBytes(4), "Expected a short read to fail")
+}
+
+func (suite *UtilsTestSuite) TestSecureZero() {
+    a := assert.New(suite.T())
+
+    buffer := []byte("secret")
+    SecureZero(buffer)
+    a.Equal(make([]byte, 6), buffer, "Buffer not zeroed")
+    SecureZero(nil)
+}
+
+func (suite *UtilsTestSuite) TestConstantTimeEqual() {
+    a := assert.New(suite.T())
+
+    inputs := [][]byte{nil, {}, []byte("a"), []byte("b"), []byte("secret"), []byte("secreT"), []byte("secrets")}
+    for _, x := range inputs {
+        for _, y := range inputs {
+            a.Equal(bytes.Equal(x, y), ConstantTimeEqual(x, y), "Mismatch comparing %q and %q", x, y)
+        }
+    }
+}
+
+func (suite *UtilsTestSuite) TestNormalizeUrl() {
+    a := assert.New(suite.T())
+
+    expected := "https://example.com"
+    a.Equal(expected, NormalizeUrl("example.com"))
+    a.Equal(expected, NormalizeUrl("http://example.com"))
+    a.Equal(expected, NormalizeUrl("https://example.com/"))
+    a.Equal(expected, NormalizeUrl(" HTTPS://Example.COM:443/ "))
+    a.Equal("https://example.com:8443/login", NormalizeUrl("example.com:8443/login/"))
+    a.Equal("https://example.com/path?q=1", NormalizeUrl("http://EXAMPLE.com:80/path?q=1"))
+
+    // only the default port of the scheme given is removed
+    a.Equal("https://example.com:80", NormalizeUrl("https://example.com:80"))
+    a.Equal("https://example.com:443", NormalizeUrl("http://example.com:443/"))
+
+    // user information is kept, and only bare hosts are given a scheme
+    a.Equal("https://alice@example.com/login", NormalizeUrl("https://alice@Example.com/login/"))
+    a.Equal("mailto:a@b.com", NormalizeUrl(" mailto:a@b.com "))
+    a.Equal("alice@example.com", NormalizeUrl("alice@example.com"))
+    a.Equal("ftp://files.example.com/pub", NormalizeUrl("FTP://Files.Example.com/pub/"))
+    a.Equal("", NormalizeUrl("  "))
+}
+
 func TestUtilsTestSuite(t *testing.T) {
     suite.Run(t, new(UtilsTestSuite))
 }